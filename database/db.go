@@ -33,6 +33,12 @@ func initModels() error {
 		&model.User{},
 		&model.Account{},        // New: Multi-inbound account
 		&model.AccountClient{},  // New: Account-client association
+		&model.Plan{},
+		&model.AccountEvent{},
+		&model.TrafficHistory{},
+		&model.AuditLog{},
+		&model.SubFetchLog{},
+		&model.RetiredSubId{},
 		&model.Slave{},
 		&model.Inbound{},
 		&model.OutboundTraffics{},
@@ -50,6 +56,17 @@ func initModels() error {
 		}
 	}
 	
+	// Audit log entries cannot be changed or deleted
+	for _, trigger := range []string{
+		"CREATE TRIGGER IF NOT EXISTS audit_logs_no_update BEFORE UPDATE ON audit_logs BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END",
+		"CREATE TRIGGER IF NOT EXISTS audit_logs_no_delete BEFORE DELETE ON audit_logs BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END",
+	} {
+		if err := db.Exec(trigger).Error; err != nil {
+			xuiLogger.Errorf("Error creating audit log trigger: %v", err)
+			return err
+		}
+	}
+
 	// Add account_id column to client_traffics if it doesn't exist
 	if !db.Migrator().HasColumn(&xray.ClientTraffic{}, "account_id") {
 		if err := db.Migrator().AddColumn(&xray.ClientTraffic{}, "account_id"); err != nil {
@@ -87,6 +104,7 @@ func initUser() error {
 		user := &model.User{
 			Username: defaultUsername,
 			Password: hashedPassword,
+			Role:     model.RoleOwner,
 		}
 		err = db.Create(user).Error
 		if err != nil {
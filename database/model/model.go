@@ -24,11 +24,26 @@ const (
 	WireGuard   Protocol = "wireguard"
 )
 
+// Roles of panel users
+const (
+	RoleOwner    = "owner"    // Everything, including the panel users
+	RoleAdmin    = "admin"    // Everything but the panel users
+	RoleOperator = "operator" // Accounts and plans; reads the rest
+	RoleReadOnly = "readonly" // Reads inbounds, accounts and slaves
+	RoleReseller = "reseller" // Only the inbounds and accounts it owns
+)
+
 // User represents a user account in the 3x-ui panel.
 type User struct {
 	Id       int    `json:"id" gorm:"primaryKey;autoIncrement"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	Role     string `json:"role" form:"role" gorm:"default:owner"` // One of the Role constants
+	SlaveIds string `json:"slaveIds" form:"slaveIds"`              // Comma separated slaves the user is limited to, empty for all; owners and admins see all
+
+	// Pool of a reseller, spent as it creates accounts and clients
+	CreditGB     int64 `json:"creditGB" form:"creditGB" gorm:"default:0"`         // GB left to give to accounts and clients
+	AccountSlots int   `json:"accountSlots" form:"accountSlots" gorm:"default:0"` // Accounts it may own at once (0 = unlimited)
 }
 
 // Account represents a multi-inbound user account with aggregated traffic management.
@@ -47,6 +62,17 @@ type Account struct {
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`               // Traffic reset period in days (0 = never)
 	CreatedAt  int64  `json:"createdAt" form:"createdAt"`                        // Creation timestamp
 	UpdatedAt  int64  `json:"updatedAt" form:"updatedAt"`                        // Last update timestamp
+
+	LastResetTime  int64  `json:"lastResetTime" form:"lastResetTime" gorm:"default:0"` // Anchor of the rolling traffic reset (0 = CreatedAt)
+	DisabledReason string `json:"disabledReason" form:"disabledReason"`                // Why the account was disabled automatically: quota or expired
+	PlanId         int    `json:"planId" form:"planId" gorm:"default:0;index"`         // Plan the account subscribes to (0 = none)
+	LimitIP        int    `json:"limitIp" form:"limitIp" gorm:"default:0"`             // Unique source IPs allowed across all clients (0 = unlimited)
+	UserId         int    `json:"userId" form:"userId" gorm:"default:0;index"`         // Panel user who created the account; resellers see only their own
+
+	// Credentials shared by all clients of the account
+	UUID     string `json:"uuid" form:"uuid"`         // Client UUID on vmess and vless inbounds
+	Password string `json:"password" form:"password"` // Client password on trojan and shadowsocks inbounds
+	SSKey    string `json:"ssKey" form:"ssKey"`       // Base64 32 byte key on shadowsocks 2022 inbounds
 }
 
 func (Account) TableName() string {
@@ -61,23 +87,154 @@ type AccountClient struct {
 	InboundId   int    `json:"inboundId" form:"inboundId" gorm:"not null;index:idx_account_inbound"`
 	ClientEmail string `json:"clientEmail" form:"clientEmail" gorm:"not null;uniqueIndex"` // Each client can only belong to one account
 	CreatedAt   int64  `json:"createdAt" form:"createdAt"`                                 // Creation timestamp
+	Provisioned bool   `json:"provisioned" form:"provisioned" gorm:"default:false"`        // Client was created from the account's plan and is removed with it
 }
 
 func (AccountClient) TableName() string {
 	return "account_clients"
 }
 
+// AccountEvent is an entry of the append-only ledger of changes to an
+// account's terms. Username is kept so entries outlive the account.
+type AccountEvent struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	AccountId int    `json:"accountId" gorm:"not null;index"`
+	Username  string `json:"username"`
+	Type      string `json:"type"`     // renew, extend, topup
+	Actor     string `json:"actor"`    // Panel user who made the change
+	Reason    string `json:"reason"`   // Free text, e.g. a payment or ticket reference
+	OldValue  string `json:"oldValue"` // Account terms before the change (JSON)
+	NewValue  string `json:"newValue"` // Account terms after the change (JSON)
+	CreatedAt int64  `json:"createdAt" gorm:"index"`
+}
+
+func (AccountEvent) TableName() string {
+	return "account_events"
+}
+
+// TrafficHistory is the traffic of a client, account, inbound or slave within
+// one hour or day. Rows are added to as traffic reports come in.
+type TrafficHistory struct {
+	Id     int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Scope  string `json:"scope" gorm:"not null;uniqueIndex:idx_traffic_bucket,priority:1"`        // client, account, inbound or slave
+	Target string `json:"target" gorm:"not null;uniqueIndex:idx_traffic_bucket,priority:2"`       // Client email or account, inbound or slave ID
+	Period string `json:"period" gorm:"not null;uniqueIndex:idx_traffic_bucket,priority:3"`       // hour or day
+	Bucket int64  `json:"bucket" gorm:"not null;uniqueIndex:idx_traffic_bucket,priority:4;index"` // Start of the hour or day (ms)
+	Up     int64  `json:"up"`
+	Down   int64  `json:"down"`
+}
+
+func (TrafficHistory) TableName() string {
+	return "traffic_history"
+}
+
+// AuditLog is an entry of the append-only record of changes made through the
+// panel, the API, the Telegram bot, LDAP sync and jobs.
+type AuditLog struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	CreatedAt int64  `json:"createdAt" gorm:"index"`
+	Actor     string `json:"actor" gorm:"index"`  // Panel user, Telegram user or job name
+	Source    string `json:"source" gorm:"index"` // panel, api, tgbot, ldap or job
+	Ip        string `json:"ip"`
+	Action    string `json:"action" gorm:"index"` // e.g. inbound.update
+	Target    string `json:"target" gorm:"index"` // e.g. inbound:5
+	Diff      string `json:"diff"`                // Changed fields as {"field":{"old":...,"new":...}} (JSON)
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
+
+// SubFetchLog records one fetch of a client or account subscription link.
+type SubFetchLog struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	CreatedAt int64  `json:"createdAt" gorm:"index"`
+	SubId     string `json:"subId" gorm:"index"`
+	Ip        string `json:"ip"`
+	Country   string `json:"country"` // ISO code from geoip.dat, empty when unknown
+	UserAgent string `json:"userAgent"`
+	Format    string `json:"format"` // links, happ, json, clash or singbox
+}
+
+func (SubFetchLog) TableName() string {
+	return "sub_fetch_logs"
+}
+
+// RetiredSubId keeps a rotated subscription ID working until ExpiresAt, so
+// clients can pick up the new link before the old one stops answering.
+type RetiredSubId struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string `json:"subId" gorm:"unique"`   // The rotated subscription ID
+	NewSubId  string `json:"newSubId" gorm:"index"` // The subscription ID it was replaced with
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt" gorm:"index"` // End of the grace period (ms)
+}
+
+func (RetiredSubId) TableName() string {
+	return "retired_sub_ids"
+}
+
+// Plan is an account template bundling a quota, a duration, a reset period
+// and the inbounds its accounts get a client on.
+type Plan struct {
+	Id          int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string `json:"name" form:"name" gorm:"unique;not null"`
+	Remark      string `json:"remark" form:"remark"`
+	TotalGB     int64  `json:"totalGB" form:"totalGB" gorm:"default:0"`   // Traffic limit in GB (0 = unlimited)
+	Duration    int    `json:"duration" form:"duration" gorm:"default:0"` // Validity in days from creation or renewal (0 = never expires)
+	Reset       int    `json:"reset" form:"reset" gorm:"default:0"`       // Traffic reset period in days (0 = never)
+	LimitIP     int    `json:"limitIp" form:"limitIp" gorm:"default:0"`   // IP limit of every provisioned client (0 = unlimited)
+	InboundTags string `json:"inboundTags" form:"inboundTags"`            // Comma separated tags of the inbounds to provision
+	SlaveGroups string `json:"slaveGroups" form:"slaveGroups"`            // Comma separated slave groups whose inbounds are provisioned
+	CreatedAt   int64  `json:"createdAt" form:"createdAt"`
+	UpdatedAt   int64  `json:"updatedAt" form:"updatedAt"`
+}
+
+func (Plan) TableName() string {
+	return "plans"
+}
+
 // Slave represents a slave server connected to the master.
 type Slave struct {
 	Id          int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	Name        string `json:"name" form:"name"`
 	Address     string `json:"address" form:"address"` // Slave IP or Domain
 	Port        int    `json:"port" form:"port"`       // Slave Port (optional if using reverse WS)
-	Secret      string `json:"secret" form:"secret"`   // Auth Token for Slave
-	Status      string `json:"status" form:"status"`   // online, offline
+	Secret      string `json:"-" form:"secret"`        // Per-slave signing credential, never sent to the panel
+	Status      string `json:"status" form:"status"`   // online, degraded, offline
 	LastSeen    int64  `json:"lastSeen" form:"lastSeen"`
 	Version     string `json:"version" form:"version"` // Slave version
 	SystemStats string `json:"systemStats" form:"systemStats"` // CPU/Mem stats (JSON)
+	Group       string `json:"group" form:"group"`             // Slave group label, plans can target all inbounds of a group
+	Endpoints   string `json:"endpoints" form:"endpoints"`     // Subscription endpoints of the slave's inbounds (JSON list of SubEndpoint)
+
+	// Enrollment and credential management
+	JoinTokenHash   string `json:"-"`                                                       // SHA-256 of the one-time join token
+	JoinTokenExpiry int64  `json:"joinTokenExpiry" form:"joinTokenExpiry" gorm:"default:0"` // Join token expiration timestamp
+	PendingSecret   string `json:"-"`                                                       // Rotated credential awaiting slave confirmation
+	SecretRotatedAt int64  `json:"secretRotatedAt" form:"secretRotatedAt" gorm:"default:0"` // Last credential rotation timestamp
+	HostId          string `json:"hostId" form:"hostId"`                                    // Identity of the host the slave enrolled from
+	Revoked         bool   `json:"revoked" form:"revoked" gorm:"default:false"`             // Revoked slaves can no longer connect
+
+	// Config delivery tracking
+	ConfigRevision  int64  `json:"configRevision" form:"configRevision" gorm:"default:0"`   // Revision of the last config pushed to the slave
+	AppliedRevision int64  `json:"appliedRevision" form:"appliedRevision" gorm:"default:0"` // Revision the slave last confirmed as applied
+	ConfigStatus    string `json:"configStatus" form:"configStatus"`                        // pending, applied, failed
+	ConfigError     string `json:"configError" form:"configError"`                          // Xray error reported for a failed revision
+	ConfigRetries   int    `json:"configRetries" form:"configRetries" gorm:"default:0"`     // Automatic retries of the current revision
+	ConfigPushedAt  int64  `json:"configPushedAt" form:"configPushedAt" gorm:"default:0"`   // Time of the last push
+
+	TrafficSeq int64 `json:"trafficSeq" form:"trafficSeq" gorm:"default:0"` // Last traffic report sequence number applied
+
+	// Agent self-update tracking
+	AgentTargetVersion string `json:"agentTargetVersion" form:"agentTargetVersion"`          // Agent version the slave was last told to upgrade to
+	AgentUpgradeStatus string `json:"agentUpgradeStatus" form:"agentUpgradeStatus"`          // pending, done, failed
+	AgentUpgradeError  string `json:"agentUpgradeError" form:"agentUpgradeError"`            // Why the last upgrade failed
+	AgentUpgradeAt     int64  `json:"agentUpgradeAt" form:"agentUpgradeAt" gorm:"default:0"` // Time the last upgrade was sent
+
+	// Connection health
+	LatencyMs       int64 `json:"latencyMs" form:"latencyMs" gorm:"default:0"`             // Round-trip time of the last ping
+	HeartbeatMisses int   `json:"heartbeatMisses" form:"heartbeatMisses" gorm:"default:0"` // Consecutive pings without a pong
 }
 
 func (Slave) TableName() string {
@@ -108,7 +265,22 @@ type Inbound struct {
 	StreamSettings string   `json:"streamSettings" form:"streamSettings"`
 	Tag            string   `json:"tag" form:"tag" gorm:"unique"`
 	Sniffing       string   `json:"sniffing" form:"sniffing"`
-	Address        string   `json:"address" form:"address"` // Custom domain/IP for subscription links (optional)
+	Address        string   `json:"address" form:"address"`       // Custom domain/IP for subscription links (optional)
+	AutoEnroll     bool     `json:"autoEnroll" form:"autoEnroll"` // Give every enabled account a client when the inbound is added
+}
+
+// SubEndpoint is an external address subscriptions send clients to for an
+// inbound, like a CDN domain or another IP of the server. Inbounds keep
+// theirs in the externalProxy list of their stream settings, slaves theirs
+// in Endpoints for inbounds without an address of their own.
+type SubEndpoint struct {
+	Dest     string `json:"dest"`             // Host or IP clients connect to
+	Port     int    `json:"port"`             // 0 = the inbound's port
+	ForceTls string `json:"forceTls"`         // same, tls or none
+	Sni      string `json:"sni,omitempty"`    // TLS server name, empty = the inbound's; not used with REALITY
+	Path     string `json:"path,omitempty"`   // Transport path (gRPC service name), empty = the inbound's
+	Remark   string `json:"remark"`           // Added to the link remark
+	Weight   int    `json:"weight,omitempty"` // Share of clients getting the endpoint first, 0 = after the weighted ones
 }
 
 // OutboundTraffics tracks traffic statistics for Xray outbound connections.
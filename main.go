@@ -469,7 +469,7 @@ func main() {
 
     slaveCmd := flag.NewFlagSet("slave", flag.ExitOnError)
     masterUrl := slaveCmd.String("master", "", "Master Server URL")
-    slaveSecret := slaveCmd.String("secret", "", "Slave Secret")
+    slaveSecret := slaveCmd.String("secret", "", "One-time join token from the install command (or legacy slave secret)")
 
 	var port int
 	var username string
@@ -533,8 +533,9 @@ func main() {
         logger.InitLogger(logging.INFO)
         
         // Support both positional arguments and flags
-        // Usage: 3x-ui slave <master_url> <secret>
-        // Or: 3x-ui slave --master <url> --secret <key>
+        // Usage: 3x-ui slave <master_url> <join_token>
+        // Or: 3x-ui slave --master <url> --secret <join_token>
+        // The join token is only used until the slave has enrolled and stored its credential
         var masterUrlVal, secretVal string
         
         if len(os.Args) >= 4 && !strings.HasPrefix(os.Args[2], "-") {
@@ -553,9 +554,9 @@ func main() {
         }
         
         if masterUrlVal == "" || secretVal == "" {
-            fmt.Println("Error: master URL and secret are required for slave mode")
-            fmt.Println("Usage: 3x-ui slave <master_url> <secret>")
-            fmt.Println("   Or: 3x-ui slave --master <url> --secret <key>")
+            fmt.Println("Error: master URL and join token are required for slave mode")
+            fmt.Println("Usage: 3x-ui slave <master_url> <join_token>")
+            fmt.Println("   Or: 3x-ui slave --master <url> --secret <join_token>")
             return
         }
         slave.Run(masterUrlVal, secretVal)
@@ -143,7 +143,7 @@ func main() {
 	}
 
 	// Compare configurations
-	fmt.Println("🔍 Comparing configurations...\n")
+	fmt.Print("🔍 Comparing configurations...\n\n")
 	diff := compareConfigs(expectedConfig, actualConfig, *verbose)
 
 	// Print results
@@ -0,0 +1,267 @@
+package slave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// systemd units of the agent and of the watchdog that restores the previous
+// binary when an upgraded agent crashes before the master accepted it.
+const (
+	agentServiceUnit  = "x-ui-slave"
+	agentRollbackUnit = "x-ui-slave-rollback"
+)
+
+// agentRollbackGrace delays the watchdog past the agent's own deadline, so a
+// running agent always rolls back by itself first.
+const agentRollbackGrace = 30 * time.Second
+
+// agentUpgrade is an agent upgrade offered by the master.
+type agentUpgrade struct {
+	Version string `json:"version"`
+	Url     string `json:"url"` // Empty to download the master's own executable
+	Sha256  string `json:"sha256"`
+	Os      string `json:"os"` // Platform of the master's executable
+	Arch    string `json:"arch"`
+	Timeout int64  `json:"timeout"` // Seconds the new agent has to reconnect
+}
+
+// pendingUpgrade is kept on disk across the restart into the new agent until
+// the master accepted its connection.
+type pendingUpgrade struct {
+	Version    string `json:"version"`
+	Executable string `json:"executable"`
+	Backup     string `json:"backup"`
+	Deadline   int64  `json:"deadline"`
+}
+
+func getPendingUpgradePath() string {
+	return filepath.Join(config.GetDBFolderPath(), "slave-upgrade.json")
+}
+
+func loadPendingUpgrade() (*pendingUpgrade, error) {
+	data, err := os.ReadFile(getPendingUpgradePath())
+	if err != nil {
+		return nil, err
+	}
+	var pending pendingUpgrade
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+func savePendingUpgrade(pending *pendingUpgrade) error {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	path := getPendingUpgradePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func removePendingUpgrade() {
+	if err := os.Remove(getPendingUpgradePath()); err != nil && !os.IsNotExist(err) {
+		logger.Warning("Failed to remove pending agent upgrade:", err)
+	}
+}
+
+// upgradeAgent downloads a new agent, verifies its checksum and version and
+// swaps it in place of the running executable, keeping the old one as backup.
+// The agent then restarts; the new one must be accepted by the master before
+// the deadline or the backup is restored.
+func (s *Slave) upgradeAgent(u *agentUpgrade) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	if u.Version == "" || len(u.Sha256) != 64 {
+		return fmt.Errorf("invalid agent upgrade")
+	}
+	if u.Version == config.GetVersion() {
+		return fmt.Errorf("agent is already at version %s", u.Version)
+	}
+	if u.Os != "" && (u.Os != runtime.GOOS || u.Arch != runtime.GOARCH) {
+		return fmt.Errorf("master serves a %s/%s agent, this slave runs %s/%s", u.Os, u.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Upgrading agent to %s...", u.Version)
+	url := u.Url
+	var header http.Header
+	if url == "" {
+		url = s.getAgentURL()
+		header = slaveauth.SignedHeaders(s.cred.Secret, s.cred.SlaveId, s.cred.HostId, http.MethodGet, url)
+	}
+	// Download next to the executable so the final rename stays on one filesystem
+	newPath := exe + ".new"
+	defer os.Remove(newPath)
+	sum, err := xray.DownloadFileWithHeader(url, header, newPath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, u.Sha256) {
+		return fmt.Errorf("checksum mismatch for agent %s: expected %s, got %s", u.Version, u.Sha256, sum)
+	}
+	if err := os.Chmod(newPath, 0o755); err != nil {
+		return err
+	}
+	out, err := exec.Command(newPath, "-v").Output()
+	if err != nil {
+		return fmt.Errorf("downloaded agent does not run: %v", err)
+	}
+	if version := strings.TrimSpace(string(out)); version != u.Version {
+		return fmt.Errorf("downloaded agent reports version %q, expected %q", version, u.Version)
+	}
+
+	timeout := time.Duration(u.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Minute
+	}
+	pending := &pendingUpgrade{
+		Version:    u.Version,
+		Executable: exe,
+		Backup:     exe + ".bak",
+		Deadline:   time.Now().Add(timeout).Unix(),
+	}
+	if err := savePendingUpgrade(pending); err != nil {
+		return err
+	}
+	if err := os.Rename(exe, pending.Backup); err != nil {
+		removePendingUpgrade()
+		return err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Rename(pending.Backup, exe)
+		removePendingUpgrade()
+		return err
+	}
+	if err := armRollbackWatchdog(pending, timeout+agentRollbackGrace); err != nil {
+		logger.Warning("Failed to arm agent rollback watchdog, a crashing agent is not rolled back:", err)
+	}
+
+	logger.Infof("Agent %s installed, restarting", u.Version)
+	// Give the response to the master a moment to go out
+	time.AfterFunc(time.Second, s.restartAgent)
+	return nil
+}
+
+// checkPendingUpgrade runs at startup. After an upgrade it starts the timer
+// that restores the previous agent unless the master accepts this one in time.
+func (s *Slave) checkPendingUpgrade() {
+	pending, err := loadPendingUpgrade()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Failed to load pending agent upgrade:", err)
+		}
+		return
+	}
+	if pending.Version != config.GetVersion() {
+		// The watchdog restored the previous binary
+		logger.Warningf("Agent upgrade to %s was rolled back", pending.Version)
+		disarmRollbackWatchdog()
+		removePendingUpgrade()
+		return
+	}
+
+	wait := time.Until(time.Unix(pending.Deadline, 0))
+	if wait <= 0 {
+		s.rollbackAgent(pending)
+		return
+	}
+	logger.Infof("Running upgraded agent %s, waiting for the master to accept it", pending.Version)
+	time.AfterFunc(wait, func() {
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		if current, err := loadPendingUpgrade(); err == nil && current.Version == pending.Version {
+			s.rollbackAgent(current)
+		}
+	})
+}
+
+// confirmAgentUpgrade completes a pending upgrade once the master accepted the
+// new agent's connection.
+func confirmAgentUpgrade() {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	pending, err := loadPendingUpgrade()
+	if err != nil || pending.Version != config.GetVersion() {
+		return
+	}
+	disarmRollbackWatchdog()
+	if err := os.Remove(pending.Backup); err != nil && !os.IsNotExist(err) {
+		logger.Warning("Failed to remove previous agent binary:", err)
+	}
+	removePendingUpgrade()
+	logger.Infof("Agent upgrade to %s confirmed by the master", pending.Version)
+}
+
+// rollbackAgent restores the previous agent binary and restarts into it.
+func (s *Slave) rollbackAgent(pending *pendingUpgrade) {
+	logger.Warningf("Agent %s was not accepted by the master in time, restoring the previous version", pending.Version)
+	if err := os.Rename(pending.Backup, pending.Executable); err != nil {
+		logger.Error("Failed to restore the previous agent:", err)
+		return
+	}
+	disarmRollbackWatchdog()
+	removePendingUpgrade()
+	s.restartAgent()
+}
+
+// restartAgent restarts the agent service so systemd runs the current binary.
+// Without systemd the agent exits with an error status for its supervisor to
+// start it again.
+func (s *Slave) restartAgent() {
+	if err := exec.Command("systemctl", "restart", "--no-block", agentServiceUnit).Run(); err == nil {
+		return
+	}
+	logger.Warning("Failed to restart the agent through systemd, exiting")
+	s.stop()
+	os.Exit(1)
+}
+
+// armRollbackWatchdog schedules a transient systemd timer that restores the
+// previous binary if the pending upgrade is still on disk when it fires.
+// It covers a new agent that crashes before it could roll back by itself.
+func armRollbackWatchdog(pending *pendingUpgrade, after time.Duration) error {
+	disarmRollbackWatchdog()
+	script := fmt.Sprintf("if [ -f %q ]; then mv -f %q %q && rm -f %q; systemctl restart %s; fi",
+		getPendingUpgradePath(), pending.Backup, pending.Executable, getPendingUpgradePath(), agentServiceUnit)
+	out, err := exec.Command("systemd-run",
+		"--unit="+agentRollbackUnit,
+		fmt.Sprintf("--on-active=%d", int64(after/time.Second)),
+		"/bin/sh", "-c", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func disarmRollbackWatchdog() {
+	exec.Command("systemctl", "stop", agentRollbackUnit+".timer").Run()
+}
@@ -0,0 +1,226 @@
+package slave
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+var (
+	accessIpRegex        = regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
+	accessEmailRegex     = regexp.MustCompile(`email: (.+)$`)
+	accessTimestampRegex = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})`)
+)
+
+// clientIp is a source IP seen in the access log with the time it was last seen.
+type clientIp struct {
+	IP        string `json:"ip"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// accessLogTruncateInterval is how often a fully reported access log is
+// truncated while IP limits are active, as the master job used to do.
+const accessLogTruncateInterval = time.Hour
+
+// accessLogReader remembers how far the access log has been reported, so
+// every line is reported once without emptying the log for the log viewer.
+type accessLogReader struct {
+	offset        int64
+	lastTruncated time.Time
+}
+
+// hasIpLimits reports whether any client in the running config has a limitIp.
+func (s *Slave) hasIpLimits() bool {
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+	if s.process == nil || !s.process.IsRunning() {
+		return false
+	}
+	for _, inbound := range s.process.GetConfig().InboundConfigs {
+		var settings struct {
+			Clients []struct {
+				LimitIp int `json:"limitIp"`
+			} `json:"clients"`
+		}
+		if err := json.Unmarshal(inbound.Settings, &settings); err != nil {
+			continue
+		}
+		for _, client := range settings.Clients {
+			if client.LimitIp > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// collectClientIps parses the access log lines written since the last
+// reported offset into the source IPs seen per client email. It returns the
+// offset to commit once the report was delivered.
+func (s *Slave) collectClientIps(accessLogPath string) (map[string][]clientIp, int64, error) {
+	file, err := os.Open(accessLogPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	offset := s.accessLog.offset
+	if info.Size() < offset {
+		// The log was truncated or rotated, start over
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	seen := make(map[string]map[string]int64)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial last line is read again once Xray finished writing it
+			break
+		}
+		offset += int64(len(line))
+		line = strings.TrimRight(line, "\r\n")
+
+		ipMatches := accessIpRegex.FindStringSubmatch(line)
+		if len(ipMatches) < 2 {
+			continue
+		}
+		ip := ipMatches[1]
+		if ip == "127.0.0.1" || ip == "::1" {
+			continue
+		}
+
+		emailMatches := accessEmailRegex.FindStringSubmatch(line)
+		if len(emailMatches) < 2 {
+			continue
+		}
+		email := emailMatches[1]
+
+		timestamp := time.Now().Unix()
+		if matches := accessTimestampRegex.FindStringSubmatch(line); len(matches) >= 2 {
+			if t, err := time.ParseInLocation("2006/01/02 15:04:05", matches[1], time.Local); err == nil {
+				timestamp = t.Unix()
+			}
+		}
+
+		if _, ok := seen[email]; !ok {
+			seen[email] = make(map[string]int64)
+		}
+		if last, ok := seen[email][ip]; !ok || timestamp > last {
+			seen[email][ip] = timestamp
+		}
+	}
+
+	result := make(map[string][]clientIp, len(seen))
+	for email, ips := range seen {
+		for ip, timestamp := range ips {
+			result[email] = append(result[email], clientIp{IP: ip, Timestamp: timestamp})
+		}
+	}
+	return result, offset, nil
+}
+
+// sendClientIps reports the client source IPs from new access log lines to
+// the master. Nothing is read while no client has an IP limit. The read
+// offset only advances after the report was sent, so IPs are not lost when
+// the connection drops.
+func (s *Slave) sendClientIps() error {
+	if !s.hasIpLimits() {
+		return nil
+	}
+	accessLogPath, err := xray.GetAccessLogPath()
+	if err != nil || accessLogPath == "" || accessLogPath == "none" {
+		return nil
+	}
+
+	clients, offset, err := s.collectClientIps(accessLogPath)
+	if err != nil {
+		return err
+	}
+	if len(clients) > 0 {
+		data, err := json.Marshal(map[string]interface{}{
+			"type":     "client_ips",
+			"clients":  clients,
+			"fail2ban": checkFail2BanInstalled(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.writeMessage(data); err != nil {
+			return err
+		}
+	}
+	s.accessLog.offset = offset
+
+	// Keep the log from growing without bound, but only once everything in it was reported
+	if s.accessLog.lastTruncated.IsZero() {
+		s.accessLog.lastTruncated = time.Now()
+	} else if time.Since(s.accessLog.lastTruncated) >= accessLogTruncateInterval {
+		if info, err := os.Stat(accessLogPath); err == nil && info.Size() == offset {
+			if err := os.Truncate(accessLogPath, 0); err != nil {
+				logger.Warning("Failed to truncate access log:", err)
+			} else {
+				s.accessLog.offset = 0
+			}
+		}
+		s.accessLog.lastTruncated = time.Now()
+	}
+	return nil
+}
+
+// checkFail2BanInstalled reports whether banned IPs can be blocked on this host.
+func checkFail2BanInstalled() bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	return exec.Command("fail2ban-client", "-h").Run() == nil
+}
+
+// limitClientIps blocks the given IPs of a client that exceeded its IP limit
+// across the cluster. The IPs are written to the IP limit log that Fail2Ban
+// watches for a temporary ban, then the client is re-added to Xray so that
+// connections from those IPs are dropped.
+func (s *Slave) limitClientIps(email string, ips []string) error {
+	logFile, err := os.OpenFile(xray.GetIPLimitLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	ipLog := log.New(logFile, "", log.LstdFlags)
+	for _, ip := range ips {
+		ipLog.Printf("[LIMIT_IP] Email = %s || SRC = %s", email, ip)
+	}
+	logFile.Close()
+
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+	if s.process == nil || !s.process.IsRunning() || s.xrayAPI == nil {
+		return fmt.Errorf("xray is not running")
+	}
+	ops := s.process.GetConfig().ReconnectUserOps(email)
+	if err := s.xrayAPI.ApplyOps(ops); err != nil {
+		return err
+	}
+	logger.Infof("[LIMIT_IP] Blocked %d IPs of %s", len(ips), email)
+	return nil
+}
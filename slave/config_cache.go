@@ -0,0 +1,75 @@
+package slave
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// getLastGoodConfigPath returns where the slave keeps the last config Xray ran with successfully.
+func getLastGoodConfigPath() string {
+	return filepath.Join(config.GetDBFolderPath(), "slave-last-good.json")
+}
+
+// loadLastGoodConfig reads the cached config from disk.
+func loadLastGoodConfig() (*xray.Config, error) {
+	data, err := os.ReadFile(getLastGoodConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	var xrayConfig xray.Config
+	if err := json.Unmarshal(data, &xrayConfig); err != nil {
+		return nil, err
+	}
+	return &xrayConfig, nil
+}
+
+// saveLastGoodConfig writes the config to disk atomically so a crash mid-write
+// never leaves a truncated cache behind.
+func saveLastGoodConfig(xrayConfig *xray.Config) error {
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := getLastGoodConfigPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// rememberGoodConfig keeps xrayConfig as the rollback target in memory and on disk.
+func (s *Slave) rememberGoodConfig(xrayConfig *xray.Config) {
+	s.lastGood = xrayConfig
+	if err := saveLastGoodConfig(xrayConfig); err != nil {
+		logger.Warning("Failed to save last known good config:", err)
+	}
+}
+
+// startFromCache starts Xray from the cached config, if there is one, so the
+// node keeps serving users while the master is unreachable.
+func (s *Slave) startFromCache() {
+	xrayConfig, err := loadLastGoodConfig()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Failed to load last known good config:", err)
+		}
+		return
+	}
+	logger.Infof("Starting Xray from last known good config (%d inbounds)", len(xrayConfig.InboundConfigs))
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+	if err := s.startXray(xrayConfig); err != nil {
+		logger.Error("Failed to start Xray from last known good config:", err)
+		return
+	}
+	s.lastGood = xrayConfig
+}
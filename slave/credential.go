@@ -0,0 +1,215 @@
+package slave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
+)
+
+// credential is the identity a slave receives from the master on enrollment.
+type credential struct {
+	MasterUrl string `json:"masterUrl"`
+	SlaveId   int    `json:"slaveId"`
+	Secret    string `json:"secret"`
+	HostId    string `json:"hostId"`
+}
+
+// getCredentialPath returns where the slave stores its enrolled credential.
+func getCredentialPath() string {
+	return filepath.Join(config.GetDBFolderPath(), "slave-credential.json")
+}
+
+func loadCredential() (*credential, error) {
+	data, err := os.ReadFile(getCredentialPath())
+	if err != nil {
+		return nil, err
+	}
+	var cred credential
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// saveCredential writes the credential atomically with owner-only permissions.
+func saveCredential(cred *credential) error {
+	data, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := getCredentialPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func removeCredential() {
+	if err := os.Remove(getCredentialPath()); err != nil && !os.IsNotExist(err) {
+		logger.Warning("Failed to remove slave credential:", err)
+	}
+}
+
+// getHostId returns a stable identity for this machine. The systemd machine id
+// is preferred; otherwise a random id is generated once and kept on disk.
+func getHostId() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	path := filepath.Join(config.GetDBFolderPath(), "slave-host-id")
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+	id := random.Seq(32)
+	if err := os.WriteFile(path, []byte(id), 0o600); err != nil {
+		logger.Warning("Failed to persist host id:", err)
+	}
+	return id
+}
+
+// getConnectURL returns the WebSocket endpoint of the master.
+func (s *Slave) getConnectURL() string {
+	baseUrl := s.MasterUrl
+	if strings.Contains(baseUrl, "/panel/api/slave/connect") {
+		return baseUrl
+	}
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+	return baseUrl + "panel/api/slave/connect"
+}
+
+// getEnrollURL returns the HTTP enrollment endpoint next to the connect endpoint.
+func (s *Slave) getEnrollURL() string {
+	return s.getMasterURL("enroll")
+}
+
+// getAgentURL returns where the master serves agent upgrades.
+func (s *Slave) getAgentURL() string {
+	return s.getMasterURL("agent")
+}
+
+// getMasterURL returns the HTTP URL of a slave endpoint next to the connect endpoint.
+func (s *Slave) getMasterURL(endpoint string) string {
+	url := strings.Replace(s.getConnectURL(), "/panel/api/slave/connect", "/panel/api/slave/"+endpoint, 1)
+	if i := strings.Index(url, "?"); i >= 0 {
+		url = url[:i]
+	}
+	if strings.HasPrefix(url, "wss://") {
+		return "https://" + strings.TrimPrefix(url, "wss://")
+	}
+	if strings.HasPrefix(url, "ws://") {
+		return "http://" + strings.TrimPrefix(url, "ws://")
+	}
+	return url
+}
+
+// ensureCredential loads the stored credential or enrolls with the join token.
+func (s *Slave) ensureCredential() error {
+	if s.cred != nil {
+		return nil
+	}
+	cred, err := loadCredential()
+	if err == nil && cred.MasterUrl == s.MasterUrl && cred.Secret != "" {
+		s.cred = cred
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warning("Failed to load slave credential:", err)
+	}
+	cred, err = s.enroll()
+	if err != nil {
+		return err
+	}
+	if err := saveCredential(cred); err != nil {
+		return fmt.Errorf("failed to save slave credential: %v", err)
+	}
+	s.cred = cred
+	return nil
+}
+
+// enroll exchanges the join token for a signing credential.
+func (s *Slave) enroll() (*credential, error) {
+	if s.JoinToken == "" {
+		return nil, fmt.Errorf("no join token configured")
+	}
+	hostId := getHostId()
+	body, err := json.Marshal(map[string]string{"hostId": hostId})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.getEnrollURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(slaveauth.JoinTokenHeader, s.JoinToken)
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Msg     string `json:"msg"`
+		Obj     struct {
+			SlaveId int    `json:"slaveId"`
+			Secret  string `json:"secret"`
+		} `json:"obj"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid enrollment response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if !result.Success || result.Obj.Secret == "" {
+		return nil, fmt.Errorf("enrollment rejected: %s", result.Msg)
+	}
+	logger.Infof("Enrolled with master as slave %d", result.Obj.SlaveId)
+	return &credential{
+		MasterUrl: s.MasterUrl,
+		SlaveId:   result.Obj.SlaveId,
+		Secret:    result.Obj.Secret,
+		HostId:    hostId,
+	}, nil
+}
+
+// rotateCredential stores a new secret sent by the master and confirms it.
+func (s *Slave) rotateCredential(secret string) {
+	if s.cred == nil || secret == "" {
+		return
+	}
+	cred := *s.cred
+	cred.Secret = secret
+	if err := saveCredential(&cred); err != nil {
+		logger.Error("Failed to save rotated credential:", err)
+		return
+	}
+	s.cred = &cred
+	if err := s.writeMessage([]byte(`{"type":"credential_rotated"}`)); err != nil {
+		logger.Error("Failed to confirm credential rotation:", err)
+		return
+	}
+	logger.Info("Slave credential rotated")
+}
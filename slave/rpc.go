@@ -0,0 +1,135 @@
+package slave
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// rpcRequest is a command from the master that expects a response with the same Id.
+type rpcRequest struct {
+	Id     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// handleRequest runs a master command and sends back its result or error.
+func (s *Slave) handleRequest(message []byte) {
+	var req rpcRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		logger.Warning("Invalid request from master:", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"type": "response",
+		"id":   req.Id,
+	}
+	result, err := s.safeCallMethod(req.Method, req.Params)
+	if err != nil {
+		response["error"] = err.Error()
+	} else {
+		response["result"] = result
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("Failed to marshal response:", err)
+		return
+	}
+	if err := s.writeMessage(data); err != nil {
+		logger.Warning("Failed to send response:", err)
+	}
+}
+
+// safeCallMethod runs callMethod and turns a panic into an error, so a bad
+// request cannot take down the slave agent.
+func (s *Slave) safeCallMethod(method string, params json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Request %s panicked: %v", method, r)
+			result, err = nil, fmt.Errorf("request %s failed: %v", method, r)
+		}
+	}()
+	return s.callMethod(method, params)
+}
+
+func (s *Slave) callMethod(method string, params json.RawMessage) (interface{}, error) {
+	serverService := service.ServerService{}
+
+	switch method {
+	case service.SlaveMethodGetLogs:
+		var p struct {
+			Count  string `json:"count"`
+			Level  string `json:"level"`
+			Syslog string `json:"syslog"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return serverService.GetLogs(p.Count, p.Level, p.Syslog), nil
+
+	case service.SlaveMethodGetXrayLogs:
+		var p struct {
+			Count       string   `json:"count"`
+			Filter      string   `json:"filter"`
+			Email       string   `json:"email"`
+			ShowDirect  string   `json:"showDirect"`
+			ShowBlocked string   `json:"showBlocked"`
+			ShowProxy   string   `json:"showProxy"`
+			Freedoms    []string `json:"freedoms"`
+			Blackholes  []string `json:"blackholes"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return serverService.GetXrayLogs(p.Count, p.Filter, p.Email, p.ShowDirect, p.ShowBlocked, p.ShowProxy,
+			p.Freedoms, p.Blackholes), nil
+
+	case service.SlaveMethodGetXrayErrorLogs:
+		var p struct {
+			Count  string `json:"count"`
+			Level  string `json:"level"`
+			Filter string `json:"filter"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return serverService.GetXrayErrorLogs(p.Count, p.Level, p.Filter), nil
+
+	case service.SlaveMethodInstallXray:
+		var p struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Version == "" {
+			return nil, fmt.Errorf("missing version")
+		}
+		return s.installXray(p.Version)
+
+	case service.SlaveMethodUpdateGeofile:
+		var p struct {
+			FileName string `json:"fileName"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if err := s.updateGeofile(p.FileName); err != nil {
+			return nil, err
+		}
+		return s.versionInfo(), nil
+
+	case service.SlaveMethodUpgradeAgent:
+		var p agentUpgrade
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.upgradeAgent(&p)
+	}
+
+	return nil, fmt.Errorf("unknown method %q", method)
+}
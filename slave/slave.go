@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,6 +17,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/xray"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -24,30 +27,63 @@ import (
 
 type Slave struct {
 	MasterUrl string
-	Secret    string
+	JoinToken string // One-time token used to enroll when no credential is stored
+	cred      *credential
 	process   *xray.Process
 	xrayAPI   *xray.XrayAPI
 	slaveId   int
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex // gorilla connections allow only one concurrent writer
+
+	// xrayMu guards replacing process and xrayAPI. Config updates, binary
+	// updates and the traffic ticker all run on different goroutines.
+	xrayMu   sync.Mutex
+	lastGood *xray.Config // Last config Xray ran with successfully
+
+	journal *trafficJournal // Traffic deltas not yet acknowledged by the master
+
+	accessLog accessLogReader // Access log position reported for IP limits
 }
 
-func NewSlave(masterUrl, secret string) *Slave {
+func NewSlave(masterUrl, joinToken string) *Slave {
 	return &Slave{
 		MasterUrl: masterUrl,
-		Secret:    secret,
+		JoinToken: joinToken,
 	}
 }
 
-func Run(masterUrl, secret string) {
-	slave := NewSlave(masterUrl, secret)
+func Run(masterUrl, joinToken string) {
+	slave := NewSlave(masterUrl, joinToken)
 	slave.Run()
 }
 
 func (s *Slave) Run() {
 	logger.Info("Starting Slave...")
 
+	// install.sh registers the agent as its own systemd unit
+	service.SetSyslogUnit("x-ui-slave")
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
+	s.journal = openTrafficJournal()
+
+	// An upgraded agent rolls back unless the master accepts it in time
+	s.checkPendingUpgrade()
+
+	// Serve users with the cached config until the master is reachable
+	s.startFromCache()
+
+	// Traffic is collected even while disconnected and replayed on reconnect
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.reportTraffic()
+		}
+	}()
+
 	go func() {
 		for {
 			s.connectAndLoop()
@@ -57,54 +93,75 @@ func (s *Slave) Run() {
 	}()
 
 	<-interrupt
+	s.stop()
+	logger.Info("Slave stopped")
+}
+
+// stop journals the remaining traffic and stops Xray.
+func (s *Slave) stop() {
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
 	if s.process != nil {
+		s.recordTraffic()
 		s.process.Stop()
 	}
-	logger.Info("Slave stopped")
 }
 
 func (s *Slave) connectAndLoop() {
-	// Build the URL - check if path already contains the endpoint
-	baseUrl := s.MasterUrl
-	var url string
-	
-	// If the URL already has the connect path, just append the secret
-	if strings.Contains(baseUrl, "/panel/api/slave/connect") {
-		if strings.Contains(baseUrl, "?") {
-			url = baseUrl + "&secret=" + s.Secret
-		} else {
-			url = baseUrl + "?secret=" + s.Secret
-		}
-	} else {
-		// Need to append the path
-		if baseUrl[len(baseUrl)-1] != '/' {
-			baseUrl += "/"
-		}
-		url = fmt.Sprintf("%spanel/api/slave/connect?secret=%s", baseUrl, s.Secret)
+	if err := s.ensureCredential(); err != nil {
+		logger.Error("Enrollment failed:", err)
+		return
 	}
-	logger.Infof("Connecting to %s", url)
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	url := s.getConnectURL()
+	logger.Infof("Connecting to %s as slave %d", url, s.cred.SlaveId)
+	c, resp, err := websocket.DefaultDialer.Dial(url, slaveauth.SignedHeaders(s.cred.Secret, s.cred.SlaveId, s.cred.HostId, http.MethodGet, url))
 	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				// Revoked or unknown credential: enroll again with the configured join token
+				logger.Error("Master rejected the slave credential, re-enrolling")
+				removeCredential()
+				s.cred = nil
+			case http.StatusConflict:
+				logger.Error("Master reports this slave identity is bound to another host")
+			case http.StatusBadRequest:
+				logger.Error("Master rejected the request timestamp, check that the system clock is synchronized")
+			}
+		}
 		logger.Error("Connect failed:", err)
 		return
 	}
 	defer c.Close()
 	logger.Info("Connected to Master")
 
+	s.writeMu.Lock()
+	s.conn = c
+	s.writeMu.Unlock()
+	defer func() {
+		s.writeMu.Lock()
+		s.conn = nil
+		s.writeMu.Unlock()
+	}()
+
+	// Journaled traffic is held back until the master sends its last seq
+	s.journal.Reset()
+
 	done := make(chan struct{})
 
 	// heartbeat / stats loop
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
-		trafficTicker := time.NewTicker(10 * time.Second)
+		ipTicker := time.NewTicker(10 * time.Second)
 		certTicker := time.NewTicker(60 * time.Minute) // Check certs every hour
 		defer ticker.Stop()
-		defer trafficTicker.Stop()
+		defer ipTicker.Stop()
 		defer certTicker.Stop()
 		
 		// Send certs immediately on connect
 		if certData := s.collectCertificates(); certData != "" {
-			if err := c.WriteMessage(websocket.TextMessage, []byte(certData)); err != nil {
+			if err := s.writeMessage([]byte(certData)); err != nil {
 				logger.Error("Failed to send initial certificates:", err)
 			}
 		}
@@ -113,21 +170,19 @@ func (s *Slave) connectAndLoop() {
 			select {
 			case <-ticker.C:
 				stats := s.collectStats()
-				if err := c.WriteMessage(websocket.TextMessage, []byte(stats)); err != nil {
+				if err := s.writeMessage([]byte(stats)); err != nil {
 					close(done)
 					return
 				}
-			case <-trafficTicker.C:
-				// Send traffic stats
-				if trafficData := s.collectTrafficStats(); trafficData != "" {
-					if err := c.WriteMessage(websocket.TextMessage, []byte(trafficData)); err != nil {
-						logger.Error("Failed to send traffic stats:", err)
-					}
+			case <-ipTicker.C:
+				// Report client source IPs for cluster-wide IP limits
+				if err := s.sendClientIps(); err != nil {
+					logger.Warning("Failed to report client IPs:", err)
 				}
 			case <-certTicker.C:
 				// Send certificate info periodically
 				if certData := s.collectCertificates(); certData != "" {
-					if err := c.WriteMessage(websocket.TextMessage, []byte(certData)); err != nil {
+					if err := s.writeMessage([]byte(certData)); err != nil {
 						logger.Error("Failed to send certificates:", err)
 					}
 				}
@@ -155,24 +210,80 @@ func (s *Slave) connectAndLoop() {
 			continue
 		}
 
+		revision, _ := msg["revision"].(float64)
+
 		switch typeStr {
 		case "update_config_full":
 			configStr, ok := msg["config"].(string)
 			if !ok {
 				logger.Error("Invalid config format")
+				s.sendConfigAck(int64(revision), fmt.Errorf("invalid config format"))
 				continue
 			}
 
 			var xrayConfig xray.Config
 			if err := json.Unmarshal([]byte(configStr), &xrayConfig); err != nil {
 				logger.Error("Failed to unmarshal config:", err)
+				s.sendConfigAck(int64(revision), err)
+				continue
+			}
+
+			logger.Infof("Received full config update (revision %d). Inbounds: %d, Outbounds (raw length): %d",
+				int64(revision), len(xrayConfig.InboundConfigs), len(xrayConfig.OutboundConfigs))
+
+			s.xrayMu.Lock()
+			err := s.applyFullConfig(&xrayConfig)
+			s.xrayMu.Unlock()
+			s.sendConfigAck(int64(revision), err)
+
+		case "update_config_delta":
+			var delta struct {
+				Ops []xray.ConfigOp `json:"ops"`
+			}
+			if err := json.Unmarshal(message, &delta); err != nil {
+				logger.Error("Failed to unmarshal config delta:", err)
+				s.sendConfigAck(int64(revision), err)
 				continue
 			}
 
-			logger.Infof("Received full config update. Inbounds: %d, Outbounds (raw length): %d", 
-				len(xrayConfig.InboundConfigs), len(xrayConfig.OutboundConfigs))
+			logger.Infof("Received config delta (revision %d) with %d ops", int64(revision), len(delta.Ops))
+
+			s.xrayMu.Lock()
+			err := s.applyConfigDelta(delta.Ops)
+			s.xrayMu.Unlock()
+			s.sendConfigAck(int64(revision), err)
+
+		case "traffic_seq":
+			lastSeq, _ := msg["lastSeq"].(float64)
+			s.journal.Sync(int64(lastSeq))
+			s.flushTraffic()
+			// The master accepted this agent, an upgrade is complete
+			confirmAgentUpgrade()
+
+		case "traffic_ack":
+			seq, _ := msg["seq"].(float64)
+			s.journal.Ack(int64(seq))
+
+		case "request":
+			// Answered concurrently so a slow command does not stall config updates
+			go s.handleRequest(message)
+
+		case "limit_ip":
+			email, _ := msg["email"].(string)
+			rawIps, _ := msg["ips"].([]interface{})
+			ips := make([]string, 0, len(rawIps))
+			for _, ip := range rawIps {
+				if ipStr, ok := ip.(string); ok {
+					ips = append(ips, ipStr)
+				}
+			}
+			if err := s.limitClientIps(email, ips); err != nil {
+				logger.Warningf("[LIMIT_IP] Failed to block IPs of %s: %v", email, err)
+			}
 
-			s.applyFullConfig(&xrayConfig)
+		case "rotate_credential":
+			secret, _ := msg["secret"].(string)
+			s.rotateCredential(secret)
 
 		case "restart_xray":
 			// Handle Xray Restart Request
@@ -181,6 +292,36 @@ func (s *Slave) connectAndLoop() {
 	}
 }
 
+// writeMessage sends a text message to the master over the current connection.
+func (s *Slave) writeMessage(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.conn == nil {
+		return fmt.Errorf("not connected to master")
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// sendConfigAck reports the outcome of applying a config revision to the master.
+func (s *Slave) sendConfigAck(revision int64, applyErr error) {
+	ack := map[string]interface{}{
+		"type":     "config_applied",
+		"revision": revision,
+	}
+	if applyErr != nil {
+		ack["type"] = "config_failed"
+		ack["error"] = applyErr.Error()
+	}
+	data, err := json.Marshal(ack)
+	if err != nil {
+		logger.Error("Failed to marshal config ack:", err)
+		return
+	}
+	if err := s.writeMessage(data); err != nil {
+		logger.Error("Failed to send config ack:", err)
+	}
+}
+
 func (s *Slave) collectStats() string {
 	v, _ := mem.VirtualMemory()
 	c, _ := cpu.Percent(0, false)
@@ -193,9 +334,11 @@ func (s *Slave) collectStats() string {
 	
 	// Get versions
 	xrayVersion := "Unknown"
+	s.xrayMu.Lock()
 	if s.process != nil {
 		xrayVersion = s.process.GetVersion()
 	}
+	s.xrayMu.Unlock()
 	uiVersion := config.GetVersion()
 	
 	return fmt.Sprintf(`{"cpu": %.2f, "mem": %.2f, "address": "%s", "xrayVersion": "%s", "uiVersion": "%s"}`, 
@@ -233,34 +376,68 @@ func (s *Slave) getPublicIP() string {
 	return ""
 }
 
-func (s *Slave) collectTrafficStats() string {
+// reportTraffic records the traffic since the last call in the journal and
+// sends everything the master has not seen yet. Periods without traffic are
+// sent live only, to keep the online client list current.
+func (s *Slave) reportTraffic() {
+	s.xrayMu.Lock()
+	stats := s.recordTraffic()
+	s.xrayMu.Unlock()
+	s.flushTraffic()
+	if stats == nil || stats.hasTraffic() {
+		return
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		logger.Error("Failed to marshal traffic data:", err)
+		return
+	}
+	if err := s.writeMessage(data); err != nil {
+		logger.Debug("Failed to send traffic status:", err)
+	}
+}
+
+// recordTraffic reads and resets the Xray counters and journals any traffic.
+// It must run before Xray is stopped, otherwise the counters are lost.
+// The caller holds xrayMu.
+func (s *Slave) recordTraffic() *trafficStats {
+	stats := s.collectTrafficStats()
+	if stats == nil || !stats.hasTraffic() {
+		return stats
+	}
+	if err := s.journal.Append(stats); err != nil {
+		logger.Error("Failed to journal traffic stats:", err)
+	}
+	return stats
+}
+
+// flushTraffic sends journaled traffic the master has not received on this connection.
+func (s *Slave) flushTraffic() {
+	for _, data := range s.journal.Unsent() {
+		if err := s.writeMessage(data); err != nil {
+			// Entries stay in the journal and are resent after reconnecting
+			logger.Debug("Failed to send journaled traffic:", err)
+			return
+		}
+	}
+}
+
+func (s *Slave) collectTrafficStats() *trafficStats {
 	if s.xrayAPI == nil || s.process == nil || !s.process.IsRunning() {
 		logger.Debug("collectTrafficStats: Xray API or process not ready")
-		return ""
+		return nil
 	}
 	
 	traffics, clientTraffics, err := s.xrayAPI.GetTraffic(true)
 	if err != nil {
 		logger.Debug("Failed to get traffic stats:", err)
-		return ""
+		return nil
 	}
 	
 	logger.Debugf("collectTrafficStats: Got %d inbound/outbound entries, %d user entries", len(traffics), len(clientTraffics))
 	
-	if len(traffics) == 0 && len(clientTraffics) == 0 {
-		return ""
-	}
-	
 	// Build traffic stats message with inbound, outbound and user stats
-	type TrafficData struct {
-		Type          string                       `json:"type"`
-		Inbounds      map[string]map[string]int64  `json:"inbounds"`
-		Outbounds     map[string]map[string]int64  `json:"outbounds"`
-		Users         []map[string]interface{}     `json:"users"`
-		OnlineClients []string                     `json:"online_clients"`
-	}
-	
-	data := TrafficData{
+	data := &trafficStats{
 		Type:          "traffic_stats",
 		Inbounds:      make(map[string]map[string]int64),
 		Outbounds:     make(map[string]map[string]int64),
@@ -270,6 +447,9 @@ func (s *Slave) collectTrafficStats() string {
 	
 	// Collect inbound and outbound traffic
 	for _, traffic := range traffics {
+		if traffic.Up == 0 && traffic.Down == 0 {
+			continue
+		}
 		if traffic.IsInbound && traffic.Tag != "api" {
 			data.Inbounds[traffic.Tag] = map[string]int64{
 				"uplink":   traffic.Up,
@@ -298,30 +478,49 @@ func (s *Slave) collectTrafficStats() string {
 		}
 	}
 	
-	// Always send traffic stats message, even if no traffic occurred this period
-	// This ensures frontend receives regular updates about online status and accumulated traffic
-	if len(data.Inbounds) == 0 && len(data.Outbounds) == 0 && len(data.Users) == 0 {
-		// Still send message with online clients list (even if empty)
-		// This triggers frontend updates from database values
-		logger.Debug("collectTrafficStats: No new traffic this period, sending status update")
+	logger.Debugf("collectTrafficStats: %d inbounds, %d outbounds, %d users, %d online", 
+		len(data.Inbounds), len(data.Outbounds), len(data.Users), len(data.OnlineClients))
+	return data
+}
+
+// applyFullConfig replaces the running Xray process with one using xrayConfig.
+// If the new config does not start, Xray is rolled back to the last known good
+// config and the original error is returned. A config identical to the running
+// one is accepted without a restart so a master reconnect does not drop users.
+// The caller holds xrayMu.
+func (s *Slave) applyFullConfig(xrayConfig *xray.Config) error {
+	if s.process != nil && s.process.IsRunning() && s.process.GetConfig().Equals(xrayConfig) {
+		logger.Info("Received config matches the running one, keeping Xray up")
+		s.rememberGoodConfig(xrayConfig)
+		return nil
 	}
-	
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		logger.Error("Failed to marshal traffic data:", err)
-		return ""
+
+	err := s.startXray(xrayConfig)
+	if err == nil {
+		s.rememberGoodConfig(xrayConfig)
+		return nil
 	}
-	
-	logger.Infof("Sending traffic stats: %d inbounds, %d outbounds, %d users, %d online", 
-		len(data.Inbounds), len(data.Outbounds), len(data.Users), len(data.OnlineClients))
-	return string(jsonData)
+
+	if s.lastGood == nil {
+		return err
+	}
+	logger.Warning("New config failed, rolling back to last known good config")
+	if rbErr := s.startXray(s.lastGood); rbErr != nil {
+		logger.Error("Rollback to last known good config failed:", rbErr)
+		return fmt.Errorf("%v; rollback failed: %v", err, rbErr)
+	}
+	return fmt.Errorf("%v; rolled back to last known good config", err)
 }
 
-func (s *Slave) applyFullConfig(xrayConfig *xray.Config) {
+// startXray replaces the running Xray process with one using xrayConfig.
+// It returns the Xray error if the new process fails to start or exits right away.
+// The caller holds xrayMu.
+func (s *Slave) startXray(xrayConfig *xray.Config) error {
 	logger.Info("Applying new full configuration...")
 
 	// Stop previous process if running
 	if s.process != nil && s.process.IsRunning() {
+		s.recordTraffic()
 		s.process.Stop()
 	}
 
@@ -330,31 +529,74 @@ func (s *Slave) applyFullConfig(xrayConfig *xray.Config) {
 
 	if err := proc.Start(); err != nil {
 		logger.Error("Failed to start Xray:", err)
-	} else {
-		s.process = proc
-		logger.Info("Xray started successfully")
-		
-		// Initialize Xray API for traffic stats
-		// Dynamic API port extraction is handled by `proc.Start()` -> `proc.refreshAPIPort()`
-		apiPort := proc.GetAPIPort()
-		logger.Infof("Xray API Port discovered: %d", apiPort)
-
-		time.Sleep(2 * time.Second) // Wait for Xray to fully start
-		if s.xrayAPI == nil {
-			s.xrayAPI = &xray.XrayAPI{}
+		return err
+	}
+	s.process = proc
+
+	// Dynamic API port extraction is handled by `proc.Start()` -> `proc.refreshAPIPort()`
+	apiPort := proc.GetAPIPort()
+	logger.Infof("Xray API Port discovered: %d", apiPort)
+
+	time.Sleep(2 * time.Second) // Wait for Xray to fully start
+	if !proc.IsRunning() {
+		err := proc.GetErr()
+		if result := proc.GetResult(); result != "" {
+			err = fmt.Errorf("%s", result)
+		} else if err == nil {
+			err = fmt.Errorf("xray exited right after start")
 		}
-		if err := s.xrayAPI.Init(apiPort); err != nil {
-			logger.Error("Failed to initialize Xray API:", err)
-		} else {
-			logger.Info("Xray API initialized successfully")
+		logger.Error("Xray exited after start:", err)
+		return err
+	}
+	logger.Info("Xray started successfully")
+
+	// Initialize Xray API for traffic stats
+	if s.xrayAPI == nil {
+		s.xrayAPI = &xray.XrayAPI{}
+	}
+	if err := s.xrayAPI.Init(apiPort); err != nil {
+		logger.Error("Failed to initialize Xray API:", err)
+	} else {
+		logger.Info("Xray API initialized successfully")
+	}
+	return nil
+}
+
+// applyConfigDelta applies inbound and user changes through the Xray API so
+// connected users are not dropped. If the live update fails, Xray is restarted
+// with the resulting config instead. The caller holds xrayMu.
+func (s *Slave) applyConfigDelta(ops []xray.ConfigOp) error {
+	if s.process == nil {
+		logger.Warning("Received config delta before any full config, ignoring")
+		return fmt.Errorf("no base config to apply delta to")
+	}
+
+	current := s.process.GetConfig()
+	newConfig := *current
+	newConfig.InboundConfigs = append([]xray.InboundConfig(nil), current.InboundConfigs...)
+	newConfig.ApplyOps(ops)
+
+	if s.process.IsRunning() && s.xrayAPI != nil {
+		err := s.xrayAPI.ApplyOps(ops)
+		if err == nil {
+			s.process.SetConfig(&newConfig)
+			s.rememberGoodConfig(&newConfig)
+			logger.Infof("Applied %d config ops via Xray API", len(ops))
+			return nil
 		}
+		logger.Warning("Failed to apply config delta via Xray API, restarting Xray:", err)
 	}
+
+	return s.applyFullConfig(&newConfig)
 }
 
 func (s *Slave) restartXray() {
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
 	logger.Info("Restarting Xray...")
 	
 	if s.process != nil && s.process.IsRunning() {
+		s.recordTraffic()
 		if err := s.process.Stop(); err != nil {
 			logger.Error("Failed to stop Xray:", err)
 			return
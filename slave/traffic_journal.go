@@ -0,0 +1,223 @@
+package slave
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// trafficStats is a traffic_stats message. Seq is assigned by the journal;
+// messages without traffic are sent live with Seq 0 and never journaled.
+type trafficStats struct {
+	Type          string                      `json:"type"`
+	Seq           int64                       `json:"seq,omitempty"`
+	Inbounds      map[string]map[string]int64 `json:"inbounds"`
+	Outbounds     map[string]map[string]int64 `json:"outbounds"`
+	Users         []map[string]interface{}    `json:"users"`
+	OnlineClients []string                    `json:"online_clients"`
+}
+
+// hasTraffic reports whether the message carries any usage that must not be lost.
+func (t *trafficStats) hasTraffic() bool {
+	return len(t.Inbounds) > 0 || len(t.Outbounds) > 0 || len(t.Users) > 0
+}
+
+// trafficJournal is a durable queue of traffic deltas. Xray counters are reset
+// when read, so every delta is written to disk before it is sent and only
+// dropped once the master acknowledged its sequence number.
+type trafficJournal struct {
+	mu      sync.Mutex
+	path    string
+	nextSeq int64
+	entries []journalEntry
+	sentSeq int64 // Highest seq sent over the current connection
+	synced  bool  // Whether the master told us its last seq on this connection
+}
+
+type journalEntry struct {
+	Seq  int64
+	Data []byte
+}
+
+// getTrafficJournalPath returns where unacknowledged traffic deltas are kept.
+func getTrafficJournalPath() string {
+	return filepath.Join(config.GetDBFolderPath(), "slave-traffic-journal.jsonl")
+}
+
+// openTrafficJournal loads pending entries from disk.
+func openTrafficJournal() *trafficJournal {
+	return loadTrafficJournal(getTrafficJournalPath())
+}
+
+// loadTrafficJournal loads the journal kept at path.
+func loadTrafficJournal(path string) *trafficJournal {
+	j := &trafficJournal{path: path, nextSeq: 1}
+	file, err := os.Open(j.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Failed to open traffic journal:", err)
+		}
+		return j
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		var stats trafficStats
+		if err := json.Unmarshal(line, &stats); err != nil || stats.Seq <= 0 {
+			// A torn last line after a crash is skipped
+			continue
+		}
+		j.entries = append(j.entries, journalEntry{Seq: stats.Seq, Data: line})
+		if stats.Seq >= j.nextSeq {
+			j.nextSeq = stats.Seq + 1
+		}
+	}
+	if len(j.entries) > 0 {
+		logger.Infof("Loaded %d unacknowledged traffic entries from journal", len(j.entries))
+	}
+	return j
+}
+
+// Append assigns the next sequence number to stats and persists it.
+func (j *trafficJournal) Append(stats *trafficStats) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats.Seq = j.nextSeq
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	j.nextSeq++
+	j.entries = append(j.entries, journalEntry{Seq: stats.Seq, Data: data})
+	return nil
+}
+
+// Ack drops every entry up to and including seq.
+func (j *trafficJournal) Ack(seq int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	i := 0
+	for i < len(j.entries) && j.entries[i].Seq <= seq {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	j.entries = append([]journalEntry(nil), j.entries[i:]...)
+	if err := j.rewrite(); err != nil {
+		logger.Warning("Failed to compact traffic journal:", err)
+	}
+}
+
+// Sync aligns the journal with the last sequence number the master processed.
+// Entries the master already has are dropped. If this slave's counter is behind
+// the master's, e.g. because the journal was deleted, pending entries are
+// renumbered so the master does not discard them as duplicates.
+func (j *trafficJournal) Sync(masterSeq int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.sentSeq = 0
+	j.synced = true
+	if j.nextSeq > masterSeq {
+		i := 0
+		for i < len(j.entries) && j.entries[i].Seq <= masterSeq {
+			i++
+		}
+		j.entries = append([]journalEntry(nil), j.entries[i:]...)
+	} else {
+		logger.Warningf("Traffic journal sequence %d is behind master (%d), renumbering", j.nextSeq, masterSeq)
+		j.nextSeq = masterSeq + 1
+		for i := range j.entries {
+			var stats trafficStats
+			if err := json.Unmarshal(j.entries[i].Data, &stats); err != nil {
+				continue
+			}
+			stats.Seq = j.nextSeq
+			if data, err := json.Marshal(stats); err == nil {
+				j.entries[i] = journalEntry{Seq: stats.Seq, Data: data}
+				j.nextSeq++
+			}
+		}
+	}
+	if err := j.rewrite(); err != nil {
+		logger.Warning("Failed to rewrite traffic journal:", err)
+	}
+}
+
+// Unsent returns the entries not yet sent over the current connection and marks
+// them sent. Nothing is returned before Sync, as entries may still be renumbered.
+func (j *trafficJournal) Unsent() [][]byte {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	result := make([][]byte, 0)
+	if !j.synced {
+		return result
+	}
+	for _, entry := range j.entries {
+		if entry.Seq > j.sentSeq {
+			result = append(result, entry.Data)
+			j.sentSeq = entry.Seq
+		}
+	}
+	return result
+}
+
+// Reset holds back pending entries until the master sent its last seq on a new connection.
+func (j *trafficJournal) Reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sentSeq = 0
+	j.synced = false
+}
+
+// rewrite replaces the journal file with the pending entries. Callers hold mu.
+func (j *trafficJournal) rewrite() error {
+	tmpPath := j.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range j.entries {
+		writer.Write(entry.Data)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, j.path)
+}
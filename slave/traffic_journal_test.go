@@ -0,0 +1,190 @@
+package slave
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	logDir, err := os.MkdirTemp("", "x-ui-slave-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XUI_LOG_FOLDER", logDir)
+	logger.InitLogger(logging.ERROR)
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+func newTestJournal(t *testing.T) *trafficJournal {
+	t.Helper()
+	return loadTrafficJournal(filepath.Join(t.TempDir(), "journal.jsonl"))
+}
+
+func appendTraffic(t *testing.T, j *trafficJournal, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		stats := &trafficStats{
+			Type:     "traffic_stats",
+			Inbounds: map[string]map[string]int64{"in": {"uplink": int64(i + 1)}},
+		}
+		if err := j.Append(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seqsOf(t *testing.T, messages [][]byte) []int64 {
+	t.Helper()
+	seqs := make([]int64, len(messages))
+	for i, data := range messages {
+		var stats trafficStats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatal(err)
+		}
+		seqs[i] = stats.Seq
+	}
+	return seqs
+}
+
+func equalSeqs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTrafficJournalSync(t *testing.T) {
+	tests := []struct {
+		name      string
+		appended  int
+		masterSeq int64
+		want      []int64
+		nextSeq   int64
+	}{
+		{"master has nothing", 3, 0, []int64{1, 2, 3}, 4},
+		{"master has some", 3, 2, []int64{3}, 4},
+		{"master has all", 3, 3, []int64{}, 4},
+		{"slave behind master is renumbered", 2, 10, []int64{11, 12}, 13},
+		{"empty journal behind master", 0, 5, []int64{}, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJournal(t)
+			appendTraffic(t, j, tt.appended)
+
+			j.Sync(tt.masterSeq)
+			if got := seqsOf(t, j.Unsent()); !equalSeqs(got, tt.want) {
+				t.Errorf("unsent seqs = %v, want %v", got, tt.want)
+			}
+			if j.nextSeq != tt.nextSeq {
+				t.Errorf("nextSeq = %d, want %d", j.nextSeq, tt.nextSeq)
+			}
+
+			// The renumbered state must survive a restart
+			reloaded := loadTrafficJournal(j.path)
+			reloaded.Sync(tt.masterSeq)
+			if got := seqsOf(t, reloaded.Unsent()); !equalSeqs(got, tt.want) {
+				t.Errorf("after reload unsent seqs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficJournalUnsent(t *testing.T) {
+	j := newTestJournal(t)
+	appendTraffic(t, j, 2)
+
+	if got := j.Unsent(); len(got) != 0 {
+		t.Fatalf("got %d entries before Sync, want none", len(got))
+	}
+	j.Sync(0)
+	if got := seqsOf(t, j.Unsent()); !equalSeqs(got, []int64{1, 2}) {
+		t.Fatalf("unsent seqs = %v, want [1 2]", got)
+	}
+	if got := j.Unsent(); len(got) != 0 {
+		t.Fatalf("entries were sent twice on one connection: %v", seqsOf(t, got))
+	}
+
+	appendTraffic(t, j, 1)
+	if got := seqsOf(t, j.Unsent()); !equalSeqs(got, []int64{3}) {
+		t.Fatalf("unsent seqs = %v, want [3]", got)
+	}
+
+	// A new connection resends everything not acknowledged
+	j.Reset()
+	if got := j.Unsent(); len(got) != 0 {
+		t.Fatalf("got %d entries after Reset before Sync, want none", len(got))
+	}
+	j.Sync(0)
+	if got := seqsOf(t, j.Unsent()); !equalSeqs(got, []int64{1, 2, 3}) {
+		t.Fatalf("unsent seqs = %v, want [1 2 3]", got)
+	}
+}
+
+func TestTrafficJournalAck(t *testing.T) {
+	tests := []struct {
+		name string
+		ack  int64
+		want []int64
+	}{
+		{"nothing", 0, []int64{1, 2, 3}},
+		{"prefix", 2, []int64{3}},
+		{"all", 3, []int64{}},
+		{"beyond last", 9, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJournal(t)
+			appendTraffic(t, j, 3)
+			j.Ack(tt.ack)
+
+			reloaded := loadTrafficJournal(j.path)
+			reloaded.Sync(0)
+			if got := seqsOf(t, reloaded.Unsent()); !equalSeqs(got, tt.want) {
+				t.Errorf("seqs after ack and reload = %v, want %v", got, tt.want)
+			}
+			if reloaded.nextSeq != 4 && len(tt.want) > 0 {
+				t.Errorf("nextSeq = %d, want 4", reloaded.nextSeq)
+			}
+		})
+	}
+}
+
+func TestTrafficJournalTornLine(t *testing.T) {
+	j := newTestJournal(t)
+	appendTraffic(t, j, 2)
+
+	// Simulate a crash in the middle of writing the next entry
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"type":"traffic_stats","seq":3,"inbo`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	reloaded := loadTrafficJournal(j.path)
+	if reloaded.nextSeq != 3 {
+		t.Errorf("nextSeq = %d, want 3", reloaded.nextSeq)
+	}
+	appendTraffic(t, reloaded, 1)
+	reloaded.Sync(0)
+	if got := seqsOf(t, reloaded.Unsent()); !equalSeqs(got, []int64{1, 2, 3}) {
+		t.Errorf("unsent seqs = %v, want [1 2 3]", got)
+	}
+}
@@ -0,0 +1,187 @@
+package slave
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// updateMu keeps two binary or geofile updates from downloading at the same time.
+// Swapping files and restarting Xray additionally holds Slave.xrayMu.
+var updateMu sync.Mutex
+
+// xrayVersionInfo is returned to the master after an update so it can record the node's versions.
+type xrayVersionInfo struct {
+	XrayVersion string `json:"xrayVersion"`
+	UiVersion   string `json:"uiVersion"`
+}
+
+func (s *Slave) versionInfo() *xrayVersionInfo {
+	info := &xrayVersionInfo{XrayVersion: "Unknown", UiVersion: config.GetVersion()}
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+	if s.process != nil {
+		info.XrayVersion = s.process.GetVersion()
+	}
+	return info
+}
+
+// installXray downloads an Xray-core release, verifies its checksum and swaps
+// it in place of the current binary with a rename. Xray is restarted with the
+// running config; if the new binary does not come up the old one is restored.
+func (s *Slave) installXray(version string) (*xrayVersionInfo, error) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	logger.Infof("Installing Xray %s...", version)
+
+	binPath := xray.GetInstalledBinaryPath()
+	tmpDir, err := os.MkdirTemp(filepath.Dir(binPath), "xray-update-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	url := xray.GetReleaseURL(version)
+	zipPath := filepath.Join(tmpDir, xray.GetReleaseAssetName())
+	sum, err := xray.DownloadFile(url, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(url, sum); err != nil {
+		return nil, err
+	}
+
+	// Extract next to the binary so the final rename stays on one filesystem
+	newPath := binPath + ".new"
+	if err := xray.ExtractBinary(zipPath, newPath); err != nil {
+		return nil, err
+	}
+	if err := exec.Command(newPath, "-version").Run(); err != nil {
+		os.Remove(newPath)
+		return nil, fmt.Errorf("downloaded Xray does not run: %v", err)
+	}
+
+	if err := s.swapXrayBinary(binPath, newPath); err != nil {
+		return nil, err
+	}
+
+	info := s.versionInfo()
+	logger.Infof("Xray updated to %s", info.XrayVersion)
+	return info, nil
+}
+
+// swapXrayBinary renames newPath over binPath and restarts Xray, restoring
+// the previous binary if the new one does not come up.
+func (s *Slave) swapXrayBinary(binPath, newPath string) error {
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+
+	backupPath := binPath + ".bak"
+	hasBackup := os.Rename(binPath, backupPath) == nil
+	if err := os.Rename(newPath, binPath); err != nil {
+		if hasBackup {
+			os.Rename(backupPath, binPath)
+		}
+		return err
+	}
+
+	if err := s.reloadXray(); err != nil {
+		if !hasBackup {
+			return err
+		}
+		logger.Warning("New Xray binary failed to start, restoring the previous one")
+		if rbErr := os.Rename(backupPath, binPath); rbErr != nil {
+			return fmt.Errorf("%v; restoring previous binary failed: %v", err, rbErr)
+		}
+		if rbErr := s.reloadXray(); rbErr != nil {
+			return fmt.Errorf("%v; previous binary failed too: %v", err, rbErr)
+		}
+		return fmt.Errorf("%v; restored previous Xray binary", err)
+	}
+	if hasBackup {
+		os.Remove(backupPath)
+	}
+	return nil
+}
+
+// updateGeofile downloads one geofile, or all of them when fileName is empty,
+// verifies each against its published checksum and replaces it with a rename
+// before restarting Xray.
+func (s *Slave) updateGeofile(fileName string) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	names := make([]string, 0, len(xray.GeofileURLs))
+	if fileName == "" {
+		for name := range xray.GeofileURLs {
+			names = append(names, name)
+		}
+	} else {
+		if _, ok := xray.GeofileURLs[fileName]; !ok {
+			return fmt.Errorf("invalid geofile name: %q not in allowlist", fileName)
+		}
+		names = append(names, fileName)
+	}
+
+	if err := os.MkdirAll(config.GetBinFolderPath(), 0o755); err != nil {
+		return err
+	}
+	// Download and verify everything first so a failure leaves all files untouched
+	for _, name := range names {
+		url := xray.GeofileURLs[name]
+		tmpPath := filepath.Join(config.GetBinFolderPath(), name) + ".new"
+		defer os.Remove(tmpPath)
+
+		sum, err := xray.DownloadFile(url, tmpPath)
+		if err == nil {
+			err = verifyChecksum(url, sum)
+		}
+		if err != nil {
+			return fmt.Errorf("geofile %s: %v", name, err)
+		}
+	}
+
+	s.xrayMu.Lock()
+	defer s.xrayMu.Unlock()
+	for _, name := range names {
+		destPath := filepath.Join(config.GetBinFolderPath(), name)
+		if err := os.Rename(destPath+".new", destPath); err != nil {
+			return fmt.Errorf("geofile %s: %v", name, err)
+		}
+		logger.Infof("Updated geofile %s", name)
+	}
+	return s.reloadXray()
+}
+
+// verifyChecksum compares sum with the checksum published for url.
+// A file without a published checksum is rejected.
+func verifyChecksum(url, sum string) error {
+	expected, err := xray.FetchReleaseChecksum(url)
+	if err != nil {
+		return fmt.Errorf("fetch checksum: %v", err)
+	}
+	if expected == "" {
+		return fmt.Errorf("no checksum published for %s", url)
+	}
+	if expected != sum {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", url, expected, sum)
+	}
+	return nil
+}
+
+// reloadXray restarts Xray with its current config so new binaries and
+// geofiles are picked up. It does nothing before the first config arrived.
+// The caller holds xrayMu.
+func (s *Slave) reloadXray() error {
+	if s.process == nil {
+		return nil
+	}
+	return s.startXray(s.process.GetConfig())
+}
@@ -148,6 +148,26 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubJsonRules = ""
 	}
 
+	SubClashEnable, err := s.settingService.GetSubClashEnable()
+	if err != nil {
+		return nil, err
+	}
+
+	SubSingboxEnable, err := s.settingService.GetSubSingboxEnable()
+	if err != nil {
+		return nil, err
+	}
+
+	SubRuleSets, err := s.settingService.GetSubRuleSets()
+	if err != nil {
+		SubRuleSets = ""
+	}
+
+	SubUserAgentFormats, err := s.settingService.GetSubUserAgentFormats()
+	if err != nil {
+		SubUserAgentFormats = ""
+	}
+
 	SubTitle, err := s.settingService.GetSubTitle()
 	if err != nil {
 		SubTitle = ""
@@ -168,6 +188,11 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubAnnounce = ""
 	}
 
+	SubRotateAnnounce, err := s.settingService.GetSubRotateAnnounce()
+	if err != nil {
+		SubRotateAnnounce = ""
+	}
+
 	SubEnableRouting, err := s.settingService.GetSubEnableRouting()
 	if err != nil {
 		return nil, err
@@ -257,7 +282,8 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	s.sub = NewSUBController(
 		g, LinksPath, JsonPath, subJsonEnable, Encrypt, ShowInfo, RemarkModel, SubUpdates,
 		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle, SubSupportUrl,
-		SubProfileUrl, SubAnnounce, SubEnableRouting, SubRoutingRules)
+		SubProfileUrl, SubAnnounce, SubEnableRouting, SubRoutingRules, SubClashEnable, SubSingboxEnable,
+		SubRuleSets, SubUserAgentFormats, SubRotateAnnounce)
 
 	return engine, nil
 }
@@ -0,0 +1,266 @@
+package sub
+
+import (
+	"fmt"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+)
+
+const (
+	clashProxyGroup = "Proxy"
+	clashAutoGroup  = "Auto"
+	clashTestUrl    = "https://www.gstatic.com/generate_204"
+	clashRuleSetUrl = "https://raw.githubusercontent.com/MetaCubeX/meta-rules-dat/meta/geo/%s/%s.mrs"
+)
+
+// SubClashService renders subscriptions as Clash Meta (mihomo) configs.
+type SubClashService struct {
+	ruleSets []subRuleSet
+
+	SubService *SubService
+}
+
+// NewSubClashService creates a Clash subscription service routing the given
+// rule sets, see parseRuleSets.
+func NewSubClashService(ruleSets string, subService *SubService) *SubClashService {
+	return &SubClashService{
+		ruleSets:   parseRuleSets(ruleSets),
+		SubService: subService,
+	}
+}
+
+type ClashConfig struct {
+	MixedPort     int                          `yaml:"mixed-port"`
+	AllowLan      bool                         `yaml:"allow-lan"`
+	Mode          string                       `yaml:"mode"`
+	LogLevel      string                       `yaml:"log-level"`
+	Proxies       []ClashProxy                 `yaml:"proxies"`
+	ProxyGroups   []ClashProxyGroup            `yaml:"proxy-groups"`
+	RuleProviders map[string]ClashRuleProvider `yaml:"rule-providers,omitempty"`
+	Rules         []string                     `yaml:"rules"`
+}
+
+type ClashProxy struct {
+	Name              string            `yaml:"name"`
+	Type              string            `yaml:"type"`
+	Server            string            `yaml:"server"`
+	Port              int               `yaml:"port"`
+	UUID              string            `yaml:"uuid,omitempty"`
+	AlterID           *int              `yaml:"alterId,omitempty"`
+	Cipher            string            `yaml:"cipher,omitempty"`
+	Password          string            `yaml:"password,omitempty"`
+	Flow              string            `yaml:"flow,omitempty"`
+	Encryption        string            `yaml:"encryption,omitempty"`
+	PacketEncoding    string            `yaml:"packet-encoding,omitempty"`
+	UDP               bool              `yaml:"udp"`
+	TLS               bool              `yaml:"tls,omitempty"`
+	ServerName        string            `yaml:"servername,omitempty"`
+	SNI               string            `yaml:"sni,omitempty"`
+	ALPN              []string          `yaml:"alpn,omitempty"`
+	ClientFingerprint string            `yaml:"client-fingerprint,omitempty"`
+	SkipCertVerify    bool              `yaml:"skip-cert-verify,omitempty"`
+	RealityOpts       *ClashRealityOpts `yaml:"reality-opts,omitempty"`
+	Network           string            `yaml:"network,omitempty"`
+	WSOpts            *ClashWSOpts      `yaml:"ws-opts,omitempty"`
+	HTTPOpts          *ClashHTTPOpts    `yaml:"http-opts,omitempty"`
+	GRPCOpts          *ClashGRPCOpts    `yaml:"grpc-opts,omitempty"`
+	XHTTPOpts         *ClashXHTTPOpts   `yaml:"xhttp-opts,omitempty"`
+}
+
+type ClashRealityOpts struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id,omitempty"`
+}
+
+type ClashWSOpts struct {
+	Path             string            `yaml:"path,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	V2rayHttpUpgrade bool              `yaml:"v2ray-http-upgrade,omitempty"`
+}
+
+type ClashHTTPOpts struct {
+	Path    []string            `yaml:"path,omitempty"`
+	Headers map[string][]string `yaml:"headers,omitempty"`
+}
+
+type ClashGRPCOpts struct {
+	ServiceName string `yaml:"grpc-service-name"`
+}
+
+type ClashXHTTPOpts struct {
+	Path string `yaml:"path,omitempty"`
+	Host string `yaml:"host,omitempty"`
+	Mode string `yaml:"mode,omitempty"`
+}
+
+type ClashProxyGroup struct {
+	Name     string   `yaml:"name"`
+	Type     string   `yaml:"type"`
+	Proxies  []string `yaml:"proxies"`
+	URL      string   `yaml:"url,omitempty"`
+	Interval int      `yaml:"interval,omitempty"`
+}
+
+type ClashRuleProvider struct {
+	Type     string `yaml:"type"`
+	Behavior string `yaml:"behavior"`
+	Format   string `yaml:"format"`
+	URL      string `yaml:"url"`
+	Interval int    `yaml:"interval"`
+}
+
+// GetClash renders the clients of a subscription as a Clash config and
+// returns it with the Subscription-Userinfo header. accountOnly only
+// accepts account subscriptions.
+func (s *SubClashService) GetClash(subId string, host string, accountOnly bool) (string, string, error) {
+	s.SubService.address = host
+	subClients, traffic, err := s.SubService.getSubClients(subId, accountOnly)
+	if err != nil {
+		return "", "", err
+	}
+	var nodes []proxyNode
+	for _, subClient := range subClients {
+		nodes = append(nodes, s.SubService.getProxyNodes(subClient.inbound, subClient.client)...)
+	}
+	config := s.buildConfig(nodes)
+	if len(config.Proxies) == 0 {
+		return "", "", common.NewError("No inbounds found with ", subId)
+	}
+
+	result, err := yaml.Marshal(config)
+	if err != nil {
+		return "", "", err
+	}
+	header := fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
+	return string(result), header, nil
+}
+
+func (s *SubClashService) buildConfig(nodes []proxyNode) *ClashConfig {
+	uniqueNames(nodes)
+	config := &ClashConfig{
+		MixedPort: 7890,
+		Mode:      "rule",
+		LogLevel:  "info",
+	}
+	var names []string
+	for _, node := range nodes {
+		proxy, ok := clashProxy(node)
+		if !ok {
+			continue
+		}
+		config.Proxies = append(config.Proxies, proxy)
+		names = append(names, proxy.Name)
+	}
+	config.ProxyGroups = []ClashProxyGroup{
+		{Name: clashProxyGroup, Type: "select", Proxies: append([]string{clashAutoGroup}, append(names, "DIRECT")...)},
+		{Name: clashAutoGroup, Type: "url-test", Proxies: names, URL: clashTestUrl, Interval: 300},
+	}
+
+	for _, ruleSet := range s.ruleSets {
+		if config.RuleProviders == nil {
+			config.RuleProviders = make(map[string]ClashRuleProvider)
+		}
+		behavior := "domain"
+		if ruleSet.Kind == "geoip" {
+			behavior = "ipcidr"
+		}
+		config.RuleProviders[ruleSet.Tag()] = ClashRuleProvider{
+			Type:     "http",
+			Behavior: behavior,
+			Format:   "mrs",
+			URL:      fmt.Sprintf(clashRuleSetUrl, ruleSet.Kind, ruleSet.Name),
+			Interval: 86400,
+		}
+		target := "DIRECT"
+		switch ruleSet.Action {
+		case "block":
+			target = "REJECT"
+		case "proxy":
+			target = clashProxyGroup
+		}
+		config.Rules = append(config.Rules, "RULE-SET,"+ruleSet.Tag()+","+target)
+	}
+	config.Rules = append(config.Rules, "MATCH,"+clashProxyGroup)
+	return config
+}
+
+// clashProxy converts a node to a Clash proxy. Clash has no XHTTP for VMess
+// and Trojan, these nodes are left out.
+func clashProxy(node proxyNode) (ClashProxy, bool) {
+	proxy := ClashProxy{
+		Name:   node.Name,
+		Server: node.Server,
+		Port:   node.Port,
+		UDP:    true,
+	}
+	switch node.Protocol {
+	case model.VMESS:
+		alterID := 0
+		proxy.Type = "vmess"
+		proxy.UUID = node.UUID
+		proxy.AlterID = &alterID
+		proxy.Cipher = node.Cipher
+	case model.VLESS:
+		proxy.Type = "vless"
+		proxy.UUID = node.UUID
+		proxy.Flow = node.Flow
+		proxy.PacketEncoding = "xudp"
+		if node.Encryption != "" && node.Encryption != "none" {
+			proxy.Encryption = node.Encryption
+		}
+	case model.Trojan:
+		proxy.Type = "trojan"
+		proxy.Password = node.Password
+	case model.Shadowsocks:
+		proxy.Type = "ss"
+		proxy.Cipher = node.Cipher
+		proxy.Password = node.Password
+		return proxy, true
+	default:
+		return proxy, false
+	}
+
+	switch node.Network {
+	case "http":
+		proxy.Network = "http"
+		proxy.HTTPOpts = &ClashHTTPOpts{Path: []string{node.Path}}
+		if node.Host != "" {
+			proxy.HTTPOpts.Headers = map[string][]string{"Host": {node.Host}}
+		}
+	case "ws", "httpupgrade":
+		proxy.Network = "ws"
+		proxy.WSOpts = &ClashWSOpts{Path: node.Path, V2rayHttpUpgrade: node.Network == "httpupgrade"}
+		if node.Host != "" {
+			proxy.WSOpts.Headers = map[string]string{"Host": node.Host}
+		}
+	case "grpc":
+		proxy.Network = "grpc"
+		proxy.GRPCOpts = &ClashGRPCOpts{ServiceName: node.ServiceName}
+	case "xhttp":
+		if node.Protocol != model.VLESS {
+			return proxy, false
+		}
+		proxy.Network = "xhttp"
+		proxy.XHTTPOpts = &ClashXHTTPOpts{Path: node.Path, Host: node.Host, Mode: node.Mode}
+	}
+
+	if node.Security == "none" {
+		return proxy, node.Protocol != model.Trojan
+	}
+	proxy.TLS = node.Protocol != model.Trojan
+	if node.Protocol == model.Trojan {
+		proxy.SNI = node.SNI
+	} else {
+		proxy.ServerName = node.SNI
+	}
+	proxy.ALPN = node.ALPN
+	proxy.ClientFingerprint = node.Fingerprint
+	proxy.SkipCertVerify = node.Insecure
+	if node.Security == "reality" {
+		proxy.RealityOpts = &ClashRealityOpts{PublicKey: node.PublicKey, ShortID: node.ShortID}
+	}
+	return proxy, true
+}
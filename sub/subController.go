@@ -3,16 +3,23 @@ package sub
 import (
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/xray"
 
 	"github.com/gin-gonic/gin"
 )
 
+// rotateAnnounceKey holds the announce of a rotated subscription ID in the
+// request context.
+const rotateAnnounceKey = "sub_rotate_announce"
+
 // SUBController handles HTTP requests for subscription links and JSON configurations.
 type SUBController struct {
 	subTitle         string
@@ -24,11 +31,19 @@ type SUBController struct {
 	subPath          string
 	subJsonPath      string
 	jsonEnabled      bool
+	clashEnabled     bool
+	singboxEnabled   bool
+	userAgentFormats []userAgentFormat
 	subEncrypt       bool
 	updateInterval   string
+	rotateAnnounce   string
 
-	subService     *SubService
-	subJsonService *SubJsonService
+	subService        *SubService
+	subFetchService   *service.SubFetchService
+	rotationService   *service.SubRotationService
+	subJsonService    *SubJsonService
+	subClashService   *SubClashService
+	subSingboxService *SubSingboxService
 }
 
 // NewSUBController creates a new subscription controller with the given configuration.
@@ -51,6 +66,11 @@ func NewSUBController(
 	subAnnounce string,
 	subEnableRouting bool,
 	subRoutingRules string,
+	clashEnabled bool,
+	singboxEnabled bool,
+	ruleSets string,
+	userAgentFormats string,
+	rotateAnnounce string,
 ) *SUBController {
 	sub := NewSubService(showInfo, rModel)
 	a := &SUBController{
@@ -63,11 +83,19 @@ func NewSUBController(
 		subPath:          subPath,
 		subJsonPath:      jsonPath,
 		jsonEnabled:      jsonEnabled,
+		clashEnabled:     clashEnabled,
+		singboxEnabled:   singboxEnabled,
+		userAgentFormats: parseUserAgentFormats(userAgentFormats),
 		subEncrypt:       encrypt,
 		updateInterval:   update,
+		rotateAnnounce:   rotateAnnounce,
 
-		subService:     sub,
-		subJsonService: NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subService:        sub,
+		subFetchService:   &service.SubFetchService{},
+		rotationService:   &service.SubRotationService{},
+		subJsonService:    NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subClashService:   NewSubClashService(ruleSets, sub),
+		subSingboxService: NewSubSingboxService(ruleSets, sub),
 	}
 	a.initRouter(g)
 	return a
@@ -76,27 +104,53 @@ func NewSUBController(
 // initRouter registers HTTP routes for subscription links and JSON endpoints
 // on the provided router group.
 func (a *SUBController) initRouter(g *gin.RouterGroup) {
-	gLink := g.Group(a.subPath)
+	gLink := g.Group(a.subPath, a.retiredSubId)
 	gLink.GET(":subid", a.subs)
 	
 	// Account-based subscription routes
-	gAccount := g.Group("/account")
+	gAccount := g.Group("/account", a.retiredSubId)
 	gAccount.GET(":subid", a.accountSubs)
 	
 	if a.jsonEnabled {
-		gJson := g.Group(a.subJsonPath)
+		gJson := g.Group(a.subJsonPath, a.retiredSubId)
 		gJson.GET(":subid", a.subJsons)
 		
 		// Account-based JSON subscription
-		gAccountJson := g.Group("/account/json")
+		gAccountJson := g.Group("/account/json", a.retiredSubId)
 		gAccountJson.GET(":subid", a.accountSubJsons)
 	}
+
+	if a.clashEnabled {
+		gLink.GET("clash/:subid", a.subClash)
+		gAccount.GET("clash/:subid", a.accountSubClash)
+	}
+
+	if a.singboxEnabled {
+		gLink.GET("singbox/:subid", a.subSingbox)
+		gAccount.GET("singbox/:subid", a.accountSubSingbox)
+	}
 }
 
 // subs handles HTTP requests for subscription links, returning either HTML page or base64-encoded subscription data.
 // This endpoint now supports both client subscription and account subscription by automatically detecting the subId type.
 func (a *SUBController) subs(c *gin.Context) {
 	subId := c.Param("subid")
+	format, ok := a.subFormat(c)
+	if !ok {
+		c.String(400, "Error!")
+		return
+	}
+	switch format {
+	case formatJson:
+		a.subJsons(c)
+		return
+	case formatClash:
+		a.serveClash(c, false)
+		return
+	case formatSingbox:
+		a.serveSingbox(c, false)
+		return
+	}
 	scheme, host, hostWithPort, hostHeader := a.subService.ResolveRequest(c)
 	
 	var subs []string
@@ -125,8 +179,7 @@ func (a *SUBController) subs(c *gin.Context) {
 		}
 
 		// If the request expects HTML (e.g., browser) or explicitly asked (?html=1 or ?view=html), render the info page here
-		accept := c.GetHeader("Accept")
-		if strings.Contains(strings.ToLower(accept), "text/html") || c.Query("html") == "1" || strings.EqualFold(c.Query("view"), "html") {
+		if wantsHtmlPage(c) {
 			// Build page data in service
 			subURL, subJsonURL := a.subService.BuildURLs(scheme, hostWithPort, a.subPath, a.subJsonPath, subId)
 			if !a.jsonEnabled {
@@ -177,6 +230,8 @@ func (a *SUBController) subs(c *gin.Context) {
 			profileUrl = fmt.Sprintf("%s://%s%s", scheme, hostWithPort, c.Request.RequestURI)
 		}
 		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle, a.subSupportUrl, profileUrl, a.subAnnounce, a.subEnableRouting, a.subRoutingRules)  
+		a.applyFormatHeaders(c, format)
+		a.recordFetch(c, format)
 
 		if a.subEncrypt {
 			c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
@@ -200,11 +255,154 @@ func (a *SUBController) subJsons(c *gin.Context) {
 			profileUrl = fmt.Sprintf("%s://%s%s", scheme, hostWithPort, c.Request.RequestURI)
 		}
 		a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle, a.subSupportUrl, profileUrl, a.subAnnounce, a.subEnableRouting, a.subRoutingRules)
+		a.recordFetch(c, formatJson)
 
 		c.String(200, jsonSub)
 	}
 }
 
+// subClash handles HTTP requests for Clash (mihomo) subscription configurations.
+func (a *SUBController) subClash(c *gin.Context) {
+	a.serveClash(c, false)
+}
+
+// accountSubClash handles HTTP requests for account-based Clash subscription configurations.
+// @route GET /sub/account/clash/:subid
+func (a *SUBController) accountSubClash(c *gin.Context) {
+	a.serveClash(c, true)
+}
+
+func (a *SUBController) serveClash(c *gin.Context, accountOnly bool) {
+	subId := c.Param("subid")
+	scheme, host, hostWithPort, _ := a.subService.ResolveRequest(c)
+	clashSub, header, err := a.subClashService.GetClash(subId, host, accountOnly)
+	if err != nil || len(clashSub) == 0 {
+		c.String(400, "Error!")
+		return
+	}
+	a.applyConfigHeaders(c, header, scheme, hostWithPort)
+	a.recordFetch(c, formatClash)
+	c.Data(200, "text/yaml; charset=utf-8", []byte(clashSub))
+}
+
+// subSingbox handles HTTP requests for sing-box subscription configurations.
+func (a *SUBController) subSingbox(c *gin.Context) {
+	a.serveSingbox(c, false)
+}
+
+// accountSubSingbox handles HTTP requests for account-based sing-box subscription configurations.
+// @route GET /sub/account/singbox/:subid
+func (a *SUBController) accountSubSingbox(c *gin.Context) {
+	a.serveSingbox(c, true)
+}
+
+func (a *SUBController) serveSingbox(c *gin.Context, accountOnly bool) {
+	subId := c.Param("subid")
+	scheme, host, hostWithPort, _ := a.subService.ResolveRequest(c)
+	singboxSub, header, err := a.subSingboxService.GetSingbox(subId, host, accountOnly)
+	if err != nil || len(singboxSub) == 0 {
+		c.String(400, "Error!")
+		return
+	}
+	a.applyConfigHeaders(c, header, scheme, hostWithPort)
+	a.recordFetch(c, formatSingbox)
+	c.Data(200, "application/json; charset=utf-8", []byte(singboxSub))
+}
+
+// retiredSubId serves a subscription ID rotated with a grace period as the
+// subscription that replaced it, with the rotation announce. The info page
+// would show the new link to whoever holds the old one, so it is refused.
+func (a *SUBController) retiredSubId(c *gin.Context) {
+	subId := c.Param("subid")
+	if subId == "" {
+		return
+	}
+	newSubId, expiresAt, ok := a.rotationService.ResolveSubId(subId)
+	if !ok {
+		return
+	}
+	announce := strings.ReplaceAll(a.rotateAnnounce, "{expiry}", time.UnixMilli(expiresAt).Format("2006-01-02 15:04"))
+	if wantsHtmlPage(c) {
+		c.String(http.StatusGone, announce)
+		c.Abort()
+		return
+	}
+	for i := range c.Params {
+		if c.Params[i].Key == "subid" {
+			c.Params[i].Value = newSubId
+		}
+	}
+	c.Set(rotateAnnounceKey, announce)
+	logger.Debugf("sub: %s is rotated, serving %s until %d", subId, newSubId, expiresAt)
+}
+
+// wantsHtmlPage reports whether a browser or ?html=1 or ?view=html asks for
+// the info page.
+func wantsHtmlPage(c *gin.Context) bool {
+	return strings.Contains(strings.ToLower(c.GetHeader("Accept")), "text/html") ||
+		c.Query("html") == "1" || strings.EqualFold(c.Query("view"), "html")
+}
+
+// subFormat picks the format of a subscription fetch from the format query
+// parameter, else from the User-Agent table. An empty format keeps the
+// default share links. ok is false for an unknown or disabled format
+// asked for explicitly.
+func (a *SUBController) subFormat(c *gin.Context) (format string, ok bool) {
+	if format = strings.ToLower(c.Query("format")); format != "" {
+		return format, a.formatEnabled(format)
+	}
+	format = matchUserAgent(a.userAgentFormats, c.GetHeader("User-Agent"))
+	if format != "" && !a.formatEnabled(format) {
+		logger.Debugf("sub: %s format matched for %q is disabled", format, c.GetHeader("User-Agent"))
+		return "", true
+	}
+	return format, true
+}
+
+func (a *SUBController) formatEnabled(format string) bool {
+	switch format {
+	case formatLinks, formatHapp:
+		return true
+	case formatJson:
+		return a.jsonEnabled
+	case formatClash:
+		return a.clashEnabled
+	case formatSingbox:
+		return a.singboxEnabled
+	}
+	return false
+}
+
+// applyFormatHeaders drops the Happ routing headers from share links picked
+// for other clients.
+func (a *SUBController) applyFormatHeaders(c *gin.Context, format string) {
+	if format == formatLinks {
+		c.Writer.Header().Del("Routing-Enable")
+		c.Writer.Header().Del("Routing")
+	}
+}
+
+// recordFetch logs a served subscription fetch with its format, in the
+// background to not hold up the response.
+func (a *SUBController) recordFetch(c *gin.Context, format string) {
+	if format == "" {
+		format = formatLinks
+	}
+	subId, ip, userAgent := c.Param("subid"), c.ClientIP(), c.GetHeader("User-Agent")
+	logger.Debugf("sub: %s fetched as %s by %s %q", subId, format, ip, userAgent)
+	go a.subFetchService.Record(subId, ip, userAgent, format)
+}
+
+// applyConfigHeaders sets the common headers of config subscriptions, with
+// the request URL as profile page unless one is configured.
+func (a *SUBController) applyConfigHeaders(c *gin.Context, header, scheme, hostWithPort string) {
+	profileUrl := a.subProfileUrl
+	if profileUrl == "" {
+		profileUrl = fmt.Sprintf("%s://%s%s", scheme, hostWithPort, c.Request.RequestURI)
+	}
+	a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle, a.subSupportUrl, profileUrl, a.subAnnounce, a.subEnableRouting, a.subRoutingRules)
+}
+
 // ApplyCommonHeaders sets common HTTP headers for subscription responses including user info, update interval, and profile title.
 func (a *SUBController) ApplyCommonHeaders(
 	c *gin.Context,
@@ -230,6 +428,10 @@ func (a *SUBController) ApplyCommonHeaders(
 	if profileUrl != "" {
 		c.Writer.Header().Set("Profile-Web-Page-Url", profileUrl)
 	}
+	// A rotated subscription announces its deprecation instead
+	if announce := c.GetString(rotateAnnounceKey); announce != "" {
+		profileAnnounce = announce
+	}
 	if profileAnnounce != "" {
 		c.Writer.Header().Set("Announce", "base64:"+base64.StdEncoding.EncodeToString([]byte(profileAnnounce)))
 	}
@@ -246,6 +448,22 @@ func (a *SUBController) ApplyCommonHeaders(
 // @route GET /sub/account/:subid
 func (a *SUBController) accountSubs(c *gin.Context) {
 	subId := c.Param("subid")
+	format, ok := a.subFormat(c)
+	if !ok {
+		c.String(400, "Error!")
+		return
+	}
+	switch format {
+	case formatJson:
+		a.accountSubJsons(c)
+		return
+	case formatClash:
+		a.serveClash(c, true)
+		return
+	case formatSingbox:
+		a.serveSingbox(c, true)
+		return
+	}
 	_, host, _, _ := a.subService.ResolveRequest(c)
 	
 	// Get account by subId
@@ -269,8 +487,7 @@ func (a *SUBController) accountSubs(c *gin.Context) {
 	}
 
 	// If the request expects HTML, render the info page
-	accept := c.GetHeader("Accept")
-	if strings.Contains(strings.ToLower(accept), "text/html") || c.Query("html") == "1" || strings.EqualFold(c.Query("view"), "html") {
+	if wantsHtmlPage(c) {
 		// Render HTML info page similar to regular subscription
 		a.renderSubInfoPage(c, account.Username, subs, lastOnline, traffic, result)
 		return
@@ -279,6 +496,8 @@ func (a *SUBController) accountSubs(c *gin.Context) {
 	// Add headers with account traffic information
 	header := fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
 	a.ApplyCommonHeaders(c, header, a.updateInterval, a.subTitle, a.subSupportUrl, a.subProfileUrl, a.subAnnounce, a.subEnableRouting, a.subRoutingRules)
+	a.applyFormatHeaders(c, format)
+	a.recordFetch(c, format)
 
 	if a.subEncrypt {
 		c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
@@ -0,0 +1,145 @@
+package sub
+
+import (
+	"cmp"
+	"hash/fnv"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/goccy/go-json"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// inboundEndpoints returns the addresses clients reach an inbound through,
+// one subscription entry each: the external proxies of the inbound, else
+// the endpoints of its slave when the inbound has no address of its own,
+// else the single inbound address. Weighted endpoints are ordered per seed,
+// the client's email, so each client keeps its order between fetches.
+func (s *SubService) inboundEndpoints(inbound *model.Inbound, stream map[string]any, seed string) []model.SubEndpoint {
+	endpoints := parseEndpoints(stream["externalProxy"])
+	if len(endpoints) == 0 && inbound.SlaveId > 0 && isWildcardListen(inbound.Listen) {
+		slave, err := s.slaveService.GetSlave(inbound.SlaveId)
+		// The inbound form fills in the slave address, which is no override
+		if err == nil && slave.Endpoints != "" && (inbound.Address == "" || inbound.Address == slave.Address) {
+			var slaveEndpoints []model.SubEndpoint
+			if err := json.Unmarshal([]byte(slave.Endpoints), &slaveEndpoints); err != nil {
+				logger.Warningf("Invalid subscription endpoints of slave %d: %v", slave.Id, err)
+			}
+			endpoints = parseEndpoints(slaveEndpoints)
+		}
+	}
+	if len(endpoints) == 0 {
+		return []model.SubEndpoint{{Dest: s.inboundAddress(inbound), Port: inbound.Port, ForceTls: "same"}}
+	}
+	for i := range endpoints {
+		if endpoints[i].Port <= 0 {
+			endpoints[i].Port = inbound.Port
+		}
+	}
+	return orderEndpoints(endpoints, seed)
+}
+
+// parseEndpoints reads a list of endpoints, skipping those without a
+// destination.
+func parseEndpoints(value any) []model.SubEndpoint {
+	if value == nil {
+		return nil
+	}
+	data, _ := json.Marshal(value)
+	var endpoints []model.SubEndpoint
+	json.Unmarshal(data, &endpoints)
+	return slices.DeleteFunc(endpoints, func(ep model.SubEndpoint) bool {
+		return ep.Dest == ""
+	})
+}
+
+func isWildcardListen(listen string) bool {
+	return listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0"
+}
+
+// orderEndpoints spreads clients over weighted endpoints: a client gets an
+// endpoint first with a chance proportional to its weight, the rest follow
+// the same way. The order only depends on seed. Endpoints without weight
+// keep their order after the weighted ones.
+func orderEndpoints(endpoints []model.SubEndpoint, seed string) []model.SubEndpoint {
+	if !slices.ContainsFunc(endpoints, func(ep model.SubEndpoint) bool { return ep.Weight > 0 }) {
+		return endpoints
+	}
+	// Weighted sampling without replacement: sort by u^(1/weight), with u
+	// drawn uniformly from a hash of the seed and the endpoint
+	keys := make(map[int]float64, len(endpoints))
+	order := make([]int, len(endpoints))
+	for i, ep := range endpoints {
+		order[i] = i
+		keys[i] = -1
+		if ep.Weight > 0 {
+			h := fnv.New64a()
+			h.Write([]byte(seed + "\x00" + ep.Dest + ":" + strconv.Itoa(ep.Port) + ep.Path))
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			keys[i] = math.Pow(u, 1/float64(ep.Weight))
+		}
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(keys[b], keys[a])
+	})
+	ordered := make([]model.SubEndpoint, len(order))
+	for i, index := range order {
+		ordered[i] = endpoints[index]
+	}
+	return ordered
+}
+
+// endpointParams returns the share link parameters of an inbound for an
+// endpoint, with its security, server name and path.
+func endpointParams(params map[string]string, ep model.SubEndpoint) map[string]string {
+	epParams := maps.Clone(params)
+	switch ep.ForceTls {
+	case "tls":
+		epParams["security"] = "tls"
+	case "none":
+		epParams["security"] = "none"
+		delete(epParams, "alpn")
+		delete(epParams, "sni")
+		delete(epParams, "fp")
+	}
+	// REALITY links need the server name the inbound accepts, so only TLS takes the override
+	if ep.Sni != "" && epParams["security"] == "tls" {
+		epParams["sni"] = ep.Sni
+	}
+	if ep.Path != "" {
+		if _, ok := epParams["path"]; ok {
+			epParams["path"] = ep.Path
+		} else if _, ok := epParams["serviceName"]; ok {
+			epParams["serviceName"] = ep.Path
+		}
+	}
+	return epParams
+}
+
+// endpointVmess returns the VMess link object of an inbound for an
+// endpoint.
+func endpointVmess(obj map[string]any, ep model.SubEndpoint) map[string]any {
+	epObj := make(map[string]any, len(obj))
+	for key, value := range obj {
+		if !(ep.ForceTls == "none" && (key == "alpn" || key == "sni" || key == "fp")) {
+			epObj[key] = value
+		}
+	}
+	epObj["add"] = ep.Dest
+	epObj["port"] = ep.Port
+	if ep.ForceTls == "tls" || ep.ForceTls == "none" {
+		epObj["tls"] = ep.ForceTls
+	}
+	if ep.Sni != "" && epObj["tls"] == "tls" {
+		epObj["sni"] = ep.Sni
+	}
+	// The path of mKCP holds its seed
+	if _, ok := epObj["path"]; ok && ep.Path != "" && epObj["net"] != "kcp" {
+		epObj["path"] = ep.Path
+	}
+	return epObj
+}
@@ -0,0 +1,78 @@
+package sub
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestOrderEndpoints(t *testing.T) {
+	endpoints := []model.SubEndpoint{
+		{Dest: "a.example.com", Port: 443, Weight: 3},
+		{Dest: "1.2.3.4", Port: 443},
+		{Dest: "b.example.com", Port: 443, Weight: 1},
+	}
+	firsts := make(map[string]int)
+	for i := range 2000 {
+		seed := "client" + strconv.Itoa(i)
+		ordered := orderEndpoints(endpoints, seed)
+		if len(ordered) != len(endpoints) {
+			t.Fatalf("orderEndpoints() returned %d endpoints, want %d", len(ordered), len(endpoints))
+		}
+		if ordered[2].Dest != "1.2.3.4" {
+			t.Fatalf("orderEndpoints() = %+v, want the unweighted endpoint last", ordered)
+		}
+		if again := orderEndpoints(endpoints, seed); again[0] != ordered[0] {
+			t.Fatalf("orderEndpoints() is not stable for seed %q", seed)
+		}
+		firsts[ordered[0].Dest]++
+	}
+	// A weight of 3 against 1 puts the endpoint first for about 3/4 of the clients
+	if share := float64(firsts["a.example.com"]) / 2000; share < 0.7 || share > 0.8 {
+		t.Errorf("endpoint with weight 3 is first for %.2f of the clients, want about 0.75", share)
+	}
+
+	unweighted := []model.SubEndpoint{{Dest: "x"}, {Dest: "y"}}
+	if ordered := orderEndpoints(unweighted, "client"); ordered[0].Dest != "x" || ordered[1].Dest != "y" {
+		t.Errorf("orderEndpoints() = %+v, want the order unchanged without weights", ordered)
+	}
+}
+
+func TestEndpointParams(t *testing.T) {
+	params := map[string]string{"type": "ws", "path": "/ws", "security": "tls", "sni": "origin.example.com", "alpn": "h2", "fp": "chrome"}
+	tests := []struct {
+		ep   model.SubEndpoint
+		want map[string]string
+	}{
+		{
+			model.SubEndpoint{ForceTls: "same", Sni: "cdn.example.com", Path: "/cdn"},
+			map[string]string{"type": "ws", "path": "/cdn", "security": "tls", "sni": "cdn.example.com", "alpn": "h2", "fp": "chrome"},
+		},
+		{
+			model.SubEndpoint{ForceTls: "none", Sni: "cdn.example.com"},
+			map[string]string{"type": "ws", "path": "/ws", "security": "none"},
+		},
+	}
+	for _, tt := range tests {
+		got := endpointParams(params, tt.ep)
+		if len(got) != len(tt.want) {
+			t.Errorf("endpointParams(%+v) = %v, want %v", tt.ep, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("endpointParams(%+v)[%q] = %q, want %q", tt.ep, k, got[k], v)
+			}
+		}
+	}
+	if params["sni"] != "origin.example.com" || params["path"] != "/ws" {
+		t.Errorf("endpointParams() changed the inbound params: %v", params)
+	}
+
+	grpc := map[string]string{"type": "grpc", "serviceName": "svc", "security": "reality", "sni": "a.com"}
+	got := endpointParams(grpc, model.SubEndpoint{Sni: "b.com", Path: "cdn-svc"})
+	if got["serviceName"] != "cdn-svc" || got["sni"] != "a.com" || got["path"] != "" {
+		t.Errorf("endpointParams() = %v, want serviceName cdn-svc and the inbound's sni a.com", got)
+	}
+}
@@ -0,0 +1,67 @@
+package sub
+
+import (
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// Subscription formats the subscription link can answer in.
+const (
+	formatLinks   = "links"   // share links
+	formatHapp    = "happ"    // share links with the Happ routing headers
+	formatJson    = "json"    // Xray JSON configs
+	formatClash   = "clash"   // Clash Meta (mihomo) YAML
+	formatSingbox = "singbox" // sing-box JSON
+)
+
+// userAgentFormat picks a format for clients whose User-Agent contains
+// Pattern.
+type userAgentFormat struct {
+	Pattern string
+	Format  string
+}
+
+func isSubFormat(format string) bool {
+	switch format {
+	case formatLinks, formatHapp, formatJson, formatClash, formatSingbox:
+		return true
+	}
+	return false
+}
+
+// parseUserAgentFormats reads a User-Agent table like "clash=clash,
+// sing-box=singbox", one pattern per comma or line. Patterns match
+// case-insensitively and the first match wins.
+func parseUserAgentFormats(value string) []userAgentFormat {
+	var formats []userAgentFormat
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, format, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		format = strings.ToLower(strings.TrimSpace(format))
+		if !ok || pattern == "" || !isSubFormat(format) {
+			logger.Warning("Ignoring invalid subscription User-Agent format:", entry)
+			continue
+		}
+		formats = append(formats, userAgentFormat{Pattern: pattern, Format: format})
+	}
+	return formats
+}
+
+// matchUserAgent returns the format of the first pattern in userAgent, or
+// an empty string when none matches.
+func matchUserAgent(formats []userAgentFormat, userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, f := range formats {
+		if strings.Contains(userAgent, f.Pattern) {
+			return f.Format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package sub
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+func TestMatchUserAgent(t *testing.T) {
+	logger.InitLogger(logging.ERROR)
+	formats := parseUserAgentFormats("Happ=happ\nclash=clash, sing-box=singbox\nsfa/=singbox\nv2rayng=links\nbad=xml\nnoformat")
+	if len(formats) != 5 {
+		t.Fatalf("parseUserAgentFormats() = %+v, want 5 entries", formats)
+	}
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Happ/1.8.3", formatHapp},
+		{"ClashMetaForAndroid/2.11.1.Meta", formatClash},
+		{"clash-verge/v2.0.3", formatClash},
+		{"SFA/1.11.0 (sing-box 1.11.0)", formatSingbox},
+		{"v2rayNG/1.9.16", formatLinks},
+		{"Mozilla/5.0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := matchUserAgent(formats, tt.userAgent); got != tt.want {
+			t.Errorf("matchUserAgent(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
@@ -72,6 +72,7 @@ func NewSubJsonService(fragment string, noises string, mux string, rules string,
 
 // GetJson generates a JSON subscription configuration for the given subscription ID and host.
 func (s *SubJsonService) GetJson(subId string, host string) (string, string, error) {
+	s.SubService.address = host
 	inbounds, err := s.SubService.getInboundsBySubId(subId)
 	if err != nil || len(inbounds) == 0 {
 		return "", "", err
@@ -103,7 +104,7 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		for _, client := range clients {
 			if client.Enable && client.SubID == subId {
 				clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
-				newConfigs := s.getConfig(inbound, client, host)
+				newConfigs := s.getConfig(inbound, client)
 				configArray = append(configArray, newConfigs...)
 			}
 		}
@@ -114,27 +115,7 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 	}
 
 	// Prepare statistics
-	for index, clientTraffic := range clientTraffics {
-		if index == 0 {
-			traffic.Up = clientTraffic.Up
-			traffic.Down = clientTraffic.Down
-			traffic.Total = clientTraffic.Total
-			if clientTraffic.ExpiryTime > 0 {
-				traffic.ExpiryTime = clientTraffic.ExpiryTime
-			}
-		} else {
-			traffic.Up += clientTraffic.Up
-			traffic.Down += clientTraffic.Down
-			if traffic.Total == 0 || clientTraffic.Total == 0 {
-				traffic.Total = 0
-			} else {
-				traffic.Total += clientTraffic.Total
-			}
-			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
-				traffic.ExpiryTime = 0
-			}
-		}
-	}
+	traffic = sumClientTraffics(clientTraffics)
 
 	// Combile outbounds
 	var finalJson []byte
@@ -148,52 +129,27 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 	return string(finalJson), header, nil
 }
 
-func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client, host string) []json_util.RawMessage {
+func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client) []json_util.RawMessage {
 	var newJsonArray []json_util.RawMessage
-	stream := s.streamData(inbound.StreamSettings)
-
-	externalProxies, ok := stream["externalProxy"].([]any)
-	if !ok || len(externalProxies) == 0 {
-		externalProxies = []any{
-			map[string]any{
-				"forceTls": "same",
-				"dest":     host,
-				"port":     float64(inbound.Port),
-				"remark":   "",
-			},
-		}
-	}
-
-	delete(stream, "externalProxy")
-
-	for _, ep := range externalProxies {
-		extPrxy := ep.(map[string]any)
-		inbound.Listen = extPrxy["dest"].(string)
-		inbound.Port = int(extPrxy["port"].(float64))
-		newStream := stream
-		switch extPrxy["forceTls"].(string) {
-		case "tls":
-			if newStream["security"] != "tls" {
-				newStream["security"] = "tls"
-				newStream["tlsSettings"] = map[string]any{}
-			}
-		case "none":
-			if newStream["security"] != "none" {
-				newStream["security"] = "none"
-				delete(newStream, "tlsSettings")
-			}
-		}
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+
+	for _, ep := range s.SubService.inboundEndpoints(inbound, stream, client.Email) {
+		epInbound := *inbound
+		epInbound.Listen = ep.Dest
+		epInbound.Port = ep.Port
+		newStream := s.endpointStream(inbound.StreamSettings, ep)
 		streamSettings, _ := json.MarshalIndent(newStream, "", "  ")
 
 		var newOutbounds []json_util.RawMessage
 
 		switch inbound.Protocol {
 		case "vmess":
-			newOutbounds = append(newOutbounds, s.genVnext(inbound, streamSettings, client))
+			newOutbounds = append(newOutbounds, s.genVnext(&epInbound, streamSettings, client))
 		case "vless":
-			newOutbounds = append(newOutbounds, s.genVless(inbound, streamSettings, client))
+			newOutbounds = append(newOutbounds, s.genVless(&epInbound, streamSettings, client))
 		case "trojan", "shadowsocks":
-			newOutbounds = append(newOutbounds, s.genServer(inbound, streamSettings, client))
+			newOutbounds = append(newOutbounds, s.genServer(&epInbound, streamSettings, client))
 		}
 
 		newOutbounds = append(newOutbounds, s.defaultOutbounds...)
@@ -201,7 +157,7 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 		maps.Copy(newConfigJson, s.configJson)
 
 		newConfigJson["outbounds"] = newOutbounds
-		newConfigJson["remarks"] = s.SubService.genRemark(inbound, client.Email, extPrxy["remark"].(string))
+		newConfigJson["remarks"] = s.SubService.genRemark(inbound, client.Email, ep.Remark)
 
 		newConfig, _ := json.MarshalIndent(newConfigJson, "", "  ")
 		newJsonArray = append(newJsonArray, newConfig)
@@ -210,6 +166,53 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 	return newJsonArray
 }
 
+// endpointStream returns the outbound stream settings of an inbound for an
+// endpoint, with its security, server name and path.
+func (s *SubJsonService) endpointStream(stream string, ep model.SubEndpoint) map[string]any {
+	newStream := s.streamData(stream)
+	delete(newStream, "externalProxy")
+	switch ep.ForceTls {
+	case "tls":
+		if newStream["security"] != "tls" {
+			newStream["security"] = "tls"
+			newStream["tlsSettings"] = map[string]any{}
+			delete(newStream, "realitySettings")
+		}
+	case "none":
+		if newStream["security"] != "none" {
+			newStream["security"] = "none"
+			delete(newStream, "tlsSettings")
+			delete(newStream, "realitySettings")
+		}
+	}
+	// REALITY keeps the server name the inbound accepts
+	if ep.Sni != "" && newStream["security"] == "tls" {
+		if tlsSettings, ok := newStream["tlsSettings"].(map[string]any); ok {
+			tlsSettings["serverName"] = ep.Sni
+		}
+	}
+	if ep.Path != "" {
+		network, _ := newStream["network"].(string)
+		switch network {
+		case "ws", "httpupgrade", "xhttp":
+			if transport, ok := newStream[network+"Settings"].(map[string]any); ok {
+				transport["path"] = ep.Path
+			}
+		case "grpc":
+			if grpc, ok := newStream["grpcSettings"].(map[string]any); ok {
+				grpc["serviceName"] = ep.Path
+			}
+		case "tcp":
+			tcp, _ := newStream["tcpSettings"].(map[string]any)
+			header, _ := tcp["header"].(map[string]any)
+			if request, ok := header["request"].(map[string]any); ok && header["type"] == "http" {
+				request["path"] = []any{ep.Path}
+			}
+		}
+	}
+	return newStream
+}
+
 func (s *SubJsonService) streamData(stream string) map[string]any {
 	var streamSettings map[string]any
 	json.Unmarshal([]byte(stream), &streamSettings)
@@ -0,0 +1,397 @@
+package sub
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// subClient is an enabled client of a subscription with its inbound.
+type subClient struct {
+	inbound *model.Inbound
+	client  model.Client
+}
+
+// proxyNode is one endpoint of a client: the server to connect to, the
+// client's credentials and the inbound's transport and security. The Clash
+// and sing-box formats are rendered from it.
+type proxyNode struct {
+	Name     string
+	Protocol model.Protocol
+	Server   string
+	Port     int
+
+	UUID       string
+	Flow       string
+	Cipher     string // VMess security or Shadowsocks method
+	Password   string
+	Encryption string // VLESS encryption
+
+	Network     string // tcp, http (TCP with HTTP header), ws, httpupgrade, grpc or xhttp
+	Path        string
+	Host        string
+	ServiceName string
+	Mode        string // XHTTP mode
+
+	Security    string // none, tls or reality
+	SNI         string
+	ALPN        []string
+	Fingerprint string
+	Insecure    bool
+	PublicKey   string
+	ShortID     string
+}
+
+// subRuleSet routes the domains or addresses of a geosite or geoip list.
+type subRuleSet struct {
+	Kind   string // geosite or geoip
+	Name   string
+	Action string // direct, block or proxy
+}
+
+// Tag names the rule set in the rendered configs.
+func (r subRuleSet) Tag() string {
+	return r.Kind + "-" + r.Name
+}
+
+// parseRuleSets reads rule sets like "geosite:cn, geoip:cn,
+// geosite:category-ads-all=block". The action defaults to direct.
+func parseRuleSets(value string) []subRuleSet {
+	var ruleSets []subRuleSet
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		action := "direct"
+		if i := strings.Index(entry, "="); i >= 0 {
+			action = strings.TrimSpace(entry[i+1:])
+			entry = strings.TrimSpace(entry[:i])
+		}
+		kind, name, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || (kind != "geosite" && kind != "geoip") || name == "" ||
+			(action != "direct" && action != "block" && action != "proxy") {
+			logger.Warning("Ignoring invalid subscription rule set:", entry)
+			continue
+		}
+		ruleSets = append(ruleSets, subRuleSet{Kind: kind, Name: name, Action: action})
+	}
+	return ruleSets
+}
+
+// getSubClients returns the enabled clients of a subscription and their
+// combined traffic. Like GetSubs, an account with the subId is looked up
+// first; accountOnly refuses client subscriptions.
+func (s *SubService) getSubClients(subId string, accountOnly bool) ([]subClient, xray.ClientTraffic, error) {
+	accountService := service.AccountService{}
+	account, err := accountService.GetAccountBySubId(subId)
+	if err == nil && account != nil {
+		return s.getAccountSubClients(account)
+	}
+	if accountOnly {
+		return nil, xray.ClientTraffic{}, common.NewError("Account not found")
+	}
+
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil {
+		return nil, xray.ClientTraffic{}, err
+	}
+	var subClients []subClient
+	var clientTraffics []xray.ClientTraffic
+	for _, inbound := range inbounds {
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			logger.Error("SubService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		s.resolveFallback(inbound)
+		for _, client := range clients {
+			if client.Enable && client.SubID == subId {
+				subClients = append(subClients, subClient{inbound, client})
+				clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+			}
+		}
+	}
+	return subClients, sumClientTraffics(clientTraffics), nil
+}
+
+// getAccountSubClients returns the enabled clients of an account with the
+// account's traffic.
+func (s *SubService) getAccountSubClients(account *model.Account) ([]subClient, xray.ClientTraffic, error) {
+	var traffic xray.ClientTraffic
+	if !account.Enable {
+		return nil, traffic, common.NewError("Account is disabled")
+	}
+	if account.ExpiryTime > 0 && time.Now().UnixMilli() > account.ExpiryTime {
+		return nil, traffic, common.NewError("Account has expired")
+	}
+	var associations []model.AccountClient
+	if err := database.GetDB().Where("account_id = ?", account.Id).Find(&associations).Error; err != nil {
+		return nil, traffic, err
+	}
+
+	var subClients []subClient
+	for _, assoc := range associations {
+		inbound, err := s.inboundService.GetInbound(assoc.InboundId)
+		if err != nil || !inbound.Enable {
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			logger.Error("SubService - GetClients: Unable to get clients from inbound")
+			continue
+		}
+		s.resolveFallback(inbound)
+		for _, client := range clients {
+			if client.Email == assoc.ClientEmail && client.Enable {
+				subClients = append(subClients, subClient{inbound, client})
+				break
+			}
+		}
+	}
+
+	traffic.Up = account.Up
+	traffic.Down = account.Down
+	traffic.Total = account.TotalGB * 1024 * 1024 * 1024 // GB to bytes
+	traffic.ExpiryTime = account.ExpiryTime
+	traffic.Enable = account.Enable
+	return subClients, traffic, nil
+}
+
+// resolveFallback points an inbound that is the fallback of another inbound
+// at the listen address, port and security of that inbound.
+func (s *SubService) resolveFallback(inbound *model.Inbound) {
+	if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+		listen, port, streamSettings, err := s.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+		if err == nil {
+			inbound.Listen = listen
+			inbound.Port = port
+			inbound.StreamSettings = streamSettings
+		}
+	}
+}
+
+// sumClientTraffics combines the traffic of the clients of a subscription.
+// The total and expiry are only kept when all clients have one.
+func sumClientTraffics(clientTraffics []xray.ClientTraffic) xray.ClientTraffic {
+	var traffic xray.ClientTraffic
+	for index, clientTraffic := range clientTraffics {
+		if index == 0 {
+			traffic.Up = clientTraffic.Up
+			traffic.Down = clientTraffic.Down
+			traffic.Total = clientTraffic.Total
+			if clientTraffic.ExpiryTime > 0 {
+				traffic.ExpiryTime = clientTraffic.ExpiryTime
+			}
+		} else {
+			traffic.Up += clientTraffic.Up
+			traffic.Down += clientTraffic.Down
+			if traffic.Total == 0 || clientTraffic.Total == 0 {
+				traffic.Total = 0
+			} else {
+				traffic.Total += clientTraffic.Total
+			}
+			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
+				traffic.ExpiryTime = 0
+			}
+		}
+	}
+	return traffic
+}
+
+// inboundAddress returns the address clients connect to for an inbound.
+func (s *SubService) inboundAddress(inbound *model.Inbound) string {
+	if isWildcardListen(inbound.Listen) {
+		return s.resolveInboundAddress(inbound)
+	}
+	return inbound.Listen
+}
+
+// getProxyNodes returns the nodes of a client, one per endpoint of the
+// inbound. Protocols and transports the Clash and sing-box formats
+// cannot express, like mKCP, give none.
+func (s *SubService) getProxyNodes(inbound *model.Inbound, client model.Client) []proxyNode {
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+	var settings map[string]any
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+
+	node := proxyNode{Protocol: inbound.Protocol, Port: inbound.Port}
+	switch inbound.Protocol {
+	case model.VMESS:
+		node.UUID = client.ID
+		node.Cipher = client.Security
+		if node.Cipher == "" {
+			node.Cipher = "auto"
+		}
+	case model.VLESS:
+		node.UUID = client.ID
+		node.Encryption, _ = settings["encryption"].(string)
+	case model.Trojan:
+		node.Password = client.Password
+	case model.Shadowsocks:
+		node.Cipher, _ = settings["method"].(string)
+		node.Password = client.Password
+		// Multi-user 2022 ciphers need the server key before the user key
+		if serverPassword, ok := settings["password"].(string); ok && strings.HasPrefix(node.Cipher, "2022") {
+			node.Password = serverPassword + ":" + client.Password
+		}
+	default:
+		return nil
+	}
+	if !node.setTransport(stream) {
+		return nil
+	}
+	node.setSecurity(stream)
+	if node.Protocol == model.VLESS && node.Network == "tcp" && node.Security != "none" {
+		node.Flow = client.Flow
+	}
+
+	endpoints := s.inboundEndpoints(inbound, stream, client.Email)
+	nodes := make([]proxyNode, 0, len(endpoints))
+	for _, ep := range endpoints {
+		epNode := node
+		epNode.Server = ep.Dest
+		epNode.Port = ep.Port
+		switch ep.ForceTls {
+		case "tls":
+			if epNode.Security != "tls" {
+				epNode.Security = "tls"
+				epNode.PublicKey = ""
+				epNode.ShortID = ""
+			}
+		case "none":
+			epNode.Security = "none"
+			epNode.SNI = ""
+			epNode.ALPN = nil
+			epNode.Fingerprint = ""
+			epNode.PublicKey = ""
+			epNode.ShortID = ""
+			epNode.Flow = ""
+		}
+		// REALITY keeps the server name the inbound accepts
+		if ep.Sni != "" && epNode.Security == "tls" {
+			epNode.SNI = ep.Sni
+		}
+		if ep.Path != "" {
+			if epNode.Network == "grpc" {
+				epNode.ServiceName = ep.Path
+			} else if epNode.Network != "tcp" {
+				epNode.Path = ep.Path
+			}
+		}
+		epNode.Name = s.genRemark(inbound, client.Email, ep.Remark)
+		nodes = append(nodes, epNode)
+	}
+	return nodes
+}
+
+// setTransport reads the transport of the stream settings. It returns false
+// for transports the formats do not support.
+func (n *proxyNode) setTransport(stream map[string]any) bool {
+	network, _ := stream["network"].(string)
+	switch network {
+	case "", "tcp":
+		n.Network = "tcp"
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if headerType, _ := header["type"].(string); headerType == "http" {
+			n.Network = "http"
+			request, _ := header["request"].(map[string]any)
+			if paths, _ := request["path"].([]any); len(paths) > 0 {
+				n.Path, _ = paths[0].(string)
+			}
+			n.Host = searchHost(request["headers"])
+		}
+	case "ws", "httpupgrade", "xhttp":
+		n.Network = network
+		transport, _ := stream[network+"Settings"].(map[string]any)
+		n.Path, _ = transport["path"].(string)
+		if host, ok := transport["host"].(string); ok && host != "" {
+			n.Host = host
+		} else {
+			n.Host = searchHost(transport["headers"])
+		}
+		if network == "xhttp" {
+			n.Mode, _ = transport["mode"].(string)
+		}
+	case "grpc":
+		n.Network = network
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		n.ServiceName, _ = grpc["serviceName"].(string)
+	default:
+		return false
+	}
+	// Shadowsocks has no transports besides plain TCP in the formats
+	return n.Protocol != model.Shadowsocks || n.Network == "tcp"
+}
+
+// setSecurity reads the TLS or REALITY settings of the stream settings.
+// Servers names and short IDs are picked at random like in share links.
+func (n *proxyNode) setSecurity(stream map[string]any) {
+	n.Security = "none"
+	switch stream["security"] {
+	case "tls":
+		n.Security = "tls"
+		tlsSettings, _ := stream["tlsSettings"].(map[string]any)
+		n.SNI, _ = tlsSettings["serverName"].(string)
+		alpns, _ := tlsSettings["alpn"].([]any)
+		for _, alpn := range alpns {
+			if value, ok := alpn.(string); ok {
+				n.ALPN = append(n.ALPN, value)
+			}
+		}
+		clientSettings, _ := tlsSettings["settings"].(map[string]any)
+		n.Fingerprint, _ = clientSettings["fingerprint"].(string)
+		n.Insecure, _ = clientSettings["allowInsecure"].(bool)
+	case "reality":
+		n.Security = "reality"
+		realitySettings, _ := stream["realitySettings"].(map[string]any)
+		if serverNames, _ := realitySettings["serverNames"].([]any); len(serverNames) > 0 {
+			n.SNI, _ = serverNames[random.Num(len(serverNames))].(string)
+		}
+		if shortIds, _ := realitySettings["shortIds"].([]any); len(shortIds) > 0 {
+			n.ShortID, _ = shortIds[random.Num(len(shortIds))].(string)
+		}
+		clientSettings, _ := realitySettings["settings"].(map[string]any)
+		n.PublicKey, _ = clientSettings["publicKey"].(string)
+		n.Fingerprint, _ = clientSettings["fingerprint"].(string)
+		// REALITY needs a browser fingerprint
+		if n.Fingerprint == "" {
+			n.Fingerprint = "chrome"
+		}
+	}
+}
+
+// uniqueNames makes the names of nodes unique, as the formats refer to
+// nodes by name.
+func uniqueNames(nodes []proxyNode) {
+	seen := make(map[string]int, len(nodes))
+	for i := range nodes {
+		name := nodes[i].Name
+		if name == "" {
+			name = string(nodes[i].Protocol)
+		}
+		seen[name]++
+		if seen[name] > 1 {
+			nodes[i].Name = name + " " + strconv.Itoa(seen[name])
+		} else {
+			nodes[i].Name = name
+		}
+	}
+}
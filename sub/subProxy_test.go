@@ -0,0 +1,189 @@
+package sub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/op/go-logging"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+func TestParseRuleSets(t *testing.T) {
+	logger.InitLogger(logging.ERROR)
+	got := parseRuleSets("geosite:CN, geoip:cn\ngeosite:category-ads-all = block,geoip:private=proxy, bogus, geosite:x=drop")
+	want := []subRuleSet{
+		{Kind: "geosite", Name: "cn", Action: "direct"},
+		{Kind: "geoip", Name: "cn", Action: "direct"},
+		{Kind: "geosite", Name: "category-ads-all", Action: "block"},
+		{Kind: "geoip", Name: "private", Action: "proxy"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRuleSets() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetProxyNodes(t *testing.T) {
+	s := NewSubService(false, "-ieo")
+	tests := []struct {
+		name    string
+		inbound *model.Inbound
+		client  model.Client
+		want    []proxyNode
+	}{
+		{
+			name: "vless reality",
+			inbound: &model.Inbound{
+				Remark: "r", Address: "example.com", Port: 443, Protocol: model.VLESS,
+				Settings: `{"encryption":"none"}`,
+				StreamSettings: `{"network":"tcp","security":"reality","realitySettings":{"serverNames":["sni.com"],
+					"shortIds":["ab"],"settings":{"publicKey":"pk","fingerprint":"firefox"}}}`,
+			},
+			client: model.Client{ID: "id", Email: "e", Flow: "xtls-rprx-vision"},
+			want: []proxyNode{{
+				Name: "r-e", Protocol: model.VLESS, Server: "example.com", Port: 443, UUID: "id",
+				Flow: "xtls-rprx-vision", Encryption: "none", Network: "tcp", Security: "reality",
+				SNI: "sni.com", Fingerprint: "firefox", PublicKey: "pk", ShortID: "ab",
+			}},
+		},
+		{
+			name: "vmess ws tls with external proxies",
+			inbound: &model.Inbound{
+				Remark: "w", Address: "example.com", Port: 443, Protocol: model.VMESS,
+				StreamSettings: `{"network":"ws","security":"tls","wsSettings":{"path":"/ws","host":"h.com"},
+					"tlsSettings":{"serverName":"t.com","alpn":["h2"]},
+					"externalProxy":[{"dest":"cdn.com","port":8443,"forceTls":"same","remark":"cdn"},
+					{"dest":"plain.com","port":80,"forceTls":"none"}]}`,
+			},
+			client: model.Client{ID: "id", Email: "e"},
+			want: []proxyNode{
+				{
+					Name: "w-e-cdn", Protocol: model.VMESS, Server: "cdn.com", Port: 8443, UUID: "id", Cipher: "auto",
+					Network: "ws", Path: "/ws", Host: "h.com", Security: "tls", SNI: "t.com", ALPN: []string{"h2"},
+				},
+				{
+					Name: "w-e", Protocol: model.VMESS, Server: "plain.com", Port: 80, UUID: "id", Cipher: "auto",
+					Network: "ws", Path: "/ws", Host: "h.com", Security: "none",
+				},
+			},
+		},
+		{
+			name: "shadowsocks 2022",
+			inbound: &model.Inbound{
+				Remark: "s", Address: "example.com", Port: 8388, Protocol: model.Shadowsocks,
+				Settings:       `{"method":"2022-blake3-aes-128-gcm","password":"server"}`,
+				StreamSettings: `{"network":"tcp","security":"none"}`,
+			},
+			client: model.Client{Email: "e", Password: "user"},
+			want: []proxyNode{{
+				Name: "s-e", Protocol: model.Shadowsocks, Server: "example.com", Port: 8388,
+				Cipher: "2022-blake3-aes-128-gcm", Password: "server:user", Network: "tcp", Security: "none",
+			}},
+		},
+		{
+			name: "kcp",
+			inbound: &model.Inbound{
+				Address: "example.com", Port: 443, Protocol: model.VLESS,
+				StreamSettings: `{"network":"kcp","security":"none"}`,
+			},
+			client: model.Client{ID: "id"},
+		},
+	}
+	for _, tt := range tests {
+		got := s.getProxyNodes(tt.inbound, tt.client)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getProxyNodes() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testNodes() []proxyNode {
+	return []proxyNode{
+		{
+			Name: "reality", Protocol: model.VLESS, Server: "a.com", Port: 443, UUID: "id", Flow: "xtls-rprx-vision",
+			Network: "tcp", Security: "reality", SNI: "sni.com", Fingerprint: "chrome", PublicKey: "pk", ShortID: "ab",
+		},
+		{
+			Name: "xhttp", Protocol: model.VLESS, Server: "a.com", Port: 443, UUID: "id",
+			Network: "xhttp", Path: "/x", Mode: "auto", Security: "tls", SNI: "a.com",
+		},
+		{
+			Name: "grpc", Protocol: model.Trojan, Server: "a.com", Port: 443, Password: "p",
+			Network: "grpc", ServiceName: "svc", Security: "tls", SNI: "a.com",
+		},
+		{
+			Name: "reality", Protocol: model.Shadowsocks, Server: "a.com", Port: 8388,
+			Cipher: "2022-blake3-aes-128-gcm", Password: "k1:k2", Network: "tcp", Security: "none",
+		},
+	}
+}
+
+func TestClashConfig(t *testing.T) {
+	s := NewSubClashService("geosite:category-ads-all=block, geoip:cn", nil)
+	config := s.buildConfig(testNodes())
+
+	var names []string
+	for _, proxy := range config.Proxies {
+		names = append(names, proxy.Name)
+	}
+	if want := []string{"reality", "xhttp", "grpc", "reality 2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("proxy names = %v, want %v", names, want)
+	}
+	reality := config.Proxies[0]
+	if !reality.TLS || reality.ServerName != "sni.com" || reality.RealityOpts == nil ||
+		reality.RealityOpts.PublicKey != "pk" || reality.Flow != "xtls-rprx-vision" {
+		t.Errorf("reality proxy = %+v", reality)
+	}
+	if xhttp := config.Proxies[1]; xhttp.Network != "xhttp" || xhttp.XHTTPOpts == nil || xhttp.XHTTPOpts.Path != "/x" {
+		t.Errorf("xhttp proxy = %+v", xhttp)
+	}
+	if grpc := config.Proxies[2]; grpc.SNI != "a.com" || grpc.GRPCOpts == nil || grpc.GRPCOpts.ServiceName != "svc" {
+		t.Errorf("grpc proxy = %+v", grpc)
+	}
+	if ss := config.Proxies[3]; ss.Type != "ss" || ss.Password != "k1:k2" {
+		t.Errorf("ss proxy = %+v", ss)
+	}
+	if want := []string{"RULE-SET,geosite-category-ads-all,REJECT", "RULE-SET,geoip-cn,DIRECT", "MATCH,Proxy"}; !reflect.DeepEqual(config.Rules, want) {
+		t.Errorf("rules = %v, want %v", config.Rules, want)
+	}
+	if provider := config.RuleProviders["geoip-cn"]; provider.Behavior != "ipcidr" || !strings.HasSuffix(provider.URL, "/geoip/cn.mrs") {
+		t.Errorf("geoip provider = %+v", provider)
+	}
+}
+
+func TestSingboxConfig(t *testing.T) {
+	s := NewSubSingboxService("geosite:cn", nil)
+	result, err := json.Marshal(s.buildConfig(testNodes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Outbounds []map[string]any `json:"outbounds"`
+		Route     struct {
+			RuleSet []map[string]any `json:"rule_set"`
+		} `json:"route"`
+	}
+	if err := json.Unmarshal(result, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []string
+	for _, outbound := range config.Outbounds {
+		tags = append(tags, outbound["tag"].(string))
+	}
+	// sing-box has no XHTTP
+	if want := []string{"proxy", "auto", "reality", "grpc", "reality 2", "direct"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("outbound tags = %v, want %v", tags, want)
+	}
+	tls, _ := config.Outbounds[2]["tls"].(map[string]any)
+	reality, _ := tls["reality"].(map[string]any)
+	if tls["server_name"] != "sni.com" || reality["public_key"] != "pk" || reality["short_id"] != "ab" {
+		t.Errorf("reality outbound = %v", config.Outbounds[2])
+	}
+	if len(config.Route.RuleSet) != 1 || config.Route.RuleSet[0]["tag"] != "geosite-cn" {
+		t.Errorf("rule sets = %v", config.Route.RuleSet)
+	}
+}
@@ -0,0 +1,223 @@
+package sub
+
+import (
+	"fmt"
+
+	"github.com/goccy/go-json"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+)
+
+const (
+	singboxProxyTag   = "proxy"
+	singboxAutoTag    = "auto"
+	singboxDirectTag  = "direct"
+	singboxTestUrl    = "https://www.gstatic.com/generate_204"
+	singboxGeositeUrl = "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/geosite-%s.srs"
+	singboxGeoipUrl   = "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-%s.srs"
+)
+
+// SubSingboxService renders subscriptions as sing-box configs.
+type SubSingboxService struct {
+	ruleSets []subRuleSet
+
+	SubService *SubService
+}
+
+// NewSubSingboxService creates a sing-box subscription service routing the
+// given rule sets, see parseRuleSets.
+func NewSubSingboxService(ruleSets string, subService *SubService) *SubSingboxService {
+	return &SubSingboxService{
+		ruleSets:   parseRuleSets(ruleSets),
+		SubService: subService,
+	}
+}
+
+// GetSingbox renders the clients of a subscription as a sing-box config and
+// returns it with the Subscription-Userinfo header. accountOnly only
+// accepts account subscriptions.
+func (s *SubSingboxService) GetSingbox(subId string, host string, accountOnly bool) (string, string, error) {
+	s.SubService.address = host
+	subClients, traffic, err := s.SubService.getSubClients(subId, accountOnly)
+	if err != nil {
+		return "", "", err
+	}
+	var nodes []proxyNode
+	for _, subClient := range subClients {
+		nodes = append(nodes, s.SubService.getProxyNodes(subClient.inbound, subClient.client)...)
+	}
+	config := s.buildConfig(nodes)
+	if config == nil {
+		return "", "", common.NewError("No inbounds found with ", subId)
+	}
+
+	result, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	header := fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
+	return string(result), header, nil
+}
+
+// buildConfig returns nil when no node can be expressed in sing-box.
+func (s *SubSingboxService) buildConfig(nodes []proxyNode) map[string]any {
+	uniqueNames(nodes)
+	var tags []string
+	var outbounds []any
+	for _, node := range nodes {
+		outbound, ok := singboxOutbound(node)
+		if !ok {
+			continue
+		}
+		outbounds = append(outbounds, outbound)
+		tags = append(tags, node.Name)
+	}
+	if len(outbounds) == 0 {
+		return nil
+	}
+	outbounds = append([]any{
+		map[string]any{
+			"type":      "selector",
+			"tag":       singboxProxyTag,
+			"outbounds": append([]string{singboxAutoTag}, append(tags, singboxDirectTag)...),
+		},
+		map[string]any{
+			"type":      "urltest",
+			"tag":       singboxAutoTag,
+			"outbounds": tags,
+			"url":       singboxTestUrl,
+			"interval":  "5m",
+		},
+	}, outbounds...)
+	outbounds = append(outbounds, map[string]any{"type": "direct", "tag": singboxDirectTag})
+
+	rules := []any{
+		map[string]any{"action": "sniff"},
+		map[string]any{"protocol": "dns", "action": "hijack-dns"},
+		map[string]any{"ip_is_private": true, "outbound": singboxDirectTag},
+	}
+	var ruleSets []any
+	for _, ruleSet := range s.ruleSets {
+		url := fmt.Sprintf(singboxGeositeUrl, ruleSet.Name)
+		if ruleSet.Kind == "geoip" {
+			url = fmt.Sprintf(singboxGeoipUrl, ruleSet.Name)
+		}
+		ruleSets = append(ruleSets, map[string]any{
+			"type":   "remote",
+			"tag":    ruleSet.Tag(),
+			"format": "binary",
+			"url":    url,
+		})
+		rule := map[string]any{"rule_set": ruleSet.Tag()}
+		switch ruleSet.Action {
+		case "block":
+			rule["action"] = "reject"
+		case "proxy":
+			rule["outbound"] = singboxProxyTag
+		default:
+			rule["outbound"] = singboxDirectTag
+		}
+		rules = append(rules, rule)
+	}
+	route := map[string]any{
+		"rules":                 rules,
+		"final":                 singboxProxyTag,
+		"auto_detect_interface": true,
+	}
+	if len(ruleSets) > 0 {
+		route["rule_set"] = ruleSets
+	}
+
+	return map[string]any{
+		"log": map[string]any{"level": "info"},
+		"inbounds": []any{
+			map[string]any{
+				"type":         "tun",
+				"tag":          "tun-in",
+				"address":      []string{"172.19.0.1/30"},
+				"auto_route":   true,
+				"strict_route": true,
+			},
+			map[string]any{
+				"type":        "mixed",
+				"tag":         "mixed-in",
+				"listen":      "127.0.0.1",
+				"listen_port": 2080,
+			},
+		},
+		"outbounds": outbounds,
+		"route":     route,
+	}
+}
+
+// singboxOutbound converts a node to a sing-box outbound. sing-box has no
+// XHTTP or TCP HTTP header transport, these nodes are left out.
+func singboxOutbound(node proxyNode) (map[string]any, bool) {
+	outbound := map[string]any{
+		"tag":         node.Name,
+		"server":      node.Server,
+		"server_port": node.Port,
+	}
+	switch node.Protocol {
+	case model.VMESS:
+		outbound["type"] = "vmess"
+		outbound["uuid"] = node.UUID
+		outbound["security"] = node.Cipher
+	case model.VLESS:
+		outbound["type"] = "vless"
+		outbound["uuid"] = node.UUID
+		outbound["packet_encoding"] = "xudp"
+		if node.Flow != "" {
+			outbound["flow"] = node.Flow
+		}
+	case model.Trojan:
+		outbound["type"] = "trojan"
+		outbound["password"] = node.Password
+	case model.Shadowsocks:
+		outbound["type"] = "shadowsocks"
+		outbound["method"] = node.Cipher
+		outbound["password"] = node.Password
+		return outbound, true
+	default:
+		return nil, false
+	}
+
+	switch node.Network {
+	case "tcp":
+	case "ws":
+		transport := map[string]any{"type": "ws", "path": node.Path}
+		if node.Host != "" {
+			transport["headers"] = map[string]any{"Host": node.Host}
+		}
+		outbound["transport"] = transport
+	case "httpupgrade":
+		outbound["transport"] = map[string]any{"type": "httpupgrade", "host": node.Host, "path": node.Path}
+	case "grpc":
+		outbound["transport"] = map[string]any{"type": "grpc", "service_name": node.ServiceName}
+	default:
+		return nil, false
+	}
+
+	if node.Security == "none" {
+		return outbound, true
+	}
+	tls := map[string]any{"enabled": true}
+	if node.SNI != "" {
+		tls["server_name"] = node.SNI
+	}
+	if node.Insecure {
+		tls["insecure"] = true
+	}
+	if len(node.ALPN) > 0 {
+		tls["alpn"] = node.ALPN
+	}
+	if node.Fingerprint != "" {
+		tls["utls"] = map[string]any{"enabled": true, "fingerprint": node.Fingerprint}
+	}
+	if node.Security == "reality" {
+		tls["reality"] = map[string]any{"enabled": true, "public_key": node.PublicKey, "short_id": node.ShortID}
+	}
+	outbound["tls"] = tls
+	return outbound, true
+}
@@ -0,0 +1,98 @@
+// Package slaveauth defines how slaves authenticate against the master.
+// Slaves enroll once with a one-time join token and afterwards sign every
+// connection request with their per-slave credential, so no secret ever
+// appears in URLs or access logs.
+package slaveauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used by slaves to authenticate against the master.
+const (
+	JoinTokenHeader = "X-Slave-Join-Token"
+	IdHeader        = "X-Slave-Id"
+	HostHeader      = "X-Slave-Host"
+	TimestampHeader = "X-Slave-Timestamp"
+	NonceHeader     = "X-Slave-Nonce"
+	SignatureHeader = "X-Slave-Signature"
+)
+
+// MaxSkew is how far a request timestamp may be from the master's clock.
+// The master remembers nonces for as long, so a signed request is accepted
+// only once.
+const MaxSkew = 5 * time.Minute
+
+// endpointPrefix starts the path of every slave endpoint on the master.
+const endpointPrefix = "/panel/api/slave/"
+
+// Request holds the signed parts of a request to the master.
+type Request struct {
+	SlaveId   int
+	HostId    string
+	Timestamp int64
+	Nonce     string
+	Method    string
+	Path      string // See EndpointPath
+}
+
+// EndpointPath returns the part of a request path the signature covers,
+// from the slave API prefix on. Base paths and reverse proxies in front of
+// the master may change what comes before it.
+func EndpointPath(path string) string {
+	if i := strings.Index(path, endpointPrefix); i >= 0 {
+		return path[i:]
+	}
+	return path
+}
+
+// Sign computes the HMAC-SHA256 signature of a request.
+func Sign(secret string, r Request) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%d\n%s\n%s\n%s", r.SlaveId, r.HostId, r.Timestamp, r.Nonce, r.Method, EndpointPath(r.Path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is valid for the request.
+func Verify(secret string, r Request, signature string) bool {
+	if secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, r)), []byte(signature))
+}
+
+// SignedHeaders returns the headers a slave sends with a request to the
+// master at rawUrl.
+func SignedHeaders(secret string, slaveId int, hostId string, method string, rawUrl string) http.Header {
+	u, err := url.Parse(rawUrl)
+	path := rawUrl
+	if err == nil {
+		path = u.Path
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	r := Request{
+		SlaveId:   slaveId,
+		HostId:    hostId,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		Method:    method,
+		Path:      path,
+	}
+	header := http.Header{}
+	header.Set(IdHeader, strconv.Itoa(slaveId))
+	header.Set(HostHeader, hostId)
+	header.Set(TimestampHeader, strconv.FormatInt(r.Timestamp, 10))
+	header.Set(NonceHeader, r.Nonce)
+	header.Set(SignatureHeader, Sign(secret, r))
+	return header
+}
@@ -0,0 +1,107 @@
+package slaveauth
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	const secret = "secret"
+	request := Request{
+		SlaveId:   1,
+		HostId:    "host-a",
+		Timestamp: time.Now().Unix(),
+		Nonce:     "0123456789abcdef",
+		Method:    http.MethodGet,
+		Path:      "/panel/api/slave/connect",
+	}
+	signature := Sign(secret, request)
+	changed := func(change func(r *Request)) Request {
+		r := request
+		change(&r)
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		request   Request
+		signature string
+		want      bool
+	}{
+		{"valid", secret, request, signature, true},
+		{"wrong secret", "other", request, signature, false},
+		{"empty secret", "", request, Sign("", request), false},
+		{"other slave", secret, changed(func(r *Request) { r.SlaveId = 2 }), signature, false},
+		{"other host", secret, changed(func(r *Request) { r.HostId = "host-b" }), signature, false},
+		{"replayed with new timestamp", secret, changed(func(r *Request) { r.Timestamp++ }), signature, false},
+		{"replayed with new nonce", secret, changed(func(r *Request) { r.Nonce = "fedcba9876543210" }), signature, false},
+		{"other method", secret, changed(func(r *Request) { r.Method = http.MethodPost }), signature, false},
+		{"other endpoint", secret, changed(func(r *Request) { r.Path = "/panel/api/slave/agent" }), signature, false},
+		{"behind a base path", secret, changed(func(r *Request) { r.Path = "/base/panel/api/slave/connect" }), signature, true},
+		{"empty signature", secret, request, "", false},
+		{"truncated signature", secret, request, signature[:len(signature)-2], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.secret, tt.request, tt.signature); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignIsUnambiguous(t *testing.T) {
+	// Fields are separated, so shifting characters between fields changes the signature
+	a := Request{SlaveId: 12, HostId: "3:host", Timestamp: 1}
+	b := Request{SlaveId: 1, HostId: "23:host", Timestamp: 1}
+	if Sign("s", a) == Sign("s", b) {
+		t.Error("different id/host pairs produced the same signature")
+	}
+	a = Request{SlaveId: 1, HostId: "host", Timestamp: 1, Nonce: "n", Method: "GET", Path: "/x"}
+	b = Request{SlaveId: 1, HostId: "host", Timestamp: 1, Nonce: "nG", Method: "ET", Path: "/x"}
+	if Sign("s", a) == Sign("s", b) {
+		t.Error("different nonce/method pairs produced the same signature")
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	const url = "wss://master.example.com:2053/base/panel/api/slave/connect"
+	header := SignedHeaders("secret", 7, "host-a", http.MethodGet, url)
+
+	slaveId, err := strconv.Atoi(header.Get(IdHeader))
+	if err != nil || slaveId != 7 {
+		t.Fatalf("%s = %q, want 7", IdHeader, header.Get(IdHeader))
+	}
+	if header.Get(HostHeader) != "host-a" {
+		t.Fatalf("%s = %q, want host-a", HostHeader, header.Get(HostHeader))
+	}
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", TimestampHeader, err)
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > MaxSkew || skew < -MaxSkew {
+		t.Errorf("timestamp is %v off", skew)
+	}
+	nonce := header.Get(NonceHeader)
+	if len(nonce) != 32 {
+		t.Fatalf("%s = %q, want 32 hex characters", NonceHeader, nonce)
+	}
+	request := Request{
+		SlaveId:   slaveId,
+		HostId:    "host-a",
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Method:    http.MethodGet,
+		Path:      "/base/panel/api/slave/connect",
+	}
+	if !Verify("secret", request, header.Get(SignatureHeader)) {
+		t.Error("signed headers do not verify")
+	}
+	if again := SignedHeaders("secret", 7, "host-a", http.MethodGet, url); again.Get(NonceHeader) == nonce {
+		t.Error("two requests got the same nonce")
+	}
+}
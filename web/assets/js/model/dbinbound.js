@@ -14,6 +14,7 @@ class DBInbound {
         this.trafficReset = "never";
         this.lastTrafficResetTime = 0;
         this.address = ""; // Custom domain/IP for subscription links
+        this.autoEnroll = false; // Give every enabled account a client on add
 
         this.listen = "";
         this.port = 0;
@@ -1752,13 +1752,45 @@ class Inbound extends XrayCommonClass {
                 let r = orderChars.split('').map(char => orders[char]).filter(x => x.length > 0).join(separationChar);
                 result.push({
                     remark: r,
-                    link: this.genLink(ep.dest, ep.port, ep.forceTls, r, client)
+                    link: this.applyEndpoint(this.genLink(ep.dest, ep.port, ep.forceTls, r, client), ep)
                 });
             });
         }
         return result;
     }
 
+    // Applies the SNI and path of an external proxy to a share link.
+    applyEndpoint(link, ep) {
+        if (ObjectUtil.isEmpty(ep.sni) && ObjectUtil.isEmpty(ep.path)) {
+            return link;
+        }
+        if (link.startsWith('vmess://')) {
+            const obj = JSON.parse(Base64.decode(link.slice('vmess://'.length)));
+            if (!ObjectUtil.isEmpty(ep.sni) && obj.tls === 'tls') {
+                obj.sni = ep.sni;
+            }
+            // The path of mKCP holds its seed
+            if (!ObjectUtil.isEmpty(ep.path) && obj.path !== undefined && obj.net !== 'kcp') {
+                obj.path = ep.path;
+            }
+            return 'vmess://' + Base64.encode(JSON.stringify(obj, null, 2));
+        }
+        const url = new URL(link);
+        const security = url.searchParams.get('security');
+        // REALITY keeps the server name the inbound accepts
+        if (!ObjectUtil.isEmpty(ep.sni) && security === 'tls') {
+            url.searchParams.set('sni', ep.sni);
+        }
+        if (!ObjectUtil.isEmpty(ep.path)) {
+            if (url.searchParams.has('path')) {
+                url.searchParams.set('path', ep.path);
+            } else if (url.searchParams.has('serviceName')) {
+                url.searchParams.set('serviceName', ep.path);
+            }
+        }
+        return url.toString();
+    }
+
     genInboundLinks(remark = '', remarkModel = '-ieo') {
         let addr = !ObjectUtil.isEmpty(this.address) ? this.address :
             (!ObjectUtil.isEmpty(this.listen) && this.listen !== "0.0.0.0" ? this.listen : location.hostname);
@@ -52,6 +52,16 @@ class AllSetting {
         this.subJsonNoises = "";
         this.subJsonMux = "";
         this.subJsonRules = "";
+        this.subClashEnable = false;
+        this.subSingboxEnable = false;
+        this.subRuleSets = "";
+        this.subUserAgentFormats = "";
+        this.subFetchLogDays = 30;
+        this.subLeakIpLimit = 10;
+        this.subLeakCountryLimit = 3;
+        this.subLeakWindow = 60;
+        this.subRotateGrace = 24;
+        this.subRotateAnnounce = "This subscription link has been replaced and stops working on {expiry}. Please import your new subscription link.";
 
         this.timeLocation = "Local";
 
@@ -77,6 +87,15 @@ class AllSetting {
         this.ldapDefaultExpiryDays = 0;
         this.ldapDefaultLimitIP = 0;
 
+        // Slave agent upgrades
+        this.slaveAgentUrl = "";
+        this.slaveAgentSha256 = "";
+        this.slaveAutoUpgrade = false;
+
+        // Traffic history retention in days
+        this.trafficHistoryHourDays = 7;
+        this.trafficHistoryDayDays = 365;
+
         if (data == null) {
             return
         }
@@ -9,14 +9,17 @@ import (
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
 )
 
 // AccountController handles HTTP requests for account management operations.
 type AccountController struct {
 	BaseController
 
-	accountService service.AccountService
-	slaveService   service.SlaveService
+	accountService     service.AccountService
+	planService        service.PlanService
+	slaveService       service.SlaveService
+	subRotationService service.SubRotationService
 }
 
 // NewAccountController creates a new account controller instance.
@@ -33,6 +36,7 @@ func (a *AccountController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateAccount)
 	g.POST("/del/:id", a.delAccount)
 	g.GET("/get/:id", a.getAccount)
+	g.POST("/:id/plan", a.setAccountPlan)
 
 	// Client management
 	g.GET("/:id/clients", a.getAccountClients)
@@ -42,6 +46,16 @@ func (a *AccountController) initRouter(g *gin.RouterGroup) {
 	// Traffic management
 	g.GET("/:id/traffic", a.getAccountTraffic)
 	g.POST("/reset/traffic/:id", a.resetAccountTraffic)
+
+	// Renewal and history
+	g.POST("/:id/renew", a.renewAccount)
+	g.POST("/:id/extend", a.extendAccount)
+	g.POST("/:id/topup", a.topupAccount)
+	g.GET("/:id/events", a.getAccountEvents)
+
+	// Credentials
+	g.POST("/:id/rotate", a.rotateCredentials)
+	g.POST("/:id/rotateSubId", a.rotateSubId)
 }
 
 // getAccounts retrieves all accounts.
@@ -58,6 +72,15 @@ func (a *AccountController) getAccounts(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.getAccounts"), err)
 		return
 	}
+	if user := session.GetLoginUser(c); service.IsScopedUser(user) {
+		visible := accounts[:0]
+		for _, account := range accounts {
+			if service.CanAccessAccount(user, account) {
+				visible = append(visible, account)
+			}
+		}
+		accounts = visible
+	}
 	jsonObj(c, accounts, nil)
 }
 
@@ -101,16 +124,73 @@ func (a *AccountController) addAccount(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.addAccount"), err)
 		return
 	}
+	user := session.GetLoginUser(c)
+	// Plans and periodic traffic resets need the plans permission
+	if (account.PlanId > 0 || account.Reset > 0) && !service.UserCan(user, service.PermPlans) {
+		forbidden(c)
+		return
+	}
+	account.UserId = user.Id
 
-	err = a.accountService.AddAccount(account)
+	// Accounts created from a plan get its defaults and clients
+	var affectedSlaves []int
+	if account.PlanId > 0 {
+		affectedSlaves, err = a.planService.AddPlanAccount(account)
+	} else {
+		err = a.accountService.AddAccount(account)
+	}
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.addAccount"), err)
 		return
 	}
 
+	a.pushConfigs(affectedSlaves, account.Id)
+	audit(c, "account.add", auditTarget("account", account.Id), nil, account)
 	jsonMsgObj(c, I18nWeb(c, "pages.accounts.toasts.addAccount"), account, nil)
 }
 
+// setAccountPlan moves an account to another plan.
+// @Summary Set account plan
+// @Description Moves an account to a plan, applying the plan's defaults and provisioning its inbounds; planId 0 detaches the account from its plan
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param planId formData int true "Plan ID, 0 to detach"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/plan [post]
+func (a *AccountController) setAccountPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.setPlan"), err)
+		return
+	}
+	planId, err := strconv.Atoi(c.PostForm("planId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.setPlan"), err)
+		return
+	}
+
+	affectedSlaves, err := a.planService.SetAccountPlan(id, planId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.setPlan"), err)
+		return
+	}
+
+	a.pushConfigs(affectedSlaves, id)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.setPlan"), nil)
+}
+
+// pushConfigs pushes the config of slaves whose clients of an account changed.
+func (a *AccountController) pushConfigs(slaveIds []int, accountId int) {
+	for _, slaveId := range slaveIds {
+		if pushErr := a.slaveService.PushConfig(slaveId); pushErr != nil {
+			logger.Errorf("Failed to push config to slave %d after provisioning account %d: %v", slaveId, accountId, pushErr)
+		} else {
+			logger.Infof("Pushed config to slave %d after provisioning account %d", slaveId, accountId)
+		}
+	}
+}
+
 // updateAccount updates an existing account.
 // @Summary Update account
 // @Description Updates an existing account
@@ -136,6 +216,11 @@ func (a *AccountController) updateAccount(c *gin.Context) {
 	}
 
 	account.Id = id
+	before, _ := a.accountService.GetAccount(id)
+	if before != nil && account.Reset != before.Reset && !service.UserCan(session.GetLoginUser(c), service.PermPlans) {
+		forbidden(c)
+		return
+	}
 	err = a.accountService.UpdateAccount(account)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.updateAccount"), err)
@@ -156,6 +241,7 @@ func (a *AccountController) updateAccount(c *gin.Context) {
 		logger.Warningf("Failed to get affected slaves for account %d: %v", account.Id, err)
 	}
 
+	audit(c, "account.update", auditTarget("account", id), before, account)
 	jsonMsgObj(c, I18nWeb(c, "pages.accounts.toasts.updateAccount"), account, nil)
 }
 
@@ -176,6 +262,7 @@ func (a *AccountController) delAccount(c *gin.Context) {
 
 	// Get affected slaves before deletion
 	affectedSlaves, _ := a.accountService.GetAccountAffectedSlaves(id)
+	before, _ := a.accountService.GetAccount(id)
 
 	err = a.accountService.DelAccount(id)
 	if err != nil {
@@ -192,6 +279,7 @@ func (a *AccountController) delAccount(c *gin.Context) {
 		}
 	}
 
+	audit(c, "account.del", auditTarget("account", id), before, nil)
 	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.delAccount"), nil)
 }
 
@@ -247,6 +335,10 @@ func (a *AccountController) addClientToAccount(c *gin.Context) {
 		return
 	}
 
+	if !canAccessInbound(c, data.InboundId) {
+		return
+	}
+
 	// If clientEmail is provided, use it (for existing clients)
 	if data.ClientEmail != "" {
 		data.Client.Email = data.ClientEmail
@@ -269,6 +361,7 @@ func (a *AccountController) addClientToAccount(c *gin.Context) {
 		}
 	}
 
+	audit(c, "account.addClient", auditTarget("account", accountId), nil, data.Client)
 	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.addClient"), nil)
 }
 
@@ -312,6 +405,7 @@ func (a *AccountController) removeClientFromAccount(c *gin.Context) {
 		}
 	}
 
+	audit(c, "account.removeClient", auditTarget("account", accountId), clientEmail, nil)
 	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.removeClient"), nil)
 }
 
@@ -376,3 +470,177 @@ func (a *AccountController) resetAccountTraffic(c *gin.Context) {
 	logger.Infof("Reset traffic for account %d", id)
 	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.resetTraffic"), nil)
 }
+
+// renewAccount starts a new term of an account on its plan.
+// @Summary Renew account
+// @Description Resets the account's traffic and sets quota, expiry and reset period to its plan's defaults
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param reason formData string false "Reason recorded in the account events"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/renew [post]
+func (a *AccountController) renewAccount(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.renew"), err)
+		return
+	}
+
+	affectedSlaves, err := a.planService.RenewAccount(id, getActor(c), c.PostForm("reason"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.renew"), err)
+		return
+	}
+
+	a.pushConfigs(affectedSlaves, id)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.renew"), nil)
+}
+
+// extendAccount moves the expiry of an account.
+// @Summary Extend account
+// @Description Extends the expiry of an account by a number of days, counting from now if it already expired
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param days formData int true "Days to add"
+// @Param reason formData string false "Reason recorded in the account events"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/extend [post]
+func (a *AccountController) extendAccount(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.extend"), err)
+		return
+	}
+	days, err := strconv.Atoi(c.PostForm("days"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.extend"), err)
+		return
+	}
+
+	affectedSlaves, err := a.accountService.ExtendAccount(id, days, getActor(c), c.PostForm("reason"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.extend"), err)
+		return
+	}
+
+	a.pushConfigs(affectedSlaves, id)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.extend"), nil)
+}
+
+// topupAccount adds traffic to the quota of an account.
+// @Summary Top up account
+// @Description Adds a number of GB to the traffic quota of an account
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param gb formData int true "GB to add"
+// @Param reason formData string false "Reason recorded in the account events"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/topup [post]
+func (a *AccountController) topupAccount(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.topup"), err)
+		return
+	}
+	gb, err := strconv.ParseInt(c.PostForm("gb"), 10, 64)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.topup"), err)
+		return
+	}
+
+	affectedSlaves, err := a.accountService.TopupAccount(id, gb, getActor(c), c.PostForm("reason"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.topup"), err)
+		return
+	}
+
+	a.pushConfigs(affectedSlaves, id)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.topup"), nil)
+}
+
+// getAccountEvents lists the renewals, extensions and top-ups of an account.
+// @Summary Get account events
+// @Description Returns the account's ledger of term changes, newest first
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/events [get]
+func (a *AccountController) getAccountEvents(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.getEvents"), err)
+		return
+	}
+	events, err := a.accountService.GetAccountEvents(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.getEvents"), err)
+		return
+	}
+	jsonObj(c, events, nil)
+}
+
+// rotateCredentials gives an account a new credential set.
+// @Summary Rotate account credentials
+// @Description Regenerates the account's UUID, password and shadowsocks 2022 key, updates every client of the account and pushes the affected slaves
+// @Tags Accounts
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/rotate [post]
+func (a *AccountController) rotateCredentials(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotate"), err)
+		return
+	}
+
+	affectedSlaves, err := a.accountService.RotateAccountCredentials(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotate"), err)
+		return
+	}
+
+	a.pushConfigs(affectedSlaves, id)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotate"), nil)
+}
+
+// rotateSubId gives an account a new subscription ID.
+// @Summary Rotate account subscription link
+// @Description Issues a new subscription ID for the account and the clients provisioned with it. The old link keeps working for the grace period with a deprecation announce, or stops at once with grace=0
+// @Tags Accounts
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param grace formData int false "Hours the old link keeps working (default: the subscription rotation setting)"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/account/{id}/rotateSubId [post]
+func (a *AccountController) rotateSubId(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotateSubId"), err)
+		return
+	}
+	grace, err := rotateGrace(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotateSubId"), err)
+		return
+	}
+	before, err := a.accountService.GetAccount(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotateSubId"), err)
+		return
+	}
+
+	subId, err := a.subRotationService.RotateAccountSubId(id, grace)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.rotateSubId"), err)
+		return
+	}
+	audit(c, "account.rotateSubId", auditTarget("account", id),
+		map[string]string{"subId": before.SubId}, map[string]string{"subId": subId})
+	jsonMsgObj(c, I18nWeb(c, "pages.accounts.toasts.rotateSubId"), subId, nil)
+}
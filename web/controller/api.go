@@ -4,7 +4,6 @@ import (
 	"net/http"
 
 	"github.com/mhsanaei/3x-ui/v2/web/service"
-	"github.com/mhsanaei/3x-ui/v2/web/session"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,6 +18,11 @@ type APIController struct {
 	slaveController       *SlaveController
 	slaveCertController   *SlaveCertController
 	accountController     *AccountController
+	planController        *PlanController
+	historyController     *TrafficHistoryController
+	subFetchController    *SubFetchController
+	userController        *UserController
+	auditController       *AuditController
 	settingController     *SettingController
 	xraySettingController *XraySettingController
 	Tgbot                 service.Tgbot
@@ -33,12 +37,18 @@ func NewAPIController(g *gin.RouterGroup, slaveService service.SlaveService) *AP
 }
 
 // checkAPIAuth is a middleware that returns 404 for unauthenticated API requests
-// to hide the existence of API endpoints from unauthorized users
+// to hide the existence of API endpoints from unauthorized users, and 403 for
+// requests the user's role or scope does not allow
 func (a *APIController) checkAPIAuth(c *gin.Context) {
-	if !session.IsLogin(c) {
+	user := loadLoginUser(c)
+	if user == nil {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+	if !service.UserCan(user, requiredAPIPermission(c)) || !canAccessRoute(c, user) {
+		forbidden(c)
+		return
+	}
 	c.Next()
 }
 
@@ -47,10 +57,13 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	// Slave connect without auth
 	slaveController := &SlaveController{slaveService: a.slaveService}
 	g.GET("/panel/api/slave/connect", slaveController.connectSlave)
+	g.POST("/panel/api/slave/enroll", slaveController.enrollSlave)
+	g.GET("/panel/api/slave/agent", slaveController.downloadAgent)
 
 	// Main API group
 	api := g.Group("/panel/api")
 	api.Use(a.checkAPIAuth)
+	api.Use(auditRequest)
 
 	// Inbounds API
 	inbounds := api.Group("/inbounds")
@@ -76,6 +89,26 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	accounts := api.Group("/account")
 	a.accountController = NewAccountController(accounts)
 
+	// Plan API (account templates)
+	plans := api.Group("/plan")
+	a.planController = NewPlanController(plans)
+
+	// Panel users API
+	users := api.Group("/users")
+	a.userController = NewUserController(users)
+
+	// Audit log API
+	auditLogs := api.Group("/audit")
+	a.auditController = NewAuditController(auditLogs)
+
+	// Traffic History API (usage per hour and day)
+	history := api.Group("/history")
+	a.historyController = NewTrafficHistoryController(history)
+
+	// Subscription fetch API (access log and stats)
+	subFetch := api.Group("/subFetch")
+	a.subFetchController = NewSubFetchController(subFetch)
+
 	// Server API
 	server := api.Group("/server")
 	a.serverController = NewServerController(server)
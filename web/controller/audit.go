@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+const (
+	auditKey         = "audit"
+	requestFailedKey = "requestFailed"
+)
+
+// auditRecord is the change a request describes for its audit log entry.
+type auditRecord struct {
+	action string
+	target string
+	before any
+	after  any
+}
+
+// auditReads are POST routes below /panel/api that only read.
+var auditReads = map[string]bool{
+	"/setting/all":               true,
+	"/setting/defaultSettings":   true,
+	"/xray/":                     true,
+	"/server/logs/:count":        true,
+	"/server/xraylogs/:count":    true,
+	"/server/getNewEchCert":      true,
+	"/inbounds/onlines":          true,
+	"/inbounds/lastOnline":       true,
+	"/inbounds/clientIps/:email": true,
+}
+
+// audit describes the change a request makes. before and after are the
+// changed object before and after it, nil for creations and deletions.
+// Requests that do not call audit are logged with their route as action.
+func audit(c *gin.Context, action, target string, before, after any) {
+	c.Set(auditKey, &auditRecord{action, target, before, after})
+}
+
+// auditTarget formats the target of an audit log entry.
+func auditTarget(kind string, id any) string {
+	return fmt.Sprintf("%s:%v", kind, id)
+}
+
+// auditSource tells requests from the panel pages from other API clients.
+func auditSource(c *gin.Context) string {
+	if isAjax(c) {
+		return service.AuditSourcePanel
+	}
+	return service.AuditSourceAPI
+}
+
+// auditRequest is a middleware writing an audit log entry for every
+// successful API request that changes something.
+func auditRequest(c *gin.Context) {
+	c.Next()
+
+	route := routeBelow(c, "/panel/api")
+	if c.Request.Method == http.MethodGet || auditReads[route] {
+		return
+	}
+	if c.Writer.Status() >= http.StatusBadRequest || c.GetBool(requestFailedKey) {
+		return
+	}
+
+	record := &auditRecord{action: route, target: routeParams(c)}
+	if value, ok := c.Get(auditKey); ok {
+		record = value.(*auditRecord)
+	}
+	auditService := service.AuditService{}
+	auditService.Log(&model.AuditLog{
+		Actor:  getActor(c),
+		Source: auditSource(c),
+		Ip:     getRemoteIp(c),
+		Action: record.action,
+		Target: record.target,
+	}, record.before, record.after)
+}
+
+// routeParams joins the route parameters of a request as name=value.
+func routeParams(c *gin.Context) string {
+	params := make([]string, 0, len(c.Params))
+	for _, param := range c.Params {
+		params = append(params, param.Key+"="+param.Value)
+	}
+	sort.Strings(params)
+	return strings.Join(params, ",")
+}
+
+// AuditController serves the audit log.
+type AuditController struct {
+	auditService service.AuditService
+}
+
+// NewAuditController creates a new audit log controller instance.
+func NewAuditController(g *gin.RouterGroup) *AuditController {
+	a := &AuditController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *AuditController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getAuditLogs)
+	g.GET("/export", a.exportAuditLogs)
+}
+
+// auditFilter reads the filter of audit log requests from the query.
+func auditFilter(c *gin.Context) service.AuditFilter {
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	return service.AuditFilter{
+		Actor:  c.Query("actor"),
+		Source: c.Query("source"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+		From:   from,
+		To:     to,
+	}
+}
+
+// getAuditLogs returns a page of the audit log.
+// @Summary Audit log
+// @Description Returns audit log entries, newest first, with the number of all matching entries
+// @Tags Audit
+// @Produce json
+// @Param actor query string false "Panel user, Telegram user or job"
+// @Param source query string false "panel, api, tgbot, ldap or job"
+// @Param action query string false "Action prefix, e.g. inbound."
+// @Param target query string false "Target, e.g. inbound:5"
+// @Param from query int false "Start time (ms)"
+// @Param to query int false "End time (ms)"
+// @Param page query int false "Page, from 1"
+// @Param pageSize query int false "Entries per page, at most 500"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/audit [get]
+func (a *AuditController) getAuditLogs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.Query("page"))
+	pageSize, _ := strconv.Atoi(c.Query("pageSize"))
+	logs, total, err := a.auditService.GetAuditLogs(auditFilter(c), page, pageSize)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.audit.toasts.getLogs"), err)
+		return
+	}
+	jsonObj(c, gin.H{"logs": logs, "total": total}, nil)
+}
+
+// exportAuditLogs downloads the matching audit log entries as JSON lines.
+// @Summary Export audit log
+// @Description Downloads matching audit log entries, oldest first, one JSON object per line
+// @Tags Audit
+// @Produce application/x-ndjson
+// @Param actor query string false "Panel user, Telegram user or job"
+// @Param source query string false "panel, api, tgbot, ldap or job"
+// @Param action query string false "Action prefix, e.g. inbound."
+// @Param target query string false "Target, e.g. inbound:5"
+// @Param from query int false "Start time (ms)"
+// @Param to query int false "End time (ms)"
+// @Success 200 {file} file
+// @Router /panel/api/audit/export [get]
+func (a *AuditController) exportAuditLogs(c *gin.Context) {
+	filename := fmt.Sprintf("audit-%s.jsonl", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	if err := a.auditService.ExportAuditLogs(auditFilter(c), c.Writer); err != nil {
+		// Headers are sent with the first line, so the download is cut short
+		c.Error(err)
+	}
+}
@@ -7,7 +7,7 @@ import (
 
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/locale"
-	"github.com/mhsanaei/3x-ui/v2/web/session"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,14 +16,23 @@ import (
 type BaseController struct{}
 
 // checkLogin is a middleware that verifies user authentication and handles unauthorized access.
+// Pages the user's role does not grant redirect to the dashboard.
 func (a *BaseController) checkLogin(c *gin.Context) {
-	if !session.IsLogin(c) {
+	user := loadLoginUser(c)
+	if user == nil {
 		if isAjax(c) {
 			pureJsonMsg(c, http.StatusUnauthorized, false, I18nWeb(c, "pages.login.loginAgain"))
 		} else {
 			c.Redirect(http.StatusTemporaryRedirect, c.GetString("base_path"))
 		}
 		c.Abort()
+	} else if !service.UserCan(user, requiredPagePermission(c)) {
+		if isAjax(c) {
+			forbidden(c)
+		} else {
+			c.Redirect(http.StatusTemporaryRedirect, c.GetString("base_path")+"panel/")
+			c.Abort()
+		}
 	} else {
 		c.Next()
 	}
@@ -21,6 +21,9 @@ type InboundController struct {
 	inboundService service.InboundService
 	xrayService    service.XrayService
 	slaveService   service.SlaveService
+	planService    service.PlanService
+	userService    service.UserService
+	rotateService  service.SubRotationService
 }
 
 // NewInboundController creates a new InboundController and sets up its routes.
@@ -44,6 +47,7 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateInbound)
 	g.POST("/clientIps/:email", a.getClientIps)
 	g.POST("/clearClientIps/:email", a.clearClientIps)
+	g.POST("/rotateClientSubId/:email", a.rotateClientSubId)
 	g.POST("/addClient", a.addInboundClient)
 	g.POST("/:id/delClient/:clientId", a.delInboundClient)
 	g.POST("/updateClient/:clientId", a.updateInboundClient)
@@ -73,7 +77,7 @@ func (a *InboundController) getInbounds(c *gin.Context) {
 	var err error
 	
 	if slaveId == -1 {
-		inbounds, err = a.inboundService.GetInbounds(user.Id)
+		inbounds, err = a.inboundService.GetInbounds(user)
 	} else {
 		inbounds, err = a.inboundService.GetInboundsForSlave(slaveId)
 	}
@@ -82,6 +86,15 @@ func (a *InboundController) getInbounds(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
 		return
 	}
+	if slaveId != -1 && service.IsScopedUser(user) {
+		visible := make([]*model.Inbound, 0, len(inbounds))
+		for _, inbound := range inbounds {
+			if service.CanAccessInbound(user, inbound) {
+				visible = append(visible, inbound)
+			}
+		}
+		inbounds = visible
+	}
 	jsonObj(c, inbounds, nil)
 }
 
@@ -189,6 +202,9 @@ func (a *InboundController) addInbound(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), common.NewError("Please select a valid slave server"))
 		return
 	}
+	if !canAccessSlave(c, inbound.SlaveId) {
+		return
+	}
 	
 	user := session.GetLoginUser(c)
 	inbound.UserId = user.Id
@@ -214,6 +230,8 @@ func (a *InboundController) addInbound(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	inbound = a.enrollInbound(inbound)
+	audit(c, "inbound.add", auditTarget("inbound", inbound.Id), nil, inbound)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -222,7 +240,7 @@ func (a *InboundController) addInbound(c *gin.Context) {
 		a.slaveService.PushConfig(inbound.SlaveId)
 	}
 	// Broadcast inbounds update via WebSocket
-	inbounds, _ := a.inboundService.GetInbounds(user.Id)
+	inbounds, _ := a.inboundService.GetInbounds(nil)
 	websocket.BroadcastInbounds(inbounds)
 }
 
@@ -249,6 +267,7 @@ func (a *InboundController) delInbound(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	audit(c, "inbound.del", auditTarget("inbound", id), inbound, nil)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundDeleteSuccess"), id, nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -260,8 +279,7 @@ func (a *InboundController) delInbound(c *gin.Context) {
     }
 
 	// Broadcast inbounds update via WebSocket
-	user := session.GetLoginUser(c)
-	inbounds, _ := a.inboundService.GetInbounds(user.Id)
+	inbounds, _ := a.inboundService.GetInbounds(nil)
 	websocket.BroadcastInbounds(inbounds)
 }
 
@@ -288,6 +306,7 @@ func (a *InboundController) updateInbound(c *gin.Context) {
 	}
 
 	// Backup original SlaveId for config push comparison
+	before := *inbound
 	originalSlaveId := inbound.SlaveId
 	logger.Infof("Original SlaveId: %d", originalSlaveId)
 
@@ -304,12 +323,17 @@ func (a *InboundController) updateInbound(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), common.NewError("Please select a valid slave server"))
 		return
 	}
+	if !canAccessSlave(c, inbound.SlaveId) {
+		return
+	}
 
 	inbound, needRestart, err := a.inboundService.UpdateInbound(inbound)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	inbound = a.enrollInbound(inbound)
+	audit(c, "inbound.update", auditTarget("inbound", inbound.Id), &before, inbound)
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), inbound, nil)
 	
 	if needRestart {
@@ -326,8 +350,7 @@ func (a *InboundController) updateInbound(c *gin.Context) {
     }
 
 	// Broadcast inbounds update via WebSocket
-	user := session.GetLoginUser(c)
-	inbounds, _ := a.inboundService.GetInbounds(user.Id)
+	inbounds, _ := a.inboundService.GetInbounds(nil)
 	websocket.BroadcastInbounds(inbounds)
 }
 
@@ -401,6 +424,39 @@ func (a *InboundController) clearClientIps(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.logCleanSuccess"), nil)
 }
 
+// rotateClientSubId gives the subscription of a client a new ID.
+// @Summary Rotate client subscription link
+// @Description Issues a new subscription ID for the client and every client sharing its subscription. The old link keeps working for the grace period with a deprecation announce, or stops at once with grace=0
+// @Tags Inbounds
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param email path string true "Client email"
+// @Param grace formData int false "Hours the old link keeps working (default: the subscription rotation setting)"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/inbounds/rotateClientSubId/{email} [post]
+func (a *InboundController) rotateClientSubId(c *gin.Context) {
+	email := c.Param("email")
+	grace, err := rotateGrace(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.rotateSubId"), err)
+		return
+	}
+	_, client, err := a.inboundService.GetClientByEmail(email)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.rotateSubId"), err)
+		return
+	}
+
+	subId, err := a.rotateService.RotateClientSubId(email, grace)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.rotateSubId"), err)
+		return
+	}
+	audit(c, "client.rotateSubId", auditTarget("client", email),
+		map[string]string{"subId": client.SubID}, map[string]string{"subId": subId})
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.rotateSubId"), subId, nil)
+}
+
 // addInboundClient adds a new client to an existing inbound.
 // @Summary Add client to inbound
 // @Description Adds a new client to an existing inbound configuration
@@ -417,12 +473,16 @@ func (a *InboundController) addInboundClient(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
 		return
 	}
+	if !canAccessInbound(c, data.Id) {
+		return
+	}
 
 	needRestart, err := a.inboundService.AddInboundClient(data)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	audit(c, "client.add", auditTarget("inbound", data.Id), nil, data.Settings)
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientAddSuccess"), nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -459,6 +519,7 @@ func (a *InboundController) delInboundClient(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	audit(c, "client.del", auditTarget("inbound", id), clientId, nil)
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientDeleteSuccess"), nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -488,12 +549,16 @@ func (a *InboundController) updateInboundClient(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
 		return
 	}
+	if !canAccessInbound(c, inbound.Id) {
+		return
+	}
 
 	needRestart, err := a.inboundService.UpdateInboundClient(inbound, clientId)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	audit(c, "client.update", auditTarget("inbound", inbound.Id), nil, inbound.Settings)
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -538,6 +603,9 @@ func (a *InboundController) importInbound(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	if !canAccessSlave(c, inbound.SlaveId) {
+		return
+	}
 	user := session.GetLoginUser(c)
 	inbound.Id = 0
 	inbound.UserId = user.Id
@@ -565,12 +633,41 @@ func (a *InboundController) importInbound(c *gin.Context) {
 
 	needRestart := false
 	inbound, needRestart, err = a.inboundService.AddInbound(inbound)
+	if err == nil {
+		inbound = a.enrollInbound(inbound)
+		if inbound.SlaveId > 0 {
+			a.slaveService.PushConfig(inbound.SlaveId)
+		}
+	}
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, err)
 	if err == nil && needRestart {
 		a.xrayService.SetToNeedRestart()
 	}
 }
 
+// enrollInbound gives the accounts an inbound is meant for a client on it and
+// pushes the configs of other slaves that changed along the way. The caller
+// pushes the inbound's own slave. Returns the inbound with its new clients.
+func (a *InboundController) enrollInbound(inbound *model.Inbound) *model.Inbound {
+	affectedSlaves, err := a.planService.EnrollInbound(inbound.Id)
+	if err != nil {
+		logger.Warningf("Failed to enroll accounts on inbound %s: %v", inbound.Tag, err)
+		return inbound
+	}
+	for _, slaveId := range affectedSlaves {
+		if slaveId == inbound.SlaveId {
+			continue
+		}
+		if pushErr := a.slaveService.PushConfig(slaveId); pushErr != nil {
+			logger.Errorf("Failed to push config to slave %d after enrolling inbound %s: %v", slaveId, inbound.Tag, pushErr)
+		}
+	}
+	if enrolled, err := a.inboundService.GetInbound(inbound.Id); err == nil {
+		return enrolled
+	}
+	return inbound
+}
+
 // delDepletedClients deletes clients in an inbound who have exhausted their traffic limits.
 // @Summary Delete depleted clients
 // @Description Removes clients whose traffic limits are exhausted
@@ -601,7 +698,17 @@ func (a *InboundController) delDepletedClients(c *gin.Context) {
 // @Success 200 {object} entity.Msg
 // @Router /panel/api/inbounds/onlines [post]
 func (a *InboundController) onlines(c *gin.Context) {
-	jsonObj(c, a.inboundService.GetOnlineClients(), nil)
+	onlines := a.inboundService.GetOnlineClients()
+	if visible := a.visibleClients(c); visible != nil {
+		scoped := make([]string, 0, len(onlines))
+		for _, email := range onlines {
+			if visible[email] {
+				scoped = append(scoped, email)
+			}
+		}
+		onlines = scoped
+	}
+	jsonObj(c, onlines, nil)
 }
 
 // lastOnline retrieves the last online timestamps for clients.
@@ -613,9 +720,31 @@ func (a *InboundController) onlines(c *gin.Context) {
 // @Router /panel/api/inbounds/lastOnline [post]
 func (a *InboundController) lastOnline(c *gin.Context) {
 	data, err := a.inboundService.GetClientsLastOnline()
+	if visible := a.visibleClients(c); visible != nil {
+		for email := range data {
+			if !visible[email] {
+				delete(data, email)
+			}
+		}
+	}
 	jsonObj(c, data, err)
 }
 
+// visibleClients returns the client emails a scoped user may see, or nil when
+// the user sees all clients.
+func (a *InboundController) visibleClients(c *gin.Context) map[string]bool {
+	user := session.GetLoginUser(c)
+	if !service.IsScopedUser(user) {
+		return nil
+	}
+	visible, err := a.userService.GetUserClientEmails(user)
+	if err != nil {
+		logger.Warning("Failed to get the clients visible to", user.Username, err)
+		return map[string]bool{}
+	}
+	return visible
+}
+
 // updateClientTraffic updates the traffic statistics for a client by email.
 // @Summary Update client traffic
 // @Description Sets upload/download traffic for a client
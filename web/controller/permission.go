@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPermission is what a route below /panel/api needs, for GET requests and
+// for all others.
+type apiPermission struct {
+	prefix string
+	read   string
+	write  string
+}
+
+// apiPermissions are matched by route prefix in order; routes without a match
+// need service.PermPanel. Reads sent as POST need the read permission for both.
+var apiPermissions = []apiPermission{
+	{"/users/report", service.PermView, service.PermView},
+	{"/users", service.PermUsers, service.PermUsers},
+	{"/setting/defaultSettings", service.PermView, service.PermView},
+	{"/setting/updateUser", service.PermView, service.PermView},
+	{"/server/status", service.PermView, service.PermPanel},
+	{"/server/cpuHistory", service.PermView, service.PermPanel},
+	{"/server/getNew", service.PermView, service.PermView},
+	{"/slave/list", service.PermView, service.PermPanel},
+	{"/slave/configStatus", service.PermView, service.PermPanel},
+	{"/inbounds/onlines", service.PermView, service.PermView},
+	{"/inbounds/lastOnline", service.PermView, service.PermView},
+	{"/inbounds/clientIps", service.PermView, service.PermView},
+	{"/inbounds/resetAllTraffics", service.PermPanel, service.PermPanel},
+	{"/inbounds/updateClientTraffic", service.PermView, service.PermPlans},
+	{"/inbounds", service.PermView, service.PermInbounds},
+	{"/account/:id/plan", service.PermView, service.PermPlans},
+	{"/account/:id/renew", service.PermView, service.PermPlans},
+	{"/account/reset/traffic", service.PermView, service.PermPlans},
+	{"/account", service.PermView, service.PermAccounts},
+	{"/plan", service.PermView, service.PermPlans},
+	{"/history", service.PermView, service.PermView},
+	{"/subFetch/:subId", service.PermView, service.PermView},
+}
+
+// routeBelow returns the route pattern of a request below prefix.
+func routeBelow(c *gin.Context, prefix string) string {
+	route := c.FullPath()
+	if i := strings.Index(route, prefix); i >= 0 {
+		return route[i+len(prefix):]
+	}
+	return route
+}
+
+// requiredAPIPermission returns the permission an API request needs.
+func requiredAPIPermission(c *gin.Context) string {
+	route := routeBelow(c, "/panel/api")
+	for _, p := range apiPermissions {
+		if strings.HasPrefix(route, p.prefix) {
+			if c.Request.Method == http.MethodGet {
+				return p.read
+			}
+			return p.write
+		}
+	}
+	return service.PermPanel
+}
+
+// requiredPagePermission returns the permission a panel page needs.
+func requiredPagePermission(c *gin.Context) string {
+	switch routeBelow(c, "/panel") {
+	case "/settings", "/xray", "/audit":
+		return service.PermPanel
+	case "/users":
+		return service.PermUsers
+	}
+	return service.PermView
+}
+
+// loadLoginUser reloads the logged in user from the database, so role changes
+// and deleted users apply to sessions that are already open.
+func loadLoginUser(c *gin.Context) *model.User {
+	user := session.GetLoginUser(c)
+	if user == nil {
+		return nil
+	}
+	userService := service.UserService{}
+	current, err := userService.GetUser(user.Id)
+	if err != nil {
+		return nil
+	}
+	session.SetLoginUser(c, current)
+	return current
+}
+
+// canAccessRoute checks the inbound, client, account and history targets in
+// the route parameters against what a scoped user may see.
+func canAccessRoute(c *gin.Context, user *model.User) bool {
+	if !service.IsScopedUser(user) {
+		return true
+	}
+	userService := service.UserService{}
+	route := routeBelow(c, "/panel/api")
+	switch {
+	case strings.HasPrefix(route, "/inbounds/"):
+		if id, err := strconv.Atoi(c.Param("id")); err == nil && !userService.CanAccessInboundId(user, id) {
+			return false
+		}
+		if email := c.Param("email"); email != "" && !userService.CanAccessClient(user, email) {
+			return false
+		}
+	case strings.HasPrefix(route, "/account/"):
+		if id, err := strconv.Atoi(c.Param("id")); err == nil && !userService.CanAccessAccountId(user, id) {
+			return false
+		}
+	case strings.HasPrefix(route, "/history/"):
+		target := c.Param("target")
+		switch c.Param("scope") {
+		case service.TrafficScopeClient:
+			return userService.CanAccessClient(user, target)
+		case service.TrafficScopeAccount:
+			id, _ := strconv.Atoi(target)
+			return userService.CanAccessAccountId(user, id)
+		case service.TrafficScopeInbound:
+			id, _ := strconv.Atoi(target)
+			return userService.CanAccessInboundId(user, id)
+		case service.TrafficScopeSlave:
+			id, _ := strconv.Atoi(target)
+			return service.CanAccessSlave(user, id)
+		}
+	case strings.HasPrefix(route, "/subFetch/:subId"):
+		return userService.CanAccessSubId(user, c.Param("subId"))
+	}
+	return true
+}
+
+// canAccessInbound reports whether the logged in user may see an inbound,
+// answering the request when it may not.
+func canAccessInbound(c *gin.Context, inboundId int) bool {
+	userService := service.UserService{}
+	if user := session.GetLoginUser(c); !service.IsScopedUser(user) || userService.CanAccessInboundId(user, inboundId) {
+		return true
+	}
+	forbidden(c)
+	return false
+}
+
+// canAccessSlave reports whether the logged in user may use a slave,
+// answering the request when it may not.
+func canAccessSlave(c *gin.Context, slaveId int) bool {
+	if service.CanAccessSlave(session.GetLoginUser(c), slaveId) {
+		return true
+	}
+	forbidden(c)
+	return false
+}
+
+// forbidden answers a request the logged in user lacks the permission for.
+func forbidden(c *gin.Context) {
+	pureJsonMsg(c, http.StatusForbidden, false, I18nWeb(c, "pages.users.forbidden"))
+	c.Abort()
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// PlanController handles HTTP requests for account plan management.
+type PlanController struct {
+	BaseController
+
+	planService  service.PlanService
+	slaveService service.SlaveService
+}
+
+// NewPlanController creates a new plan controller instance.
+func NewPlanController(g *gin.RouterGroup) *PlanController {
+	a := &PlanController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *PlanController) initRouter(g *gin.RouterGroup) {
+	g.GET("/list", a.getPlans)
+	g.POST("/add", a.addPlan)
+	g.POST("/update/:id", a.updatePlan)
+	g.POST("/del/:id", a.delPlan)
+}
+
+// getPlans retrieves all plans.
+// @Summary List plans
+// @Description Returns all account plans
+// @Tags Plans
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/plan/list [get]
+func (a *PlanController) getPlans(c *gin.Context) {
+	plans, err := a.planService.GetPlans()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.getPlans"), err)
+		return
+	}
+	jsonObj(c, plans, nil)
+}
+
+// addPlan creates a new plan.
+// @Summary Add plan
+// @Description Creates a new account plan
+// @Tags Plans
+// @Accept json
+// @Produce json
+// @Param plan body model.Plan true "Plan data"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/plan/add [post]
+func (a *PlanController) addPlan(c *gin.Context) {
+	plan := &model.Plan{}
+	if err := c.ShouldBind(plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.addPlan"), err)
+		return
+	}
+	plan.Id = 0
+	err := a.planService.AddPlan(plan)
+	audit(c, "plan.add", auditTarget("plan", plan.Id), nil, plan)
+	jsonMsgObj(c, I18nWeb(c, "pages.accounts.toasts.addPlan"), plan, err)
+}
+
+// updatePlan updates a plan and propagates it to the plan's accounts.
+// @Summary Update plan
+// @Description Updates a plan; quota, reset period, IP limit and inbounds are applied to every account on it
+// @Tags Plans
+// @Accept json
+// @Produce json
+// @Param id path int true "Plan ID"
+// @Param plan body model.Plan true "Updated plan data"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/plan/update/{id} [post]
+func (a *PlanController) updatePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.updatePlan"), err)
+		return
+	}
+	plan := &model.Plan{}
+	if err := c.ShouldBind(plan); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.updatePlan"), err)
+		return
+	}
+	plan.Id = id
+	before, _ := a.planService.GetPlan(id)
+
+	affectedSlaves, err := a.planService.UpdatePlan(plan)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.updatePlan"), err)
+		return
+	}
+	for _, slaveId := range affectedSlaves {
+		if pushErr := a.slaveService.PushConfig(slaveId); pushErr != nil {
+			logger.Errorf("Failed to push config to slave %d after plan update: %v", slaveId, pushErr)
+		} else {
+			logger.Infof("Pushed config to slave %d after updating plan %d", slaveId, id)
+		}
+	}
+	audit(c, "plan.update", auditTarget("plan", id), before, plan)
+	jsonMsgObj(c, I18nWeb(c, "pages.accounts.toasts.updatePlan"), plan, nil)
+}
+
+// delPlan deletes a plan. Its accounts keep their limits and clients.
+// @Summary Delete plan
+// @Description Deletes a plan; its accounts are detached and keep their clients
+// @Tags Plans
+// @Produce json
+// @Param id path int true "Plan ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/plan/del/{id} [post]
+func (a *PlanController) delPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.delPlan"), err)
+		return
+	}
+	before, _ := a.planService.GetPlan(id)
+	err = a.planService.DelPlan(id)
+	audit(c, "plan.del", auditTarget("plan", id), before, nil)
+	jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.delPlan"), err)
+}
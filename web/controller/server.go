@@ -22,6 +22,7 @@ type ServerController struct {
 
 	serverService  service.ServerService
 	settingService service.SettingService
+	slaveService   service.SlaveService
 
 	lastStatus *service.Status
 
@@ -157,10 +158,20 @@ func (a *ServerController) getXrayVersion(c *gin.Context) {
 // @Tags Server
 // @Produce json
 // @Param version path string true "Xray version to install"
+// @Param slaveIds formData string false "Comma separated slave IDs, or all, to update one after another instead of the master"
 // @Success 200 {object} entity.Msg
 // @Router /panel/api/server/installXray/{version} [post]
 func (a *ServerController) installXray(c *gin.Context) {
 	version := c.Param("version")
+	if slaveIds, ok, err := getSlaveIdsParam(c, &a.slaveService); ok || err != nil {
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
+			return
+		}
+		results, err := a.slaveService.RollInstallXray(slaveIds, version)
+		jsonObj(c, results, err)
+		return
+	}
 	err := a.serverService.UpdateXray(version)
 	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
 }
@@ -171,6 +182,7 @@ func (a *ServerController) installXray(c *gin.Context) {
 // @Tags Server
 // @Produce json
 // @Param fileName path string false "Geo file name"
+// @Param slaveIds formData string false "Comma separated slave IDs, or all, to update one after another instead of the master"
 // @Success 200 {object} entity.Msg
 // @Router /panel/api/server/updateGeofile/{fileName} [post]
 func (a *ServerController) updateGeofile(c *gin.Context) {
@@ -183,6 +195,16 @@ func (a *ServerController) updateGeofile(c *gin.Context) {
 		return
 	}
 
+	if slaveIds, ok, err := getSlaveIdsParam(c, &a.slaveService); ok || err != nil {
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.index.geofileUpdatePopover"), err)
+			return
+		}
+		results, err := a.slaveService.RollUpdateGeofile(slaveIds, fileName)
+		jsonObj(c, results, err)
+		return
+	}
+
 	err := a.serverService.UpdateGeofile(fileName)
 	jsonMsg(c, I18nWeb(c, "pages.index.geofileUpdatePopover"), err)
 }
@@ -266,32 +288,65 @@ func (a *ServerController) restartSlaveXray(c *gin.Context) {
 // @Param count path string true "Number of log lines"
 // @Param level formData string false "Log level filter"
 // @Param syslog formData string false "Syslog filter"
+// @Param slaveId formData int false "Read the logs of this slave instead of the master"
 // @Success 200 {object} entity.Msg
 // @Router /panel/api/server/logs/{count} [post]
 func (a *ServerController) getLogs(c *gin.Context) {
 	count := c.Param("count")
 	level := c.PostForm("level")
 	syslog := c.PostForm("syslog")
+	if slaveId, ok := getSlaveIdParam(c); ok {
+		logs, err := a.slaveService.GetSlaveLogs(slaveId, count, level, syslog)
+		jsonObj(c, logs, err)
+		return
+	}
 	logs := a.serverService.GetLogs(count, level, syslog)
 	jsonObj(c, logs, nil)
 }
 
+// getSlaveIdParam returns the slaveId form value when a slave was selected.
+func getSlaveIdParam(c *gin.Context) (int, bool) {
+	slaveId, err := strconv.Atoi(c.PostForm("slaveId"))
+	if err != nil || slaveId <= 0 {
+		return 0, false
+	}
+	return slaveId, true
+}
+
 // getXrayLogs retrieves Xray logs with filtering options for direct, blocked, and proxy traffic.
 // @Summary Get Xray logs
-// @Description Retrieves Xray access logs with filtering by traffic type
+// @Description Retrieves Xray access logs with filtering by traffic type, or error log lines with logType=error
 // @Tags Server
 // @Accept x-www-form-urlencoded
 // @Produce json
 // @Param count path string true "Number of log lines"
 // @Param filter formData string false "Text filter"
+// @Param email formData string false "Only entries of this client email"
 // @Param showDirect formData string false "Show direct traffic"
 // @Param showBlocked formData string false "Show blocked traffic"
 // @Param showProxy formData string false "Show proxy traffic"
+// @Param logType formData string false "access (default) or error"
+// @Param level formData string false "Error log level filter"
+// @Param slaveId formData int false "Read the logs of this slave instead of the master"
 // @Success 200 {object} entity.Msg
 // @Router /panel/api/server/xraylogs/{count} [post]
 func (a *ServerController) getXrayLogs(c *gin.Context) {
 	count := c.Param("count")
 	filter := c.PostForm("filter")
+	email := c.PostForm("email")
+	slaveId, isSlave := getSlaveIdParam(c)
+
+	if c.PostForm("logType") == "error" {
+		level := c.PostForm("level")
+		if isSlave {
+			logs, err := a.slaveService.GetSlaveXrayErrorLogs(slaveId, count, level, filter)
+			jsonObj(c, logs, err)
+			return
+		}
+		jsonObj(c, a.serverService.GetXrayErrorLogs(count, level, filter), nil)
+		return
+	}
+
 	showDirect := c.PostForm("showDirect")
 	showBlocked := c.PostForm("showBlocked")
 	showProxy := c.PostForm("showProxy")
@@ -329,7 +384,12 @@ func (a *ServerController) getXrayLogs(c *gin.Context) {
 		blackholes = []string{"blocked"}
 	}
 
-	logs := a.serverService.GetXrayLogs(count, filter, showDirect, showBlocked, showProxy, freedoms, blackholes)
+	if isSlave {
+		logs, err := a.slaveService.GetSlaveXrayLogs(slaveId, count, filter, email, showDirect, showBlocked, showProxy, freedoms, blackholes)
+		jsonObj(c, logs, err)
+		return
+	}
+	logs := a.serverService.GetXrayLogs(count, filter, email, showDirect, showBlocked, showProxy, freedoms, blackholes)
 	jsonObj(c, logs, nil)
 }
 
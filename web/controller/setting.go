@@ -92,7 +92,9 @@ func (a *SettingController) updateSetting(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 		return
 	}
+	before, _ := a.settingService.GetAllSetting()
 	err = a.settingService.UpdateAllSetting(allSetting)
+	audit(c, "setting.update", "settings", before, allSetting)
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 }
 
@@ -131,6 +133,7 @@ func (a *SettingController) updateUser(c *gin.Context) {
 		user.Password = crypto.HashPassword(form.NewPassword)
 		session.SetLoginUser(c, user)
 	}
+	audit(c, "user.updateSelf", auditTarget("user", user.Id), nil, nil)
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyUser"), err)
 }
 
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,6 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/web/session"
 	"github.com/mhsanaei/3x-ui/v2/logger"
@@ -16,6 +18,7 @@ import (
 
 type SlaveController struct {
 	slaveService service.SlaveService
+	planService  service.PlanService
 }
 
 func NewSlaveController(g *gin.RouterGroup, slaveService service.SlaveService) *SlaveController {
@@ -29,6 +32,13 @@ func (s *SlaveController) initRouter(g *gin.RouterGroup) {
 	g.POST("/add", s.addSlave)
 	g.POST("/del/:id", s.delSlave)
 	g.GET("/install/:id", s.getInstallCommand)
+	g.GET("/configStatus", s.getConfigStatus)
+	g.POST("/pushConfig/:id", s.pushConfig)
+	g.POST("/revoke/:id", s.revokeSlave)
+	g.POST("/rotateSecret/:id", s.rotateSecret)
+	g.POST("/upgradeAgent", s.upgradeAgent)
+	g.POST("/setGroup/:id", s.setGroup)
+	g.POST("/setEndpoints/:id", s.setEndpoints)
 }
 
 // getSlaves retrieves all slave nodes with traffic info.
@@ -48,7 +58,22 @@ func (s *SlaveController) getSlaves(c *gin.Context) {
         c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"success": true, "obj": slaves})
+    c.JSON(http.StatusOK, gin.H{"success": true, "obj": visibleSlaves(c, slaves)})
+}
+
+// visibleSlaves drops the slaves the logged in user is not limited to.
+func visibleSlaves(c *gin.Context, slaves []map[string]interface{}) []map[string]interface{} {
+	user := session.GetLoginUser(c)
+	if service.UserSlaveIds(user) == nil {
+		return slaves
+	}
+	visible := make([]map[string]interface{}, 0, len(slaves))
+	for _, slave := range slaves {
+		if id, ok := slave["id"].(int); ok && service.CanAccessSlave(user, id) {
+			visible = append(visible, slave)
+		}
+	}
+	return visible
 }
 
 // addSlave adds a new slave node.
@@ -87,6 +112,7 @@ func (s *SlaveController) addSlave(c *gin.Context) {
     }
     
     logger.Infof("Slave added successfully: id=%d, name=%s", slave.Id, slave.Name)
+    audit(c, "slave.add", auditTarget("slave", slave.Id), nil, slave)
     c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Slave added", "obj": slave})
 }
 
@@ -117,6 +143,7 @@ func (s *SlaveController) delSlave(c *gin.Context) {
     }
     
     logger.Infof("Successfully deleted slave %d", id)
+    audit(c, "slave.del", auditTarget("slave", id), nil, nil)
     c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Slave deleted"})
 }
 
@@ -141,12 +168,248 @@ func (s *SlaveController) getInstallCommand(c *gin.Context) {
 		basePath = bp.(string)
 	}
 	
-	command, err := s.slaveService.GenerateInstallCommand(id, c.Request, basePath)
+	command, expiry, err := s.slaveService.GenerateInstallCommand(id, c.Request, basePath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "obj": gin.H{"command": command, "joinTokenExpiry": expiry}})
+}
+
+// setGroup changes the group of a slave and reprovisions the accounts of plans
+// that target slave groups.
+// @Summary Set slave group
+// @Description Sets the group label plans use to target the slave's inbounds
+// @Tags Slaves
+// @Produce json
+// @Param id path int true "Slave ID"
+// @Param group formData string false "Group label, empty to clear"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/setGroup/{id} [post]
+func (s *SlaveController) setGroup(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid slave ID"})
+		return
+	}
+	if err := s.slaveService.SetSlaveGroup(id, c.PostForm("group")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	affectedSlaves, err := s.planService.ProvisionAllAccounts()
+	if err != nil {
+		logger.Warningf("Failed to reprovision plan accounts after changing the group of slave %d: %v", id, err)
+	}
+	for _, slaveId := range affectedSlaves {
+		if pushErr := s.slaveService.PushConfig(slaveId); pushErr != nil {
+			logger.Errorf("Failed to push config to slave %d after changing slave groups: %v", slaveId, pushErr)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Slave group updated"})
+}
+
+// setEndpoints changes the subscription endpoints of a slave.
+// @Summary Set slave endpoints
+// @Description Sets the hosts, ports, SNIs and paths subscriptions list for the slave's inbounds without an address of their own
+// @Tags Slaves
+// @Produce json
+// @Param id path int true "Slave ID"
+// @Param endpoints formData string false "JSON list of endpoints, empty to clear"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/setEndpoints/{id} [post]
+func (s *SlaveController) setEndpoints(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid slave ID"})
+		return
+	}
+	before, _ := s.slaveService.GetSlave(id)
+	if err := s.slaveService.SetSlaveEndpoints(id, c.PostForm("endpoints")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	after, _ := s.slaveService.GetSlave(id)
+	audit(c, "slave.setEndpoints", auditTarget("slave", id), before, after)
+	c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Slave endpoints updated"})
+}
+
+// revokeSlave revokes a slave's credential and disconnects it.
+// @Summary Revoke slave
+// @Description Invalidates the slave's credential and join token; the slave must be reinstalled with a new install command
+// @Tags Slaves
+// @Produce json
+// @Param id path int true "Slave ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/revoke/{id} [post]
+func (s *SlaveController) revokeSlave(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid slave ID"})
+		return
+	}
+	if err := s.slaveService.RevokeSlave(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Slave revoked"})
+}
+
+// rotateSecret issues a new signing credential to a connected slave.
+// @Summary Rotate slave credential
+// @Description Sends a new signing credential to the slave; the old one stays valid until the slave confirms
+// @Tags Slaves
+// @Produce json
+// @Param id path int true "Slave ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/rotateSecret/{id} [post]
+func (s *SlaveController) rotateSecret(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid slave ID"})
+		return
+	}
+	if err := s.slaveService.RotateSlaveSecret(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Credential rotation sent"})
+}
+
+// enrollSlave exchanges a one-time join token for a per-slave signing credential.
+// @Summary Enroll slave
+// @Description Called by a slave during installation; the join token is sent in the X-Slave-Join-Token header
+// @Tags Slaves
+// @Accept json
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/enroll [post]
+func (s *SlaveController) enrollSlave(c *gin.Context) {
+	var req struct {
+		HostId string `json:"hostId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid request data"})
+		return
+	}
+	enrollment, err := s.slaveService.EnrollSlave(c.GetHeader(slaveauth.JoinTokenHeader), req.HostId)
+	if err != nil {
+		logger.Warningf("Slave enrollment from %s rejected: %v", getRemoteIp(c), err)
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "Invalid or expired join token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "obj": enrollment})
+}
+
+// getConfigStatus returns the desired and applied config revision of every slave.
+// @Summary Get slave config status
+// @Description Returns each slave's pushed config revision, the revision it confirmed and the last Xray error
+// @Tags Slaves
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/configStatus [get]
+func (s *SlaveController) getConfigStatus(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	statuses, err := s.slaveService.GetConfigStatuses()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"success": true, "obj": gin.H{"command": command}})
+	c.JSON(http.StatusOK, gin.H{"success": true, "obj": visibleSlaves(c, statuses)})
+}
+
+// pushConfig re-sends the complete config to a slave.
+// @Summary Push slave config
+// @Description Sends the full Xray config to a slave as a new revision
+// @Tags Slaves
+// @Produce json
+// @Param id path int true "Slave ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/pushConfig/{id} [post]
+func (s *SlaveController) pushConfig(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": "Invalid slave ID"})
+		return
+	}
+	if err := s.slaveService.RetryConfig(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "msg": "Config pushed"})
+}
+
+// upgradeAgent replaces the agent of slaves with the master's version.
+// @Summary Upgrade slave agents
+// @Description Upgrades the given slaves one after another and waits for each to reconnect with the new version
+// @Tags Slaves
+// @Produce json
+// @Param slaveIds formData string true "Comma separated slave IDs, or all"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/slave/upgradeAgent [post]
+func (s *SlaveController) upgradeAgent(c *gin.Context) {
+	if !session.IsLogin(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	slaveIds, ok, err := getSlaveIdsParam(c, &s.slaveService)
+	if err == nil && !ok {
+		err = errors.New("no slaves selected")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	results, err := s.slaveService.RollUpgradeAgent(slaveIds)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"success": false, "msg": err.Error(), "obj": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "obj": results})
+}
+
+// downloadAgent serves the master's executable as the slave agent upgrade.
+// @Summary Download slave agent
+// @Description Called by a slave during an agent upgrade; authenticated like the WebSocket connection
+// @Tags Slaves
+// @Produce octet-stream
+// @Router /panel/api/slave/agent [get]
+func (s *SlaveController) downloadAgent(c *gin.Context) {
+	slave, err := s.slaveService.AuthenticateSlave(c.Request)
+	if err != nil {
+		logger.Warningf("Agent download from %s rejected: %v", getRemoteIp(c), err)
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "unauthorized"})
+		return
+	}
+	path, err := service.GetAgentBinaryPath()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	logger.Infof("Slave %d is downloading the agent", slave.Id)
+	c.FileAttachment(path, "x-ui")
 }
 
 var slaveUpgrader = websocket.Upgrader{
@@ -157,13 +420,31 @@ var slaveUpgrader = websocket.Upgrader{
 // @Summary Connect slave (WebSocket)
 // @Description WebSocket endpoint for slave-to-master communication
 // @Tags Slaves
-// @Param secret query string true "Slave secret key"
+// @Param X-Slave-Id header int true "Slave ID"
+// @Param X-Slave-Host header string true "Host identity the slave enrolled from"
+// @Param X-Slave-Timestamp header int true "Unix timestamp of the request"
+// @Param X-Slave-Nonce header string true "Random value used only once per request"
+// @Param X-Slave-Signature header string true "HMAC-SHA256 of id, host, timestamp, nonce, method and path with the slave credential"
 // @Router /panel/api/slave/connect [get]
 func (s *SlaveController) connectSlave(c *gin.Context) {
-    secret := c.Query("secret")
-    slave, err := s.slaveService.GetSlaveBySecret(secret)
+    slave, err := s.slaveService.AuthenticateSlave(c.Request)
     if err != nil {
-         c.JSON(http.StatusUnauthorized, gin.H{"success": false, "msg": "Invalid secret"})
+         logger.Warningf("Slave connection from %s rejected: %v", getRemoteIp(c), err)
+         // The slave drops its credential only on 401 and 403
+         status := http.StatusServiceUnavailable
+         switch {
+         case errors.Is(err, service.ErrSlaveUnauthorized):
+             status = http.StatusUnauthorized
+         case errors.Is(err, service.ErrSlaveRevoked):
+             status = http.StatusForbidden
+         case errors.Is(err, service.ErrSlaveHostMismatch):
+             status = http.StatusConflict
+         case errors.Is(err, service.ErrSlaveClockSkew):
+             status = http.StatusBadRequest
+         case errors.Is(err, service.ErrSlaveOutdated):
+             status = http.StatusUpgradeRequired
+         }
+         c.JSON(status, gin.H{"success": false, "msg": err.Error()})
          return
     }
     
@@ -173,6 +454,15 @@ func (s *SlaveController) connectSlave(c *gin.Context) {
     }
     
     s.slaveService.AddSlaveConn(slave.Id, ws)
+    stopMonitor := s.slaveService.MonitorSlaveConn(slave.Id, ws)
+    defer stopMonitor()
+    if err := s.slaveService.SetSlaveStatus(slave.Id, service.SlaveOnline); err != nil {
+        logger.Warningf("Failed to mark slave %d online: %v", slave.Id, err)
+    }
+
+    if err := s.slaveService.SendTrafficSeq(slave.Id); err != nil {
+        logger.Warningf("Failed to send traffic sequence to slave %d: %v", slave.Id, err)
+    }
     
     // Initial Config Push
     s.slaveService.PushConfig(slave.Id)
@@ -180,6 +470,8 @@ func (s *SlaveController) connectSlave(c *gin.Context) {
     for {
         _, msg, err := ws.ReadMessage()
         if err != nil {
+            // Also reached when no pong arrived within the read deadline
+            logger.Infof("Slave %d connection closed: %v", slave.Id, err)
             break
         }
         
@@ -190,20 +482,41 @@ func (s *SlaveController) connectSlave(c *gin.Context) {
             if msgType, ok := msgData["type"].(string); ok {
                 switch msgType {
                 case "traffic_stats":
-                    s.slaveService.ProcessTrafficStats(slave.Id, msgData)
+                    if err := s.slaveService.ProcessTrafficStats(slave.Id, msgData); err != nil {
+                        // Not acknowledged, the slave replays the report later
+                        logger.Warningf("Failed to apply traffic report from slave %d: %v", slave.Id, err)
+                    }
+                    continue
+                case "response":
+                    s.slaveService.ProcessSlaveResponse(slave.Id, msg)
+                    continue
+                case "client_ips":
+                    s.slaveService.ProcessClientIps(slave.Id, msgData)
                     continue
                 case "cert_report":
                     s.slaveService.ProcessCertReport(slave.Id, msgData)
                     continue
+                case "credential_rotated":
+                    if err := s.slaveService.ProcessCredentialRotated(slave.Id); err != nil {
+                        logger.Warningf("Failed to commit rotated credential for slave %d: %v", slave.Id, err)
+                    }
+                    continue
+                case "config_applied", "config_failed":
+                    if err := s.slaveService.ProcessConfigAck(slave.Id, msgData); err != nil {
+                        logger.Warningf("Failed to process config ack from slave %d: %v", slave.Id, err)
+                    }
+                    continue
                 }
             }
         }
         
         // Otherwise treat as system stats
-        s.slaveService.UpdateSlaveStatus(slave.Id, "online", string(msg))
-        logger.Debug("Received from slave %d: %s", slave.Id, string(msg))
+        s.slaveService.UpdateSlaveStats(slave.Id, string(msg))
+        logger.Debugf("Received from slave %d: %s", slave.Id, string(msg))
     }
     
-    s.slaveService.RemoveSlaveConn(slave.Id)
-    s.slaveService.UpdateSlaveStatus(slave.Id, "offline", "")
+    // Only the connection that is still registered may mark the slave offline
+    if s.slaveService.ReleaseSlaveConn(slave.Id, ws) {
+        s.slaveService.UpdateSlaveStatus(slave.Id, service.SlaveOffline, "")
+    }
 }
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// SubFetchController serves the logged fetches of subscription links.
+type SubFetchController struct {
+	BaseController
+
+	subFetchService service.SubFetchService
+}
+
+// NewSubFetchController creates a new subscription fetch controller instance.
+func NewSubFetchController(g *gin.RouterGroup) *SubFetchController {
+	a := &SubFetchController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *SubFetchController) initRouter(g *gin.RouterGroup) {
+	g.GET("/stats", a.getStats)
+	g.GET("/:subId", a.getSubFetches)
+}
+
+// getStats returns the fetch stats of all subscriptions.
+// @Summary Get subscription fetch stats
+// @Description Returns per subscription the number of fetches, unique IPs and countries and the last fetch, most recently fetched first.
+// @Tags Subscription Fetches
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/subFetch/stats [get]
+func (a *SubFetchController) getStats(c *gin.Context) {
+	stats, err := a.subFetchService.GetStats()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subFetch.toasts.get"), err)
+		return
+	}
+	jsonObj(c, stats, nil)
+}
+
+// getSubFetches returns the stats and the latest fetches of a subscription.
+// @Summary Get subscription fetches
+// @Description Returns the fetch stats and the 100 latest fetches (time, IP, country, User-Agent and format) of a client or account subscription.
+// @Tags Subscription Fetches
+// @Produce json
+// @Param subId path string true "Subscription ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/subFetch/{subId} [get]
+func (a *SubFetchController) getSubFetches(c *gin.Context) {
+	subId := c.Param("subId")
+	stats, err := a.subFetchService.GetStats(subId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subFetch.toasts.get"), err)
+		return
+	}
+	logs, err := a.subFetchService.GetLogs(subId, 100)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.subFetch.toasts.get"), err)
+		return
+	}
+	result := gin.H{"stats": nil, "logs": logs}
+	if len(stats) > 0 {
+		result["stats"] = stats[0]
+	}
+	jsonObj(c, result, nil)
+}
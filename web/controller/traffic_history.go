@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// TrafficHistoryController serves the traffic time series of clients,
+// accounts, inbounds and slaves.
+type TrafficHistoryController struct {
+	BaseController
+
+	trafficHistoryService service.TrafficHistoryService
+}
+
+// NewTrafficHistoryController creates a new traffic history controller instance.
+func NewTrafficHistoryController(g *gin.RouterGroup) *TrafficHistoryController {
+	a := &TrafficHistoryController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *TrafficHistoryController) initRouter(g *gin.RouterGroup) {
+	g.GET("/:scope/:target", a.getTrafficHistory)
+}
+
+// getTrafficHistory returns the traffic of one target per hour or day.
+// @Summary Get traffic history
+// @Description Returns the traffic of a client (by email), account, inbound or slave (by ID) per hour or day, oldest first. Buckets without traffic are left out.
+// @Tags Traffic History
+// @Produce json
+// @Param scope path string true "client, account, inbound or slave"
+// @Param target path string true "Client email or account, inbound or slave ID"
+// @Param period query string false "hour or day (default day)"
+// @Param from query int false "Earliest bucket start in ms"
+// @Param to query int false "Latest bucket start in ms"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/history/{scope}/{target} [get]
+func (a *TrafficHistoryController) getTrafficHistory(c *gin.Context) {
+	period := c.DefaultQuery("period", service.TrafficPeriodDay)
+	from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+	to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+	history, err := a.trafficHistoryService.GetTrafficHistory(c.Param("scope"), c.Param("target"), period, from, to)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.accounts.toasts.getUsage"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
+)
+
+// UserController handles HTTP requests for panel user management.
+type UserController struct {
+	BaseController
+
+	userService service.UserService
+}
+
+// NewUserController creates a new panel user controller instance.
+func NewUserController(g *gin.RouterGroup) *UserController {
+	a := &UserController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *UserController) initRouter(g *gin.RouterGroup) {
+	g.GET("/list", a.getUsers)
+	g.POST("/add", a.addUser)
+	g.POST("/update/:id", a.updateUser)
+	g.POST("/del/:id", a.delUser)
+	g.GET("/report", a.getResellerReports)
+}
+
+// getUsers retrieves all panel users.
+// @Summary List panel users
+// @Description Returns all panel users with their roles and slaves, without passwords
+// @Tags Users
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/users/list [get]
+func (a *UserController) getUsers(c *gin.Context) {
+	users, err := a.userService.GetUsers()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.getUsers"), err)
+		return
+	}
+	jsonObj(c, users, nil)
+}
+
+// getResellerReports reports on the pools and traffic of resellers.
+// @Summary Reseller report
+// @Description Returns the credit and account slots resellers have left and the traffic of their accounts; a reseller gets only its own report
+// @Tags Users
+// @Produce json
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/users/report [get]
+func (a *UserController) getResellerReports(c *gin.Context) {
+	reports, err := a.userService.GetResellerReports(session.GetLoginUser(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.getReport"), err)
+		return
+	}
+	jsonObj(c, reports, nil)
+}
+
+// addUser creates a panel user.
+// @Summary Add panel user
+// @Description Creates a panel user with a role; slaveIds limits non-admin roles to some slaves
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param user body model.User true "User with plain text password"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/users/add [post]
+func (a *UserController) addUser(c *gin.Context) {
+	user := &model.User{}
+	if err := c.ShouldBind(user); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.addUser"), err)
+		return
+	}
+	err := a.userService.AddUser(user)
+	user.Password = ""
+	audit(c, "user.add", auditTarget("user", user.Id), nil, user)
+	jsonMsgObj(c, I18nWeb(c, "pages.users.toasts.addUser"), user, err)
+}
+
+// updateUser changes a panel user.
+// @Summary Update panel user
+// @Description Changes the name, role and slaves of a panel user, and its password when one is given
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param user body model.User true "User, password empty to keep it"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/users/update/{id} [post]
+func (a *UserController) updateUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.updateUser"), err)
+		return
+	}
+	user := &model.User{}
+	if err := c.ShouldBind(user); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.updateUser"), err)
+		return
+	}
+	user.Id = id
+	before, _ := a.userService.GetUser(id)
+	if before != nil {
+		before.Password = ""
+	}
+	err = a.userService.UpdatePanelUser(user)
+	user.Password = ""
+	audit(c, "user.update", auditTarget("user", id), before, user)
+	jsonMsgObj(c, I18nWeb(c, "pages.users.toasts.updateUser"), user, err)
+}
+
+// delUser deletes a panel user.
+// @Summary Delete panel user
+// @Description Deletes a panel user; the last owner and the logged in user cannot be deleted
+// @Tags Users
+// @Produce json
+// @Param id path int true "User ID"
+// @Success 200 {object} entity.Msg
+// @Router /panel/api/users/del/{id} [post]
+func (a *UserController) delUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.delUser"), err)
+		return
+	}
+	if id == session.GetLoginUser(c).Id {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.delUser"), common.NewError("cannot delete the logged in user"))
+		return
+	}
+	before, _ := a.userService.GetUser(id)
+	if before != nil {
+		before.Password = ""
+	}
+	err = a.userService.DelUser(id)
+	audit(c, "user.del", auditTarget("user", id), before, nil)
+	jsonMsg(c, I18nWeb(c, "pages.users.toasts.delUser"), err)
+}
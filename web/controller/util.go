@@ -1,13 +1,17 @@
 package controller
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/mhsanaei/3x-ui/v2/config"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
 
 	"github.com/gin-gonic/gin"
 )
@@ -28,6 +32,29 @@ func getRemoteIp(c *gin.Context) string {
 	return ip
 }
 
+// getActor returns the username of the logged in panel user.
+func getActor(c *gin.Context) string {
+	if user := session.GetLoginUser(c); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+// rotateGrace reads the optional grace form value of a subscription
+// rotation in hours. It is -1 when absent, which picks the configured grace
+// period.
+func rotateGrace(c *gin.Context) (int, error) {
+	value := c.PostForm("grace")
+	if value == "" {
+		return -1, nil
+	}
+	grace, err := strconv.Atoi(value)
+	if err == nil && grace < 0 {
+		err = fmt.Errorf("grace period cannot be negative: %d", grace)
+	}
+	return grace, err
+}
+
 // jsonMsg sends a JSON response with a message and error status.
 func jsonMsg(c *gin.Context, msg string, err error) {
 	jsonMsgObj(c, msg, nil, err)
@@ -51,6 +78,7 @@ func jsonMsgObj(c *gin.Context, msg string, obj any, err error) {
 	} else {
 		m.Success = false
 		m.Msg = msg + " (" + err.Error() + ")"
+		c.Set(requestFailedKey, true)
 		logger.Warning(msg+" "+I18nWeb(c, "fail")+": ", err)
 	}
 	c.JSON(http.StatusOK, m)
@@ -84,6 +112,10 @@ func html(c *gin.Context, name string, title string, data gin.H) {
 	data["host"] = host
 	data["request_uri"] = c.Request.RequestURI
 	data["base_path"] = c.GetString("base_path")
+	data["role"] = ""
+	if user := session.GetLoginUser(c); user != nil {
+		data["role"] = user.Role
+	}
 	c.HTML(http.StatusOK, name, getContext(data))
 }
 
@@ -102,3 +134,25 @@ func getContext(h gin.H) gin.H {
 func isAjax(c *gin.Context) bool {
 	return c.GetHeader("X-Requested-With") == "XMLHttpRequest"
 }
+
+// getSlaveIdsParam parses the slaveIds form value of a rollout.
+// "all" selects every connected slave.
+func getSlaveIdsParam(c *gin.Context, slaveService *service.SlaveService) ([]int, bool, error) {
+	value := strings.TrimSpace(c.PostForm("slaveIds"))
+	if value == "" {
+		return nil, false, nil
+	}
+	if value == "all" {
+		slaveIds, err := slaveService.GetUpdatableSlaveIds()
+		return slaveIds, true, err
+	}
+	var slaveIds []int
+	for _, part := range strings.Split(value, ",") {
+		slaveId, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || slaveId <= 0 {
+			return nil, true, fmt.Errorf("invalid slave id %q", part)
+		}
+		slaveIds = append(slaveIds, slaveId)
+	}
+	return slaveIds, true, nil
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/util/common"
-	"github.com/mhsanaei/3x-ui/v2/web/session"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
 	"github.com/mhsanaei/3x-ui/v2/web/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -81,7 +81,8 @@ func NewWebSocketController(hub *websocket.Hub) *WebSocketController {
 // HandleWebSocket handles WebSocket connections
 func (w *WebSocketController) HandleWebSocket(c *gin.Context) {
 	// Check authentication
-	if !session.IsLogin(c) {
+	user := loadLoginUser(c)
+	if user == nil {
 		logger.Warningf("Unauthorized WebSocket connection attempt from %s", getRemoteIp(c))
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
@@ -101,6 +102,7 @@ func (w *WebSocketController) HandleWebSocket(c *gin.Context) {
 		Hub:    w.hub,
 		Send:   make(chan []byte, 512), // Increased from 256 to 512 to prevent overflow
 		Topics: make(map[websocket.MessageType]bool),
+		Scoped: service.IsScopedUser(user),
 	}
 
 	// Register client
@@ -126,7 +126,9 @@ func (a *XraySettingController) updateSetting(c *gin.Context) {
 		return
 	}
 	
+	before, _ := a.SlaveSettingService.GetXrayConfigForSlave(slaveId)
 	err := a.SlaveSettingService.SaveXrayConfigForSlave(slaveId, xraySetting)
+	audit(c, "xray.update", auditTarget("slave", slaveId), before, xraySetting)
 	if err == nil {
 		go func() {
 			slaveService := service.SlaveService{}
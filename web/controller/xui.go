@@ -30,6 +30,8 @@ func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	g.GET("/slaves", a.slaves)
 	g.GET("/settings", a.settings)
 	g.GET("/xray", a.xraySettings)
+	g.GET("/users", a.users)
+	g.GET("/audit", a.audit)
 }
 
 // index renders the main panel index page.
@@ -61,3 +63,13 @@ func (a *XUIController) settings(c *gin.Context) {
 func (a *XUIController) xraySettings(c *gin.Context) {
 	html(c, "xray.html", "pages.xray.title", nil)
 }
+
+// users renders the panel users page.
+func (a *XUIController) users(c *gin.Context) {
+	html(c, "users.html", "pages.users.title", nil)
+}
+
+// audit renders the audit log page.
+func (a *XUIController) audit(c *gin.Context) {
+	html(c, "audit.html", "pages.audit.title", nil)
+}
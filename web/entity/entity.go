@@ -80,6 +80,25 @@ type AllSetting struct {
 	SubJsonNoises               string `json:"subJsonNoises" form:"subJsonNoises"`                             // JSON subscription noise configuration
 	SubJsonMux                  string `json:"subJsonMux" form:"subJsonMux"`                                   // JSON subscription mux configuration
 	SubJsonRules                string `json:"subJsonRules" form:"subJsonRules"`
+	SubClashEnable              bool   `json:"subClashEnable" form:"subClashEnable"`           // Enable Clash (mihomo) subscription endpoint
+	SubSingboxEnable            bool   `json:"subSingboxEnable" form:"subSingboxEnable"`       // Enable sing-box subscription endpoint
+	SubRuleSets                 string `json:"subRuleSets" form:"subRuleSets"`                 // geosite/geoip rule sets routed in Clash and sing-box configs
+	SubUserAgentFormats         string `json:"subUserAgentFormats" form:"subUserAgentFormats"` // User-Agent pattern=format table picking the subscription format
+	SubFetchLogDays             int    `json:"subFetchLogDays" form:"subFetchLogDays"`         // Days subscription fetches are kept, 0 = forever
+	SubLeakIpLimit              int    `json:"subLeakIpLimit" form:"subLeakIpLimit"`           // Distinct IPs per subscription within the leak window before alerting, 0 = off
+	SubLeakCountryLimit         int    `json:"subLeakCountryLimit" form:"subLeakCountryLimit"` // Distinct countries per subscription within the leak window before alerting, 0 = off
+	SubLeakWindow               int    `json:"subLeakWindow" form:"subLeakWindow"`             // Leak detection window in minutes
+	SubRotateGrace              int    `json:"subRotateGrace" form:"subRotateGrace"`           // Hours a rotated subscription ID keeps working, 0 = revoked at once
+	SubRotateAnnounce           string `json:"subRotateAnnounce" form:"subRotateAnnounce"`     // Announce served on a rotated subscription ID, {expiry} = end of the grace period
+
+	// Cluster settings
+	SlaveAgentUrl    string `json:"slaveAgentUrl" form:"slaveAgentUrl"`       // Agent upgrade artifact URL, empty to serve the master's own binary
+	SlaveAgentSha256 string `json:"slaveAgentSha256" form:"slaveAgentSha256"` // Expected SHA-256 of the artifact at SlaveAgentUrl
+	SlaveAutoUpgrade bool   `json:"slaveAutoUpgrade" form:"slaveAutoUpgrade"` // Upgrade slaves whose agent version differs from the master
+
+	// Traffic history retention in days, 0 = forever
+	TrafficHistoryHourDays int `json:"trafficHistoryHourDays" form:"trafficHistoryHourDays"`
+	TrafficHistoryDayDays  int `json:"trafficHistoryDayDays" form:"trafficHistoryDayDays"`
 
 	// LDAP settings
 	LdapEnable     bool   `json:"ldapEnable" form:"ldapEnable"`
@@ -130,6 +149,22 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("Sub port is not a valid port:", s.SubPort)
 	}
 
+	if s.TrafficHistoryHourDays < 0 || s.TrafficHistoryDayDays < 0 {
+		return common.NewError("traffic history retention cannot be negative")
+	}
+
+	if s.SubFetchLogDays < 0 || s.SubLeakIpLimit < 0 || s.SubLeakCountryLimit < 0 {
+		return common.NewError("subscription fetch retention and leak limits cannot be negative")
+	}
+
+	if s.SubLeakWindow <= 0 {
+		return common.NewError("subscription leak window must be positive:", s.SubLeakWindow)
+	}
+
+	if s.SubRotateGrace < 0 {
+		return common.NewError("subscription rotation grace period cannot be negative:", s.SubRotateGrace)
+	}
+
 	if (s.SubPort == s.WebPort) && (s.WebListen == s.SubListen) {
 		return common.NewError("Sub and Web could not use same ip:port, ", s.SubListen, ":", s.SubPort, " & ", s.WebListen, ":", s.WebPort)
 	}
@@ -173,5 +208,10 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("time location not exist:", s.TimeLocation)
 	}
 
+	// Slaves refuse an artifact they cannot verify
+	if s.SlaveAgentUrl != "" && len(s.SlaveAgentSha256) != 64 {
+		return common.NewError("slave agent sha256 is required for a custom agent url")
+	}
+
 	return nil
 }
@@ -0,0 +1,33 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// AccountTrafficResetJob resets account traffic on each account's own reset
+// period, counted from its creation or last reset.
+type AccountTrafficResetJob struct {
+	accountService service.AccountService
+	slaveService   service.SlaveService
+}
+
+// NewAccountTrafficResetJob creates a new account traffic reset job instance.
+func NewAccountTrafficResetJob() *AccountTrafficResetJob {
+	return &AccountTrafficResetJob{}
+}
+
+// Run resets every account that is due and pushes configs to the slaves of
+// accounts whose clients were enabled again.
+func (j *AccountTrafficResetJob) Run() {
+	slaveIds, err := j.accountService.ResetDueAccounts()
+	if err != nil {
+		logger.Warning("AccountTrafficResetJob - Failed to reset accounts:", err)
+		return
+	}
+	for _, slaveId := range slaveIds {
+		if err := j.slaveService.PushConfig(slaveId); err != nil {
+			logger.Errorf("AccountTrafficResetJob - Failed to push config to slave %d: %v", slaveId, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// CheckSlaveConfigJob re-sends configs that slaves never acknowledged.
+type CheckSlaveConfigJob struct {
+	slaveService service.SlaveService
+}
+
+// NewCheckSlaveConfigJob creates a new slave config retry job instance.
+func NewCheckSlaveConfigJob() *CheckSlaveConfigJob {
+	return &CheckSlaveConfigJob{}
+}
+
+// Run retries every connected slave whose latest config revision is
+// still unconfirmed after a minute.
+func (j *CheckSlaveConfigJob) Run() {
+	j.slaveService.RetryUnappliedConfigs(time.Minute)
+}
@@ -21,6 +21,7 @@ type LdapSyncJob struct {
 	settingService service.SettingService
 	inboundService service.InboundService
 	xrayService    service.XrayService
+	auditService   service.AuditService
 }
 
 // --- Helper functions for mustGet ---
@@ -146,6 +147,7 @@ func (j *LdapSyncJob) Run() {
 			logger.Warningf("Failed to add clients for tag %s: %v", tag, err)
 		} else {
 			logger.Infof("LDAP auto-create: %d clients for %s", len(newClients), tag)
+			j.audit("client.add", payload.Id, newClients)
 			j.xrayService.SetToNeedRestart()
 		}
 	}
@@ -171,6 +173,16 @@ func (j *LdapSyncJob) Run() {
 	}
 }
 
+// audit records a change the sync made to the clients of an inbound.
+func (j *LdapSyncJob) audit(action string, inboundId int, clients any) {
+	j.auditService.Log(&model.AuditLog{
+		Actor:  "ldap-sync",
+		Source: service.AuditSourceLDAP,
+		Action: action,
+		Target: "inbound:" + strconv.Itoa(inboundId),
+	}, nil, clients)
+}
+
 func splitCsv(s string) []string {
 	if s == "" {
 		return DefaultTruthyValues
@@ -233,6 +245,7 @@ func (j *LdapSyncJob) batchSetEnable(ib *model.Inbound, emails []string, enable
 	}
 
 	logger.Infof("Batch set enable=%v for %d clients in inbound %s", enable, len(emails), ib.Tag)
+	j.audit("client.update", ib.Id, clients)
 	j.xrayService.SetToNeedRestart()
 }
 
@@ -294,6 +307,7 @@ func (j *LdapSyncJob) deleteClientsNotInLDAP(inboundTag string, ldapEmails map[s
 				} else {
 					logger.Infof("Deleted client %s from inbound id=%d(tag=%s)",
 						c.Email, ib.Id, ib.Tag)
+					j.audit("client.del", ib.Id, c.Email)
 					// do not restart here
 					restartNeeded = true
 				}
@@ -1,6 +1,8 @@
 package job
 
 import (
+	"strconv"
+
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
 )
@@ -11,6 +13,7 @@ type Period string
 // PeriodicTrafficResetJob resets traffic statistics for inbounds based on their configured reset period.
 type PeriodicTrafficResetJob struct {
 	inboundService service.InboundService
+	auditService   service.AuditService
 	period         Period
 }
 
@@ -44,6 +47,8 @@ func (j *PeriodicTrafficResetJob) Run() {
 			continue
 		}
 		resetCount++
+		j.auditService.LogJob("traffic-reset", "inbound.resetTraffic", "inbound:"+strconv.Itoa(inbound.Id),
+			map[string]string{"period": string(j.period)})
 	}
 
 	if resetCount > 0 {
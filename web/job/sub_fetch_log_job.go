@@ -0,0 +1,23 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// SubFetchLogJob drops subscription fetches past their configured retention.
+type SubFetchLogJob struct {
+	subFetchService service.SubFetchService
+}
+
+// NewSubFetchLogJob creates a new subscription fetch log cleanup job instance.
+func NewSubFetchLogJob() *SubFetchLogJob {
+	return &SubFetchLogJob{}
+}
+
+// Run deletes expired subscription fetches.
+func (j *SubFetchLogJob) Run() {
+	if err := j.subFetchService.DeleteExpiredLogs(); err != nil {
+		logger.Warning("SubFetchLogJob - Failed to delete expired fetches:", err)
+	}
+}
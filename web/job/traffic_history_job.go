@@ -0,0 +1,23 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// TrafficHistoryJob drops traffic history past its configured retention.
+type TrafficHistoryJob struct {
+	trafficHistoryService service.TrafficHistoryService
+}
+
+// NewTrafficHistoryJob creates a new traffic history cleanup job instance.
+func NewTrafficHistoryJob() *TrafficHistoryJob {
+	return &TrafficHistoryJob{}
+}
+
+// Run deletes expired hourly and daily traffic history.
+func (j *TrafficHistoryJob) Run() {
+	if err := j.trafficHistoryService.DeleteExpiredTrafficHistory(); err != nil {
+		logger.Warning("TrafficHistoryJob - Failed to delete expired history:", err)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database"
@@ -19,6 +20,12 @@ type AccountService struct {
 	inboundService InboundService
 }
 
+// Reasons stored in model.Account.DisabledReason when a job disables an account
+const (
+	AccountDisabledQuota   = "quota"
+	AccountDisabledExpired = "expired"
+)
+
 // GetAccounts retrieves all accounts from the database with their client count.
 func (s *AccountService) GetAccounts() ([]*model.Account, error) {
 	db := database.GetDB()
@@ -101,12 +108,30 @@ func (s *AccountService) AddAccount(account *model.Account) error {
 		account.SubId = random.Seq(16)
 	}
 
+	// Credentials change through RotateAccountCredentials only
+	generateAccountCredentials(account)
+
 	// Set timestamps
 	now := time.Now().UnixMilli()
 	account.CreatedAt = now
 	account.UpdatedAt = now
 
-	return db.Create(account).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Accounts of resellers take a slot and their quota from its pool
+		reseller, err := resellerOwner(tx, account.UserId)
+		if err != nil {
+			return err
+		}
+		if reseller != nil {
+			if err := takeAccountSlot(tx, reseller); err != nil {
+				return err
+			}
+			if err := chargeResellerNew(tx, reseller, account.TotalGB); err != nil {
+				return err
+			}
+		}
+		return tx.Create(account).Error
+	})
 }
 
 // UpdateAccount updates an existing account.
@@ -144,10 +169,30 @@ func (s *AccountService) UpdateAccount(account *model.Account) error {
 	// Update timestamp
 	account.UpdatedAt = time.Now().UnixMilli()
 
-	// Preserve CreatedAt
+	// Preserve CreatedAt, the reset anchor, the creating panel user and the plan, which changes through SetAccountPlan
 	account.CreatedAt = oldAccount.CreatedAt
+	account.PlanId = oldAccount.PlanId
+	account.UserId = oldAccount.UserId
+	account.LastResetTime = oldAccount.LastResetTime
+	account.DisabledReason = oldAccount.DisabledReason
+	account.UUID = oldAccount.UUID
+	account.Password = oldAccount.Password
+	account.SSKey = oldAccount.SSKey
+	if account.Enable {
+		account.DisabledReason = ""
+	}
 
 	return db.Transaction(func(tx *gorm.DB) error {
+		// Quota added to a reseller's account comes from its pool
+		reseller, err := resellerOwner(tx, account.UserId)
+		if err != nil {
+			return err
+		}
+		if reseller != nil {
+			if err := chargeResellerChange(tx, reseller, oldAccount.TotalGB, account.TotalGB); err != nil {
+				return err
+			}
+		}
 		if err := tx.Save(account).Error; err != nil {
 			return err
 		}
@@ -183,9 +228,20 @@ func (s *AccountService) UpdateAccount(account *model.Account) error {
 }
 
 // DelAccount deletes an account and its associated client relationships.
+// Clients provisioned from the account's plan are removed from their inbounds.
 func (s *AccountService) DelAccount(id int) error {
 	db := database.GetDB()
 
+	var provisioned []model.AccountClient
+	if err := db.Where("account_id = ? AND provisioned = ?", id, true).Find(&provisioned).Error; err != nil {
+		return err
+	}
+	for _, assoc := range provisioned {
+		if _, err := s.inboundService.DelInboundClientByEmail(assoc.InboundId, assoc.ClientEmail); err != nil {
+			logger.Warningf("Failed to remove provisioned client %s of account %d: %v", assoc.ClientEmail, id, err)
+		}
+	}
+
 	return db.Transaction(func(tx *gorm.DB) error {
 		// Delete account-client associations
 		if err := tx.Where("account_id = ?", id).Delete(&model.AccountClient{}).Error; err != nil {
@@ -294,9 +350,18 @@ func (s *AccountService) GetAccountAffectedSlaves(accountId int) ([]int, error)
 
 // AddClientToAccount associates a client with an account.
 // This creates the client in the inbound if it doesn't exist, or links an existing client.
+// The client takes over the account's credentials.
 func (s *AccountService) AddClientToAccount(accountId, inboundId int, client *model.Client) error {
 	db := database.GetDB()
 
+	account, err := s.GetAccount(accountId)
+	if err != nil {
+		return err
+	}
+	if err := ensureAccountCredentials(account); err != nil {
+		return err
+	}
+
 	return db.Transaction(func(tx *gorm.DB) error {
 		// Check if client email already associated with another account
 		existingAssoc := &model.AccountClient{}
@@ -356,13 +421,21 @@ func (s *AccountService) AddClientToAccount(accountId, inboundId int, client *mo
 				Total:      0,
 				ExpiryTime: 0,
 			}
-			return tx.Create(traffic).Error
+			if err := tx.Create(traffic).Error; err != nil {
+				return err
+			}
 		} else if err != nil {
 			return err
+		} else {
+			// Update existing traffic record with account association
+			if err := tx.Model(traffic).Update("account_id", accountId).Error; err != nil {
+				return err
+			}
 		}
 
-		// Update existing traffic record with account association
-		return tx.Model(traffic).Update("account_id", accountId).Error
+		// Replace the client's own credentials with the account's
+		_, err = s.applyAccountCredentials(tx, inbound, []string{client.Email}, account)
+		return err
 	})
 }
 
@@ -447,29 +520,43 @@ func (s *AccountService) CheckAccountExpiry(accountId int) (expired bool, err er
 // It also re-enables the account and all its associated clients.
 // Returns a list of affected slave IDs that need config update.
 func (s *AccountService) ResetAccountTraffic(accountId int) ([]int, error) {
+	return s.resetAccountTraffic(accountId, time.Now().UnixMilli(), true)
+}
+
+// resetAccountTraffic zeroes the traffic of an account and its clients and
+// moves its reset anchor to resetTime. With reenable the account and its
+// clients are enabled again.
+func (s *AccountService) resetAccountTraffic(accountId int, resetTime int64, reenable bool) ([]int, error) {
 	db := database.GetDB()
 	var affectedSlaves []int
 
 	err := db.Transaction(func(tx *gorm.DB) error {
-		// Reset account traffic and re-enable the account
-		if err := tx.Model(&model.Account{}).Where("id = ?", accountId).Updates(map[string]interface{}{
-			"up":     0,
-			"down":   0,
-			"enable": true,
-		}).Error; err != nil {
+		accountUpdates := map[string]interface{}{
+			"up":              0,
+			"down":            0,
+			"last_reset_time": resetTime,
+		}
+		clientUpdates := map[string]interface{}{
+			"up":   0,
+			"down": 0,
+		}
+		if reenable {
+			accountUpdates["enable"] = true
+			accountUpdates["disabled_reason"] = ""
+			clientUpdates["enable"] = true
+		}
+
+		// Reset account traffic
+		if err := tx.Model(&model.Account{}).Where("id = ?", accountId).Updates(accountUpdates).Error; err != nil {
 			return err
 		}
 
-		// Reset client traffics and re-enable all associated clients
-		if err := tx.Model(&xray.ClientTraffic{}).Where("account_id = ?", accountId).Updates(map[string]interface{}{
-			"up":     0,
-			"down":   0,
-			"enable": true,
-		}).Error; err != nil {
+		// Reset client traffics
+		if err := tx.Model(&xray.ClientTraffic{}).Where("account_id = ?", accountId).Updates(clientUpdates).Error; err != nil {
 			return err
 		}
 
-		logger.Infof("Reset traffic and re-enabled account %d and all associated clients", accountId)
+		logger.Infof("Reset traffic of account %d and its clients (re-enabled: %v)", accountId, reenable)
 		return nil
 	})
 
@@ -482,6 +569,69 @@ func (s *AccountService) ResetAccountTraffic(accountId int) ([]int, error) {
 	return affectedSlaves, err
 }
 
+// dueAccountReset returns the latest reset boundary of a rolling reset period
+// that has passed. Boundaries fall every periodDays after anchor, so resets
+// stay on the account's own schedule even when a run was missed.
+func dueAccountReset(anchor int64, periodDays int, now int64) (int64, bool) {
+	if periodDays <= 0 || anchor <= 0 {
+		return 0, false
+	}
+	period := int64(periodDays) * 24 * int64(time.Hour/time.Millisecond)
+	if now < anchor+period {
+		return 0, false
+	}
+	return anchor + (now-anchor)/period*period, true
+}
+
+// ResetDueAccounts resets every account whose reset period has passed since
+// its creation or last reset. Clients disabled only because the quota was used
+// up are enabled again; accounts that expired or were disabled by hand stay
+// disabled. Returns the slaves whose config changed.
+func (s *AccountService) ResetDueAccounts() ([]int, error) {
+	db := database.GetDB()
+	var accounts []model.Account
+	if err := db.Where("reset > 0").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	affectedSlaveIds := make(map[int]bool)
+	for _, account := range accounts {
+		anchor := account.LastResetTime
+		if anchor <= 0 {
+			anchor = account.CreatedAt
+		}
+		resetTime, due := dueAccountReset(anchor, account.Reset, now)
+		if !due {
+			continue
+		}
+
+		expired := account.ExpiryTime > 0 && account.ExpiryTime <= now
+		reenable := !account.Enable && account.DisabledReason == AccountDisabledQuota && !expired
+		slaveIds, err := s.resetAccountTraffic(account.Id, resetTime, reenable)
+		if err != nil {
+			logger.Warningf("Failed to reset traffic of account %s: %v", account.Username, err)
+			continue
+		}
+		logger.Infof("Periodic traffic reset of account %s (every %d days)", account.Username, account.Reset)
+		auditService := AuditService{}
+		auditService.LogJob("account-reset", "account.resetTraffic", "account:"+strconv.Itoa(account.Id),
+			map[string]bool{"enable": account.Enable || reenable})
+		// Only re-enabled clients change the slave configs
+		if reenable {
+			for _, slaveId := range slaveIds {
+				affectedSlaveIds[slaveId] = true
+			}
+		}
+	}
+
+	slaveIdList := make([]int, 0, len(affectedSlaveIds))
+	for slaveId := range affectedSlaveIds {
+		slaveIdList = append(slaveIdList, slaveId)
+	}
+	return slaveIdList, nil
+}
+
 // SyncAccountTraffic synchronizes account traffic from its associated client traffics.
 // This should be called periodically or after traffic updates.
 func (s *AccountService) SyncAccountTraffic(accountId int) error {
@@ -568,7 +718,10 @@ func (s *AccountService) DisableClientsExceedingAccountLimit() ([]int, error) {
 		// Check if limit exceeded
 		if totalUsed >= totalLimit {
 			// Disable the account itself
-			err = db.Model(&model.Account{}).Where("id = ?", account.Id).Update("enable", false).Error
+			err = db.Model(&model.Account{}).Where("id = ?", account.Id).Updates(map[string]interface{}{
+				"enable":          false,
+				"disabled_reason": AccountDisabledQuota,
+			}).Error
 			if err != nil {
 				logger.Warningf("Failed to disable account %s: %v", account.Username, err)
 				continue
@@ -594,6 +747,9 @@ func (s *AccountService) DisableClientsExceedingAccountLimit() ([]int, error) {
 
 			logger.Infof("Disabled account %s and its clients - traffic limit exceeded (used: %d bytes, limit: %d bytes)",
 				account.Username, totalUsed, totalLimit)
+			auditService := AuditService{}
+			auditService.LogJob("account-limit", "account.disable", "account:"+strconv.Itoa(account.Id),
+				map[string]string{"disabledReason": AccountDisabledQuota})
 		}
 	}
 
@@ -624,7 +780,10 @@ func (s *AccountService) DisableExpiredAccountClients() ([]int, error) {
 
 	for _, account := range expiredAccounts {
 		// Disable the account itself
-		err = db.Model(&model.Account{}).Where("id = ?", account.Id).Update("enable", false).Error
+		err = db.Model(&model.Account{}).Where("id = ?", account.Id).Updates(map[string]interface{}{
+			"enable":          false,
+			"disabled_reason": AccountDisabledExpired,
+		}).Error
 		if err != nil {
 			logger.Warningf("Failed to disable expired account %s: %v", account.Username, err)
 			continue
@@ -650,6 +809,9 @@ func (s *AccountService) DisableExpiredAccountClients() ([]int, error) {
 		}
 
 		logger.Infof("Disabled account %s and its clients - account expired", account.Username)
+		auditService := AuditService{}
+		auditService.LogJob("account-limit", "account.disable", "account:"+strconv.Itoa(account.Id),
+			map[string]string{"disabledReason": AccountDisabledExpired})
 	}
 
 	// Convert map to slice
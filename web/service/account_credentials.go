@@ -0,0 +1,175 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+
+	"gorm.io/gorm"
+)
+
+// generateAccountCredentials gives an account a new random credential set.
+func generateAccountCredentials(account *model.Account) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	account.UUID = uuid.NewString()
+	account.Password = random.Seq(16)
+	account.SSKey = base64.StdEncoding.EncodeToString(key)
+}
+
+// ensureAccountCredentials gives an account created before accounts owned
+// their credentials a credential set. It is derived from the subscription ID
+// the same way provisioned clients used to be, so existing clients keep
+// matching the account.
+func ensureAccountCredentials(account *model.Account) error {
+	if account.UUID != "" && account.Password != "" && account.SSKey != "" {
+		return nil
+	}
+	derived := uuid.NewSHA1(uuid.NameSpaceOID, []byte(account.SubId)).String()
+	key := sha256.Sum256([]byte("shadowsocks:" + account.SubId))
+	account.UUID = derived
+	account.Password = derived
+	account.SSKey = base64.StdEncoding.EncodeToString(key[:])
+
+	db := database.GetDB()
+	return db.Model(&model.Account{}).Where("id = ?", account.Id).Updates(map[string]any{
+		"uuid":     account.UUID,
+		"password": account.Password,
+		"ss_key":   account.SSKey,
+	}).Error
+}
+
+// accountShadowsocksPassword returns the client password of an account on a
+// shadowsocks inbound. Shadowsocks 2022 ciphers take the account key cut to
+// the cipher's key length, other ciphers the account password.
+func accountShadowsocksPassword(account *model.Account, inbound *model.Inbound) string {
+	var settings struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+	if !strings.HasPrefix(settings.Method, "2022-") {
+		return account.Password
+	}
+	if !strings.Contains(settings.Method, "aes-128") {
+		return account.SSKey
+	}
+	key, err := base64.StdEncoding.DecodeString(account.SSKey)
+	if err != nil || len(key) < 16 {
+		return account.SSKey
+	}
+	return base64.StdEncoding.EncodeToString(key[:16])
+}
+
+// setClientCredentials projects the account's credentials into a client
+// entry of an inbound's settings.
+func setClientCredentials(client map[string]any, account *model.Account, inbound *model.Inbound) {
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS:
+		client["id"] = account.UUID
+	case model.Trojan:
+		client["password"] = account.Password
+	case model.Shadowsocks:
+		client["password"] = accountShadowsocksPassword(account, inbound)
+	}
+}
+
+// applyAccountCredentials projects the account's credentials into the given
+// clients of an inbound. Reports whether the inbound changed.
+func (s *AccountService) applyAccountCredentials(tx *gorm.DB, inbound *model.Inbound, emails []string, account *model.Account) (bool, error) {
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return false, err
+	}
+	clients, _ := settings["clients"].([]any)
+	changed := false
+	now := time.Now().UnixMilli()
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := client["email"].(string)
+		if !s.inboundService.contains(emails, email) {
+			continue
+		}
+		before, _ := json.Marshal(client)
+		setClientCredentials(client, account, inbound)
+		if after, _ := json.Marshal(client); string(after) != string(before) {
+			client["updated_at"] = now
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	inbound.Settings = string(newSettings)
+	return true, tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", inbound.Settings).Error
+}
+
+// RotateAccountCredentials gives an account a new credential set and projects
+// it into every client of the account, so a leaked UUID or password stops
+// working everywhere at once. Returns the slaves whose config changed.
+func (s *AccountService) RotateAccountCredentials(accountId int) ([]int, error) {
+	account, err := s.GetAccount(accountId)
+	if err != nil {
+		return nil, err
+	}
+	generateAccountCredentials(account)
+
+	db := database.GetDB()
+	var links []model.AccountClient
+	if err := db.Where("account_id = ?", accountId).Find(&links).Error; err != nil {
+		return nil, err
+	}
+	emailsByInbound := make(map[int][]string)
+	for _, link := range links {
+		emailsByInbound[link.InboundId] = append(emailsByInbound[link.InboundId], link.ClientEmail)
+	}
+
+	affectedSlaveIds := make(map[int]bool)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.Account{}).Where("id = ?", accountId).Updates(map[string]any{
+			"uuid":       account.UUID,
+			"password":   account.Password,
+			"ss_key":     account.SSKey,
+			"updated_at": time.Now().UnixMilli(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		for inboundId, emails := range emailsByInbound {
+			inbound := &model.Inbound{}
+			if err := tx.Where("id = ?", inboundId).First(inbound).Error; err != nil {
+				return err
+			}
+			changed, err := s.applyAccountCredentials(tx, inbound, emails, account)
+			if err != nil {
+				return err
+			}
+			if changed {
+				affectedSlaveIds[inbound.SlaveId] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Rotated credentials of account %s on %d inbounds", account.Username, len(emailsByInbound))
+	delete(affectedSlaveIds, 0)
+	return mapKeys(affectedSlaveIds), nil
+}
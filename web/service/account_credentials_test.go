@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestAccountShadowsocksPassword(t *testing.T) {
+	tests := []struct {
+		method  string
+		keySize int // 0 for a plain password
+	}{
+		{"aes-256-gcm", 0},
+		{"chacha20-ietf-poly1305", 0},
+		{"2022-blake3-aes-128-gcm", 16},
+		{"2022-blake3-aes-256-gcm", 32},
+		{"2022-blake3-chacha20-poly1305", 32},
+	}
+
+	account := &model.Account{}
+	generateAccountCredentials(account)
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			inbound := &model.Inbound{Protocol: model.Shadowsocks, Settings: `{"method":"` + tt.method + `","clients":[]}`}
+			password := accountShadowsocksPassword(account, inbound)
+			if password == "" {
+				t.Fatal("empty password")
+			}
+			if again := accountShadowsocksPassword(account, inbound); again != password {
+				t.Errorf("password not stable: %q then %q", password, again)
+			}
+			if tt.keySize == 0 {
+				if password != account.Password {
+					t.Errorf("password = %q, want the account password", password)
+				}
+				return
+			}
+			key, err := base64.StdEncoding.DecodeString(password)
+			if err != nil {
+				t.Fatalf("password %q is not base64: %v", password, err)
+			}
+			if len(key) != tt.keySize {
+				t.Errorf("key has %d bytes, want %d", len(key), tt.keySize)
+			}
+		})
+	}
+}
+
+func TestSetClientCredentials(t *testing.T) {
+	account := &model.Account{}
+	generateAccountCredentials(account)
+
+	tests := []struct {
+		inbound *model.Inbound
+		field   string
+		want    string
+	}{
+		{&model.Inbound{Protocol: model.VLESS}, "id", account.UUID},
+		{&model.Inbound{Protocol: model.VMESS}, "id", account.UUID},
+		{&model.Inbound{Protocol: model.Trojan}, "password", account.Password},
+		{&model.Inbound{Protocol: model.Shadowsocks, Settings: `{"method":"2022-blake3-aes-256-gcm"}`}, "password", account.SSKey},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.inbound.Protocol), func(t *testing.T) {
+			client := map[string]any{"email": "alice-1", "id": "old", "password": "old"}
+			setClientCredentials(client, account, tt.inbound)
+			if client[tt.field] != tt.want {
+				t.Errorf("%s = %v, want %q", tt.field, client[tt.field], tt.want)
+			}
+		})
+	}
+}
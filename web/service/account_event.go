@@ -0,0 +1,185 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+// Account event types stored in model.AccountEvent.Type
+const (
+	AccountEventRenew  = "renew"
+	AccountEventExtend = "extend"
+	AccountEventTopup  = "topup"
+)
+
+// accountTerms is the part of an account recorded in the event ledger.
+type accountTerms struct {
+	TotalGB    int64 `json:"totalGB"`
+	ExpiryTime int64 `json:"expiryTime"`
+	Reset      int   `json:"reset"`
+	Enable     bool  `json:"enable"`
+	Used       int64 `json:"used"` // Traffic used in bytes
+}
+
+// ExtendAccount moves the expiry of an account days further. An expired
+// account is extended from now. Returns the slaves whose config changed.
+func (s *AccountService) ExtendAccount(id, days int, actor, reason string) ([]int, error) {
+	if days <= 0 {
+		return nil, common.NewError("days must be positive")
+	}
+	account, err := s.GetAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	if account.ExpiryTime <= 0 {
+		return nil, common.NewError("account never expires:", account.Username)
+	}
+	return s.changeAccountTerms(account, AccountEventExtend, actor, reason, false, func(a *model.Account) {
+		from := time.UnixMilli(a.ExpiryTime)
+		if now := time.Now(); from.Before(now) {
+			from = now
+		}
+		a.ExpiryTime = from.AddDate(0, 0, days).UnixMilli()
+	})
+}
+
+// TopupAccount adds gb to the traffic quota of an account. Returns the
+// slaves whose config changed.
+func (s *AccountService) TopupAccount(id int, gb int64, actor, reason string) ([]int, error) {
+	if gb <= 0 {
+		return nil, common.NewError("traffic must be positive")
+	}
+	account, err := s.GetAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	if account.TotalGB <= 0 {
+		return nil, common.NewError("account has unlimited traffic:", account.Username)
+	}
+	return s.changeAccountTerms(account, AccountEventTopup, actor, reason, false, func(a *model.Account) {
+		a.TotalGB += gb
+	})
+}
+
+// canReenableAccount reports whether an account the jobs disabled is within
+// its quota and expiry again. Accounts disabled by hand are never enabled.
+func canReenableAccount(account *model.Account, used int64, now int64) bool {
+	if account.Enable {
+		return false
+	}
+	if account.DisabledReason != AccountDisabledQuota && account.DisabledReason != AccountDisabledExpired {
+		return false
+	}
+	if account.ExpiryTime > 0 && account.ExpiryTime <= now {
+		return false
+	}
+	return account.TotalGB <= 0 || used < account.TotalGB*1024*1024*1024
+}
+
+// GetAccountEvents returns the ledger of an account, newest first.
+func (s *AccountService) GetAccountEvents(accountId int) ([]*model.AccountEvent, error) {
+	db := database.GetDB()
+	var events []*model.AccountEvent
+	err := db.Where("account_id = ?", accountId).Order("id desc").Find(&events).Error
+	return events, err
+}
+
+// changeAccountTerms applies change to an account and records it in the
+// ledger. With resetTraffic the account's traffic starts over. An account the
+// jobs disabled for its quota or expiry is enabled again once the new terms
+// allow it; accounts disabled by hand stay disabled. Returns the slaves whose
+// config changed.
+func (s *AccountService) changeAccountTerms(account *model.Account, eventType, actor, reason string, resetTraffic bool, change func(*model.Account)) ([]int, error) {
+	used := account.Up + account.Down
+	oldTerms := accountTerms{account.TotalGB, account.ExpiryTime, account.Reset, account.Enable, used}
+
+	change(account)
+	now := time.Now()
+	if resetTraffic {
+		used = 0
+	}
+	reenable := canReenableAccount(account, used, now.UnixMilli())
+	if reenable {
+		account.Enable = true
+		account.DisabledReason = ""
+	}
+	newTerms := accountTerms{account.TotalGB, account.ExpiryTime, account.Reset, account.Enable, used}
+
+	oldValue, err := json.Marshal(oldTerms)
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := json.Marshal(newTerms)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Quota added to a reseller's account comes from its pool
+		reseller, err := resellerOwner(tx, account.UserId)
+		if err != nil {
+			return err
+		}
+		if reseller != nil {
+			if err := chargeResellerChange(tx, reseller, oldTerms.TotalGB, account.TotalGB); err != nil {
+				return err
+			}
+		}
+		accountUpdates := map[string]any{
+			"total_gb":        account.TotalGB,
+			"expiry_time":     account.ExpiryTime,
+			"reset":           account.Reset,
+			"enable":          account.Enable,
+			"disabled_reason": account.DisabledReason,
+			"updated_at":      now.UnixMilli(),
+		}
+		clientUpdates := map[string]any{}
+		if resetTraffic {
+			accountUpdates["up"] = 0
+			accountUpdates["down"] = 0
+			accountUpdates["last_reset_time"] = now.UnixMilli()
+			clientUpdates["up"] = 0
+			clientUpdates["down"] = 0
+		}
+		if reenable {
+			clientUpdates["enable"] = true
+		}
+		if err := tx.Model(&model.Account{}).Where("id = ?", account.Id).Updates(accountUpdates).Error; err != nil {
+			return err
+		}
+		if len(clientUpdates) > 0 {
+			if err := tx.Model(&xray.ClientTraffic{}).Where("account_id = ?", account.Id).Updates(clientUpdates).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&model.AccountEvent{
+			AccountId: account.Id,
+			Username:  account.Username,
+			Type:      eventType,
+			Actor:     actor,
+			Reason:    reason,
+			OldValue:  string(oldValue),
+			NewValue:  string(newValue),
+			CreatedAt: now.UnixMilli(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Account %s: %s by %s (re-enabled: %v)", account.Username, eventType, actor, reenable)
+
+	// Only re-enabled clients change the slave configs
+	if !reenable {
+		return []int{}, nil
+	}
+	return s.GetAccountAffectedSlaves(account.Id)
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// accountIpWindow is how long a source IP counts as a device of an account
+// after it was last seen on one of the account's clients.
+const accountIpWindow = 5 * time.Minute
+
+// accountIpNotifyInterval bounds how often a user is told about the same
+// exceeded account IP limit.
+const accountIpNotifyInterval = time.Hour
+
+// accountIpSeen is a source IP of an account with the client it was last
+// seen on.
+type accountIpSeen struct {
+	email    string
+	lastSeen int64
+}
+
+// Source IPs of accounts with an IP limit, merged across all their clients
+// and slaves.
+var (
+	accountIpsLock    sync.Mutex
+	accountIps        = make(map[int]map[string]accountIpSeen) // accountId -> ip -> last seen
+	accountIpNotified = make(map[int]int64)                     // accountId -> last notification
+)
+
+// AccountIpViolation is an account connected from more source IPs than its
+// LimitIP allows.
+type AccountIpViolation struct {
+	Account *model.Account
+	Count   int                 // Unique source IPs within accountIpWindow
+	Blocked map[string][]string // Client email -> oldest IPs over the limit
+	Notify  bool                // Whether to tell the user, at most once per accountIpNotifyInterval
+}
+
+// TrackAccountIps merges the client IPs reported by slaves into the IPs of
+// their accounts and returns the accounts over their IP limit. The IPs to
+// block are the least recently seen ones, so the newest devices keep working.
+func (s *AccountService) TrackAccountIps(reports map[string]map[string]int64) ([]*AccountIpViolation, error) {
+	db := database.GetDB()
+	var links []struct {
+		ClientEmail string
+		AccountId   int
+	}
+	if len(reports) > 0 {
+		emails := make([]string, 0, len(reports))
+		for email := range reports {
+			emails = append(emails, email)
+		}
+		err := db.Model(&model.AccountClient{}).
+			Select("account_clients.client_email, account_clients.account_id").
+			Joins("JOIN accounts ON accounts.id = account_clients.account_id").
+			Where("accounts.limit_ip > 0 AND account_clients.client_email IN ?", emails).
+			Scan(&links).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	accountIpsLock.Lock()
+	defer accountIpsLock.Unlock()
+
+	for _, link := range links {
+		if accountIps[link.AccountId] == nil {
+			accountIps[link.AccountId] = make(map[string]accountIpSeen)
+		}
+		for ip, lastSeen := range reports[link.ClientEmail] {
+			if seen, ok := accountIps[link.AccountId][ip]; !ok || lastSeen > seen.lastSeen {
+				accountIps[link.AccountId][ip] = accountIpSeen{email: link.ClientEmail, lastSeen: lastSeen}
+			}
+		}
+	}
+
+	now := time.Now()
+	accountIds := make([]int, 0, len(accountIps))
+	for accountId, ips := range accountIps {
+		for ip, seen := range ips {
+			if seen.lastSeen < now.Add(-accountIpWindow).Unix() {
+				delete(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			delete(accountIps, accountId)
+			continue
+		}
+		accountIds = append(accountIds, accountId)
+	}
+	if len(accountIds) == 0 {
+		return nil, nil
+	}
+
+	var accounts []*model.Account
+	if err := db.Where("id IN ? AND limit_ip > 0", accountIds).Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	limited := make(map[int]bool)
+	violations := make([]*AccountIpViolation, 0)
+	for _, account := range accounts {
+		limited[account.Id] = true
+		ips := accountIps[account.Id]
+		if len(ips) <= account.LimitIP {
+			continue
+		}
+		violation := &AccountIpViolation{
+			Account: account,
+			Count:   len(ips),
+			Blocked: excessAccountIps(ips, account.LimitIP),
+		}
+		// Blocked IPs no longer count once their block is in place
+		for _, blocked := range violation.Blocked {
+			for _, ip := range blocked {
+				delete(ips, ip)
+			}
+		}
+		if account.TgId > 0 && now.Unix()-accountIpNotified[account.Id] >= int64(accountIpNotifyInterval.Seconds()) {
+			accountIpNotified[account.Id] = now.Unix()
+			violation.Notify = true
+		}
+		violations = append(violations, violation)
+	}
+	// Forget accounts whose limit was lifted
+	for _, accountId := range accountIds {
+		if !limited[accountId] {
+			delete(accountIps, accountId)
+		}
+	}
+	return violations, nil
+}
+
+// excessAccountIps returns the IPs of an account beyond the limit newest
+// ones, grouped by the client they were seen on.
+func excessAccountIps(ips map[string]accountIpSeen, limit int) map[string][]string {
+	sorted := make([]string, 0, len(ips))
+	for ip := range ips {
+		sorted = append(sorted, ip)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if ips[sorted[i]].lastSeen != ips[sorted[j]].lastSeen {
+			return ips[sorted[i]].lastSeen > ips[sorted[j]].lastSeen // Newest first
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	excess := make(map[string][]string)
+	if len(sorted) <= limit {
+		return excess
+	}
+	for _, ip := range sorted[limit:] {
+		email := ips[ip].email
+		excess[email] = append(excess[email], ip)
+	}
+	return excess
+}
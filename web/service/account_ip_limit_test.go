@@ -0,0 +1,24 @@
+package service
+
+import "testing"
+
+func TestExcessAccountIps(t *testing.T) {
+	ips := map[string]accountIpSeen{
+		"10.0.0.1": {email: "alice-1", lastSeen: 100},
+		"10.0.0.2": {email: "alice-2", lastSeen: 300},
+		"10.0.0.3": {email: "alice-1", lastSeen: 200},
+		"10.0.0.4": {email: "alice-2", lastSeen: 50},
+	}
+
+	excess := excessAccountIps(ips, 2)
+	if len(excess["alice-1"]) != 1 || excess["alice-1"][0] != "10.0.0.1" {
+		t.Errorf("alice-1 blocked %q, want [10.0.0.1]", excess["alice-1"])
+	}
+	if len(excess["alice-2"]) != 1 || excess["alice-2"][0] != "10.0.0.4" {
+		t.Errorf("alice-2 blocked %q, want [10.0.0.4]", excess["alice-2"])
+	}
+
+	if excess := excessAccountIps(ips, 4); len(excess) != 0 {
+		t.Errorf("under the limit blocked %v, want none", excess)
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestDueAccountReset(t *testing.T) {
+	const day = int64(24 * 60 * 60 * 1000)
+	const anchor = int64(1_700_000_000_000)
+
+	tests := []struct {
+		name      string
+		anchor    int64
+		period    int
+		now       int64
+		wantDue   bool
+		wantReset int64
+	}{
+		{name: "no period", anchor: anchor, period: 0, now: anchor + 100*day},
+		{name: "no anchor", anchor: 0, period: 30, now: anchor},
+		{name: "before the first boundary", anchor: anchor, period: 30, now: anchor + 30*day - 1},
+		{name: "on the boundary", anchor: anchor, period: 30, now: anchor + 30*day, wantDue: true, wantReset: anchor + 30*day},
+		{name: "stays on the anchor schedule", anchor: anchor, period: 30, now: anchor + 30*day + 5*60*1000, wantDue: true, wantReset: anchor + 30*day},
+		{name: "missed periods collapse into the latest", anchor: anchor, period: 7, now: anchor + 23*day, wantDue: true, wantReset: anchor + 21*day},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset, due := dueAccountReset(tt.anchor, tt.period, tt.now)
+			if due != tt.wantDue || reset != tt.wantReset {
+				t.Errorf("dueAccountReset() = %d, %v, want %d, %v", reset, due, tt.wantReset, tt.wantDue)
+			}
+		})
+	}
+}
+
+func TestCanReenableAccount(t *testing.T) {
+	const gb = int64(1024 * 1024 * 1024)
+	const now = int64(1_700_000_000_000)
+
+	tests := []struct {
+		name    string
+		account model.Account
+		used    int64
+		want    bool
+	}{
+		{name: "enabled", account: model.Account{Enable: true, TotalGB: 10}, used: 20 * gb},
+		{name: "disabled by hand", account: model.Account{TotalGB: 10}, used: 0},
+		{name: "quota raised above usage", account: model.Account{TotalGB: 20, DisabledReason: AccountDisabledQuota}, used: 15 * gb, want: true},
+		{name: "quota still used up", account: model.Account{TotalGB: 20, DisabledReason: AccountDisabledQuota}, used: 20 * gb},
+		{name: "quota fine but expired", account: model.Account{TotalGB: 20, ExpiryTime: now, DisabledReason: AccountDisabledQuota}, used: 0},
+		{name: "expiry extended", account: model.Account{ExpiryTime: now + 1, DisabledReason: AccountDisabledExpired}, used: 50 * gb, want: true},
+		{name: "extended but over quota", account: model.Account{TotalGB: 10, ExpiryTime: now + 1, DisabledReason: AccountDisabledExpired}, used: 10 * gb},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canReenableAccount(&tt.account, tt.used, now); got != tt.want {
+				t.Errorf("canReenableAccount = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm"
+)
+
+// Sources of model.AuditLog entries
+const (
+	AuditSourcePanel = "panel" // Panel pages
+	AuditSourceAPI   = "api"   // API calls from outside the panel pages
+	AuditSourceTgbot = "tgbot" // Telegram bot commands
+	AuditSourceLDAP  = "ldap"  // LDAP sync
+	AuditSourceJob   = "job"   // Jobs and changes the panel makes on its own
+)
+
+// auditSecretKeys are redacted from audit diffs when a field name contains them.
+var auditSecretKeys = []string{"password", "secret", "token", "privatekey", "sskey"}
+
+// AuditService records who changed what. Entries are append-only: the
+// database refuses to change or delete them.
+type AuditService struct{}
+
+// AuditFilter selects audit log entries. Empty fields match everything;
+// Action matches by prefix, so "inbound." selects all inbound changes.
+type AuditFilter struct {
+	Actor  string
+	Source string
+	Action string
+	Target string
+	From   int64 // ms
+	To     int64 // ms
+}
+
+// Log records a change. before and after are the changed object before and
+// after the change, nil for creations and deletions. Failing to record is
+// logged but does not fail the change itself.
+func (s *AuditService) Log(entry *model.AuditLog, before, after any) {
+	diff, err := auditDiff(before, after)
+	if err != nil {
+		logger.Warning("Failed to diff audit log entry", entry.Action, entry.Target, err)
+	}
+	entry.Id = 0
+	entry.CreatedAt = time.Now().UnixMilli()
+	entry.Diff = diff
+	if err := database.GetDB().Create(entry).Error; err != nil {
+		logger.Warning("Failed to write audit log entry", entry.Action, entry.Target, err)
+	}
+}
+
+// LogJob records a change a job made on its own. actor names the job.
+func (s *AuditService) LogJob(actor, action, target string, after any) {
+	s.Log(&model.AuditLog{
+		Actor:  actor,
+		Source: AuditSourceJob,
+		Action: action,
+		Target: target,
+	}, nil, after)
+}
+
+// GetAuditLogs returns a page of matching entries, newest first, and the
+// number of all matching entries.
+func (s *AuditService) GetAuditLogs(filter AuditFilter, page, pageSize int) ([]*model.AuditLog, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 500 {
+		pageSize = 50
+	}
+	query := s.query(filter)
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var logs []*model.AuditLog
+	err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&logs).Error
+	return logs, total, err
+}
+
+// ExportAuditLogs writes the matching entries to w as JSON lines, oldest first.
+func (s *AuditService) ExportAuditLogs(filter AuditFilter, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	var logs []*model.AuditLog
+	return s.query(filter).Order("id").FindInBatches(&logs, 500, func(tx *gorm.DB, batch int) error {
+		for _, entry := range logs {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func (s *AuditService) query(filter AuditFilter) *gorm.DB {
+	query := database.GetDB().Model(&model.AuditLog{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Source != "" {
+		query = query.Where("source = ?", filter.Source)
+	}
+	if filter.Action != "" {
+		query = query.Where("action LIKE ?", filter.Action+"%")
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	if filter.From > 0 {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if filter.To > 0 {
+		query = query.Where("created_at <= ?", filter.To)
+	}
+	return query
+}
+
+// auditDiff returns the fields that differ between before and after as
+// {"field":{"old":...,"new":...}}. Fields holding JSON text, like inbound
+// settings, are compared field by field too. Secrets are redacted.
+func auditDiff(before, after any) (string, error) {
+	oldValue, err := auditValue(before)
+	if err != nil {
+		return "", err
+	}
+	newValue, err := auditValue(after)
+	if err != nil {
+		return "", err
+	}
+	diff := diffValues(oldValue, newValue)
+	if diff == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(diff)
+	return string(data), err
+}
+
+// auditValue converts v to plain JSON values, decoding JSON text in strings.
+func auditValue(v any) (any, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return decodeJSONText(value), nil
+}
+
+func decodeJSONText(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			v[key] = decodeJSONText(field)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = decodeJSONText(item)
+		}
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			var decoded any
+			if json.Unmarshal([]byte(trimmed), &decoded) == nil {
+				return decodeJSONText(decoded)
+			}
+		}
+	}
+	return value
+}
+
+// diffValues returns nil when before and after are equal. Objects are
+// diffed per field; anything else, like lists of clients, is replaced as a
+// whole with the secrets in it redacted.
+func diffValues(before, after any) any {
+	beforeMap, beforeIsMap := before.(map[string]any)
+	afterMap, afterIsMap := after.(map[string]any)
+	if beforeIsMap && afterIsMap || beforeIsMap && after == nil || before == nil && afterIsMap {
+		diff := map[string]any{}
+		for key, value := range beforeMap {
+			if change := diffField(key, value, afterMap[key]); change != nil {
+				diff[key] = change
+			}
+		}
+		for key, value := range afterMap {
+			if _, ok := beforeMap[key]; ok {
+				continue
+			}
+			if change := diffField(key, nil, value); change != nil {
+				diff[key] = change
+			}
+		}
+		if len(diff) == 0 {
+			return nil
+		}
+		return diff
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	return map[string]any{"old": redactSecrets(before), "new": redactSecrets(after)}
+}
+
+func diffField(key string, before, after any) any {
+	if isAuditSecret(key) {
+		if reflect.DeepEqual(before, after) {
+			return nil
+		}
+		return map[string]any{"old": redact(before), "new": redact(after)}
+	}
+	return diffValues(before, after)
+}
+
+func isAuditSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range auditSecretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecrets redacts the secret fields of all objects in value.
+func redactSecrets(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for key, field := range v {
+			if isAuditSecret(key) {
+				redacted[key] = redact(field)
+			} else {
+				redacted[key] = redactSecrets(field)
+			}
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = redactSecrets(item)
+		}
+		return redacted
+	}
+	return value
+}
+
+func redact(value any) any {
+	if value == nil || value == "" {
+		return value
+	}
+	return "***"
+}
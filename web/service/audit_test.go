@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before := &model.Inbound{
+		Id:       1,
+		Remark:   "old",
+		Port:     443,
+		Settings: `{"clients":[{"email":"a","password":"p1"}]}`,
+	}
+	after := &model.Inbound{
+		Id:       1,
+		Remark:   "new",
+		Port:     443,
+		Settings: `{"clients":[{"email":"a","password":"p2"}]}`,
+	}
+	tests := []struct {
+		name   string
+		before any
+		after  any
+		want   string
+	}{
+		{"unchanged", before, before, ""},
+		{"nothing", nil, nil, ""},
+		{"created", nil, map[string]int{"id": 1}, `{"id":{"new":1,"old":null}}`},
+		{"deleted", map[string]int{"id": 1}, nil, `{"id":{"new":null,"old":1}}`},
+		{"value", "a", "b", `{"new":"b","old":"a"}`},
+		{"json text and secrets", before, after,
+			`{"remark":{"new":"new","old":"old"},"settings":{"clients":{"new":[{"email":"a","password":"***"}],"old":[{"email":"a","password":"***"}]}}}`},
+		{"redacted", map[string]string{"tgBotToken": "a"}, map[string]string{"tgBotToken": "b"},
+			`{"tgBotToken":{"new":"***","old":"***"}}`},
+		{"secret unchanged", map[string]string{"password": "a"}, map[string]string{"password": "a"}, ""},
+	}
+	for _, tt := range tests {
+		got, err := auditDiff(tt.before, tt.after)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: auditDiff() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// countryRange is an address range of a country in geoip.dat.
+type countryRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+var geoipCountries struct {
+	once   sync.Once
+	ranges []countryRange // Sorted by start
+}
+
+// LookupCountry returns the ISO country code of an IP from Xray's
+// geoip.dat, or an empty string when it is unknown. The file is read on the
+// first lookup.
+func LookupCountry(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	geoipCountries.once.Do(func() {
+		geoipCountries.ranges = loadCountryRanges(xray.GetGeoipPath())
+	})
+	return findCountry(geoipCountries.ranges, addr.Unmap())
+}
+
+// loadCountryRanges reads the country entries of a geoip.dat file. Lists
+// that are not countries, like private or cloudflare, are skipped.
+func loadCountryRanges(path string) []countryRange {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warning("Country lookup is unavailable:", err)
+		return nil
+	}
+	var list router.GeoIPList
+	if err := proto.Unmarshal(data, &list); err != nil {
+		logger.Warning("Failed to parse", path, err)
+		return nil
+	}
+	var ranges []countryRange
+	for _, entry := range list.Entry {
+		if len(entry.CountryCode) != 2 || entry.ReverseMatch {
+			continue
+		}
+		country := strings.ToUpper(entry.CountryCode)
+		for _, cidr := range entry.Cidr {
+			addr, ok := netip.AddrFromSlice(cidr.Ip)
+			if !ok {
+				continue
+			}
+			prefix, err := addr.Unmap().Prefix(int(cidr.Prefix))
+			if err != nil {
+				continue
+			}
+			ranges = append(ranges, countryRange{start: prefix.Addr(), end: lastAddr(prefix), country: country})
+		}
+	}
+	slices.SortFunc(ranges, func(a, b countryRange) int {
+		return a.start.Compare(b.start)
+	})
+	return ranges
+}
+
+// findCountry returns the country of the range holding addr.
+func findCountry(ranges []countryRange, addr netip.Addr) string {
+	i, _ := slices.BinarySearchFunc(ranges, addr, func(r countryRange, addr netip.Addr) int {
+		return r.start.Compare(addr)
+	})
+	// ranges[i] is the first range starting after addr, or at it
+	if i < len(ranges) && ranges[i].start == addr {
+		return ranges[i].country
+	}
+	if i > 0 && addr.Compare(ranges[i-1].end) <= 0 {
+		return ranges[i-1].country
+	}
+	return ""
+}
+
+// lastAddr returns the last address of a prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr()
+	bytes := addr.AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return last
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFindCountry(t *testing.T) {
+	var ranges []countryRange
+	for _, r := range []struct{ prefix, country string }{
+		{"1.0.0.0/24", "AU"},
+		{"1.0.1.0/24", "CN"},
+		{"5.0.0.0/8", "DE"},
+		{"2001:db8::/32", "NL"},
+	} {
+		prefix := netip.MustParsePrefix(r.prefix)
+		ranges = append(ranges, countryRange{start: prefix.Addr(), end: lastAddr(prefix), country: r.country})
+	}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.0.0", "AU"},
+		{"1.0.0.255", "AU"},
+		{"1.0.1.7", "CN"},
+		{"1.0.2.0", ""},
+		{"5.255.255.255", "DE"},
+		{"0.0.0.1", ""},
+		{"2001:db8:ffff::1", "NL"},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		if got := findCountry(ranges, netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("findCountry(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
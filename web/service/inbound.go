@@ -26,12 +26,13 @@ type InboundService struct {
 	xrayApi xray.XrayAPI
 }
 
-// GetInbounds retrieves all inbounds for a specific user.
-// Returns a slice of inbound models with their associated client statistics.
-func (s *InboundService) GetInbounds(userId int) ([]*model.Inbound, error) {
+// GetInbounds retrieves the inbounds a panel user may see, or all inbounds
+// when user is nil. Returns a slice of inbound models with their associated
+// client statistics.
+func (s *InboundService) GetInbounds(user *model.User) ([]*model.Inbound, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
-	err := db.Model(model.Inbound{}).Preload("ClientStats").Where("user_id = ?", userId).Find(&inbounds).Error
+	err := scopeInbounds(db.Model(model.Inbound{}).Preload("ClientStats"), user).Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
@@ -308,6 +309,18 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 		}
 	}()
 
+	// Clients of a reseller's inbound take their quota from its pool
+	var reseller *model.User
+	reseller, err = resellerOwner(tx, inbound.UserId)
+	if err != nil {
+		return inbound, false, err
+	}
+	if reseller != nil {
+		if err = chargeResellerClients(tx, reseller, nil, clients); err != nil {
+			return inbound, false, err
+		}
+	}
+
 	err = tx.Save(inbound).Error
 	if err == nil {
 		if len(inbound.ClientStats) == 0 {
@@ -554,11 +567,13 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	oldInbound.TrafficReset = inbound.TrafficReset
 	oldInbound.SlaveId = inbound.SlaveId
 	oldInbound.Listen = inbound.Listen
+	oldInbound.Address = inbound.Address
 	oldInbound.Port = inbound.Port
 	oldInbound.Protocol = inbound.Protocol
 	oldInbound.Settings = inbound.Settings
 	oldInbound.StreamSettings = inbound.StreamSettings
 	oldInbound.Sniffing = inbound.Sniffing
+	oldInbound.AutoEnroll = inbound.AutoEnroll
 	
 	// Generate tag with format inbound-<SlaveName>-<Protocol>-<Port>
 	slaveName := "master"
@@ -635,6 +650,11 @@ func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inb
 			if err != nil {
 				return err
 			}
+			// Drop the account link of the removed client
+			err = tx.Where("client_email = ?", oldClient.Email).Delete(&model.AccountClient{}).Error
+			if err != nil {
+				return err
+			}
 		}
 	}
 	for _, newClient := range newClients {
@@ -652,10 +672,26 @@ func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inb
 			}
 		}
 	}
+
+	// Clients added or raised in a reseller's inbound take quota from its pool
+	reseller, err := resellerOwner(tx, oldInbound.UserId)
+	if err != nil {
+		return err
+	}
+	if reseller != nil {
+		return chargeResellerClients(tx, reseller, oldClients, newClients)
+	}
 	return nil
 }
 
 func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
+	return s.addInboundClient(data, true)
+}
+
+// addInboundClient adds clients to an inbound. With chargeReseller, the quota
+// of the clients is taken from the pool of the reseller owning the inbound;
+// clients created for accounts are charged with the account instead.
+func (s *InboundService) addInboundClient(data *model.Inbound, chargeReseller bool) (bool, error) {
 	logger.Infof("Adding clients to inbound: id=%d, tag=%s", data.Id, data.Tag)
 	clients, err := s.GetClients(data)
 	if err != nil {
@@ -743,6 +779,24 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		}
 	}()
 
+	if chargeReseller {
+		var reseller *model.User
+		reseller, err = resellerOwner(tx, oldInbound.UserId)
+		if err != nil {
+			return false, err
+		}
+		if reseller != nil {
+			for _, client := range clients {
+				if err = checkResellerReset(0, client.Reset); err != nil {
+					return false, err
+				}
+				if err = chargeResellerNew(tx, reseller, clientGB(client.TotalGB)); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+
 	needRestart := false
 	if p != nil {
 		s.xrayApi.Init(p.GetAPIPort())
@@ -908,6 +962,8 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	}
 
 	oldEmail := ""
+	oldTotalGB := int64(0)
+	oldReset := 0
 	newClientId := ""
 	clientIndex := -1
 	for index, oldClient := range oldClients {
@@ -925,6 +981,8 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 		}
 		if clientId == oldClientId {
 			oldEmail = oldClient.Email
+			oldTotalGB = oldClient.TotalGB
+			oldReset = oldClient.Reset
 			clientIndex = index
 			break
 		}
@@ -990,6 +1048,22 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 		}
 	}()
 
+	// Quota added to a client of a reseller's inbound comes from its pool
+	var reseller *model.User
+	reseller, err = resellerOwner(tx, oldInbound.UserId)
+	if err != nil {
+		return false, err
+	}
+	if reseller != nil {
+		if err = checkResellerReset(oldReset, clients[0].Reset); err != nil {
+			return false, err
+		}
+		err = chargeResellerChange(tx, reseller, clientGB(oldTotalGB), clientGB(clients[0].TotalGB))
+		if err != nil {
+			return false, err
+		}
+	}
+
 	if len(clients[0].Email) > 0 {
 		if len(oldEmail) > 0 {
 			err = s.UpdateClientStat(tx, oldEmail, &clients[0])
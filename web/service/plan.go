@@ -0,0 +1,590 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+// PlanService manages account plans. Accounts on a plan get a client on
+// every inbound the plan targets; clients created this way are tracked as
+// provisioned and are removed again when the plan no longer covers them.
+type PlanService struct {
+	inboundService InboundService
+	accountService AccountService
+}
+
+// provisionProtocols are the protocols with per-client credentials that
+// accounts can be provisioned on.
+var provisionProtocols = []model.Protocol{model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks}
+
+// GetPlans returns all plans.
+func (s *PlanService) GetPlans() ([]*model.Plan, error) {
+	db := database.GetDB()
+	var plans []*model.Plan
+	err := db.Model(model.Plan{}).Order("id").Find(&plans).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// GetPlan returns a single plan by ID.
+func (s *PlanService) GetPlan(id int) (*model.Plan, error) {
+	db := database.GetDB()
+	plan := &model.Plan{}
+	if err := db.Model(model.Plan{}).Where("id = ?", id).First(plan).Error; err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// AddPlan creates a new plan.
+func (s *PlanService) AddPlan(plan *model.Plan) error {
+	if err := s.checkPlan(plan); err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	plan.CreatedAt = now
+	plan.UpdatedAt = now
+	return database.GetDB().Create(plan).Error
+}
+
+// UpdatePlan saves a plan and propagates its quota, reset period, IP limit
+// and inbound set to every account on it. Expiry dates are kept, a changed
+// duration applies from the next renewal. Returns the slaves whose config
+// changed.
+func (s *PlanService) UpdatePlan(plan *model.Plan) ([]int, error) {
+	oldPlan, err := s.GetPlan(plan.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkPlan(plan); err != nil {
+		return nil, err
+	}
+	plan.CreatedAt = oldPlan.CreatedAt
+	plan.UpdatedAt = time.Now().UnixMilli()
+
+	db := database.GetDB()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(plan).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Account{}).Where("plan_id = ?", plan.Id).Updates(map[string]any{
+			"total_gb":   plan.TotalGB,
+			"reset":      plan.Reset,
+			"updated_at": plan.UpdatedAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Plan %s updated, propagating to its accounts", plan.Name)
+	return s.provisionAccounts(db.Model(&model.Account{}).Where("plan_id = ?", plan.Id))
+}
+
+// ProvisionAllAccounts reconciles the clients of every account on a plan,
+// e.g. after slaves changed group. Returns the slaves whose config changed.
+func (s *PlanService) ProvisionAllAccounts() ([]int, error) {
+	db := database.GetDB()
+	return s.provisionAccounts(db.Model(&model.Account{}).Where("plan_id > 0"))
+}
+
+func (s *PlanService) provisionAccounts(query *gorm.DB) ([]int, error) {
+	var accountIds []int
+	if err := query.Pluck("id", &accountIds).Error; err != nil {
+		return nil, err
+	}
+	affectedSlaveIds := make(map[int]bool)
+	for _, accountId := range accountIds {
+		slaveIds, err := s.ProvisionAccount(accountId)
+		if err != nil {
+			logger.Warningf("Failed to provision account %d from its plan: %v", accountId, err)
+			continue
+		}
+		for _, slaveId := range slaveIds {
+			affectedSlaveIds[slaveId] = true
+		}
+	}
+	return mapKeys(affectedSlaveIds), nil
+}
+
+// DelPlan deletes a plan. Its accounts keep their limits and clients, which
+// are then managed by hand.
+func (s *PlanService) DelPlan(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		var accountIds []int
+		if err := tx.Model(&model.Account{}).Where("plan_id = ?", id).Pluck("id", &accountIds).Error; err != nil {
+			return err
+		}
+		if err := s.detachAccounts(tx, accountIds); err != nil {
+			return err
+		}
+		return tx.Delete(&model.Plan{}, id).Error
+	})
+}
+
+func (s *PlanService) checkPlan(plan *model.Plan) error {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" {
+		return common.NewError("plan name is required")
+	}
+	if plan.TotalGB < 0 || plan.Duration < 0 || plan.Reset < 0 || plan.LimitIP < 0 {
+		return common.NewError("plan limits cannot be negative")
+	}
+	plan.InboundTags = strings.Join(splitList(plan.InboundTags), ",")
+	plan.SlaveGroups = strings.Join(splitList(plan.SlaveGroups), ",")
+
+	var count int64
+	err := database.GetDB().Model(&model.Plan{}).Where("name = ? AND id != ?", plan.Name, plan.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("Plan name already exists:", plan.Name)
+	}
+	return nil
+}
+
+// detachAccounts takes accounts off their plan. Their provisioned clients
+// become regular clients that are no longer removed automatically.
+func (s *PlanService) detachAccounts(tx *gorm.DB, accountIds []int) error {
+	if len(accountIds) == 0 {
+		return nil
+	}
+	if err := tx.Model(&model.Account{}).Where("id IN ?", accountIds).Update("plan_id", 0).Error; err != nil {
+		return err
+	}
+	return tx.Model(&model.AccountClient{}).Where("account_id IN ?", accountIds).Update("provisioned", false).Error
+}
+
+// GetPlanInbounds returns the inbounds a plan provisions: those listed by tag
+// and those on a slave of one of its groups. Only protocols with per-client
+// credentials are included.
+func (s *PlanService) GetPlanInbounds(plan *model.Plan) ([]*model.Inbound, error) {
+	tags := splitList(plan.InboundTags)
+	groups := splitList(plan.SlaveGroups)
+	if len(tags) == 0 && len(groups) == 0 {
+		return []*model.Inbound{}, nil
+	}
+
+	db := database.GetDB()
+	query := db.Model(&model.Inbound{}).Where("protocol IN ?", provisionProtocols)
+	switch {
+	case len(tags) > 0 && len(groups) > 0:
+		query = query.Where("tag IN ? OR slave_id IN (?)", tags, db.Model(&model.Slave{}).Select("id").Where("\"group\" IN ?", groups))
+	case len(tags) > 0:
+		query = query.Where("tag IN ?", tags)
+	default:
+		query = query.Where("slave_id IN (?)", db.Model(&model.Slave{}).Select("id").Where("\"group\" IN ?", groups))
+	}
+	var inbounds []*model.Inbound
+	if err := query.Order("id").Find(&inbounds).Error; err != nil {
+		return nil, err
+	}
+	return inbounds, nil
+}
+
+// ApplyPlanDefaults copies a plan's quota, expiry and reset period onto an
+// account. The expiry counts from now.
+func ApplyPlanDefaults(account *model.Account, plan *model.Plan) {
+	account.PlanId = plan.Id
+	account.TotalGB = plan.TotalGB
+	account.Reset = plan.Reset
+	account.ExpiryTime = 0
+	if plan.Duration > 0 {
+		account.ExpiryTime = time.Now().AddDate(0, 0, plan.Duration).UnixMilli()
+	}
+}
+
+// AddPlanAccount creates an account from a plan and provisions its clients.
+// Returns the slaves whose config changed.
+func (s *PlanService) AddPlanAccount(account *model.Account) ([]int, error) {
+	plan, err := s.GetPlan(account.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	ApplyPlanDefaults(account, plan)
+	if err := s.accountService.AddAccount(account); err != nil {
+		return nil, err
+	}
+	return s.ProvisionAccount(account.Id)
+}
+
+// SetAccountPlan moves an account to another plan, resetting its quota,
+// expiry and reset period to the plan's defaults and provisioning the plan's
+// inbounds. Plan 0 takes the account off its plan and keeps its clients.
+// Returns the slaves whose config changed.
+func (s *PlanService) SetAccountPlan(accountId, planId int) ([]int, error) {
+	account, err := s.accountService.GetAccount(accountId)
+	if err != nil {
+		return nil, err
+	}
+	db := database.GetDB()
+	if planId == 0 {
+		return []int{}, s.detachAccounts(db, []int{accountId})
+	}
+
+	plan, err := s.GetPlan(planId)
+	if err != nil {
+		return nil, err
+	}
+	ApplyPlanDefaults(account, plan)
+	err = db.Model(&model.Account{}).Where("id = ?", accountId).Updates(map[string]any{
+		"plan_id":     account.PlanId,
+		"total_gb":    account.TotalGB,
+		"expiry_time": account.ExpiryTime,
+		"reset":       account.Reset,
+		"updated_at":  time.Now().UnixMilli(),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Moved account %s to plan %s", account.Username, plan.Name)
+	return s.ProvisionAccount(accountId)
+}
+
+// RenewAccount starts a new term of an account on its plan: the traffic is
+// reset and quota, expiry and reset period go back to the plan's defaults.
+// Returns the slaves whose config changed.
+func (s *PlanService) RenewAccount(accountId int, actor, reason string) ([]int, error) {
+	account, err := s.accountService.GetAccount(accountId)
+	if err != nil {
+		return nil, err
+	}
+	if account.PlanId == 0 {
+		return nil, common.NewError("account has no plan to renew:", account.Username)
+	}
+	plan, err := s.GetPlan(account.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	affectedSlaveIds := make(map[int]bool)
+	slaveIds, err := s.accountService.changeAccountTerms(account, AccountEventRenew, actor, reason, true, func(a *model.Account) {
+		ApplyPlanDefaults(a, plan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, slaveId := range slaveIds {
+		affectedSlaveIds[slaveId] = true
+	}
+	slaveIds, err = s.ProvisionAccount(accountId)
+	if err != nil {
+		logger.Warningf("Failed to provision renewed account %s: %v", account.Username, err)
+	}
+	for _, slaveId := range slaveIds {
+		affectedSlaveIds[slaveId] = true
+	}
+	return mapKeys(affectedSlaveIds), nil
+}
+
+// ProvisionAccount reconciles an account's clients with its plan: a client is
+// added on every plan or auto-enroll inbound the account has no client on yet,
+// provisioned clients on inbounds no longer covered are removed, and the
+// plan's IP limit is applied to the remaining provisioned clients. Clients
+// linked by hand are left alone. Returns the slaves whose config changed.
+func (s *PlanService) ProvisionAccount(accountId int) ([]int, error) {
+	db := database.GetDB()
+	account := &model.Account{}
+	if err := db.Where("id = ?", accountId).First(account).Error; err != nil {
+		return nil, err
+	}
+	if account.PlanId == 0 {
+		return []int{}, nil
+	}
+	if err := ensureAccountCredentials(account); err != nil {
+		return nil, err
+	}
+	plan, err := s.GetPlan(account.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	inbounds, err := s.GetPlanInbounds(plan)
+	if err != nil {
+		return nil, err
+	}
+	inbounds, err = s.withAutoEnrollInbounds(inbounds)
+	if err != nil {
+		return nil, err
+	}
+	var links []model.AccountClient
+	if err := db.Where("account_id = ?", accountId).Find(&links).Error; err != nil {
+		return nil, err
+	}
+
+	linked := make(map[int]bool)
+	provisioned := make(map[int][]string)
+	for _, link := range links {
+		linked[link.InboundId] = true
+		if link.Provisioned {
+			provisioned[link.InboundId] = append(provisioned[link.InboundId], link.ClientEmail)
+		}
+	}
+
+	affectedSlaveIds := make(map[int]bool)
+	wanted := make(map[int]bool)
+	for _, inbound := range inbounds {
+		wanted[inbound.Id] = true
+		if !linked[inbound.Id] {
+			client := newPlanClient(account, plan, inbound)
+			if err := s.addProvisionedClient(account.Id, inbound, client); err != nil {
+				logger.Warningf("Failed to provision account %s on inbound %s: %v", account.Username, inbound.Tag, err)
+				continue
+			}
+			affectedSlaveIds[inbound.SlaveId] = true
+			continue
+		}
+		if emails := provisioned[inbound.Id]; len(emails) > 0 {
+			changed, err := s.setClientsLimitIP(inbound, emails, plan.LimitIP)
+			if err != nil {
+				logger.Warningf("Failed to update IP limit of account %s on inbound %s: %v", account.Username, inbound.Tag, err)
+			} else if changed {
+				affectedSlaveIds[inbound.SlaveId] = true
+			}
+		}
+	}
+
+	for inboundId, emails := range provisioned {
+		if wanted[inboundId] {
+			continue
+		}
+		inbound, err := s.inboundService.GetInbound(inboundId)
+		if err != nil {
+			continue
+		}
+		for _, email := range emails {
+			// Also drops the account link of the client
+			if _, err := s.inboundService.DelInboundClientByEmail(inboundId, email); err != nil {
+				logger.Warningf("Failed to remove client %s of account %s from inbound %s: %v", email, account.Username, inbound.Tag, err)
+				continue
+			}
+			affectedSlaveIds[inbound.SlaveId] = true
+		}
+	}
+
+	delete(affectedSlaveIds, 0)
+	return mapKeys(affectedSlaveIds), nil
+}
+
+// withAutoEnrollInbounds adds the auto-enroll inbounds to a plan's inbounds.
+func (s *PlanService) withAutoEnrollInbounds(inbounds []*model.Inbound) ([]*model.Inbound, error) {
+	db := database.GetDB()
+	var autoEnroll []*model.Inbound
+	err := db.Model(&model.Inbound{}).Where("auto_enroll = ? AND protocol IN ?", true, provisionProtocols).Order("id").Find(&autoEnroll).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	for _, inbound := range inbounds {
+		seen[inbound.Id] = true
+	}
+	for _, inbound := range autoEnroll {
+		if !seen[inbound.Id] {
+			inbounds = append(inbounds, inbound)
+		}
+	}
+	return inbounds, nil
+}
+
+// EnrollInbound provisions the accounts a new inbound is meant for: accounts
+// on a plan that covers it, and with auto-enroll every enabled account. It is
+// safe to call again, accounts that already have a client on the inbound are
+// skipped. Returns the slaves whose config changed.
+func (s *PlanService) EnrollInbound(inboundId int) ([]int, error) {
+	inbound, err := s.inboundService.GetInbound(inboundId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.isProvisionProtocol(inbound.Protocol) {
+		return []int{}, nil
+	}
+
+	db := database.GetDB()
+	affectedSlaveIds := make(map[int]bool)
+	planQuery := db.Model(&model.Account{}).Where("plan_id > 0")
+	if !inbound.AutoEnroll {
+		plans, err := s.GetPlans()
+		if err != nil {
+			return nil, err
+		}
+		planIds := []int{}
+		for _, plan := range plans {
+			planInbounds, err := s.GetPlanInbounds(plan)
+			if err != nil {
+				return nil, err
+			}
+			for _, planInbound := range planInbounds {
+				if planInbound.Id == inbound.Id {
+					planIds = append(planIds, plan.Id)
+					break
+				}
+			}
+		}
+		if len(planIds) == 0 {
+			return []int{}, nil
+		}
+		planQuery = planQuery.Where("plan_id IN ?", planIds)
+	}
+	slaveIds, err := s.provisionAccounts(planQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, slaveId := range slaveIds {
+		affectedSlaveIds[slaveId] = true
+	}
+
+	if inbound.AutoEnroll {
+		var accounts []*model.Account
+		err := db.Model(&model.Account{}).
+			Where("plan_id = 0 AND enable = ?", true).
+			Where("id NOT IN (?)", db.Model(&model.AccountClient{}).Select("account_id").Where("inbound_id = ?", inbound.Id)).
+			Order("id").Find(&accounts).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, account := range accounts {
+			if err := ensureAccountCredentials(account); err != nil {
+				return nil, err
+			}
+			if err := s.addProvisionedClient(account.Id, inbound, newAccountClient(account, inbound)); err != nil {
+				logger.Warningf("Failed to enroll account %s on inbound %s: %v", account.Username, inbound.Tag, err)
+				continue
+			}
+			affectedSlaveIds[inbound.SlaveId] = true
+		}
+		logger.Infof("Enrolled %d accounts on inbound %s", len(accounts), inbound.Tag)
+	}
+
+	delete(affectedSlaveIds, 0)
+	return mapKeys(affectedSlaveIds), nil
+}
+
+func (s *PlanService) isProvisionProtocol(protocol model.Protocol) bool {
+	for _, p := range provisionProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// addProvisionedClient adds client to inbound and links it to the account.
+func (s *PlanService) addProvisionedClient(accountId int, inbound *model.Inbound, client *model.Client) error {
+	settings, err := json.Marshal(map[string]any{"clients": []*model.Client{client}})
+	if err != nil {
+		return err
+	}
+	// The account's quota was charged with the account itself
+	if _, err := s.inboundService.addInboundClient(&model.Inbound{Id: inbound.Id, Settings: string(settings)}, false); err != nil {
+		return err
+	}
+
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		link := &model.AccountClient{
+			AccountId:   accountId,
+			InboundId:   inbound.Id,
+			ClientEmail: client.Email,
+			CreatedAt:   time.Now().UnixMilli(),
+			Provisioned: true,
+		}
+		if err := tx.Create(link).Error; err != nil {
+			return err
+		}
+		return tx.Model(&xray.ClientTraffic{}).Where("email = ?", client.Email).Update("account_id", accountId).Error
+	})
+}
+
+// setClientsLimitIP sets the IP limit of the given clients of an inbound.
+func (s *PlanService) setClientsLimitIP(inbound *model.Inbound, emails []string, limitIP int) (bool, error) {
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return false, err
+	}
+	clients, _ := settings["clients"].([]any)
+	changed := false
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := client["email"].(string)
+		if !s.inboundService.contains(emails, email) {
+			continue
+		}
+		if current, _ := client["limitIp"].(float64); int(current) != limitIP {
+			client["limitIp"] = limitIP
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	db := database.GetDB()
+	return true, db.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", string(newSettings)).Error
+}
+
+// newPlanClient builds the client an account gets on a plan inbound.
+func newPlanClient(account *model.Account, plan *model.Plan, inbound *model.Inbound) *model.Client {
+	client := newAccountClient(account, inbound)
+	client.LimitIP = plan.LimitIP
+	client.Comment = plan.Name
+	return client
+}
+
+// newAccountClient builds the client an account gets on an inbound. Quota and
+// expiry are enforced on the account, so the client itself is unlimited. The
+// credentials are the account's own, so an account has the same UUID or
+// password on every inbound.
+func newAccountClient(account *model.Account, inbound *model.Inbound) *model.Client {
+	client := &model.Client{
+		Email:  fmt.Sprintf("%s-%d", account.Username, inbound.Id),
+		Enable: account.Enable,
+		TgID:   account.TgId,
+		SubID:  account.SubId,
+	}
+	switch inbound.Protocol {
+	case model.Trojan:
+		client.Password = account.Password
+	case model.Shadowsocks:
+		client.Password = accountShadowsocksPassword(account, inbound)
+	default:
+		client.ID = account.UUID
+	}
+	return client
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	result := []string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+func mapKeys(m map[int]bool) []int {
+	result := make([]int, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	return result
+}
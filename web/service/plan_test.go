@@ -0,0 +1,40 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestNewAccountClientCredentials(t *testing.T) {
+	account := &model.Account{Username: "alice", Enable: true}
+	other := &model.Account{Username: "bob", Enable: true}
+	generateAccountCredentials(account)
+	generateAccountCredentials(other)
+
+	vless := newAccountClient(account, &model.Inbound{Id: 1, Protocol: model.VLESS})
+	vmess := newAccountClient(account, &model.Inbound{Id: 2, Protocol: model.VMESS})
+	trojan := newAccountClient(account, &model.Inbound{Id: 3, Protocol: model.Trojan})
+	if vless.ID == "" || vless.ID != vmess.ID {
+		t.Errorf("UUIDs differ across inbounds: %q and %q", vless.ID, vmess.ID)
+	}
+	if vless.ID != account.UUID || trojan.Password != account.Password {
+		t.Errorf("client credentials %q, %q do not match the account", vless.ID, trojan.Password)
+	}
+	if vless.Email != "alice-1" || trojan.Email != "alice-3" {
+		t.Errorf("emails = %q, %q, want alice-1, alice-3", vless.Email, trojan.Email)
+	}
+	if got := newAccountClient(other, &model.Inbound{Id: 1, Protocol: model.VLESS}); got.ID == vless.ID {
+		t.Error("different accounts got the same UUID")
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" in-1, ,in-2,,")
+	if len(got) != 2 || got[0] != "in-1" || got[1] != "in-2" {
+		t.Errorf("splitList = %q, want [in-1 in-2]", got)
+	}
+	if got := splitList(""); len(got) != 0 {
+		t.Errorf("splitList of empty string = %q, want none", got)
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+const bytesPerGB = 1024 * 1024 * 1024
+
+// ResellerReport is the credit a reseller has left and the traffic of the
+// accounts it owns.
+type ResellerReport struct {
+	UserId       int    `json:"userId"`
+	Username     string `json:"username"`
+	CreditGB     int64  `json:"creditGB"`
+	AccountSlots int    `json:"accountSlots"`
+	Accounts     int64  `json:"accounts"`    // Accounts it owns
+	AllocatedGB  int64  `json:"allocatedGB"` // Quota of the accounts it owns
+	Up           int64  `json:"up"`
+	Down         int64  `json:"down"`
+}
+
+// resellerOwner returns the panel user owning an account or inbound when it
+// is a reseller, nil otherwise.
+func resellerOwner(tx *gorm.DB, userId int) (*model.User, error) {
+	if userId <= 0 {
+		return nil, nil
+	}
+	user := &model.User{}
+	err := tx.Where("id = ?", userId).First(user).Error
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Role != model.RoleReseller {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// chargeResellerNew deducts the quota of a new account or client from the
+// reseller's credit. Resellers cannot hand out unlimited quota.
+func chargeResellerNew(tx *gorm.DB, reseller *model.User, gb int64) error {
+	if gb <= 0 {
+		return common.NewError("resellers must set a traffic limit")
+	}
+	return deductCredit(tx, reseller, gb)
+}
+
+// chargeResellerChange deducts the quota added to an account or client from
+// the reseller's credit.
+func chargeResellerChange(tx *gorm.DB, reseller *model.User, oldGB, newGB int64) error {
+	gb, err := creditCharge(oldGB, newGB)
+	if err != nil || gb == 0 {
+		return err
+	}
+	return deductCredit(tx, reseller, gb)
+}
+
+// creditCharge returns the credit a quota change costs. Credit is not
+// refundable: lowering the quota, or deleting the account or client, gives
+// nothing back, since the quota may already have been used.
+func creditCharge(oldGB, newGB int64) (int64, error) {
+	if newGB <= 0 {
+		if oldGB > 0 {
+			return 0, common.NewError("resellers must set a traffic limit")
+		}
+		return 0, nil
+	}
+	if newGB <= oldGB {
+		return 0, nil
+	}
+	return newGB - oldGB, nil
+}
+
+// chargeResellerClients charges the quota of the clients added or raised in
+// the settings of a reseller's inbound, matching clients by email.
+func chargeResellerClients(tx *gorm.DB, reseller *model.User, oldClients, newClients []model.Client) error {
+	oldByEmail := make(map[string]model.Client, len(oldClients))
+	for _, client := range oldClients {
+		oldByEmail[client.Email] = client
+	}
+	for _, client := range newClients {
+		old, exists := oldByEmail[client.Email]
+		if err := checkResellerReset(old.Reset, client.Reset); err != nil {
+			return err
+		}
+		var err error
+		if exists {
+			err = chargeResellerChange(tx, reseller, clientGB(old.TotalGB), clientGB(client.TotalGB))
+		} else {
+			err = chargeResellerNew(tx, reseller, clientGB(client.TotalGB))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkResellerReset rejects reset periods set on a reseller's clients, as
+// every reset would restore the used quota without charging for it.
+func checkResellerReset(oldReset, newReset int) error {
+	if newReset > 0 && newReset != oldReset {
+		return common.NewError("resellers cannot set a reset period")
+	}
+	return nil
+}
+
+func deductCredit(tx *gorm.DB, reseller *model.User, gb int64) error {
+	result := tx.Model(&model.User{}).
+		Where("id = ? AND credit_gb >= ?", reseller.Id, gb).
+		Update("credit_gb", gorm.Expr("credit_gb - ?", gb))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewErrorf("not enough credit: %d GB needed", gb)
+	}
+	reseller.CreditGB -= gb
+	return nil
+}
+
+// takeAccountSlot checks that a reseller has an account slot left. Slots are
+// freed when accounts are deleted.
+func takeAccountSlot(tx *gorm.DB, reseller *model.User) error {
+	if reseller.AccountSlots <= 0 {
+		return nil
+	}
+	var count int64
+	if err := tx.Model(&model.Account{}).Where("user_id = ?", reseller.Id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= int64(reseller.AccountSlots) {
+		return common.NewErrorf("all %d account slots are used", reseller.AccountSlots)
+	}
+	return nil
+}
+
+// clientGB rounds a client quota in bytes up to whole GB.
+func clientGB(totalBytes int64) int64 {
+	if totalBytes <= 0 {
+		return 0
+	}
+	return (totalBytes + bytesPerGB - 1) / bytesPerGB
+}
+
+// GetResellerReports reports on all resellers, or only on user itself when
+// it is a reseller.
+func (s *UserService) GetResellerReports(user *model.User) ([]*ResellerReport, error) {
+	db := database.GetDB()
+	var resellers []*model.User
+	query := db.Where("role = ?", model.RoleReseller)
+	if user.Role == model.RoleReseller {
+		query = query.Where("id = ?", user.Id)
+	}
+	if err := query.Order("id").Find(&resellers).Error; err != nil {
+		return nil, err
+	}
+
+	reports := make([]*ResellerReport, 0, len(resellers))
+	for _, reseller := range resellers {
+		report := &ResellerReport{
+			UserId:       reseller.Id,
+			Username:     reseller.Username,
+			CreditGB:     reseller.CreditGB,
+			AccountSlots: reseller.AccountSlots,
+		}
+		var allocation struct {
+			Accounts    int64
+			AllocatedGB int64
+		}
+		accounts := db.Model(&model.Account{}).Where("user_id = ?", reseller.Id)
+		err := accounts.Session(&gorm.Session{}).
+			Select("COUNT(*) AS accounts, COALESCE(SUM(total_gb), 0) AS allocated_gb").
+			Scan(&allocation).Error
+		if err != nil {
+			return nil, err
+		}
+		report.Accounts = allocation.Accounts
+		report.AllocatedGB = allocation.AllocatedGB
+
+		var traffic struct {
+			Up   int64
+			Down int64
+		}
+		err = db.Model(&xray.ClientTraffic{}).
+			Where("account_id IN (?)", accounts.Session(&gorm.Session{}).Select("id")).
+			Select("COALESCE(SUM(up), 0) AS up, COALESCE(SUM(down), 0) AS down").
+			Scan(&traffic).Error
+		if err != nil {
+			return nil, err
+		}
+		report.Up = traffic.Up
+		report.Down = traffic.Down
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,66 @@
+package service
+
+import "testing"
+
+func TestClientGB(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  int64
+	}{
+		{0, 0},
+		{-1, 0},
+		{1, 1},
+		{bytesPerGB, 1},
+		{bytesPerGB + 1, 2},
+		{5 * bytesPerGB, 5},
+	}
+	for _, tt := range tests {
+		if got := clientGB(tt.bytes); got != tt.want {
+			t.Errorf("clientGB(%d) = %d, want %d", tt.bytes, got, tt.want)
+		}
+	}
+}
+
+func TestCheckResellerReset(t *testing.T) {
+	tests := []struct {
+		oldReset int
+		newReset int
+		wantErr  bool
+	}{
+		{0, 0, false},
+		{0, 30, true},
+		{30, 30, false}, // Set before the inbound was a reseller's
+		{30, 7, true},
+		{30, 0, false},
+	}
+	for _, tt := range tests {
+		if err := checkResellerReset(tt.oldReset, tt.newReset); (err != nil) != tt.wantErr {
+			t.Errorf("checkResellerReset(%d, %d) = %v, wantErr %v", tt.oldReset, tt.newReset, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCreditCharge(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldGB   int64
+		newGB   int64
+		want    int64
+		wantErr bool
+	}{
+		{"raised", 10, 25, 15, false},
+		{"unchanged", 10, 10, 0, false},
+		{"lowered is not refunded", 25, 10, 0, false},
+		{"limit removed", 10, 0, 0, true},
+		{"still unlimited", 0, 0, 0, false},
+		{"limit set", 0, 10, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := creditCharge(tt.oldGB, tt.newGB)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("creditCharge(%d, %d) = %d, %v, want %d, wantErr %v", tt.oldGB, tt.newGB, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
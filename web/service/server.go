@@ -91,6 +91,8 @@ type Status struct {
 		Threads uint32 `json:"threads"`
 		Mem     uint64 `json:"mem"`
 		Uptime  uint64 `json:"uptime"`
+		// Subscription fetches per format since startup
+		SubFetches map[string]uint64 `json:"subFetches"`
 	} `json:"appStats"`
 }
 
@@ -104,6 +106,7 @@ type Release struct {
 type ServerService struct {
 	xrayService        XrayService
 	inboundService     InboundService
+	subFetchService    SubFetchService
 	cachedIPv4         string
 	cachedIPv6         string
 	noIPv6             bool
@@ -413,6 +416,7 @@ func (s *ServerService) GetStatus(lastStatus *Status) *Status {
 	} else {
 		status.AppStats.Uptime = 0
 	}
+	status.AppStats.SubFetches = s.subFetchService.GetCounts()
 
 	return status
 }
@@ -593,35 +597,8 @@ func (s *ServerService) RestartXrayService() error {
 }
 
 func (s *ServerService) downloadXRay(version string) (string, error) {
-	osName := runtime.GOOS
-	arch := runtime.GOARCH
-
-	switch osName {
-	case "darwin":
-		osName = "macos"
-	case "windows":
-		osName = "windows"
-	}
-
-	switch arch {
-	case "amd64":
-		arch = "64"
-	case "arm64":
-		arch = "arm64-v8a"
-	case "armv7":
-		arch = "arm32-v7a"
-	case "armv6":
-		arch = "arm32-v6"
-	case "armv5":
-		arch = "arm32-v5"
-	case "386":
-		arch = "32"
-	case "s390x":
-		arch = "s390x"
-	}
-
-	fileName := fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
-	url := fmt.Sprintf("https://github.com/XTLS/Xray-core/releases/download/%s/%s", version, fileName)
+	fileName := xray.GetReleaseAssetName()
+	url := xray.GetReleaseURL(version)
 	resp, err := http.Get(url)
 	if err != nil {
 		return "", err
@@ -709,6 +686,26 @@ logger.Errorf("Failed to stop Xray before update: %v", err)
 	return nil
 }
 
+// maxLogCount bounds how many log lines or entries can be requested at once.
+const maxLogCount = 10000
+
+// syslogUnit is the systemd unit whose journal GetLogs reads for syslog.
+var syslogUnit = "x-ui"
+
+// SetSyslogUnit changes the systemd unit read for syslog, e.g. to x-ui-slave on slaves.
+func SetSyslogUnit(unit string) {
+	syslogUnit = unit
+}
+
+// parseLogCount parses a requested number of log lines, rejecting values outside 1..maxLogCount.
+func parseLogCount(count string) (int, bool) {
+	countInt, err := strconv.Atoi(count)
+	if err != nil || countInt < 1 || countInt > maxLogCount {
+		return 0, false
+	}
+	return countInt, true
+}
+
 func (s *ServerService) GetLogs(count string, level string, syslog string) []string {
 	c, _ := strconv.Atoi(count)
 	var lines []string
@@ -720,8 +717,8 @@ func (s *ServerService) GetLogs(count string, level string, syslog string) []str
 		}
 
 		// Validate and sanitize count parameter
-		countInt, err := strconv.Atoi(count)
-		if err != nil || countInt < 1 || countInt > 10000 {
+		countInt, ok := parseLogCount(count)
+		if !ok {
 			return []string{"Invalid count parameter - must be a number between 1 and 10000"}
 		}
 
@@ -741,15 +738,17 @@ func (s *ServerService) GetLogs(count string, level string, syslog string) []str
 		}
 
 		// Use hardcoded command with validated parameters
-		cmd := exec.Command("journalctl", "-u", "x-ui", "--no-pager", "-n", strconv.Itoa(countInt), "-p", level)
+		cmd := exec.Command("journalctl", "-u", syslogUnit, "--no-pager", "-n", strconv.Itoa(countInt), "-p", level)
 		var out bytes.Buffer
 		cmd.Stdout = &out
-		err = cmd.Run()
-		if err != nil {
-			return []string{"Failed to run journalctl command! Make sure systemd is available and x-ui service is registered."}
+		if err := cmd.Run(); err != nil {
+			return []string{fmt.Sprintf("Failed to run journalctl command! Make sure systemd is available and %s service is registered.", syslogUnit)}
 		}
 		lines = strings.Split(out.String(), "\n")
 	} else {
+		if c < 1 || c > maxLogCount {
+			return []string{"Invalid count parameter - must be a number between 1 and 10000"}
+		}
 		lines = logger.GetLogs(c, level)
 	}
 
@@ -759,6 +758,7 @@ func (s *ServerService) GetLogs(count string, level string, syslog string) []str
 func (s *ServerService) GetXrayLogs(
 	count string,
 	filter string,
+	email string,
 	showDirect string,
 	showBlocked string,
 	showProxy string,
@@ -771,7 +771,10 @@ func (s *ServerService) GetXrayLogs(
 		Proxied
 	)
 
-	countInt, _ := strconv.Atoi(count)
+	countInt, ok := parseLogCount(count)
+	if !ok {
+		return nil
+	}
 	var entries []LogEntry
 
 	pathToAccessLog, err := xray.GetAccessLogPath()
@@ -826,6 +829,10 @@ func (s *ServerService) GetXrayLogs(
 			}
 		}
 
+		if email != "" && entry.Email != email {
+			continue
+		}
+
 		if logEntryContains(line, freedoms) {
 			if showDirect == "false" {
 				continue
@@ -853,6 +860,52 @@ func (s *ServerService) GetXrayLogs(
 	return entries
 }
 
+// GetXrayErrorLogs returns the last count lines of the Xray error log,
+// optionally limited to one severity (debug, info, warning, error) and a text filter.
+func (s *ServerService) GetXrayErrorLogs(count string, level string, filter string) []string {
+	lines := make([]string, 0)
+	countInt, ok := parseLogCount(count)
+	if !ok {
+		return lines
+	}
+
+	pathToErrorLog, err := xray.GetErrorLogPath()
+	if err != nil || pathToErrorLog == "" || pathToErrorLog == "none" {
+		return lines
+	}
+
+	file, err := os.Open(pathToErrorLog)
+	if err != nil {
+		return lines
+	}
+	defer file.Close()
+
+	levelTag := ""
+	if level != "" {
+		levelTag = "[" + strings.ToUpper(level[:1]) + strings.ToLower(level[1:]) + "]"
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if levelTag != "" && !strings.Contains(line, levelTag) {
+			continue
+		}
+		if filter != "" && !strings.Contains(line, filter) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) > countInt {
+		lines = lines[len(lines)-countInt:]
+	}
+	return lines
+}
+
 func logEntryContains(line string, suffixes []string) bool {
 	for _, sfx := range suffixes {
 		if strings.Contains(line, sfx+"]") {
@@ -1056,22 +1109,9 @@ func (s *ServerService) IsValidGeofileName(filename string) bool {
 }
 
 func (s *ServerService) UpdateGeofile(fileName string) error {
-	type geofileEntry struct {
-		URL      string
-		FileName string
-	}
-	geofileAllowlist := map[string]geofileEntry{
-		"geoip.dat":      {"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip.dat"},
-		"geosite.dat":    {"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite.dat"},
-		"geoip_IR.dat":   {"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geoip.dat", "geoip_IR.dat"},
-		"geosite_IR.dat": {"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geosite.dat", "geosite_IR.dat"},
-		"geoip_RU.dat":   {"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip_RU.dat"},
-		"geosite_RU.dat": {"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite_RU.dat"},
-	}
-
 	// Strict allowlist check to avoid writing uncontrolled files
 	if fileName != "" {
-		if _, ok := geofileAllowlist[fileName]; !ok {
+		if _, ok := xray.GeofileURLs[fileName]; !ok {
 			return common.NewErrorf("Invalid geofile name: %q not in allowlist", fileName)
 		}
 	}
@@ -1148,17 +1188,16 @@ func (s *ServerService) UpdateGeofile(fileName string) error {
 
 	if fileName == "" {
 		// Download all geofiles
-		for _, entry := range geofileAllowlist {
-			destPath := filepath.Join(config.GetBinFolderPath(), entry.FileName)
-			if err := downloadFile(entry.URL, destPath); err != nil {
-				errorMessages = append(errorMessages, fmt.Sprintf("Error downloading Geofile '%s': %v", entry.FileName, err))
+		for name, url := range xray.GeofileURLs {
+			destPath := filepath.Join(config.GetBinFolderPath(), name)
+			if err := downloadFile(url, destPath); err != nil {
+				errorMessages = append(errorMessages, fmt.Sprintf("Error downloading Geofile '%s': %v", name, err))
 			}
 		}
 	} else {
-		entry := geofileAllowlist[fileName]
-		destPath := filepath.Join(config.GetBinFolderPath(), entry.FileName)
-		if err := downloadFile(entry.URL, destPath); err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("Error downloading Geofile '%s': %v", entry.FileName, err))
+		destPath := filepath.Join(config.GetBinFolderPath(), fileName)
+		if err := downloadFile(xray.GeofileURLs[fileName], destPath); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("Error downloading Geofile '%s': %v", fileName, err))
 		}
 	}
 
@@ -75,11 +75,26 @@ var defaultValueMap = map[string]string{
 	"subJsonNoises":               "",
 	"subJsonMux":                  "",
 	"subJsonRules":                "",
+	"subClashEnable":              "false",
+	"subSingboxEnable":            "false",
+	"subRuleSets":                 "",
+	"subUserAgentFormats":         "happ=happ\nclash=clash\nmihomo=clash\nstash=clash\nsing-box=singbox\nsfa/=singbox\nsfi/=singbox\nsfm/=singbox\nv2rayng=links\nv2rayn=links\nstreisand=links\nshadowrocket=links\nhiddify=links",
+	"subFetchLogDays":             "30",
+	"subLeakIpLimit":              "10",
+	"subLeakCountryLimit":         "3",
+	"subLeakWindow":               "60",
+	"subRotateGrace":              "24",
+	"subRotateAnnounce":           "This subscription link has been replaced and stops working on {expiry}. Please import your new subscription link.",
 	"datepicker":                  "gregorian",
 	"warp":                        "",
 	"externalTrafficInformEnable": "false",
 	"externalTrafficInformURI":    "",
 	"xrayOutboundTestUrl":         "https://www.google.com/generate_204",
+	"slaveAgentUrl":               "",
+	"slaveAgentSha256":            "",
+	"slaveAutoUpgrade":            "false",
+	"trafficHistoryHourDays":      "7",
+	"trafficHistoryDayDays":       "365",
 
 	// LDAP defaults
 	"ldapEnable":            "false",
@@ -571,6 +586,56 @@ func (s *SettingService) GetSubJsonRules() (string, error) {
 	return s.getString("subJsonRules")
 }
 
+func (s *SettingService) GetSubClashEnable() (bool, error) {
+	return s.getBool("subClashEnable")
+}
+
+func (s *SettingService) GetSubSingboxEnable() (bool, error) {
+	return s.getBool("subSingboxEnable")
+}
+
+func (s *SettingService) GetSubRuleSets() (string, error) {
+	return s.getString("subRuleSets")
+}
+
+func (s *SettingService) GetSubUserAgentFormats() (string, error) {
+	return s.getString("subUserAgentFormats")
+}
+
+// GetSubFetchLogDays returns how many days subscription fetches are kept, 0 = forever.
+func (s *SettingService) GetSubFetchLogDays() (int, error) {
+	return s.getInt("subFetchLogDays")
+}
+
+// GetSubLeakIpLimit returns how many distinct IPs may fetch a subscription
+// within the leak window, 0 = no limit.
+func (s *SettingService) GetSubLeakIpLimit() (int, error) {
+	return s.getInt("subLeakIpLimit")
+}
+
+// GetSubLeakCountryLimit returns how many distinct countries may fetch a
+// subscription within the leak window, 0 = no limit.
+func (s *SettingService) GetSubLeakCountryLimit() (int, error) {
+	return s.getInt("subLeakCountryLimit")
+}
+
+// GetSubLeakWindow returns the leak detection window in minutes.
+func (s *SettingService) GetSubLeakWindow() (int, error) {
+	return s.getInt("subLeakWindow")
+}
+
+// GetSubRotateGrace returns how many hours a rotated subscription ID keeps
+// working, 0 = revoked at once.
+func (s *SettingService) GetSubRotateGrace() (int, error) {
+	return s.getInt("subRotateGrace")
+}
+
+// GetSubRotateAnnounce returns the announce message served on a rotated
+// subscription ID during its grace period.
+func (s *SettingService) GetSubRotateAnnounce() (string, error) {
+	return s.getString("subRotateAnnounce")
+}
+
 func (s *SettingService) GetDatepicker() (string, error) {
 	return s.getString("datepicker")
 }
@@ -609,6 +674,31 @@ func (s *SettingService) GetIpLimitEnable() (bool, error) {
 	return (accessLogPath != "none" && accessLogPath != ""), nil
 }
 
+// GetSlaveAgentUrl returns where slaves download agent upgrades from.
+// Empty means the master serves its own executable.
+func (s *SettingService) GetSlaveAgentUrl() (string, error) {
+	return s.getString("slaveAgentUrl")
+}
+
+// GetSlaveAgentSha256 returns the expected SHA-256 of the artifact at slaveAgentUrl.
+func (s *SettingService) GetSlaveAgentSha256() (string, error) {
+	return s.getString("slaveAgentSha256")
+}
+
+func (s *SettingService) GetSlaveAutoUpgrade() (bool, error) {
+	return s.getBool("slaveAutoUpgrade")
+}
+
+// GetTrafficHistoryHourDays returns how many days hourly traffic history is kept, 0 = forever.
+func (s *SettingService) GetTrafficHistoryHourDays() (int, error) {
+	return s.getInt("trafficHistoryHourDays")
+}
+
+// GetTrafficHistoryDayDays returns how many days daily traffic history is kept, 0 = forever.
+func (s *SettingService) GetTrafficHistoryDayDays() (int, error) {
+	return s.getInt("trafficHistoryDayDays")
+}
+
 // LDAP exported getters
 func (s *SettingService) GetLdapEnable() (bool, error) {
 	return s.getBool("ldapEnable")
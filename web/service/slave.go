@@ -2,8 +2,11 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,47 +24,319 @@ type SlaveService struct {
 	SlaveSettingService SlaveSettingService
 }
 
+// maxConfigRetries bounds how often the same unacknowledged revision is re-sent automatically.
+const maxConfigRetries = 5
+
+// slaveConn wraps a slave WebSocket; gorilla connections allow only one concurrent writer.
+type slaveConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *slaveConn) writeMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
 // In-memory store for active connections
 var (
-	slaveConns      = make(map[int]*websocket.Conn)
+	slaveConns      = make(map[int]*slaveConn)
 	slaveLock       sync.RWMutex
 	slaveOnlineClients = make(map[int][]string) // Store online clients per slave
+	slaveLastConfigs   = make(map[int]*pushedConfig) // Last config sent to each connected slave
 )
 
+// slavePushLocks serialize building, diffing, sending and remembering the
+// config of each slave. Without them two concurrent pushes diff against the
+// same cached config and the slower one can leave an outdated cache behind.
+var (
+	slavePushLocks    = make(map[int]*sync.Mutex)
+	slavePushLocksMux sync.Mutex
+)
+
+func slavePushLock(slaveId int) *sync.Mutex {
+	slavePushLocksMux.Lock()
+	defer slavePushLocksMux.Unlock()
+	lock, ok := slavePushLocks[slaveId]
+	if !ok {
+		lock = &sync.Mutex{}
+		slavePushLocks[slaveId] = lock
+	}
+	return lock
+}
+
+// pushedConfig is the config last sent to a slave, used to compute deltas.
+type pushedConfig struct {
+	config      *xray.Config
+	inboundTags map[string]bool
+}
+
 func (s *SlaveService) AddSlaveConn(slaveId int, conn *websocket.Conn) {
 	slaveLock.Lock()
 	defer slaveLock.Unlock()
 	if old, ok := slaveConns[slaveId]; ok {
-		old.Close()
+		old.conn.Close()
 	}
-	slaveConns[slaveId] = conn
+	slaveConns[slaveId] = &slaveConn{conn: conn}
+	// A fresh connection always starts from a full config
+	delete(slaveLastConfigs, slaveId)
 	logger.Infof("Slave %d connected", slaveId)
 }
 
+// ReleaseSlaveConn unregisters conn when it is still the active connection of
+// the slave. It reports false if a newer connection has replaced it meanwhile,
+// in which case the slave must not be marked offline.
+func (s *SlaveService) ReleaseSlaveConn(slaveId int, conn *websocket.Conn) bool {
+	slaveLock.RLock()
+	current, ok := slaveConns[slaveId]
+	slaveLock.RUnlock()
+	if !ok || current.conn != conn {
+		conn.Close()
+		return false
+	}
+	s.RemoveSlaveConn(slaveId)
+	return true
+}
+
 func (s *SlaveService) RemoveSlaveConn(slaveId int) {
 	slaveLock.Lock()
 	defer slaveLock.Unlock()
 	if conn, ok := slaveConns[slaveId]; ok {
-		conn.Close()
+		conn.conn.Close()
 		delete(slaveConns, slaveId)
 	}
 	// Clear online clients for this slave
 	delete(slaveOnlineClients, slaveId)
+	delete(slaveLastConfigs, slaveId)
+	delete(slaveFail2Ban, slaveId)
 	logger.Infof("Slave %d disconnected", slaveId)
 }
 
+// PushConfig brings the Xray config on a slave in line with the database.
+// Only the difference to the last pushed config is sent when the template
+// (log, routing, DNS, outbounds, ...) is unchanged, so the slave can apply it
+// through the Xray API without restarting the process and dropping users.
+// Every push carries a new revision which the slave acknowledges with
+// config_applied or config_failed.
 func (s *SlaveService) PushConfig(slaveId int) error {
+	return s.pushConfig(slaveId, false)
+}
+
+// RetryConfig re-sends the complete config to a slave whose last revision
+// was not confirmed, without resetting its retry counter.
+func (s *SlaveService) RetryConfig(slaveId int) error {
+	return s.pushConfig(slaveId, true)
+}
+
+func (s *SlaveService) pushConfig(slaveId int, isRetry bool) error {
+	lock := slavePushLock(slaveId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if isRetry {
+		s.forgetPushedConfig(slaveId)
+	}
+
+	xrayConfig, inboundTags, err := s.buildSlaveConfig(slaveId)
+	if err != nil {
+		return err
+	}
+
+	slaveLock.RLock()
+	last, hasLast := slaveLastConfigs[slaveId]
+	_, connected := slaveConns[slaveId]
+	slaveLock.RUnlock()
+
+	if !connected {
+		return fmt.Errorf("slave %d not connected", slaveId)
+	}
+
+	msg := map[string]any{}
+	if hasLast {
+		ignoreTags := make(map[string]bool, len(inboundTags)+len(last.inboundTags))
+		for tag := range last.inboundTags {
+			ignoreTags[tag] = true
+		}
+		for tag := range inboundTags {
+			ignoreTags[tag] = true
+		}
+		if last.config.TemplateEquals(xrayConfig, ignoreTags) {
+			ops := xray.DiffInbounds(last.config.InboundConfigs, xrayConfig.InboundConfigs)
+			if len(ops) == 0 {
+				logger.Debugf("PushConfig: config for slave %d unchanged, nothing to send", slaveId)
+				return nil
+			}
+			msg["type"] = "update_config_delta"
+			msg["ops"] = ops
+		} else {
+			logger.Infof("PushConfig: template for slave %d changed, full config required", slaveId)
+		}
+	}
+
+	if msg["type"] == nil {
+		finalConfigBytes, err := json.Marshal(xrayConfig)
+		if err != nil {
+			return fmt.Errorf("failed to marshal final xray config: %v", err)
+		}
+		msg["type"] = "update_config_full"
+		msg["config"] = string(finalConfigBytes)
+	}
+
+	revision, err := s.nextConfigRevision(slaveId, isRetry)
+	if err != nil {
+		return fmt.Errorf("failed to allocate config revision for slave %d: %v", slaveId, err)
+	}
+	msg["revision"] = revision
+
+	logger.Infof("PushConfig: sending %s revision %d to slave %d", msg["type"], revision, slaveId)
+	if err := s.sendToSlave(slaveId, msg); err != nil {
+		s.forgetPushedConfig(slaveId)
+		s.markConfigFailed(slaveId, revision, err.Error())
+		return err
+	}
+	s.rememberPushedConfig(slaveId, xrayConfig, inboundTags)
+	return nil
+}
+
+// nextConfigRevision increments and returns the slave's desired config revision.
+func (s *SlaveService) nextConfigRevision(slaveId int, isRetry bool) (int64, error) {
+	db := database.GetDB()
+	var revision int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{
+			"config_revision":  gorm.Expr("config_revision + 1"),
+			"config_status":    "pending",
+			"config_pushed_at": time.Now().Unix(),
+		}
+		if isRetry {
+			updates["config_retries"] = gorm.Expr("config_retries + 1")
+		} else {
+			updates["config_retries"] = 0
+		}
+		if err := tx.Model(&model.Slave{}).Where("id = ?", slaveId).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Slave{}).Where("id = ?", slaveId).Pluck("config_revision", &revision).Error
+	})
+	return revision, err
+}
+
+func (s *SlaveService) markConfigFailed(slaveId int, revision int64, errMsg string) {
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).
+		Where("id = ? AND config_revision = ?", slaveId, revision).
+		Updates(map[string]any{
+			"config_status": "failed",
+			"config_error":  errMsg,
+		}).Error
+	if err != nil {
+		logger.Warningf("Failed to record config failure for slave %d: %v", slaveId, err)
+	}
+}
+
+// ProcessConfigAck records a config_applied or config_failed acknowledgement from a slave.
+func (s *SlaveService) ProcessConfigAck(slaveId int, data map[string]interface{}) error {
+	msgType, _ := data["type"].(string)
+	revisionFloat, _ := data["revision"].(float64)
+	revision := int64(revisionFloat)
+	errMsg, _ := data["error"].(string)
+
+	db := database.GetDB()
+	switch msgType {
+	case "config_applied":
+		logger.Infof("Slave %d applied config revision %d", slaveId, revision)
+		if err := db.Model(&model.Slave{}).
+			Where("id = ? AND applied_revision < ?", slaveId, revision).
+			Update("applied_revision", revision).Error; err != nil {
+			return err
+		}
+		return db.Model(&model.Slave{}).
+			Where("id = ? AND config_revision = ?", slaveId, revision).
+			Updates(map[string]any{
+				"config_status":  "applied",
+				"config_error":   "",
+				"config_retries": 0,
+			}).Error
+	case "config_failed":
+		logger.Warningf("Slave %d failed to apply config revision %d: %s", slaveId, revision, errMsg)
+		// The slave state no longer matches what we sent, so the next push must be complete
+		s.forgetPushedConfig(slaveId)
+		s.markConfigFailed(slaveId, revision, errMsg)
+		return nil
+	}
+	return fmt.Errorf("unknown config ack type %q", msgType)
+}
+
+// GetConfigStatuses returns the desired and applied config revision of every slave.
+func (s *SlaveService) GetConfigStatuses() ([]map[string]interface{}, error) {
+	slaves, err := s.GetAllSlaves()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, len(slaves))
+	for i, slave := range slaves {
+		result[i] = map[string]interface{}{
+			"id":              slave.Id,
+			"name":            slave.Name,
+			"status":          slave.Status,
+			"configRevision":  slave.ConfigRevision,
+			"appliedRevision": slave.AppliedRevision,
+			"configStatus":    slave.ConfigStatus,
+			"configError":     slave.ConfigError,
+			"configRetries":   slave.ConfigRetries,
+			"configPushedAt":  slave.ConfigPushedAt,
+			"inSync":          slave.ConfigRevision == slave.AppliedRevision,
+		}
+	}
+	return result, nil
+}
+
+// RetryUnappliedConfigs re-sends the config to connected slaves whose latest
+// revision has not been acknowledged within pendingTimeout. Failed revisions
+// are not retried: the slave rolls back on every attempt, dropping its users
+// each time, so they are left for a manual push once the cause is fixed.
+func (s *SlaveService) RetryUnappliedConfigs(pendingTimeout time.Duration) {
+	db := database.GetDB()
+	var slaves []*model.Slave
+	err := db.Where("applied_revision < config_revision AND config_retries < ? AND config_status = ? AND config_pushed_at <= ?",
+		maxConfigRetries, "pending", time.Now().Add(-pendingTimeout).Unix()).
+		Find(&slaves).Error
+	if err != nil {
+		logger.Warning("Failed to query slaves with unapplied configs:", err)
+		return
+	}
+
+	for _, slave := range slaves {
+		slaveLock.RLock()
+		_, connected := slaveConns[slave.Id]
+		slaveLock.RUnlock()
+		if !connected {
+			continue
+		}
+		logger.Infof("Retrying unacknowledged config for slave %d (revision %d, attempt %d)",
+			slave.Id, slave.ConfigRevision, slave.ConfigRetries+1)
+		if err := s.RetryConfig(slave.Id); err != nil {
+			logger.Warningf("Config retry for slave %d failed: %v", slave.Id, err)
+		}
+	}
+}
+
+// buildSlaveConfig assembles the complete Xray config for a slave from its
+// template and its enabled inbounds. The returned set contains the tags of
+// the inbounds that come from the database rather than from the template.
+func (s *SlaveService) buildSlaveConfig(slaveId int) (*xray.Config, map[string]bool, error) {
 	// 1. Get the Full Template from Slave Settings (contains Log, API, DNS, Outbounds/Routing)
 	templateJson, err := s.SlaveSettingService.GetXrayConfigForSlave(slaveId)
 	if err != nil {
-		return fmt.Errorf("failed to get xray template config for slave %d: %v", slaveId, err)
+		return nil, nil, fmt.Errorf("failed to get xray template config for slave %d: %v", slaveId, err)
 	}
 	logger.Infof("PushConfig: retrieved template for slave %d, length: %d", slaveId, len(templateJson))
 
 	// 2. Parse Template into xray.Config struct
 	var xrayConfig xray.Config
 	if err := json.Unmarshal([]byte(templateJson), &xrayConfig); err != nil {
-		return fmt.Errorf("failed to unmarshal xray template config: %v", err)
+		return nil, nil, fmt.Errorf("failed to unmarshal xray template config: %v", err)
 	}
 
 	// 3. Clean up config (remove helper fields like slaveId from routing/outbounds)
@@ -98,11 +373,12 @@ func (s *SlaveService) PushConfig(slaveId int) error {
 	// 4. Fetch Inbounds from Database for this Slave
 	inbounds, err := s.InboundService.GetInboundsForSlave(slaveId)
 	if err != nil {
-		return fmt.Errorf("failed to get inbounds for slave %d: %v", slaveId, err)
+		return nil, nil, fmt.Errorf("failed to get inbounds for slave %d: %v", slaveId, err)
 	}
 
 	// 4. Convert DB Inbounds to Xray InboundConfigs and Append to Template's Inbounds
 	// Note: We keep existing inbounds from the template (like 'api' inbound)
+	inboundTags := make(map[string]bool)
 	for _, inbound := range inbounds {
 		if inbound.Enable {
 			// Filter out disabled clients before generating config
@@ -114,20 +390,29 @@ func (s *SlaveService) PushConfig(slaveId int) error {
 			}
 			xrayInbound := filteredInbound.GenXrayInboundConfig()
 			xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *xrayInbound)
+			inboundTags[xrayInbound.Tag] = true
 		}
 	}
 
-	// 5. Marshal the Final Config to JSON
-	finalConfigBytes, err := json.Marshal(xrayConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal final xray config: %v", err)
-	}
+	return &xrayConfig, inboundTags, nil
+}
 
-	// 6. Send to Slave
-	data, err := json.Marshal(map[string]interface{}{
-		"type":   "update_config_full",
-		"config": string(finalConfigBytes),
-	})
+func (s *SlaveService) rememberPushedConfig(slaveId int, config *xray.Config, inboundTags map[string]bool) {
+	slaveLock.Lock()
+	defer slaveLock.Unlock()
+	slaveLastConfigs[slaveId] = &pushedConfig{config: config, inboundTags: inboundTags}
+}
+
+// forgetPushedConfig drops the cached config so the next push is a full one.
+func (s *SlaveService) forgetPushedConfig(slaveId int) {
+	slaveLock.Lock()
+	defer slaveLock.Unlock()
+	delete(slaveLastConfigs, slaveId)
+}
+
+// sendToSlave marshals payload and writes it to the slave's WebSocket connection.
+func (s *SlaveService) sendToSlave(slaveId int, payload any) error {
+	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
@@ -140,27 +425,26 @@ func (s *SlaveService) PushConfig(slaveId int) error {
 		return fmt.Errorf("slave %d not connected", slaveId)
 	}
 
-	logger.Infof("PushConfig: sending update_config_full to slave %d, payload size: %d", slaveId, len(data))
-	return conn.WriteMessage(websocket.TextMessage, data)
+	return conn.writeMessage(data)
 }
 
-func (s *SlaveService) RestartSlaveXray(slaveId int) error {
-	data, err := json.Marshal(map[string]interface{}{
-		"type": "restart_xray",
-	})
+// SendTrafficSeq tells a freshly connected slave the last traffic report
+// sequence number applied, so it can drop or replay its journal accordingly.
+func (s *SlaveService) SendTrafficSeq(slaveId int) error {
+	slave, err := s.GetSlave(slaveId)
 	if err != nil {
 		return err
 	}
+	return s.sendToSlave(slaveId, map[string]any{
+		"type":    "traffic_seq",
+		"lastSeq": slave.TrafficSeq,
+	})
+}
 
-	slaveLock.RLock()
-	conn, ok := slaveConns[slaveId]
-	slaveLock.RUnlock()
-
-	if !ok {
-		return fmt.Errorf("slave %d not connected", slaveId)
-	}
-
-	return conn.WriteMessage(websocket.TextMessage, data)
+func (s *SlaveService) RestartSlaveXray(slaveId int) error {
+	return s.sendToSlave(slaveId, map[string]interface{}{
+		"type": "restart_xray",
+	})
 }
 
 func (s *SlaveService) GetAllSlaves() ([]*model.Slave, error) {
@@ -198,14 +482,23 @@ func (s *SlaveService) GetAllSlavesWithTraffic() ([]map[string]interface{}, erro
 			"id":           slave.Id,
 			"name":         slave.Name,
 			"address":      slave.Address,
+			"group":        slave.Group,
+			"endpoints":    slave.Endpoints,
 			"port":         slave.Port,
-			"secret":       slave.Secret,
+			"hostId":       slave.HostId,
+			"revoked":      slave.Revoked,
 			"status":       slave.Status,
 			"lastSeen":     slave.LastSeen,
 			"version":      slave.Version,
 			"systemStats":  slave.SystemStats,
 			"totalUplink":  totalUplink,
 			"totalDownlink": totalDownlink,
+			"configRevision":  slave.ConfigRevision,
+			"appliedRevision": slave.AppliedRevision,
+			"configStatus":    slave.ConfigStatus,
+			"configError":     slave.ConfigError,
+			"latencyMs":       slave.LatencyMs,
+			"heartbeatMisses": slave.HeartbeatMisses,
 		}
 	}
 
@@ -219,18 +512,10 @@ func (s *SlaveService) GetSlave(id int) (*model.Slave, error) {
 	return &slave, err
 }
 
-func (s *SlaveService) GetSlaveBySecret(secret string) (*model.Slave, error) {
-	db := database.GetDB()
-	var slave model.Slave
-	err := db.Where("secret = ?", secret).First(&slave).Error
-	return &slave, err
-}
-
 func (s *SlaveService) AddSlave(slave *model.Slave) error {
-	// Auto-generate secret if not provided
-	if slave.Secret == "" {
-		slave.Secret = generateRandomSecret(32)
-	}
+	// The signing credential is issued when the slave enrolls with its join token
+	slave.Secret = ""
+	slave.Group = strings.TrimSpace(slave.Group)
 	slave.Status = "offline"
 	slave.LastSeen = time.Now().Unix()
 	
@@ -238,13 +523,52 @@ func (s *SlaveService) AddSlave(slave *model.Slave) error {
 	return db.Create(slave).Error
 }
 
-func generateRandomSecret(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[time.Now().UnixNano()%int64(len(charset))]
+// SetSlaveGroup changes the group label plans use to target the slave's inbounds.
+func (s *SlaveService) SetSlaveGroup(id int, group string) error {
+	db := database.GetDB()
+	return db.Model(&model.Slave{}).Where("id = ?", id).Update("group", strings.TrimSpace(group)).Error
+}
+
+// SetSlaveEndpoints changes the subscription endpoints of the slave's
+// inbounds, a JSON list of SubEndpoint. Subscriptions use them for the
+// inbounds without an address or external proxies of their own.
+func (s *SlaveService) SetSlaveEndpoints(id int, endpoints string) error {
+	var list []model.SubEndpoint
+	if strings.TrimSpace(endpoints) != "" {
+		if err := json.Unmarshal([]byte(endpoints), &list); err != nil {
+			return fmt.Errorf("invalid endpoints: %w", err)
+		}
 	}
-	return string(b)
+	for i := range list {
+		ep := &list[i]
+		ep.Dest = strings.TrimSpace(ep.Dest)
+		if ep.Dest == "" {
+			return fmt.Errorf("endpoint %d has no address", i+1)
+		}
+		if ep.Port < 0 || ep.Port > 65535 {
+			return fmt.Errorf("endpoint %d has an invalid port %d", i+1, ep.Port)
+		}
+		if ep.Weight < 0 {
+			return fmt.Errorf("endpoint %d has a negative weight", i+1)
+		}
+		switch ep.ForceTls {
+		case "":
+			ep.ForceTls = "same"
+		case "same", "tls", "none":
+		default:
+			return fmt.Errorf("endpoint %d has an invalid security %q", i+1, ep.ForceTls)
+		}
+	}
+	value := ""
+	if len(list) > 0 {
+		data, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	db := database.GetDB()
+	return db.Model(&model.Slave{}).Where("id = ?", id).Update("endpoints", value).Error
 }
 
 func (s *SlaveService) DeleteSlave(id int) error {
@@ -338,15 +662,23 @@ func (s *SlaveService) DeleteSlave(id int) error {
 }
 
 func (s *SlaveService) UpdateSlaveStatus(id int, status string, stats string) error {
+    if err := s.SetSlaveStatus(id, status); err != nil {
+        return err
+    }
+    return s.UpdateSlaveStats(id, stats)
+}
+
+// UpdateSlaveStats stores a system stats report without touching the health status.
+func (s *SlaveService) UpdateSlaveStats(id int, stats string) error {
     db := database.GetDB()
     
     updates := map[string]interface{}{
-        "status":      status,
         "systemStats": stats,
         "lastSeen":    time.Now().Unix(),
     }
     
     // Extract address from stats JSON if present
+    uiVersion := ""
     if stats != "" {
         var statsData map[string]interface{}
         if err := json.Unmarshal([]byte(stats), &statsData); err == nil {
@@ -356,17 +688,21 @@ func (s *SlaveService) UpdateSlaveStatus(id int, status string, stats string) er
             
             // Extract versions if present
             xrayVersion, _ := statsData["xrayVersion"].(string)
-            uiVersion, _ := statsData["uiVersion"].(string)
+            uiVersion, _ = statsData["uiVersion"].(string)
             
             if xrayVersion != "" || uiVersion != "" {
-                if xrayVersion == "" { xrayVersion = "Unknown" }
-                if uiVersion == "" { uiVersion = "Unknown" }
-                updates["version"] = fmt.Sprintf("Xray: %s / 3x-ui: %s", xrayVersion, uiVersion)
+                updates["version"] = formatSlaveVersion(xrayVersion, uiVersion)
             }
         }
     }
     
-    return db.Model(&model.Slave{}).Where("id = ?", id).Updates(updates).Error
+    if err := db.Model(&model.Slave{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+        return err
+    }
+    if uiVersion != "" {
+        s.checkAgentVersion(id, uiVersion)
+    }
+    return nil
 }
 
 func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interface{}) error {
@@ -390,6 +726,151 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 		logger.Debugf("Updated online clients for slave %d: %d clients", slaveId, len(clients))
 	}
 
+	// Journaled reports carry a sequence number. A slave replays unacknowledged
+	// reports after a reconnect, so reports that were already applied are only
+	// acknowledged again. Reports without a sequence carry no traffic.
+	// The sequence and all counters are updated in one transaction and the
+	// report is acknowledged only after it committed, so a failed write leaves
+	// the report in the slave's journal to be replayed.
+	var seq int64
+	if seqValue, ok := data["seq"].(float64); ok && seqValue > 0 {
+		seq = int64(seqValue)
+	}
+	duplicate := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if seq > 0 {
+			result := tx.Model(&model.Slave{}).
+				Where("id = ? AND traffic_seq < ?", slaveId, seq).
+				Update("traffic_seq", seq)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				duplicate = true
+				return nil
+			}
+		}
+		return s.applyTrafficStats(tx, slaveId, data, now)
+	})
+	if err != nil {
+		return err
+	}
+	if seq > 0 {
+		if err := s.sendToSlave(slaveId, map[string]any{"type": "traffic_ack", "seq": seq}); err != nil {
+			logger.Debugf("Failed to acknowledge traffic report %d of slave %d: %v", seq, slaveId, err)
+		}
+	}
+	if duplicate {
+		logger.Debugf("ProcessTrafficStats: Skipping duplicate report %d from slave %d", seq, slaveId)
+		return nil
+	}
+
+	// Check and disable clients that exceeded traffic or expiry limits
+	inboundService := InboundService{}
+	accountService := AccountService{}
+	needConfigPush := false
+	
+	// 1. Check individual client limits (legacy support)
+	disabledClientCount, err := s.checkAndDisableInvalidClients(db, slaveId)
+	if err != nil {
+		logger.Warning("Error checking invalid clients:", err)
+	} else if disabledClientCount > 0 {
+		logger.Infof("Disabled %d clients on slave %d due to individual traffic/expiry limits", disabledClientCount, slaveId)
+		needConfigPush = true
+	}
+	
+	// 2. Check account-level traffic limits
+	trafficLimitSlaves, err := accountService.DisableClientsExceedingAccountLimit()
+	if err != nil {
+		logger.Warning("Error checking account traffic limits:", err)
+	} else if len(trafficLimitSlaves) > 0 {
+		logger.Infof("Detected accounts disabled due to traffic limits on slaves: %v", trafficLimitSlaves)
+		needConfigPush = true
+	}
+	
+	// 3. Check account-level expiry
+	expirySlaves, err := accountService.DisableExpiredAccountClients()
+	if err != nil {
+		logger.Warning("Error checking account expiry:", err)
+	} else if len(expirySlaves) > 0 {
+		logger.Infof("Detected accounts disabled due to expiry on slaves: %v", expirySlaves)
+		needConfigPush = true
+	}
+	
+	// Push updated config to slave if any clients/accounts were disabled
+	if needConfigPush {
+		if err := s.PushConfig(slaveId); err != nil {
+			logger.Errorf("Failed to push config after disabling clients on slave %d: %v", slaveId, err)
+		} else {
+			logger.Infof("Pushed updated config to slave %d after disabling clients/accounts", slaveId)
+		}
+	}
+	
+	// Broadcast updates to frontend via WebSocket for real-time display
+	// Get updated inbounds with accumulated traffic from database
+	// IMPORTANT: Create a new InboundService instance to force fresh database query
+	// This ensures we don't get cached data from the previous operations
+	freshInboundService := InboundService{}
+	updatedInbounds, err := freshInboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Failed to get inbounds for websocket broadcast:", err)
+	} else if updatedInbounds == nil {
+		logger.Warning("GetAllInbounds returned nil (no error)")
+	} else {
+		logger.Infof("GetAllInbounds returned %d inbounds", len(updatedInbounds))
+		if len(updatedInbounds) > 0 {
+			// Log sample data from first inbound for verification
+			logger.Infof("Sample inbound data - id=%d, tag=%s, up=%d, down=%d, clientStats=%d",
+				updatedInbounds[0].Id, updatedInbounds[0].Tag, updatedInbounds[0].Up, 
+				updatedInbounds[0].Down, len(updatedInbounds[0].ClientStats))
+			// Also log the inbound that was just updated if it exists
+			for _, inbound := range updatedInbounds {
+				if inbound.SlaveId == slaveId {
+					logger.Infof("Slave %d inbound - id=%d, tag=%s, up=%d, down=%d",
+						slaveId, inbound.Id, inbound.Tag, inbound.Up, inbound.Down)
+				}
+			}
+		}
+		logger.Infof("Calling BroadcastInbounds with %d inbounds", len(updatedInbounds))
+		ws.BroadcastInbounds(updatedInbounds)
+		logger.Infof("BroadcastInbounds completed (broadcasted %d inbounds to frontend)", len(updatedInbounds))
+	}
+
+	
+	// Get online clients and last online map
+	onlineClients := s.GetAllOnlineClients()
+	lastOnlineMap, err := inboundService.GetClientsLastOnline()
+	if err != nil {
+		logger.Warning("Failed to get last online map:", err)
+		lastOnlineMap = make(map[string]int64)
+	}
+	
+	// Broadcast traffic update with online status
+	trafficUpdate := map[string]any{
+		"onlineClients": onlineClients,
+		"lastOnlineMap": lastOnlineMap,
+	}
+	ws.BroadcastTraffic(trafficUpdate)
+	logger.Debugf("Broadcasted traffic update: %d online clients", len(onlineClients))
+	
+	// Get and broadcast outbounds if any
+	outboundService := OutboundService{}
+	updatedOutbounds, err := outboundService.GetOutboundsTraffic()
+	if err != nil {
+		logger.Warning("Failed to get outbounds for websocket broadcast:", err)
+	} else if updatedOutbounds != nil && len(updatedOutbounds) > 0 {
+		ws.BroadcastOutbounds(updatedOutbounds)
+		logger.Debugf("Broadcasted %d outbounds to frontend", len(updatedOutbounds))
+	}
+
+	return nil
+}
+
+// applyTrafficStats adds the inbound, user, account and outbound counters of
+// a traffic report inside tx. Any failed write aborts the whole report.
+func (s *SlaveService) applyTrafficStats(tx *gorm.DB, slaveId int, data map[string]interface{}, now time.Time) error {
+	history := make(trafficHistoryBatch)
+
 	// Process inbound traffic stats
 	if inbounds, ok := data["inbounds"].(map[string]interface{}); ok {
 		logger.Infof("ProcessTrafficStats: Processing %d inbounds for slave %d", len(inbounds), slaveId)
@@ -404,7 +885,7 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 			downlink, _ := stats["downlink"].(float64)
 
 			// Update inbounds table directly
-			result := db.Model(&model.Inbound{}).
+			result := tx.Model(&model.Inbound{}).
 				Where("tag = ? AND slave_id = ?", inboundTag, slaveId).
 				Updates(map[string]interface{}{
 					"up":       gorm.Expr("up + ?", int64(uplink)),
@@ -413,11 +894,20 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 				})
 
 			if result.Error != nil {
-				logger.Errorf("Failed to update inbound traffic: slave=%d, tag=%s, error=%v",
-					slaveId, inboundTag, result.Error)
-			} else {
-				logger.Infof("Updated inbound traffic: slave=%d, tag=%s, up=%d, down=%d, rows=%d",
-					slaveId, inboundTag, int64(uplink), int64(downlink), result.RowsAffected)
+				return fmt.Errorf("update inbound traffic: slave=%d, tag=%s: %w", slaveId, inboundTag, result.Error)
+			}
+			logger.Infof("Updated inbound traffic: slave=%d, tag=%s, up=%d, down=%d, rows=%d",
+				slaveId, inboundTag, int64(uplink), int64(downlink), result.RowsAffected)
+
+			if result.RowsAffected > 0 && (uplink != 0 || downlink != 0) {
+				var inboundIds []int
+				if err := tx.Model(&model.Inbound{}).Where("tag = ? AND slave_id = ?", inboundTag, slaveId).Pluck("id", &inboundIds).Error; err != nil {
+					return err
+				}
+				for _, inboundId := range inboundIds {
+					history.add(TrafficScopeInbound, strconv.Itoa(inboundId), int64(uplink), int64(downlink))
+				}
+				history.add(TrafficScopeSlave, strconv.Itoa(slaveId), int64(uplink), int64(downlink))
 			}
 		}
 	}
@@ -444,22 +934,27 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 
 			// Update client traffic
 			var clientTraffic xray.ClientTraffic
-			result := db.Where("email = ?", email).First(&clientTraffic)
-
-			if result.Error == nil {
-				// Update existing client
-				clientTraffic.Up += int64(uplink)
-				clientTraffic.Down += int64(downlink)
-				clientTraffic.AllTime += int64(uplink) + int64(downlink)
-				clientTraffic.LastOnline = now.Unix()
-				db.Save(&clientTraffic)
-
-
-
-				logger.Infof("Updated user traffic: email=%s, up=%d, down=%d, inbound_id=%d",
-					email, int64(uplink), int64(downlink), clientTraffic.InboundId)
-			} else {
+			result := tx.Where("email = ?", email).First(&clientTraffic)
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 				logger.Debugf("User not found in database: %s", email)
+				continue
+			}
+			if result.Error != nil {
+				return result.Error
+			}
+
+			clientTraffic.Up += int64(uplink)
+			clientTraffic.Down += int64(downlink)
+			clientTraffic.AllTime += int64(uplink) + int64(downlink)
+			clientTraffic.LastOnline = now.Unix()
+			if err := tx.Save(&clientTraffic).Error; err != nil {
+				return fmt.Errorf("update user traffic: email=%s: %w", email, err)
+			}
+			logger.Infof("Updated user traffic: email=%s, up=%d, down=%d, inbound_id=%d",
+				email, int64(uplink), int64(downlink), clientTraffic.InboundId)
+			history.add(TrafficScopeClient, email, int64(uplink), int64(downlink))
+			if clientTraffic.AccountId > 0 {
+				history.add(TrafficScopeAccount, strconv.Itoa(clientTraffic.AccountId), int64(uplink), int64(downlink))
 			}
 		}
 		
@@ -482,7 +977,13 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 			
 			// Get account association
 			var clientTraffic xray.ClientTraffic
-			if err := db.Where("email = ?", email).First(&clientTraffic).Error; err == nil && clientTraffic.AccountId > 0 {
+			if err := tx.Where("email = ?", email).First(&clientTraffic).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				}
+				return err
+			}
+			if clientTraffic.AccountId > 0 {
 				uplink, _ := userData["uplink"].(float64)
 				downlink, _ := userData["downlink"].(float64)
 				
@@ -496,19 +997,23 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 		// Update account traffic by aggregating from all its clients
 		for accountId := range accountTrafficMap {
 			var totalUp, totalDown int64
-			err := db.Model(&xray.ClientTraffic{}).
+			err := tx.Model(&xray.ClientTraffic{}).
 				Select("COALESCE(SUM(up), 0) as up, COALESCE(SUM(down), 0) as down").
 				Where("account_id = ?", accountId).
 				Row().Scan(&totalUp, &totalDown)
-			if err == nil {
-				db.Model(&model.Account{}).Where("id = ?", accountId).
-					Updates(map[string]interface{}{
-						"up":        totalUp,
-						"down":      totalDown,
-						"updatedAt": now.UnixMilli(),
-					})
-				logger.Debugf("Updated account %d traffic: up=%d, down=%d", accountId, totalUp, totalDown)
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&model.Account{}).Where("id = ?", accountId).
+				Updates(map[string]interface{}{
+					"up":        totalUp,
+					"down":      totalDown,
+					"updatedAt": now.UnixMilli(),
+				}).Error
+			if err != nil {
+				return fmt.Errorf("update account %d traffic: %w", accountId, err)
 			}
+			logger.Debugf("Updated account %d traffic: up=%d, down=%d", accountId, totalUp, totalDown)
 		}
 	}
 
@@ -533,129 +1038,39 @@ func (s *SlaveService) ProcessTrafficStats(slaveId int, data map[string]interfac
 
 			// Update or create outbound traffic record
 			var outbound model.OutboundTraffics
-			result := db.Where("tag = ? AND slave_id = ?", outboundTag, slaveId).
+			result := tx.Where("tag = ? AND slave_id = ?", outboundTag, slaveId).
 				FirstOrCreate(&outbound, model.OutboundTraffics{Tag: outboundTag, SlaveId: slaveId})
 
-			if result.Error == nil {
-				outbound.Up += int64(uplink)
-				outbound.Down += int64(downlink)
-				outbound.Total = outbound.Up + outbound.Down
-				db.Save(&outbound)
-
-				logger.Infof("Updated outbound traffic: slave=%d, tag=%s, up=%d, down=%d, total=%d",
-					slaveId, outboundTag, int64(uplink), int64(downlink), outbound.Total)
-			} else {
-				logger.Errorf("Failed to update outbound traffic: slave=%d, tag=%s, error=%v",
-					slaveId, outboundTag, result.Error)
+			if result.Error != nil {
+				return fmt.Errorf("update outbound traffic: slave=%d, tag=%s: %w", slaveId, outboundTag, result.Error)
 			}
-		}
-	}
-
-	// Check and disable clients that exceeded traffic or expiry limits
-	inboundService := InboundService{}
-	accountService := AccountService{}
-	needConfigPush := false
-	
-	// 1. Check individual client limits (legacy support)
-	disabledClientCount, err := s.checkAndDisableInvalidClients(db, slaveId)
-	if err != nil {
-		logger.Warning("Error checking invalid clients:", err)
-	} else if disabledClientCount > 0 {
-		logger.Infof("Disabled %d clients on slave %d due to individual traffic/expiry limits", disabledClientCount, slaveId)
-		needConfigPush = true
-	}
-	
-	// 2. Check account-level traffic limits
-	trafficLimitSlaves, err := accountService.DisableClientsExceedingAccountLimit()
-	if err != nil {
-		logger.Warning("Error checking account traffic limits:", err)
-	} else if len(trafficLimitSlaves) > 0 {
-		logger.Infof("Detected accounts disabled due to traffic limits on slaves: %v", trafficLimitSlaves)
-		needConfigPush = true
-	}
-	
-	// 3. Check account-level expiry
-	expirySlaves, err := accountService.DisableExpiredAccountClients()
-	if err != nil {
-		logger.Warning("Error checking account expiry:", err)
-	} else if len(expirySlaves) > 0 {
-		logger.Infof("Detected accounts disabled due to expiry on slaves: %v", expirySlaves)
-		needConfigPush = true
-	}
-	
-	// Push updated config to slave if any clients/accounts were disabled
-	if needConfigPush {
-		if err := s.PushConfig(slaveId); err != nil {
-			logger.Errorf("Failed to push config after disabling clients on slave %d: %v", slaveId, err)
-		} else {
-			logger.Infof("Pushed updated config to slave %d after disabling clients/accounts", slaveId)
-		}
-	}
-	
-	// Broadcast updates to frontend via WebSocket for real-time display
-	// Get updated inbounds with accumulated traffic from database
-	// IMPORTANT: Create a new InboundService instance to force fresh database query
-	// This ensures we don't get cached data from the previous operations
-	freshInboundService := InboundService{}
-	updatedInbounds, err := freshInboundService.GetAllInbounds()
-	if err != nil {
-		logger.Warning("Failed to get inbounds for websocket broadcast:", err)
-	} else if updatedInbounds == nil {
-		logger.Warning("GetAllInbounds returned nil (no error)")
-	} else {
-		logger.Infof("GetAllInbounds returned %d inbounds", len(updatedInbounds))
-		if len(updatedInbounds) > 0 {
-			// Log sample data from first inbound for verification
-			logger.Infof("Sample inbound data - id=%d, tag=%s, up=%d, down=%d, clientStats=%d",
-				updatedInbounds[0].Id, updatedInbounds[0].Tag, updatedInbounds[0].Up, 
-				updatedInbounds[0].Down, len(updatedInbounds[0].ClientStats))
-			// Also log the inbound that was just updated if it exists
-			for _, inbound := range updatedInbounds {
-				if inbound.SlaveId == slaveId {
-					logger.Infof("Slave %d inbound - id=%d, tag=%s, up=%d, down=%d",
-						slaveId, inbound.Id, inbound.Tag, inbound.Up, inbound.Down)
-				}
+			outbound.Up += int64(uplink)
+			outbound.Down += int64(downlink)
+			outbound.Total = outbound.Up + outbound.Down
+			if err := tx.Save(&outbound).Error; err != nil {
+				return fmt.Errorf("update outbound traffic: slave=%d, tag=%s: %w", slaveId, outboundTag, err)
 			}
+			logger.Infof("Updated outbound traffic: slave=%d, tag=%s, up=%d, down=%d, total=%d",
+				slaveId, outboundTag, int64(uplink), int64(downlink), outbound.Total)
 		}
-		logger.Infof("Calling BroadcastInbounds with %d inbounds", len(updatedInbounds))
-		ws.BroadcastInbounds(updatedInbounds)
-		logger.Infof("BroadcastInbounds completed (broadcasted %d inbounds to frontend)", len(updatedInbounds))
 	}
 
-	
-	// Get online clients and last online map
-	onlineClients := s.GetAllOnlineClients()
-	lastOnlineMap, err := inboundService.GetClientsLastOnline()
-	if err != nil {
-		logger.Warning("Failed to get last online map:", err)
-		lastOnlineMap = make(map[string]int64)
-	}
-	
-	// Broadcast traffic update with online status
-	trafficUpdate := map[string]any{
-		"onlineClients": onlineClients,
-		"lastOnlineMap": lastOnlineMap,
+	if err := history.write(tx, now); err != nil {
+		return fmt.Errorf("write traffic history: slave=%d: %w", slaveId, err)
 	}
-	ws.BroadcastTraffic(trafficUpdate)
-	logger.Debugf("Broadcasted traffic update: %d online clients", len(onlineClients))
-	
-	// Get and broadcast outbounds if any
-	outboundService := OutboundService{}
-	updatedOutbounds, err := outboundService.GetOutboundsTraffic()
-	if err != nil {
-		logger.Warning("Failed to get outbounds for websocket broadcast:", err)
-	} else if updatedOutbounds != nil && len(updatedOutbounds) > 0 {
-		ws.BroadcastOutbounds(updatedOutbounds)
-		logger.Debugf("Broadcasted %d outbounds to frontend", len(updatedOutbounds))
-	}
-
 	return nil
 }
 
-func (s *SlaveService) GenerateInstallCommand(slaveId int, req *http.Request, basePath string) (string, error) {
-	slave, err := s.GetSlave(slaveId)
+
+// GenerateInstallCommand builds the install command for a slave together with
+// a fresh one-time join token and the token's expiry timestamp.
+func (s *SlaveService) GenerateInstallCommand(slaveId int, req *http.Request, basePath string) (string, int64, error) {
+	if _, err := s.GetSlave(slaveId); err != nil {
+		return "", 0, err
+	}
+	joinToken, expiry, err := s.IssueJoinToken(slaveId)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	
 	// Get master server address from request
@@ -671,9 +1086,9 @@ func (s *SlaveService) GenerateInstallCommand(slaveId int, req *http.Request, ba
 	
 	// Generate install command
 	command := fmt.Sprintf("bash <(curl -Ls https://raw.githubusercontent.com/Copperchaleu/3x-ui-cluster/main/install.sh) slave %s %s",
-		masterUrl, slave.Secret)
+		masterUrl, joinToken)
 	
-	return command, nil
+	return command, expiry, nil
 }
 
 // ProcessCertReport processes certificate information reported by slave
@@ -782,11 +1197,13 @@ func (s *SlaveService) filterDisabledClients(inbound *model.Inbound) (*model.Inb
 	}
 	
 	accountEnableMap := make(map[int]bool)
+	accountLimitIPMap := make(map[int]int)
 	if len(accountIds) > 0 {
 		var accounts []model.Account
 		if err := db.Where("id IN ?", accountIds).Find(&accounts).Error; err == nil {
 			for _, acc := range accounts {
 				accountEnableMap[acc.Id] = acc.Enable
+				accountLimitIPMap[acc.Id] = acc.LimitIP
 			}
 		}
 	}
@@ -795,8 +1212,10 @@ func (s *SlaveService) filterDisabledClients(inbound *model.Inbound) (*model.Inb
 	// Priority: If client is associated with account, use account's enable status
 	// Otherwise, use client's own enable status
 	enableMap := make(map[string]bool)
+	limitIPMap := make(map[string]int)
 	for _, ct := range clientTraffics {
 		var finalEnabled bool
+		limitIPMap[ct.Email] = accountLimitIPMap[ct.AccountId]
 		
 		// If client is associated with an account, prioritize account status
 		if ct.AccountId > 0 {
@@ -831,6 +1250,12 @@ func (s *SlaveService) filterDisabledClients(inbound *model.Inbound) (*model.Inb
 			continue
 		}
 		
+		// Clients over their IP limit are removed while the block lasts
+		if isIpLimitBlocked(inbound.SlaveId, email) {
+			logger.Debugf("Filtering out IP limited client: %s from inbound %d", email, inbound.Id)
+			continue
+		}
+
 		// Check if client is enabled
 		if enabled, exists := enableMap[email]; exists && !enabled {
 			// Client is disabled, skip it
@@ -838,6 +1263,14 @@ func (s *SlaveService) filterDisabledClients(inbound *model.Inbound) (*model.Inb
 			continue
 		}
 		
+		// Slaves only report the source IPs of clients with an IP limit, so
+		// clients of an account with one carry the account's limit
+		if limit := limitIPMap[email]; limit > 0 {
+			if own, _ := client["limitIp"].(float64); own <= 0 || int(own) > limit {
+				client["limitIp"] = limit
+			}
+		}
+
 		// Client is enabled or not found in traffic table, keep it
 		filteredClients = append(filteredClients, clientInterface)
 	}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// agentUpgradeTimeout is how long a slave has to reconnect with a new agent
+// before it restores the previous binary.
+const agentUpgradeTimeout = 3 * time.Minute
+
+// agentUpgradeGrace covers the restart and reconnect delay after the slave's own deadline.
+const agentUpgradeGrace = 30 * time.Second
+
+// Agent upgrade states stored in model.Slave.AgentUpgradeStatus
+const (
+	AgentUpgradePending = "pending"
+	AgentUpgradeDone    = "done"
+	AgentUpgradeFailed  = "failed"
+)
+
+// The master's own executable doubles as the slave agent. Its checksum is
+// computed once, the file does not change while the panel runs.
+var (
+	agentSumOnce sync.Once
+	agentSum     string
+	agentSumErr  error
+)
+
+// GetAgentBinaryPath returns the executable the master serves to slaves.
+func GetAgentBinaryPath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func getAgentBinarySha256() (string, error) {
+	agentSumOnce.Do(func() {
+		path, err := GetAgentBinaryPath()
+		if err != nil {
+			agentSumErr = err
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			agentSumErr = err
+			return
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			agentSumErr = err
+			return
+		}
+		agentSum = hex.EncodeToString(hash.Sum(nil))
+	})
+	return agentSum, agentSumErr
+}
+
+// getAgentArtifact describes the upgrade offered to slaves: the configured
+// artifact URL with its checksum, or else the master's own executable, which
+// only runs on slaves of the same platform.
+func (s *SlaveService) getAgentArtifact() (map[string]any, error) {
+	artifact := map[string]any{
+		"version": config.GetVersion(),
+		"timeout": int64(agentUpgradeTimeout / time.Second),
+	}
+	settingService := SettingService{}
+	url, err := settingService.GetSlaveAgentUrl()
+	if err != nil {
+		return nil, err
+	}
+	if url != "" {
+		sum, err := settingService.GetSlaveAgentSha256()
+		if err != nil {
+			return nil, err
+		}
+		if sum == "" {
+			return nil, fmt.Errorf("no checksum configured for the slave agent url")
+		}
+		artifact["url"] = url
+		artifact["sha256"] = strings.ToLower(strings.TrimSpace(sum))
+		return artifact, nil
+	}
+	sum, err := getAgentBinarySha256()
+	if err != nil {
+		return nil, err
+	}
+	artifact["sha256"] = sum
+	artifact["os"] = runtime.GOOS
+	artifact["arch"] = runtime.GOARCH
+	return artifact, nil
+}
+
+// UpgradeSlaveAgent makes a slave replace its agent with the master's version
+// and waits until it reconnected with that version. A slave whose new agent
+// does not reconnect in time restores its previous binary on its own.
+func (s *SlaveService) UpgradeSlaveAgent(slaveId int) (string, error) {
+	artifact, err := s.getAgentArtifact()
+	if err != nil {
+		return "", err
+	}
+	version, _ := artifact["version"].(string)
+	started, err := s.beginAgentUpgrade(slaveId, version)
+	if err != nil {
+		return "", err
+	}
+	if !started {
+		return "", fmt.Errorf("slave %d is already upgrading its agent", slaveId)
+	}
+
+	logger.Infof("Upgrading agent of slave %d to %s", slaveId, version)
+	if err := s.callSlave(slaveId, SlaveMethodUpgradeAgent, artifact, nil, slaveUpdateTimeout); err != nil {
+		s.finishAgentUpgrade(slaveId, err)
+		return "", err
+	}
+	return s.waitAgentUpgrade(slaveId)
+}
+
+// RollUpgradeAgent upgrades the agent of the given slaves one at a time,
+// stopping at the first slave that does not come back with the new version.
+func (s *SlaveService) RollUpgradeAgent(slaveIds []int) ([]SlaveUpdateResult, error) {
+	return s.rollOut(slaveIds, s.UpgradeSlaveAgent)
+}
+
+// beginAgentUpgrade marks an upgrade as pending unless one is already running.
+func (s *SlaveService) beginAgentUpgrade(slaveId int, version string) (bool, error) {
+	db := database.GetDB()
+	now := time.Now()
+	stale := now.Add(-agentUpgradeTimeout - agentUpgradeGrace).Unix()
+	result := db.Model(&model.Slave{}).
+		Where("id = ? AND (COALESCE(agent_upgrade_status, '') <> ? OR agent_upgrade_at < ?)", slaveId, AgentUpgradePending, stale).
+		Updates(map[string]any{
+			"agent_target_version": version,
+			"agent_upgrade_status": AgentUpgradePending,
+			"agent_upgrade_error":  "",
+			"agent_upgrade_at":     now.Unix(),
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// finishAgentUpgrade records the outcome of a pending upgrade.
+func (s *SlaveService) finishAgentUpgrade(slaveId int, upgradeErr error) {
+	updates := map[string]any{"agent_upgrade_status": AgentUpgradeDone, "agent_upgrade_error": ""}
+	if upgradeErr != nil {
+		updates["agent_upgrade_status"] = AgentUpgradeFailed
+		updates["agent_upgrade_error"] = upgradeErr.Error()
+	}
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).
+		Where("id = ? AND agent_upgrade_status = ?", slaveId, AgentUpgradePending).
+		Updates(updates).Error
+	if err != nil {
+		logger.Warningf("Failed to record agent upgrade of slave %d: %v", slaveId, err)
+	}
+}
+
+// waitAgentUpgrade polls until the slave confirmed the new version through
+// its stats report or the upgrade timed out.
+func (s *SlaveService) waitAgentUpgrade(slaveId int) (string, error) {
+	deadline := time.Now().Add(agentUpgradeTimeout + agentUpgradeGrace)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		slave, err := s.GetSlave(slaveId)
+		if err != nil {
+			return "", err
+		}
+		switch slave.AgentUpgradeStatus {
+		case AgentUpgradeDone:
+			return slave.Version, nil
+		case AgentUpgradeFailed:
+			return "", fmt.Errorf("agent upgrade failed: %s", slave.AgentUpgradeError)
+		}
+	}
+	err := fmt.Errorf("slave did not reconnect with the new agent, it rolls back to the previous version")
+	s.finishAgentUpgrade(slaveId, err)
+	return "", err
+}
+
+// checkAgentVersion runs on every stats report. It confirms a pending upgrade
+// once the slave reports the target version, fails it after the timeout, and
+// offers an upgrade to outdated slaves when automatic upgrades are enabled.
+func (s *SlaveService) checkAgentVersion(slaveId int, uiVersion string) {
+	slave, err := s.GetSlave(slaveId)
+	if err != nil {
+		return
+	}
+	if slave.AgentUpgradeStatus == AgentUpgradePending {
+		if uiVersion == slave.AgentTargetVersion {
+			logger.Infof("Slave %d reconnected with agent %s", slaveId, uiVersion)
+			s.finishAgentUpgrade(slaveId, nil)
+		} else if time.Since(time.Unix(slave.AgentUpgradeAt, 0)) > agentUpgradeTimeout+agentUpgradeGrace {
+			s.finishAgentUpgrade(slaveId, fmt.Errorf("slave is running %s after the upgrade timeout", uiVersion))
+		}
+		return
+	}
+
+	masterVersion := config.GetVersion()
+	if uiVersion == masterVersion || slave.Revoked {
+		return
+	}
+	// A failed upgrade to this version is not retried automatically
+	if slave.AgentTargetVersion == masterVersion && slave.AgentUpgradeStatus == AgentUpgradeFailed {
+		return
+	}
+	settingService := SettingService{}
+	if auto, err := settingService.GetSlaveAutoUpgrade(); err != nil || !auto {
+		return
+	}
+	go func() {
+		if _, err := s.UpgradeSlaveAgent(slaveId); err != nil {
+			logger.Warningf("Automatic agent upgrade of slave %d failed: %v", slaveId, err)
+		}
+	}()
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
+	"gorm.io/gorm"
+)
+
+const (
+	joinTokenTTL       = 24 * time.Hour
+	slaveSecretLength  = 48
+	slaveJoinTokenSize = 32
+)
+
+var (
+	ErrSlaveUnauthorized = errors.New("slave authentication failed")
+	ErrSlaveRevoked      = errors.New("slave has been revoked")
+	ErrSlaveHostMismatch = errors.New("slave identity is already bound to another host")
+	ErrSlaveClockSkew    = errors.New("slave clock differs too much from the master")
+	ErrSlaveReplayed     = errors.New("slave request was already used")
+	ErrSlaveOutdated     = errors.New("slave agent signs requests without a nonce, update it")
+)
+
+// slaveNonces remembers the nonces of accepted slave requests until their
+// timestamp leaves the allowed skew, so a captured request cannot be sent
+// again.
+var slaveNonces = struct {
+	sync.Mutex
+	expiries map[string]int64 // Unix time a nonce may be forgotten at, by slave ID and nonce
+}{expiries: make(map[string]int64)}
+
+// useSlaveNonce records a nonce of a slave. It returns false when the nonce
+// was used before.
+func useSlaveNonce(slaveId int, nonce string, timestamp int64) bool {
+	now := time.Now().Unix()
+	key := strconv.Itoa(slaveId) + ":" + nonce
+	slaveNonces.Lock()
+	defer slaveNonces.Unlock()
+	for k, expiry := range slaveNonces.expiries {
+		if expiry < now {
+			delete(slaveNonces.expiries, k)
+		}
+	}
+	if _, ok := slaveNonces.expiries[key]; ok {
+		return false
+	}
+	slaveNonces.expiries[key] = timestamp + int64(slaveauth.MaxSkew/time.Second)
+	return true
+}
+
+// SlaveEnrollment is returned to a slave after it exchanged its join token.
+type SlaveEnrollment struct {
+	SlaveId int    `json:"slaveId"`
+	Secret  string `json:"secret"`
+}
+
+func hashJoinToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueJoinToken creates a new one-time join token for a slave, replacing any
+// previous unused token. Only its hash is stored.
+func (s *SlaveService) IssueJoinToken(slaveId int) (string, int64, error) {
+	token := random.Seq(slaveJoinTokenSize)
+	expiry := time.Now().Add(joinTokenTTL).Unix()
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Updates(map[string]any{
+		"join_token_hash":   hashJoinToken(token),
+		"join_token_expiry": expiry,
+	}).Error
+	if err != nil {
+		return "", 0, err
+	}
+	return token, expiry, nil
+}
+
+// EnrollSlave exchanges a join token for a per-slave signing credential and
+// binds the slave to the host it enrolled from. A slave that still holds a
+// legacy secret may present it once in place of a join token.
+func (s *SlaveService) EnrollSlave(token, hostId string) (*SlaveEnrollment, error) {
+	if token == "" || hostId == "" {
+		return nil, ErrSlaveUnauthorized
+	}
+	db := database.GetDB()
+	var slave model.Slave
+	err := db.Where("join_token_hash = ? AND join_token_expiry > ?", hashJoinToken(token), time.Now().Unix()).
+		First(&slave).Error
+	if err != nil {
+		if err := db.Where("secret = ? AND host_id = ? AND revoked = ?", token, "", false).First(&slave).Error; err != nil {
+			return nil, ErrSlaveUnauthorized
+		}
+		logger.Warningf("Slave %d enrolled with its legacy secret, the secret has been rotated", slave.Id)
+	}
+
+	secret := random.Seq(slaveSecretLength)
+	err = db.Model(&model.Slave{}).Where("id = ?", slave.Id).Updates(map[string]any{
+		"secret":            secret,
+		"pending_secret":    "",
+		"secret_rotated_at": time.Now().Unix(),
+		"host_id":           hostId,
+		"revoked":           false,
+		"join_token_hash":   "",
+		"join_token_expiry": 0,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// A previous host that is still connected must not keep the identity
+	s.RemoveSlaveConn(slave.Id)
+
+	logger.Infof("Slave %d enrolled from host %s", slave.Id, hostId)
+	return &SlaveEnrollment{SlaveId: slave.Id, Secret: secret}, nil
+}
+
+// AuthenticateSlave verifies the signed headers of a slave connection request.
+// Only ErrSlaveUnauthorized and ErrSlaveRevoked mean the credential itself is
+// invalid; clock skew and lookup errors are transient and must not make the
+// slave discard it.
+func (s *SlaveService) AuthenticateSlave(req *http.Request) (*model.Slave, error) {
+	slaveId, err := strconv.Atoi(req.Header.Get(slaveauth.IdHeader))
+	if err != nil {
+		return nil, ErrSlaveUnauthorized
+	}
+	hostId := req.Header.Get(slaveauth.HostHeader)
+	signature := req.Header.Get(slaveauth.SignatureHeader)
+	timestamp, err := strconv.ParseInt(req.Header.Get(slaveauth.TimestampHeader), 10, 64)
+	if err != nil || hostId == "" || signature == "" {
+		return nil, ErrSlaveUnauthorized
+	}
+	nonce := req.Header.Get(slaveauth.NonceHeader)
+	if nonce == "" {
+		// Agents from before nonces keep their credential on this error
+		return nil, ErrSlaveOutdated
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > slaveauth.MaxSkew || skew < -slaveauth.MaxSkew {
+		return nil, ErrSlaveClockSkew
+	}
+
+	slave, err := s.GetSlave(slaveId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSlaveUnauthorized
+		}
+		return nil, fmt.Errorf("look up slave %d: %w", slaveId, err)
+	}
+	if slave.Revoked {
+		return nil, ErrSlaveRevoked
+	}
+	if slave.HostId != hostId {
+		return nil, ErrSlaveHostMismatch
+	}
+
+	signed := slaveauth.Request{
+		SlaveId:   slaveId,
+		HostId:    hostId,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+	}
+	pending := false
+	switch {
+	case slaveauth.Verify(slave.Secret, signed, signature):
+	case slaveauth.Verify(slave.PendingSecret, signed, signature):
+		pending = true
+	default:
+		return nil, ErrSlaveUnauthorized
+	}
+	// Only signed nonces are remembered, others could fill the cache
+	if !useSlaveNonce(slaveId, nonce, timestamp) {
+		return nil, ErrSlaveReplayed
+	}
+	if pending {
+		// The slave stored a rotated credential but its confirmation got lost
+		if err := s.commitRotatedSecret(slaveId); err != nil {
+			return nil, err
+		}
+	}
+	return slave, nil
+}
+
+// IsSlaveConnected reports whether a slave currently holds an open connection.
+func (s *SlaveService) IsSlaveConnected(slaveId int) bool {
+	slaveLock.RLock()
+	defer slaveLock.RUnlock()
+	_, ok := slaveConns[slaveId]
+	return ok
+}
+
+// RotateSlaveSecret sends a new signing credential to a connected slave.
+// The old credential stays valid until the slave confirms it stored the new one.
+func (s *SlaveService) RotateSlaveSecret(slaveId int) error {
+	if !s.IsSlaveConnected(slaveId) {
+		return fmt.Errorf("slave %d not connected", slaveId)
+	}
+	secret := random.Seq(slaveSecretLength)
+	db := database.GetDB()
+	if err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Update("pending_secret", secret).Error; err != nil {
+		return err
+	}
+	return s.sendToSlave(slaveId, map[string]any{
+		"type":   "rotate_credential",
+		"secret": secret,
+	})
+}
+
+// ProcessCredentialRotated promotes the pending credential after the slave confirmed it.
+func (s *SlaveService) ProcessCredentialRotated(slaveId int) error {
+	return s.commitRotatedSecret(slaveId)
+}
+
+func (s *SlaveService) commitRotatedSecret(slaveId int) error {
+	db := database.GetDB()
+	result := db.Model(&model.Slave{}).
+		Where("id = ? AND pending_secret <> ?", slaveId, "").
+		Updates(map[string]any{
+			"secret":            gorm.Expr("pending_secret"),
+			"pending_secret":    "",
+			"secret_rotated_at": time.Now().Unix(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logger.Infof("Slave %d credential rotated", slaveId)
+	}
+	return nil
+}
+
+// RevokeSlave invalidates a slave's credential and join token and drops its connection.
+// The slave can only come back through a new install command.
+func (s *SlaveService) RevokeSlave(slaveId int) error {
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Updates(map[string]any{
+		"revoked":           true,
+		"secret":            "",
+		"pending_secret":    "",
+		"host_id":           "",
+		"join_token_hash":   "",
+		"join_token_expiry": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	s.RemoveSlaveConn(slaveId)
+	if err := s.UpdateSlaveStatus(slaveId, "offline", ""); err != nil {
+		logger.Warningf("Failed to mark revoked slave %d offline: %v", slaveId, err)
+	}
+	logger.Infof("Slave %d revoked", slaveId)
+	return nil
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/util/slaveauth"
+)
+
+func TestUseSlaveNonce(t *testing.T) {
+	now := time.Now().Unix()
+	if !useSlaveNonce(1, "nonce-a", now) {
+		t.Fatal("first use of a nonce was rejected")
+	}
+	if useSlaveNonce(1, "nonce-a", now) {
+		t.Error("replayed nonce was accepted")
+	}
+	if !useSlaveNonce(2, "nonce-a", now) {
+		t.Error("nonce of another slave was rejected")
+	}
+
+	// Nonces are forgotten once their timestamp is outside the skew
+	old := now - int64(slaveauth.MaxSkew/time.Second) - 1
+	useSlaveNonce(1, "nonce-b", old)
+	useSlaveNonce(1, "nonce-c", now)
+	slaveNonces.Lock()
+	_, kept := slaveNonces.expiries["1:nonce-b"]
+	slaveNonces.Unlock()
+	if kept {
+		t.Error("expired nonce was kept")
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// ipLimitBlockDuration is how long a client stays removed from slaves that
+// cannot ban IPs, matching the default Fail2Ban bantime of the IP limit jail.
+const ipLimitBlockDuration = 30 * time.Minute
+
+// Client source IPs reported by slaves since the last CheckClientIpJob run,
+// merged across all slaves so IP limits apply to the whole cluster.
+var (
+	slaveClientIps = make(map[string]map[string]int64) // email -> ip -> last seen
+	slaveFail2Ban  = make(map[int]bool)                // Whether a slave can ban IPs
+	ipLimitBlocks  = make(map[int]map[string]int64)    // slaveId -> email -> block expiry
+)
+
+// ProcessClientIps merges a client_ips report from a slave's access log.
+func (s *SlaveService) ProcessClientIps(slaveId int, data map[string]interface{}) {
+	clients, _ := data["clients"].(map[string]interface{})
+	fail2ban, _ := data["fail2ban"].(bool)
+
+	slaveLock.Lock()
+	defer slaveLock.Unlock()
+	slaveFail2Ban[slaveId] = fail2ban
+	for email, rawIps := range clients {
+		ips, ok := rawIps.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, rawIp := range ips {
+			entry, ok := rawIp.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip, _ := entry["ip"].(string)
+			timestamp, _ := entry["timestamp"].(float64)
+			if ip == "" {
+				continue
+			}
+			if _, ok := slaveClientIps[email]; !ok {
+				slaveClientIps[email] = make(map[string]int64)
+			}
+			if last, ok := slaveClientIps[email][ip]; !ok || int64(timestamp) > last {
+				slaveClientIps[email][ip] = int64(timestamp)
+			}
+		}
+	}
+}
+
+// TakeClientIps returns the client IPs reported since the last call and clears them.
+func (s *SlaveService) TakeClientIps() map[string]map[string]int64 {
+	slaveLock.Lock()
+	defer slaveLock.Unlock()
+	reports := slaveClientIps
+	slaveClientIps = make(map[string]map[string]int64)
+	return reports
+}
+
+// LimitClientIps enforces an exceeded IP limit on every slave serving the client.
+// Slaves with Fail2Ban temporarily ban the given IPs and drop their connections.
+// Slaves that cannot ban IPs get the client removed from their config for
+// ipLimitBlockDuration instead, as dropping the connections alone would let
+// the same IPs reconnect right away. The block applies to account clients as
+// well, since it does not depend on the client's or account's enable flag.
+func (s *SlaveService) LimitClientIps(email string, ips []string) error {
+	db := database.GetDB()
+	var slaveIds []int
+	err := db.Model(&model.Inbound{}).
+		Joins("JOIN client_traffics ON client_traffics.inbound_id = inbounds.id").
+		Where("client_traffics.email = ? AND inbounds.enable = ?", email, true).
+		Distinct().
+		Pluck("inbounds.slave_id", &slaveIds).Error
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	expiry := time.Now().Add(ipLimitBlockDuration).Unix()
+	for _, slaveId := range slaveIds {
+		slaveLock.Lock()
+		fail2ban := slaveFail2Ban[slaveId]
+		_, blocked := ipLimitBlocks[slaveId][email]
+		if !fail2ban {
+			if ipLimitBlocks[slaveId] == nil {
+				ipLimitBlocks[slaveId] = make(map[string]int64)
+			}
+			ipLimitBlocks[slaveId][email] = expiry
+		}
+		slaveLock.Unlock()
+
+		if fail2ban {
+			err := s.sendToSlave(slaveId, map[string]any{
+				"type":  "limit_ip",
+				"email": email,
+				"ips":   ips,
+			})
+			if err != nil {
+				logger.Warningf("[LIMIT_IP] Failed to send IP block for %s to slave %d: %v", email, slaveId, err)
+			}
+			continue
+		}
+		if blocked {
+			// Already removed from the slave, the block was only extended
+			continue
+		}
+		logger.Warningf("[LIMIT_IP] Blocking client %s on slave %d for %v, the slave cannot ban IPs without Fail2Ban",
+			email, slaveId, ipLimitBlockDuration)
+		if err := s.PushConfig(slaveId); err != nil {
+			errs = append(errs, fmt.Errorf("slave %d: %w", slaveId, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to push config after blocking %s: %v", email, errs)
+	}
+	return nil
+}
+
+// isIpLimitBlocked reports whether email is currently removed from a slave for exceeding its IP limit.
+func isIpLimitBlocked(slaveId int, email string) bool {
+	slaveLock.RLock()
+	defer slaveLock.RUnlock()
+	expiry, ok := ipLimitBlocks[slaveId][email]
+	return ok && expiry > time.Now().Unix()
+}
+
+// ReleaseExpiredIpLimitBlocks lifts expired IP limit blocks and pushes the
+// config to the slaves that serve the released clients again.
+func (s *SlaveService) ReleaseExpiredIpLimitBlocks() {
+	now := time.Now().Unix()
+	released := make([]int, 0)
+	slaveLock.Lock()
+	for slaveId, blocks := range ipLimitBlocks {
+		expired := false
+		for email, expiry := range blocks {
+			if expiry <= now {
+				delete(blocks, email)
+				expired = true
+				logger.Infof("[LIMIT_IP] Released client %s on slave %d", email, slaveId)
+			}
+		}
+		if len(blocks) == 0 {
+			delete(ipLimitBlocks, slaveId)
+		}
+		if expired {
+			released = append(released, slaveId)
+		}
+	}
+	slaveLock.Unlock()
+
+	for _, slaveId := range released {
+		if err := s.PushConfig(slaveId); err != nil {
+			logger.Warningf("[LIMIT_IP] Failed to push config to slave %d after releasing blocks: %v", slaveId, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	ws "github.com/mhsanaei/3x-ui/v2/web/websocket"
+)
+
+// A slave is degraded about slaveDegradedMisses+1 intervals after its last
+// pong, so the read timeout must leave room for that before it drops the
+// connection.
+const (
+	slavePingInterval   = 10 * time.Second
+	slaveDegradedMisses = 2                     // Consecutive missed pongs before a slave is degraded
+	slaveReadTimeout    = 5 * slavePingInterval // Connection is dropped without a pong for this long
+)
+
+// Slave health states
+const (
+	SlaveOnline   = "online"
+	SlaveDegraded = "degraded"
+	SlaveOffline  = "offline"
+)
+
+// slaveHeartbeat counts the pings a slave left unanswered.
+type slaveHeartbeat struct {
+	awaitingPong bool
+	misses       int
+}
+
+// ping records a ping and returns the consecutive misses, counting the
+// previous ping when no pong answered it.
+func (h *slaveHeartbeat) ping() int {
+	if h.awaitingPong {
+		h.misses++
+	}
+	h.awaitingPong = true
+	return h.misses
+}
+
+func (h *slaveHeartbeat) pong() {
+	h.awaitingPong = false
+	h.misses = 0
+}
+
+// slaveHealth returns the status of a connected slave from its missed pongs
+// and the time since its last pong.
+func slaveHealth(misses int, sinceLastPong time.Duration) string {
+	switch {
+	case sinceLastPong >= slaveReadTimeout:
+		return SlaveOffline
+	case misses >= slaveDegradedMisses:
+		return SlaveDegraded
+	}
+	return SlaveOnline
+}
+
+// slaveStatusLock serializes status transitions so each one is reported once.
+var slaveStatusLock sync.Mutex
+
+// MonitorSlaveConn pings a slave connection and tracks its round-trip latency.
+// Every pong extends the read deadline, so a half-open connection makes the
+// pending read fail after slaveReadTimeout and the slave is marked offline.
+// Missed pongs are counted and mark the slave degraded before that.
+// The returned function stops the pinger.
+func (s *SlaveService) MonitorSlaveConn(slaveId int, conn *websocket.Conn) func() {
+	var mu sync.Mutex
+	var heartbeat slaveHeartbeat
+
+	conn.SetReadDeadline(time.Now().Add(slaveReadTimeout))
+	conn.SetPongHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(slaveReadTimeout))
+		mu.Lock()
+		heartbeat.pong()
+		mu.Unlock()
+
+		var latency time.Duration
+		if sentAt, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			latency = time.Since(time.Unix(0, sentAt))
+		}
+		s.recordSlavePong(slaveId, latency)
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(slavePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				missed := heartbeat.ping()
+				mu.Unlock()
+
+				if missed > 0 {
+					s.recordHeartbeatMiss(slaveId, missed)
+				}
+				payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+				// WriteControl may be called concurrently with the other writers
+				if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(5*time.Second)); err != nil {
+					logger.Debugf("Failed to ping slave %d: %v", slaveId, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (s *SlaveService) recordSlavePong(slaveId int, latency time.Duration) {
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Updates(map[string]any{
+		"latency_ms":       latency.Milliseconds(),
+		"heartbeat_misses": 0,
+	}).Error
+	if err != nil {
+		logger.Warningf("Failed to record pong of slave %d: %v", slaveId, err)
+		return
+	}
+	if err := s.SetSlaveStatus(slaveId, SlaveOnline); err != nil {
+		logger.Warningf("Failed to update status of slave %d: %v", slaveId, err)
+	}
+}
+
+func (s *SlaveService) recordHeartbeatMiss(slaveId int, misses int) {
+	db := database.GetDB()
+	if err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Update("heartbeat_misses", misses).Error; err != nil {
+		logger.Warningf("Failed to record heartbeat miss of slave %d: %v", slaveId, err)
+		return
+	}
+	if slaveHealth(misses, 0) != SlaveDegraded {
+		return
+	}
+	if err := s.SetSlaveStatus(slaveId, SlaveDegraded); err != nil {
+		logger.Warningf("Failed to update status of slave %d: %v", slaveId, err)
+	}
+}
+
+// SetSlaveStatus changes the health status of a slave and notifies the panel
+// and the Telegram admins when it actually changed.
+func (s *SlaveService) SetSlaveStatus(slaveId int, status string) error {
+	slaveStatusLock.Lock()
+	defer slaveStatusLock.Unlock()
+
+	slave, err := s.GetSlave(slaveId)
+	if err != nil {
+		return err
+	}
+	if slave.Status == status {
+		return nil
+	}
+
+	db := database.GetDB()
+	updates := map[string]any{"status": status}
+	if status == SlaveOffline {
+		updates["heartbeat_misses"] = 0
+	}
+	if err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	s.notifySlaveStatus(slave, status)
+	return nil
+}
+
+func (s *SlaveService) notifySlaveStatus(slave *model.Slave, status string) {
+	level := "info"
+	switch status {
+	case SlaveOnline:
+		level = "success"
+	case SlaveDegraded:
+		level = "warning"
+	case SlaveOffline:
+		level = "error"
+	}
+	logger.Infof("Slave %d (%s) is now %s, was %s", slave.Id, slave.Name, status, slave.Status)
+	ws.BroadcastNotification("Slave "+status,
+		fmt.Sprintf("Slave %s is now %s (was %s)", slave.Name, status, slave.Status), level)
+
+	tgbot := Tgbot{}
+	if tgbot.IsRunning() {
+		msg := tgbot.I18nBot("tgbot.messages.slaveStatus",
+			"Name=="+slave.Name,
+			"Status=="+status,
+			"OldStatus=="+slave.Status)
+		go tgbot.SendMsgToTgbotAdmins(msg)
+	}
+}
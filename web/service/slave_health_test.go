@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlaveHealthSteps(t *testing.T) {
+	// The master pings every interval; the slave answers the ping at 0 and
+	// then stops answering.
+	var heartbeat slaveHeartbeat
+	heartbeat.ping()
+	heartbeat.pong()
+
+	var statuses []string
+	for elapsed := slavePingInterval; elapsed <= 2*slaveReadTimeout; elapsed += slavePingInterval {
+		status := slaveHealth(heartbeat.ping(), elapsed)
+		if len(statuses) == 0 || statuses[len(statuses)-1] != status {
+			statuses = append(statuses, status)
+		}
+		if status == SlaveOffline {
+			break
+		}
+	}
+	want := []string{SlaveOnline, SlaveDegraded, SlaveOffline}
+	if len(statuses) != len(want) {
+		t.Fatalf("statuses = %v, want %v", statuses, want)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("statuses = %v, want %v", statuses, want)
+		}
+	}
+
+	// A pong brings a degraded slave back
+	heartbeat.pong()
+	if status := slaveHealth(heartbeat.ping(), slavePingInterval); status != SlaveOnline {
+		t.Errorf("status after a pong = %s, want %s", status, SlaveOnline)
+	}
+}
+
+func TestSlaveDegradedBeforeTimeout(t *testing.T) {
+	// Misses are counted on the ping after the unanswered one, so the slave
+	// is degraded slaveDegradedMisses+1 intervals after its last pong
+	degradedAfter := time.Duration(slaveDegradedMisses+1) * slavePingInterval
+	if degradedAfter+slavePingInterval > slaveReadTimeout {
+		t.Errorf("slaves are degraded after %v but dropped after %v, too close to show the degraded state", degradedAfter, slaveReadTimeout)
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+)
+
+// slaveRequestTimeout bounds how long a request waits for the slave's response.
+const slaveRequestTimeout = 15 * time.Second
+
+// Remote commands a slave answers over its WebSocket.
+const (
+	SlaveMethodGetLogs          = "get_logs"
+	SlaveMethodGetXrayLogs      = "get_xray_logs"
+	SlaveMethodGetXrayErrorLogs = "get_xray_error_logs"
+	SlaveMethodInstallXray      = "install_xray"
+	SlaveMethodUpdateGeofile    = "update_geofile"
+	SlaveMethodUpgradeAgent     = "upgrade_agent"
+)
+
+var ErrSlaveRequestTimeout = errors.New("slave did not respond in time")
+
+// slaveResponse is the reply to a request, matched to it by Id.
+type slaveResponse struct {
+	Id     string          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// Requests waiting for a slave response, keyed by correlation id
+var (
+	slaveRequests    = make(map[string]chan *slaveResponse)
+	slaveRequestLock sync.Mutex
+)
+
+// CallSlave sends a request to a connected slave and waits for its response.
+// The result is decoded into result.
+func (s *SlaveService) CallSlave(slaveId int, method string, params map[string]any, result any) error {
+	return s.callSlave(slaveId, method, params, result, slaveRequestTimeout)
+}
+
+// callSlave is CallSlave with a custom timeout for long running commands.
+func (s *SlaveService) callSlave(slaveId int, method string, params map[string]any, result any, timeout time.Duration) error {
+	id := random.Seq(16)
+	ch := make(chan *slaveResponse, 1)
+
+	slaveRequestLock.Lock()
+	slaveRequests[id] = ch
+	slaveRequestLock.Unlock()
+	defer func() {
+		slaveRequestLock.Lock()
+		delete(slaveRequests, id)
+		slaveRequestLock.Unlock()
+	}()
+
+	err := s.sendToSlave(slaveId, map[string]any{
+		"type":   "request",
+		"id":     id,
+		"method": method,
+		"params": params,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return fmt.Errorf("slave %d: %s", slaveId, resp.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-time.After(timeout):
+		return ErrSlaveRequestTimeout
+	}
+}
+
+// ProcessSlaveResponse hands a response message to the request waiting for it.
+func (s *SlaveService) ProcessSlaveResponse(slaveId int, message []byte) {
+	var resp slaveResponse
+	if err := json.Unmarshal(message, &resp); err != nil {
+		logger.Warningf("Invalid response from slave %d: %v", slaveId, err)
+		return
+	}
+
+	slaveRequestLock.Lock()
+	ch, ok := slaveRequests[resp.Id]
+	slaveRequestLock.Unlock()
+	if !ok {
+		logger.Debugf("Dropping response %s from slave %d, request timed out", resp.Id, slaveId)
+		return
+	}
+	ch <- &resp
+}
+
+// GetSlaveLogs fetches the last panel log lines of a slave.
+func (s *SlaveService) GetSlaveLogs(slaveId int, count string, level string, syslog string) ([]string, error) {
+	var lines []string
+	err := s.CallSlave(slaveId, SlaveMethodGetLogs, map[string]any{
+		"count":  count,
+		"level":  level,
+		"syslog": syslog,
+	}, &lines)
+	return lines, err
+}
+
+// GetSlaveXrayLogs fetches parsed Xray access log entries of a slave.
+func (s *SlaveService) GetSlaveXrayLogs(
+	slaveId int,
+	count string,
+	filter string,
+	email string,
+	showDirect string,
+	showBlocked string,
+	showProxy string,
+	freedoms []string,
+	blackholes []string) ([]LogEntry, error) {
+
+	var entries []LogEntry
+	err := s.CallSlave(slaveId, SlaveMethodGetXrayLogs, map[string]any{
+		"count":       count,
+		"filter":      filter,
+		"email":       email,
+		"showDirect":  showDirect,
+		"showBlocked": showBlocked,
+		"showProxy":   showProxy,
+		"freedoms":    freedoms,
+		"blackholes":  blackholes,
+	}, &entries)
+	return entries, err
+}
+
+// GetSlaveXrayErrorLogs fetches the last Xray error log lines of a slave.
+func (s *SlaveService) GetSlaveXrayErrorLogs(slaveId int, count string, level string, filter string) ([]string, error) {
+	var lines []string
+	err := s.CallSlave(slaveId, SlaveMethodGetXrayErrorLogs, map[string]any{
+		"count":  count,
+		"level":  level,
+		"filter": filter,
+	}, &lines)
+	return lines, err
+}
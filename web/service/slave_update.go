@@ -0,0 +1,134 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// slaveUpdateTimeout bounds a remote Xray or geofile update, which includes the download.
+const slaveUpdateTimeout = 5 * time.Minute
+
+// SlaveUpdateResult is the outcome of an update on one slave of a rollout.
+type SlaveUpdateResult struct {
+	SlaveId int    `json:"slaveId"`
+	Name    string `json:"name"`
+	Version string `json:"version"` // Versions reported by the slave after the update
+	Error   string `json:"error"`
+	Skipped bool   `json:"skipped"` // Not attempted because an earlier slave failed
+}
+
+// slaveVersionInfo is the version report a slave sends back after an update.
+type slaveVersionInfo struct {
+	XrayVersion string `json:"xrayVersion"`
+	UiVersion   string `json:"uiVersion"`
+}
+
+// formatSlaveVersion renders the versions of a slave as stored in model.Slave.Version.
+func formatSlaveVersion(xrayVersion, uiVersion string) string {
+	if xrayVersion == "" {
+		xrayVersion = "Unknown"
+	}
+	if uiVersion == "" {
+		uiVersion = "Unknown"
+	}
+	return fmt.Sprintf("Xray: %s / 3x-ui: %s", xrayVersion, uiVersion)
+}
+
+// InstallSlaveXray makes a slave download, verify and switch to the given
+// Xray-core release, and records the version it reports afterwards.
+func (s *SlaveService) InstallSlaveXray(slaveId int, version string) (string, error) {
+	var info slaveVersionInfo
+	err := s.callSlave(slaveId, SlaveMethodInstallXray, map[string]any{
+		"version": version,
+	}, &info, slaveUpdateTimeout)
+	if err != nil {
+		return "", err
+	}
+	return s.recordSlaveVersion(slaveId, &info)
+}
+
+// UpdateSlaveGeofile makes a slave refresh one geofile, or all of them when
+// fileName is empty, and restart Xray.
+func (s *SlaveService) UpdateSlaveGeofile(slaveId int, fileName string) (string, error) {
+	var info slaveVersionInfo
+	err := s.callSlave(slaveId, SlaveMethodUpdateGeofile, map[string]any{
+		"fileName": fileName,
+	}, &info, slaveUpdateTimeout)
+	if err != nil {
+		return "", err
+	}
+	return s.recordSlaveVersion(slaveId, &info)
+}
+
+func (s *SlaveService) recordSlaveVersion(slaveId int, info *slaveVersionInfo) (string, error) {
+	version := formatSlaveVersion(info.XrayVersion, info.UiVersion)
+	db := database.GetDB()
+	err := db.Model(&model.Slave{}).Where("id = ?", slaveId).Update("version", version).Error
+	return version, err
+}
+
+// RollInstallXray installs an Xray-core release on the given slaves one at a time.
+// The rollout stops at the first failing slave so a broken release does not
+// take down the whole cluster; the remaining slaves are reported as skipped.
+func (s *SlaveService) RollInstallXray(slaveIds []int, version string) ([]SlaveUpdateResult, error) {
+	return s.rollOut(slaveIds, func(slaveId int) (string, error) {
+		return s.InstallSlaveXray(slaveId, version)
+	})
+}
+
+// RollUpdateGeofile refreshes geofiles on the given slaves one at a time,
+// stopping at the first failure like RollInstallXray.
+func (s *SlaveService) RollUpdateGeofile(slaveIds []int, fileName string) ([]SlaveUpdateResult, error) {
+	return s.rollOut(slaveIds, func(slaveId int) (string, error) {
+		return s.UpdateSlaveGeofile(slaveId, fileName)
+	})
+}
+
+func (s *SlaveService) rollOut(slaveIds []int, update func(slaveId int) (string, error)) ([]SlaveUpdateResult, error) {
+	results := make([]SlaveUpdateResult, 0, len(slaveIds))
+	var failed error
+	for _, slaveId := range slaveIds {
+		result := SlaveUpdateResult{SlaveId: slaveId}
+		if slave, err := s.GetSlave(slaveId); err == nil {
+			result.Name = slave.Name
+		}
+		if failed != nil {
+			result.Skipped = true
+			results = append(results, result)
+			continue
+		}
+
+		version, err := update(slaveId)
+		if err != nil {
+			logger.Warningf("Update of slave %d failed, stopping rollout: %v", slaveId, err)
+			result.Error = err.Error()
+			failed = fmt.Errorf("slave %d: %v", slaveId, err)
+		} else {
+			logger.Infof("Slave %d updated: %s", slaveId, version)
+			result.Version = version
+		}
+		results = append(results, result)
+	}
+	return results, failed
+}
+
+// GetUpdatableSlaveIds returns the slaves a cluster-wide rollout is sent to:
+// every slave that is connected and not revoked.
+func (s *SlaveService) GetUpdatableSlaveIds() ([]int, error) {
+	slaves, err := s.GetAllSlaves()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(slaves))
+	for _, slave := range slaves {
+		if slave.Revoked || slave.Status == SlaveOffline {
+			continue
+		}
+		ids = append(ids, slave.Id)
+	}
+	return ids, nil
+}
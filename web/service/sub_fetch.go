@@ -0,0 +1,227 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	ws "github.com/mhsanaei/3x-ui/v2/web/websocket"
+)
+
+var subFetches = struct {
+	sync.Mutex
+	counts map[string]uint64
+	alerts map[string]int64 // Last leak alert per subId (ms)
+}{counts: make(map[string]uint64), alerts: make(map[string]int64)}
+
+// SubFetchService logs subscription fetches, counts them per format since
+// startup and alerts when a subscription link looks shared.
+type SubFetchService struct {
+	settingService SettingService
+}
+
+// SubFetchStats summarizes the logged fetches of a subscription.
+type SubFetchStats struct {
+	SubId         string `json:"subId"`
+	Fetches       int64  `json:"fetches"`
+	UniqueIps     int64  `json:"uniqueIps"`
+	Countries     int64  `json:"countries"`
+	LastFetch     int64  `json:"lastFetch"`
+	LastIp        string `json:"lastIp"`
+	LastUserAgent string `json:"lastUserAgent"`
+	LastFormat    string `json:"lastFormat"`
+}
+
+// Count records a fetch of a subscription in format.
+func (s *SubFetchService) Count(format string) {
+	subFetches.Lock()
+	defer subFetches.Unlock()
+	subFetches.counts[format]++
+}
+
+// GetCounts returns the number of fetches per format.
+func (s *SubFetchService) GetCounts() map[string]uint64 {
+	subFetches.Lock()
+	defer subFetches.Unlock()
+	return maps.Clone(subFetches.counts)
+}
+
+// Record logs a fetch of a subscription and checks the subscription for a
+// leak.
+func (s *SubFetchService) Record(subId, ip, userAgent, format string) {
+	s.Count(format)
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	fetch := &model.SubFetchLog{
+		CreatedAt: time.Now().UnixMilli(),
+		SubId:     subId,
+		Ip:        ip,
+		UserAgent: userAgent,
+		Format:    format,
+	}
+	if limit, _ := s.settingService.GetSubLeakCountryLimit(); limit > 0 {
+		fetch.Country = LookupCountry(ip)
+	}
+	if err := database.GetDB().Create(fetch).Error; err != nil {
+		logger.Warning("Failed to log subscription fetch:", err)
+		return
+	}
+	if err := s.checkLeak(subId, fetch.CreatedAt); err != nil {
+		logger.Warning("Failed to check subscription for a leak:", err)
+	}
+}
+
+// checkLeak alerts once per window when a subscription was fetched from more
+// distinct IPs or countries than allowed within the window.
+func (s *SubFetchService) checkLeak(subId string, now int64) error {
+	ipLimit, err := s.settingService.GetSubLeakIpLimit()
+	if err != nil {
+		return err
+	}
+	countryLimit, err := s.settingService.GetSubLeakCountryLimit()
+	if err != nil {
+		return err
+	}
+	window, err := s.settingService.GetSubLeakWindow()
+	if err != nil {
+		return err
+	}
+	if (ipLimit <= 0 && countryLimit <= 0) || window <= 0 {
+		return nil
+	}
+	since := now - int64(window)*time.Minute.Milliseconds()
+
+	var counts struct {
+		Ips       int
+		Countries int
+	}
+	err = database.GetDB().Model(&model.SubFetchLog{}).
+		Select("COUNT(DISTINCT ip) AS ips, COUNT(DISTINCT NULLIF(country, '')) AS countries").
+		Where("sub_id = ? AND created_at >= ?", subId, since).
+		Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+	if (ipLimit <= 0 || counts.Ips <= ipLimit) && (countryLimit <= 0 || counts.Countries <= countryLimit) {
+		return nil
+	}
+
+	subFetches.Lock()
+	if subFetches.alerts[subId] >= since {
+		subFetches.Unlock()
+		return nil
+	}
+	subFetches.alerts[subId] = now
+	subFetches.Unlock()
+
+	s.notifyLeak(subId, counts.Ips, counts.Countries, window)
+	return nil
+}
+
+func (s *SubFetchService) notifyLeak(subId string, ips, countries, window int) {
+	owner := subIdOwner(subId)
+	logger.Warningf("Subscription %s (%s) was fetched from %d IPs in %d countries within %d minutes", subId, owner, ips, countries, window)
+	// Alerts name subscriptions of any owner, so scoped users do not get them
+	ws.BroadcastUnscopedNotification("Subscription link shared?",
+		fmt.Sprintf("Subscription %s (%s) was fetched from %d IPs in %d countries within %d minutes", subId, owner, ips, countries, window), "warning")
+
+	tgbot := Tgbot{}
+	if tgbot.IsRunning() {
+		msg := tgbot.I18nBot("tgbot.messages.subLeak",
+			"SubId=="+subId,
+			"Owner=="+owner,
+			"Ips=="+strconv.Itoa(ips),
+			"Countries=="+strconv.Itoa(countries),
+			"Window=="+strconv.Itoa(window))
+		go tgbot.SendMsgToTgbotAdmins(msg)
+	}
+}
+
+// GetStats returns the fetch stats of the given subscriptions, or of all
+// logged subscriptions without subIds, most recently fetched first.
+func (s *SubFetchService) GetStats(subIds ...string) ([]*SubFetchStats, error) {
+	db := database.GetDB()
+	query := db.Model(&model.SubFetchLog{}).
+		Select("sub_id, COUNT(*) AS fetches, COUNT(DISTINCT ip) AS unique_ips, " +
+			"COUNT(DISTINCT NULLIF(country, '')) AS countries, MAX(created_at) AS last_fetch")
+	if len(subIds) > 0 {
+		query = query.Where("sub_id IN ?", subIds)
+	}
+	var stats []*SubFetchStats
+	if err := query.Group("sub_id").Order("last_fetch DESC").Scan(&stats).Error; err != nil {
+		return nil, err
+	}
+
+	lastQuery := db.Where("id IN (?)", db.Model(&model.SubFetchLog{}).Select("MAX(id)").Group("sub_id"))
+	if len(subIds) > 0 {
+		lastQuery = lastQuery.Where("sub_id IN ?", subIds)
+	}
+	var lasts []*model.SubFetchLog
+	if err := lastQuery.Find(&lasts).Error; err != nil {
+		return nil, err
+	}
+	lastBySubId := make(map[string]*model.SubFetchLog, len(lasts))
+	for _, last := range lasts {
+		lastBySubId[last.SubId] = last
+	}
+	for _, stat := range stats {
+		if last, ok := lastBySubId[stat.SubId]; ok {
+			stat.LastIp = last.Ip
+			stat.LastUserAgent = last.UserAgent
+			stat.LastFormat = last.Format
+		}
+	}
+	return stats, nil
+}
+
+// GetLogs returns the most recent fetches of a subscription.
+func (s *SubFetchService) GetLogs(subId string, limit int) ([]*model.SubFetchLog, error) {
+	var logs []*model.SubFetchLog
+	err := database.GetDB().Where("sub_id = ?", subId).Order("id DESC").Limit(limit).Find(&logs).Error
+	return logs, err
+}
+
+// DeleteExpiredLogs drops fetches older than the configured retention.
+func (s *SubFetchService) DeleteExpiredLogs() error {
+	days, err := s.settingService.GetSubFetchLogDays()
+	if err != nil || days <= 0 {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	result := database.GetDB().Where("created_at < ?", cutoff).Delete(&model.SubFetchLog{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logger.Infof("Deleted %d subscription fetches older than %d days", result.RowsAffected, days)
+	}
+	return nil
+}
+
+// subIdClientEmails returns the emails of the inbound clients with a subId.
+func subIdClientEmails(subId string) ([]string, error) {
+	var emails []string
+	err := database.GetDB().Raw(`SELECT DISTINCT JSON_EXTRACT(client.value, '$.email')
+		FROM inbounds, JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE JSON_EXTRACT(client.value, '$.subId') = ?`, subId).Scan(&emails).Error
+	return emails, err
+}
+
+// subIdOwner names the account or the clients a subscription belongs to.
+func subIdOwner(subId string) string {
+	accountService := AccountService{}
+	if account, err := accountService.GetAccountBySubId(subId); err == nil && account != nil {
+		return "account " + account.Username
+	}
+	if emails, err := subIdClientEmails(subId); err == nil && len(emails) > 0 {
+		return strings.Join(emails, ", ")
+	}
+	return "unknown"
+}
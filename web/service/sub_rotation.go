@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+
+	"gorm.io/gorm"
+)
+
+// SubRotationService gives accounts and clients a new subscription ID
+// without recreating them. The rotated ID either stops working at once or
+// keeps serving the new subscription for a grace period.
+type SubRotationService struct {
+	settingService SettingService
+	inboundService InboundService
+}
+
+// RotateAccountSubId gives an account a new subscription ID. Clients
+// provisioned with the account's subscription ID get the new one too. A
+// negative grace uses the configured grace period in hours, 0 revokes the
+// old ID at once. Returns the new subscription ID.
+func (s *SubRotationService) RotateAccountSubId(accountId int, grace int) (string, error) {
+	accountService := AccountService{}
+	account, err := accountService.GetAccount(accountId)
+	if err != nil {
+		return "", err
+	}
+	// Credentials of older accounts are derived from the subscription ID;
+	// store them before it changes so the account's clients keep working.
+	if err := ensureAccountCredentials(account); err != nil {
+		return "", err
+	}
+	return s.rotate(account.SubId, grace)
+}
+
+// RotateClientSubId gives the subscription of a client a new ID. All
+// clients sharing the subscription move with it. Grace works as in
+// RotateAccountSubId.
+func (s *SubRotationService) RotateClientSubId(email string, grace int) (string, error) {
+	_, client, err := s.inboundService.GetClientByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	if client.SubID == "" {
+		return "", common.NewError("Client has no subscription:", email)
+	}
+	return s.rotate(client.SubID, grace)
+}
+
+// rotate replaces subId on the account and the clients holding it. Xray
+// configs do not depend on subscription IDs, so no slave needs a push.
+func (s *SubRotationService) rotate(subId string, grace int) (string, error) {
+	if grace < 0 {
+		var err error
+		if grace, err = s.settingService.GetSubRotateGrace(); err != nil {
+			return "", err
+		}
+	}
+	newSubId := random.Seq(16)
+	now := time.Now().UnixMilli()
+
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.Account{}).Where("sub_id = ?", subId).Updates(map[string]any{
+			"sub_id":     newSubId,
+			"updated_at": now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		found := result.RowsAffected > 0
+
+		var inbounds []*model.Inbound
+		err := tx.Where(`id IN (
+			SELECT DISTINCT inbounds.id
+			FROM inbounds, JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+			WHERE JSON_EXTRACT(client.value, '$.subId') = ?
+		)`, subId).Find(&inbounds).Error
+		if err != nil {
+			return err
+		}
+		for _, inbound := range inbounds {
+			if err := replaceClientSubId(tx, inbound, subId, newSubId, now); err != nil {
+				return err
+			}
+		}
+		if !found && len(inbounds) == 0 {
+			return common.NewError("Subscription not found:", subId)
+		}
+
+		if err := tx.Where("expires_at <= ?", now).Delete(&model.RetiredSubId{}).Error; err != nil {
+			return err
+		}
+		if grace == 0 {
+			// Revoking also ends the grace period of earlier rotations
+			return tx.Where("new_sub_id = ?", subId).Delete(&model.RetiredSubId{}).Error
+		}
+		// Earlier rotations of the subscription now lead to the new ID
+		if err := tx.Model(&model.RetiredSubId{}).Where("new_sub_id = ?", subId).Update("new_sub_id", newSubId).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.RetiredSubId{
+			SubId:     subId,
+			NewSubId:  newSubId,
+			CreatedAt: now,
+			ExpiresAt: now + int64(grace)*time.Hour.Milliseconds(),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	logger.Infof("Rotated subscription %s to %s with a grace period of %d hours", subId, newSubId, grace)
+	return newSubId, nil
+}
+
+// replaceClientSubId moves the clients of an inbound from subId to newSubId.
+func replaceClientSubId(tx *gorm.DB, inbound *model.Inbound, subId, newSubId string, now int64) error {
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return err
+	}
+	clients, _ := settings["clients"].([]any)
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok || client["subId"] != subId {
+			continue
+		}
+		client["subId"] = newSubId
+		client["updated_at"] = now
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", string(newSettings)).Error
+}
+
+// ResolveSubId returns the subscription ID a rotated subId was replaced
+// with and the end of its grace period. ok is false when subId is not in a
+// grace period.
+func (s *SubRotationService) ResolveSubId(subId string) (newSubId string, expiresAt int64, ok bool) {
+	retired := &model.RetiredSubId{}
+	err := database.GetDB().Where("sub_id = ? AND expires_at > ?", subId, time.Now().UnixMilli()).First(retired).Error
+	if err != nil {
+		return "", 0, false
+	}
+	return retired.NewSubId, retired.ExpiresAt, true
+}
@@ -105,11 +105,13 @@ const (
 // Tgbot provides business logic for Telegram bot integration.
 // It handles bot commands, user interactions, and status reporting via Telegram.
 type Tgbot struct {
-	inboundService InboundService
-	settingService SettingService
-	serverService  ServerService
-	xrayService    XrayService
-	lastStatus     *Status
+	inboundService        InboundService
+	settingService        SettingService
+	serverService         ServerService
+	xrayService           XrayService
+	accountService        AccountService
+	trafficHistoryService TrafficHistoryService
+	lastStatus            *Status
 }
 
 // NewTgbot creates a new Tgbot instance.
@@ -254,6 +256,7 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 			{Command: "help", Description: t.I18nBot("tgbot.commands.helpDesc")},
 			{Command: "status", Description: t.I18nBot("tgbot.commands.statusDesc")},
 			{Command: "id", Description: t.I18nBot("tgbot.commands.idDesc")},
+			{Command: "history", Description: t.I18nBot("tgbot.commands.historyDesc")},
 		},
 	})
 	if err != nil {
@@ -581,6 +584,7 @@ func (t *Tgbot) OnReceive() {
 							if err != nil {
 								output += t.I18nBot("tgbot.messages.selectUserFailed")
 							} else {
+								t.audit(message.From, "client.setTgId", fmt.Sprintf("traffic:%d", message.UsersShared.RequestID), userID)
 								output += t.I18nBot("tgbot.messages.userSaved")
 							}
 							t.SendMsgToTgbot(message.Chat.ID, output, tu.ReplyKeyboardRemove())
@@ -636,6 +640,13 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		} else {
 			msg += t.I18nBot("tgbot.commands.usage")
 		}
+	case "history":
+		onlyMessage = true
+		if len(commandArgs) > 0 {
+			t.getAccountHistory(chatId, message.From.ID, commandArgs[0], isAdmin)
+		} else {
+			msg += t.I18nBot("tgbot.commands.historyUsage")
+		}
 	case "inbound":
 		onlyMessage = true
 		if isAdmin && len(commandArgs) > 0 {
@@ -804,6 +815,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			case "reset_traffic_c":
 				err := t.inboundService.ResetClientTrafficByEmail(email)
 				if err == nil {
+					t.audit(&callbackQuery.From, "client.resetTraffic", "client:"+email, nil)
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.resetTrafficSuccess", "Email=="+email))
 					t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
 				} else {
@@ -849,6 +861,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							t.xrayService.SetToNeedRestart()
 						}
 						if err == nil {
+							t.audit(&callbackQuery.From, "client.setTrafficLimit", "client:"+email, map[string]int{"totalGB": limitTraffic})
 							t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.setTrafficLimitSuccess", "Email=="+email))
 							t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
 							return
@@ -1058,6 +1071,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							t.xrayService.SetToNeedRestart()
 						}
 						if err == nil {
+							t.audit(&callbackQuery.From, "client.setExpiry", "client:"+email, map[string]int64{"expiryTime": date})
 							t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.expireResetSuccess", "Email=="+email))
 							t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
 							return
@@ -1255,6 +1269,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 							t.xrayService.SetToNeedRestart()
 						}
 						if err == nil {
+							t.audit(&callbackQuery.From, "client.setIpLimit", "client:"+email, map[string]int{"limitIp": count})
 							t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.resetIpSuccess", "Email=="+email, "Count=="+strconv.Itoa(count)))
 							t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
 							return
@@ -1423,6 +1438,39 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				} else {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				}
+			case "rotate_sub":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel " + email)),
+					),
+				)
+				if grace, err := t.settingService.GetSubRotateGrace(); err == nil && grace > 0 {
+					inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRotateSub", "Hours=="+strconv.Itoa(grace))).WithCallbackData(t.encodeQuery("rotate_sub_c "+email+" "+strconv.Itoa(grace))),
+					))
+				}
+				inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tu.InlineKeyboardRow(
+					tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRevokeSub")).WithCallbackData(t.encodeQuery("rotate_sub_c "+email+" 0")),
+				))
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "rotate_sub_c":
+				if len(dataArray) == 3 {
+					grace, err := strconv.Atoi(dataArray[2])
+					if err == nil {
+						rotationService := SubRotationService{}
+						var subId string
+						subId, err = rotationService.RotateClientSubId(email, grace)
+						if err == nil {
+							t.audit(&callbackQuery.From, "client.rotateSubId", "client:"+email, map[string]any{"subId": subId, "grace": grace})
+							t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.rotateSubSuccess", "Email=="+email))
+							t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+							t.sendClientSubLinks(chatId, email)
+							return
+						}
+						logger.Warning("Failed to rotate subscription of", email, err)
+					}
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 			case "ip_log":
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.getIpLog", "Email=="+email))
 				t.searchClientIps(chatId, email)
@@ -1450,6 +1498,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					t.xrayService.SetToNeedRestart()
 				}
 				if err == nil {
+					t.audit(&callbackQuery.From, "client.setTgId", "client:"+email, EmptyTelegramUserID)
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.removedTGUserSuccess", "Email=="+email))
 					t.clientTelegramUserInfo(chatId, email, callbackQuery.Message.GetMessageID())
 				} else {
@@ -1471,6 +1520,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					t.xrayService.SetToNeedRestart()
 				}
 				if err == nil {
+					t.audit(&callbackQuery.From, "client.toggleEnable", "client:"+email, map[string]bool{"enable": enabled})
 					if enabled {
 						t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.enableSuccess", "Email=="+email))
 					} else {
@@ -1885,6 +1935,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			errorMessage := fmt.Sprintf("%v", err)
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.error_add_client", "error=="+errorMessage), tu.ReplyKeyboardRemove())
 		} else {
+			t.audit(&callbackQuery.From, "client.add", fmt.Sprintf("inbound:%d", receiver_inbound_ID), client_Email)
 			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.successfulOperation"), tu.ReplyKeyboardRemove())
 		}
@@ -1895,6 +1946,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			errorMessage := fmt.Sprintf("%v", err)
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.error_add_client", "error=="+errorMessage), tu.ReplyKeyboardRemove())
 		} else {
+			t.audit(&callbackQuery.From, "client.add", fmt.Sprintf("inbound:%d", receiver_inbound_ID), client_Email)
 			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.successfulOperation"), tu.ReplyKeyboardRemove())
 		}
@@ -1922,6 +1974,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		for _, email := range emails {
 			err := t.inboundService.ResetClientTrafficByEmail(email)
 			if err == nil {
+				t.audit(&callbackQuery.From, "client.resetTraffic", "client:"+email, nil)
 				msg := t.I18nBot("tgbot.messages.SuccessResetTraffic", "ClientEmail=="+email)
 				t.SendMsgToTgbot(chatId, msg, tu.ReplyKeyboardRemove())
 			} else {
@@ -2138,6 +2191,24 @@ func (t *Tgbot) SubmitAddClient() (bool, error) {
 	return t.inboundService.AddInboundClient(newInbound)
 }
 
+// audit records a change made through the bot by a Telegram user.
+func (t *Tgbot) audit(from *telego.User, action, target string, after any) {
+	actor := ""
+	if from != nil {
+		actor = fmt.Sprintf("tg:%d", from.ID)
+		if from.Username != "" {
+			actor += " @" + from.Username
+		}
+	}
+	auditService := AuditService{}
+	auditService.Log(&model.AuditLog{
+		Actor:  actor,
+		Source: AuditSourceTgbot,
+		Action: action,
+		Target: target,
+	}, nil, after)
+}
+
 // checkAdmin checks if the given Telegram ID is an admin.
 func checkAdmin(tgId int64) bool {
 	for _, adminId := range adminIds {
@@ -3077,6 +3148,47 @@ func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 	t.SendAnswer(chatId, output, false)
 }
 
+// accountHistoryDays is how many days /history shows.
+const accountHistoryDays = 7
+
+// getAccountHistory sends the daily traffic of an account over the last
+// accountHistoryDays days. Users who are not admins only see accounts linked
+// to their Telegram ID.
+func (t *Tgbot) getAccountHistory(chatId int64, tgUserID int64, username string, isAdmin bool) {
+	account, err := t.accountService.GetAccountByUsername(username)
+	if err != nil || (!isAdmin && account.TgId != tgUserID) {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noResult"))
+		return
+	}
+
+	_, today := trafficBuckets(time.Now())
+	first := time.UnixMilli(today).AddDate(0, 0, 1-accountHistoryDays)
+	history, err := t.trafficHistoryService.GetTrafficHistory(TrafficScopeAccount, strconv.Itoa(account.Id), TrafficPeriodDay, first.UnixMilli(), 0)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
+		return
+	}
+	byDay := make(map[int64]*model.TrafficHistory, len(history))
+	for _, h := range history {
+		byDay[h.Bucket] = h
+	}
+
+	output := t.I18nBot("tgbot.messages.accountHistory", "Username=="+account.Username, "Days=="+strconv.Itoa(accountHistoryDays))
+	for day := first; !day.After(time.UnixMilli(today)); day = day.AddDate(0, 0, 1) {
+		var up, down int64
+		if h, ok := byDay[day.UnixMilli()]; ok {
+			up, down = h.Up, h.Down
+		}
+		output += t.I18nBot("tgbot.messages.historyDay",
+			"Date=="+day.Format("2006-01-02"),
+			"Upload=="+common.FormatTraffic(up),
+			"Download=="+common.FormatTraffic(down))
+	}
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+	t.SendMsgToTgbot(chatId, output)
+}
+
 // searchClientIps searches and sends client IP addresses for the given email.
 func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
 	ips, err := t.inboundService.GetInboundClientIps(email)
@@ -3225,6 +3337,9 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.setTGUser")).WithCallbackData(t.encodeQuery("tg_user "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.rotateSub")).WithCallbackData(t.encodeQuery("rotate_sub "+email)),
+		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.toggle")).WithCallbackData(t.encodeQuery("toggle_enable "+email)),
 		),
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Scopes of model.TrafficHistory rows
+const (
+	TrafficScopeClient  = "client"
+	TrafficScopeAccount = "account"
+	TrafficScopeInbound = "inbound"
+	TrafficScopeSlave   = "slave"
+)
+
+// Periods of model.TrafficHistory rows
+const (
+	TrafficPeriodHour = "hour"
+	TrafficPeriodDay  = "day"
+)
+
+// TrafficHistoryService answers how much traffic a client, account, inbound
+// or slave used per hour or day. Traffic reports of slaves are added to the
+// hour and the day they arrived in; hourly rows are kept for a shorter time
+// than daily ones.
+type TrafficHistoryService struct {
+	settingService SettingService
+}
+
+type trafficHistoryTarget struct {
+	scope  string
+	target string
+}
+
+// trafficHistoryBatch collects the traffic of one report per target, so
+// each target's buckets are written once per report.
+type trafficHistoryBatch map[trafficHistoryTarget][2]int64
+
+func (b trafficHistoryBatch) add(scope, target string, up, down int64) {
+	if up == 0 && down == 0 {
+		return
+	}
+	key := trafficHistoryTarget{scope, target}
+	traffic := b[key]
+	traffic[0] += up
+	traffic[1] += down
+	b[key] = traffic
+}
+
+// write adds the collected traffic to the hour and day buckets containing now.
+func (b trafficHistoryBatch) write(tx *gorm.DB, now time.Time) error {
+	hour, day := trafficBuckets(now)
+	for key, traffic := range b {
+		for _, bucket := range []struct {
+			period string
+			start  int64
+		}{{TrafficPeriodHour, hour}, {TrafficPeriodDay, day}} {
+			row := &model.TrafficHistory{
+				Scope:  key.scope,
+				Target: key.target,
+				Period: bucket.period,
+				Bucket: bucket.start,
+				Up:     traffic[0],
+				Down:   traffic[1],
+			}
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "scope"}, {Name: "target"}, {Name: "period"}, {Name: "bucket"}},
+				DoUpdates: clause.Assignments(map[string]any{
+					"up":   gorm.Expr("up + ?", traffic[0]),
+					"down": gorm.Expr("down + ?", traffic[1]),
+				}),
+			}).Create(row).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trafficBuckets returns the start of the hour and the day containing t in ms.
+func trafficBuckets(t time.Time) (hour, day int64) {
+	year, month, date := t.Date()
+	hour = time.Date(year, month, date, t.Hour(), 0, 0, 0, t.Location()).UnixMilli()
+	day = time.Date(year, month, date, 0, 0, 0, 0, t.Location()).UnixMilli()
+	return hour, day
+}
+
+// GetTrafficHistory returns the traffic of a target per hour or day with
+// buckets starting between from and to (ms), oldest first. Buckets without
+// traffic are left out.
+func (s *TrafficHistoryService) GetTrafficHistory(scope, target, period string, from, to int64) ([]*model.TrafficHistory, error) {
+	switch scope {
+	case TrafficScopeClient, TrafficScopeAccount, TrafficScopeInbound, TrafficScopeSlave:
+	default:
+		return nil, common.NewError("unknown traffic history scope:", scope)
+	}
+	if period != TrafficPeriodHour && period != TrafficPeriodDay {
+		return nil, common.NewError("unknown traffic history period:", period)
+	}
+
+	db := database.GetDB()
+	query := db.Model(&model.TrafficHistory{}).Where("scope = ? AND target = ? AND period = ?", scope, target, period)
+	if from > 0 {
+		query = query.Where("bucket >= ?", from)
+	}
+	if to > 0 {
+		query = query.Where("bucket <= ?", to)
+	}
+	var history []*model.TrafficHistory
+	err := query.Order("bucket").Find(&history).Error
+	return history, err
+}
+
+// DeleteExpiredTrafficHistory drops history older than the configured retention.
+func (s *TrafficHistoryService) DeleteExpiredTrafficHistory() error {
+	hourDays, err := s.settingService.GetTrafficHistoryHourDays()
+	if err != nil {
+		return err
+	}
+	dayDays, err := s.settingService.GetTrafficHistoryDayDays()
+	if err != nil {
+		return err
+	}
+
+	db := database.GetDB()
+	now := time.Now()
+	for period, days := range map[string]int{TrafficPeriodHour: hourDays, TrafficPeriodDay: dayDays} {
+		if days <= 0 {
+			continue
+		}
+		cutoff := now.AddDate(0, 0, -days).UnixMilli()
+		result := db.Where("period = ? AND bucket < ?", period, cutoff).Delete(&model.TrafficHistory{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			logger.Infof("Deleted %d %sly traffic history rows older than %d days", result.RowsAffected, period, days)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficBuckets(t *testing.T) {
+	loc := time.FixedZone("UTC+5:30", 5*3600+1800)
+	hour, day := trafficBuckets(time.Date(2024, 3, 9, 14, 47, 12, 0, loc))
+	if want := time.Date(2024, 3, 9, 14, 0, 0, 0, loc).UnixMilli(); hour != want {
+		t.Errorf("hour bucket = %d, want %d", hour, want)
+	}
+	if want := time.Date(2024, 3, 9, 0, 0, 0, 0, loc).UnixMilli(); day != want {
+		t.Errorf("day bucket = %d, want %d", day, want)
+	}
+}
+
+func TestTrafficHistoryBatchAdd(t *testing.T) {
+	batch := make(trafficHistoryBatch)
+	batch.add(TrafficScopeClient, "alice", 10, 20)
+	batch.add(TrafficScopeClient, "alice", 1, 2)
+	batch.add(TrafficScopeClient, "bob", 0, 0)
+
+	if got := batch[trafficHistoryTarget{TrafficScopeClient, "alice"}]; got != [2]int64{11, 22} {
+		t.Errorf("alice = %v, want [11 22]", got)
+	}
+	if _, ok := batch[trafficHistoryTarget{TrafficScopeClient, "bob"}]; ok {
+		t.Error("bob without traffic was added")
+	}
+}
@@ -2,10 +2,12 @@ package service
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
 	"github.com/mhsanaei/3x-ui/v2/util/crypto"
 	ldaputil "github.com/mhsanaei/3x-ui/v2/util/ldap"
 	"github.com/xlzd/gotp"
@@ -18,13 +20,15 @@ type UserService struct {
 	settingService SettingService
 }
 
-// GetFirstUser retrieves the first user from the database.
-// This is typically used for initial setup or when there's only one admin user.
+// GetFirstUser retrieves the first owner from the database.
+// This is typically used for initial setup and the command line.
 func (s *UserService) GetFirstUser() (*model.User, error) {
 	db := database.GetDB()
 
 	user := &model.User{}
 	err := db.Model(model.User{}).
+		Where("role = ?", model.RoleOwner).
+		Order("id").
 		First(user).
 		Error
 	if err != nil {
@@ -33,6 +37,135 @@ func (s *UserService) GetFirstUser() (*model.User, error) {
 	return user, nil
 }
 
+// GetUser retrieves a panel user by ID.
+func (s *UserService) GetUser(id int) (*model.User, error) {
+	db := database.GetDB()
+	user := &model.User{}
+	err := db.Model(model.User{}).Where("id = ?", id).First(user).Error
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUsers returns all panel users without their password hashes.
+func (s *UserService) GetUsers() ([]*model.User, error) {
+	db := database.GetDB()
+	var users []*model.User
+	if err := db.Model(model.User{}).Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		user.Password = ""
+	}
+	return users, nil
+}
+
+// AddUser creates a panel user. The password is given in plain text.
+func (s *UserService) AddUser(user *model.User) error {
+	if err := s.checkUser(user); err != nil {
+		return err
+	}
+	if !crypto.ValidatePasswordStrength(user.Password) {
+		return common.NewError("password must be at least 8 characters and contain uppercase, lowercase, and digits")
+	}
+	user.Id = 0
+	user.Password = crypto.HashPassword(user.Password)
+	return database.GetDB().Create(user).Error
+}
+
+// UpdatePanelUser changes the name, role, slaves and reseller pool of a panel
+// user, and its password when one is given in plain text. The last owner
+// keeps its role.
+func (s *UserService) UpdatePanelUser(user *model.User) error {
+	old, err := s.GetUser(user.Id)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUser(user); err != nil {
+		return err
+	}
+	if old.Role == model.RoleOwner && user.Role != model.RoleOwner {
+		if err := s.checkOtherOwner(user.Id); err != nil {
+			return err
+		}
+	}
+	updates := map[string]any{
+		"username":      user.Username,
+		"role":          user.Role,
+		"slave_ids":     user.SlaveIds,
+		"credit_gb":     user.CreditGB,
+		"account_slots": user.AccountSlots,
+	}
+	if user.Password != "" {
+		if !crypto.ValidatePasswordStrength(user.Password) {
+			return common.NewError("password must be at least 8 characters and contain uppercase, lowercase, and digits")
+		}
+		updates["password"] = crypto.HashPassword(user.Password)
+	}
+	return database.GetDB().Model(model.User{}).Where("id = ?", user.Id).Updates(updates).Error
+}
+
+// DelUser deletes a panel user. The last owner cannot be deleted.
+func (s *UserService) DelUser(id int) error {
+	user, err := s.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if user.Role == model.RoleOwner {
+		if err := s.checkOtherOwner(id); err != nil {
+			return err
+		}
+	}
+	return database.GetDB().Delete(&model.User{}, id).Error
+}
+
+// checkUser validates the name, role and slaves of a panel user.
+func (s *UserService) checkUser(user *model.User) error {
+	user.Username = strings.TrimSpace(user.Username)
+	if user.Username == "" {
+		return common.NewError("username can not be empty")
+	}
+	if !isValidRole(user.Role) {
+		return common.NewError("unknown role:", user.Role)
+	}
+	slaveIds, err := parseSlaveIds(user.SlaveIds)
+	if err != nil {
+		return err
+	}
+	user.SlaveIds = joinSlaveIds(slaveIds)
+	if user.CreditGB < 0 || user.AccountSlots < 0 {
+		return common.NewError("credit and account slots must be >= 0")
+	}
+	if user.Role != model.RoleReseller {
+		user.CreditGB = 0
+		user.AccountSlots = 0
+	}
+
+	var count int64
+	err = database.GetDB().Model(model.User{}).Where("username = ? AND id != ?", user.Username, user.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("username already exists:", user.Username)
+	}
+	return nil
+}
+
+// checkOtherOwner fails unless a user other than id is an owner.
+func (s *UserService) checkOtherOwner(id int) error {
+	var count int64
+	err := database.GetDB().Model(model.User{}).Where("role = ? AND id != ?", model.RoleOwner, id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return common.NewError("the panel needs at least one owner")
+	}
+	return nil
+}
+
 func (s *UserService) CheckUser(username string, password string, twoFactorCode string) *model.User {
 	db := database.GetDB()
 
@@ -134,10 +267,11 @@ func (s *UserService) UpdateFirstUser(username string, password string) error {
 
 	db := database.GetDB()
 	user := &model.User{}
-	err := db.Model(model.User{}).First(user).Error
+	err := db.Model(model.User{}).Where("role = ?", model.RoleOwner).Order("id").First(user).Error
 	if database.IsNotFound(err) {
 		user.Username = username
 		user.Password = hashedPassword
+		user.Role = model.RoleOwner
 		return db.Model(model.User{}).Create(user).Error
 	} else if err != nil {
 		return err
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+// Permissions granted to panel user roles
+const (
+	PermView     = "view"     // Read inbounds, accounts, plans, slaves and server status
+	PermAccounts = "accounts" // Change accounts
+	PermPlans    = "plans"    // Change plans and move accounts between them
+	PermInbounds = "inbounds" // Change inbounds and their clients
+	PermPanel    = "panel"    // Settings, xray config, slaves and server control
+	PermUsers    = "users"    // Manage panel users
+)
+
+var rolePermissions = map[string][]string{
+	model.RoleOwner:    {PermView, PermAccounts, PermPlans, PermInbounds, PermPanel, PermUsers},
+	model.RoleAdmin:    {PermView, PermAccounts, PermPlans, PermInbounds, PermPanel},
+	model.RoleOperator: {PermView, PermAccounts, PermPlans},
+	model.RoleReadOnly: {PermView},
+	model.RoleReseller: {PermView, PermAccounts, PermInbounds},
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// UserCan reports whether a panel user's role grants a permission.
+func UserCan(user *model.User, permission string) bool {
+	if user == nil {
+		return false
+	}
+	for _, granted := range rolePermissions[user.Role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// UserSlaveIds returns the slaves a panel user is limited to, or nil when it
+// sees all of them.
+func UserSlaveIds(user *model.User) []int {
+	if user == nil || user.Role == model.RoleOwner || user.Role == model.RoleAdmin {
+		return nil
+	}
+	slaveIds, _ := parseSlaveIds(user.SlaveIds)
+	return slaveIds
+}
+
+// IsScopedUser reports whether a panel user sees only part of the inbounds,
+// accounts or slaves.
+func IsScopedUser(user *model.User) bool {
+	return user != nil && (user.Role == model.RoleReseller || UserSlaveIds(user) != nil)
+}
+
+// CanAccessSlave reports whether a panel user may see a slave.
+func CanAccessSlave(user *model.User, slaveId int) bool {
+	slaveIds := UserSlaveIds(user)
+	if slaveIds == nil {
+		return true
+	}
+	for _, id := range slaveIds {
+		if id == slaveId {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessInbound reports whether a panel user may see an inbound. Resellers
+// see the inbounds they created.
+func CanAccessInbound(user *model.User, inbound *model.Inbound) bool {
+	if user.Role == model.RoleReseller && inbound.UserId != user.Id {
+		return false
+	}
+	return CanAccessSlave(user, inbound.SlaveId)
+}
+
+// CanAccessAccount reports whether a panel user may see an account. Resellers
+// see the accounts they created.
+func CanAccessAccount(user *model.User, account *model.Account) bool {
+	return user.Role != model.RoleReseller || account.UserId == user.Id
+}
+
+// scopeInbounds limits an inbound query to the inbounds a panel user may see.
+// A nil user sees all inbounds.
+func scopeInbounds(query *gorm.DB, user *model.User) *gorm.DB {
+	if user == nil {
+		return query
+	}
+	if user.Role == model.RoleReseller {
+		query = query.Where("user_id = ?", user.Id)
+	}
+	if slaveIds := UserSlaveIds(user); slaveIds != nil {
+		query = query.Where("slave_id IN ?", slaveIds)
+	}
+	return query
+}
+
+// CanAccessInboundId reports whether a panel user may see an inbound by ID.
+func (s *UserService) CanAccessInboundId(user *model.User, inboundId int) bool {
+	inbound := &model.Inbound{}
+	if err := database.GetDB().Select("id, user_id, slave_id").Where("id = ?", inboundId).First(inbound).Error; err != nil {
+		return false
+	}
+	return CanAccessInbound(user, inbound)
+}
+
+// CanAccessAccountId reports whether a panel user may see an account by ID.
+func (s *UserService) CanAccessAccountId(user *model.User, accountId int) bool {
+	account := &model.Account{}
+	if err := database.GetDB().Select("id, user_id").Where("id = ?", accountId).First(account).Error; err != nil {
+		return false
+	}
+	return CanAccessAccount(user, account)
+}
+
+// CanAccessClient reports whether a panel user may see a client by email.
+func (s *UserService) CanAccessClient(user *model.User, email string) bool {
+	if !IsScopedUser(user) {
+		return true
+	}
+	traffic := &xray.ClientTraffic{}
+	if err := database.GetDB().Select("inbound_id").Where("email = ?", email).First(traffic).Error; err != nil {
+		return false
+	}
+	return s.CanAccessInboundId(user, traffic.InboundId)
+}
+
+// CanAccessSubId reports whether a panel user may see the account or one of
+// the clients a subscription belongs to.
+func (s *UserService) CanAccessSubId(user *model.User, subId string) bool {
+	if !IsScopedUser(user) {
+		return true
+	}
+	account := &model.Account{}
+	if err := database.GetDB().Select("id, user_id").Where("sub_id = ?", subId).First(account).Error; err == nil {
+		return CanAccessAccount(user, account)
+	}
+	emails, err := subIdClientEmails(subId)
+	if err != nil {
+		return false
+	}
+	for _, email := range emails {
+		if s.CanAccessClient(user, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUserClientEmails returns the client emails on the inbounds a scoped
+// panel user may see.
+func (s *UserService) GetUserClientEmails(user *model.User) (map[string]bool, error) {
+	var emails []string
+	query := database.GetDB().Model(&xray.ClientTraffic{}).
+		Joins("JOIN inbounds ON inbounds.id = client_traffics.inbound_id")
+	if user.Role == model.RoleReseller {
+		query = query.Where("inbounds.user_id = ?", user.Id)
+	}
+	if slaveIds := UserSlaveIds(user); slaveIds != nil {
+		query = query.Where("inbounds.slave_id IN ?", slaveIds)
+	}
+	if err := query.Pluck("client_traffics.email", &emails).Error; err != nil {
+		return nil, err
+	}
+	visible := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		visible[email] = true
+	}
+	return visible, nil
+}
+
+// parseSlaveIds parses a comma separated slave list. Empty means no limit.
+func parseSlaveIds(value string) ([]int, error) {
+	var slaveIds []int
+	for _, part := range splitList(value) {
+		slaveId, err := strconv.Atoi(part)
+		if err != nil || slaveId <= 0 {
+			return nil, common.NewError("invalid slave id:", part)
+		}
+		slaveIds = append(slaveIds, slaveId)
+	}
+	return slaveIds, nil
+}
+
+func joinSlaveIds(slaveIds []int) string {
+	sort.Ints(slaveIds)
+	parts := make([]string, 0, len(slaveIds))
+	for _, slaveId := range slaveIds {
+		parts = append(parts, strconv.Itoa(slaveId))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+func TestUserCan(t *testing.T) {
+	cases := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{model.RoleOwner, PermUsers, true},
+		{model.RoleAdmin, PermUsers, false},
+		{model.RoleAdmin, PermPanel, true},
+		{model.RoleOperator, PermPlans, true},
+		{model.RoleOperator, PermInbounds, false},
+		{model.RoleReadOnly, PermView, true},
+		{model.RoleReadOnly, PermAccounts, false},
+		{model.RoleReseller, PermInbounds, true},
+		{model.RoleReseller, PermPlans, false},
+		{"unknown", PermView, false},
+	}
+	for _, c := range cases {
+		if got := UserCan(&model.User{Role: c.role}, c.permission); got != c.want {
+			t.Errorf("UserCan(%s, %s) = %v, want %v", c.role, c.permission, got, c.want)
+		}
+	}
+	if UserCan(nil, PermView) {
+		t.Error("nil user was granted a permission")
+	}
+}
+
+func TestUserScope(t *testing.T) {
+	admin := &model.User{Id: 1, Role: model.RoleAdmin, SlaveIds: "2"}
+	operator := &model.User{Id: 2, Role: model.RoleOperator, SlaveIds: "2,3"}
+	reseller := &model.User{Id: 3, Role: model.RoleReseller}
+
+	if IsScopedUser(admin) || !CanAccessSlave(admin, 5) {
+		t.Error("admin is limited to its slaves")
+	}
+	if !IsScopedUser(operator) || !CanAccessSlave(operator, 3) || CanAccessSlave(operator, 5) {
+		t.Error("operator is not limited to slaves 2 and 3")
+	}
+	if !IsScopedUser(reseller) {
+		t.Error("reseller is not scoped")
+	}
+	if !CanAccessInbound(reseller, &model.Inbound{UserId: 3, SlaveId: 5}) {
+		t.Error("reseller cannot see its own inbound")
+	}
+	if CanAccessInbound(reseller, &model.Inbound{UserId: 1, SlaveId: 5}) {
+		t.Error("reseller sees another user's inbound")
+	}
+	if CanAccessAccount(reseller, &model.Account{UserId: 1}) || !CanAccessAccount(operator, &model.Account{UserId: 1}) {
+		t.Error("account ownership is not applied to resellers only")
+	}
+}
+
+func TestParseSlaveIds(t *testing.T) {
+	slaveIds, err := parseSlaveIds(" 3, 1 ,,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := joinSlaveIds(slaveIds); got != "1,2,3" {
+		t.Errorf("joinSlaveIds = %q, want 1,2,3", got)
+	}
+	if _, err := parseSlaveIds("1,x"); err == nil {
+		t.Error("invalid slave id accepted")
+	}
+}
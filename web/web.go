@@ -313,7 +313,7 @@ func (s *Server) startTask() {
 	// This ensures real-time updates even when slaves don't have traffic changes
 	s.cron.AddJob("@every 10s", job.NewBroadcastStatusJob())
 
-	// check client ips from log file every 10 sec
+	// enforce client ip limits from slave access log reports every 10 sec
 	s.cron.AddJob("@every 10s", job.NewCheckClientIpJob())
 
 	// check client ips from log file every day
@@ -330,6 +330,18 @@ func (s *Server) startTask() {
 	// Check account traffic limits and expiry every 2 minutes
 	s.cron.AddJob("@every 2m", job.NewCheckAccountLimitJob())
 
+	// Reset account traffic on each account's own rolling period
+	s.cron.AddJob("@every 5m", job.NewAccountTrafficResetJob())
+
+	// Drop traffic history past its retention every hour
+	s.cron.AddJob("@hourly", job.NewTrafficHistoryJob())
+
+	// Drop subscription fetches past their retention every day
+	s.cron.AddJob("@daily", job.NewSubFetchLogJob())
+
+	// Retry slave configs that failed or were not acknowledged
+	s.cron.AddJob("@every 30s", job.NewCheckSlaveConfigJob())
+
 	// LDAP sync scheduling
 	if ldapEnabled, _ := s.settingService.GetLdapEnable(); ldapEnabled {
 		runtime, err := s.settingService.GetLdapSyncCron()
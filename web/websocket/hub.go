@@ -36,6 +36,22 @@ type Client struct {
 	Send   chan []byte
 	Hub    *Hub
 	Topics map[MessageType]bool // Subscribed topics
+	Scoped bool                 // Panel user sees only part of the inbounds; gets refresh hints instead of full lists
+}
+
+// scopedMessageTypes carry data of all inbounds. Scoped clients get a
+// refresh hint instead and reload what they may see through the API.
+var scopedMessageTypes = map[MessageType]bool{
+	MessageTypeInbounds:  true,
+	MessageTypeTraffic:   true,
+	MessageTypeOutbounds: true,
+}
+
+// broadcastMessage is a message for all clients together with what scoped
+// clients get instead, nothing when scoped is nil.
+type broadcastMessage struct {
+	data   []byte
+	scoped []byte
 }
 
 // Hub maintains the set of active clients and broadcasts messages to them
@@ -44,7 +60,7 @@ type Hub struct {
 	clients map[*Client]bool
 
 	// Inbound messages from clients
-	broadcast chan []byte
+	broadcast chan broadcastMessage
 
 	// Register requests from clients
 	register chan *Client
@@ -79,9 +95,9 @@ func NewHub() *Hub {
 
 	return &Hub{
 		clients:        make(map[*Client]bool),
-		broadcast:      make(chan []byte, 2048), // Increased from 256 to 2048 for high load
-		register:       make(chan *Client, 100), // Buffered channel for fast registration
-		unregister:     make(chan *Client, 100), // Buffered channel for fast unregistration
+		broadcast:      make(chan broadcastMessage, 2048), // Increased from 256 to 2048 for high load
+		register:       make(chan *Client, 100),           // Buffered channel for fast registration
+		unregister:     make(chan *Client, 100),           // Buffered channel for fast unregistration
 		ctx:            ctx,
 		cancel:         cancel,
 		workerPoolSize: workerPoolSize,
@@ -157,7 +173,7 @@ func (h *Hub) Run() {
 			logger.Debugf("WebSocket client disconnected: %s (total: %d)", client.ID, count)
 
 		case message := <-h.broadcast:
-			if message == nil {
+			if message.data == nil {
 				continue
 			}
 			// Optimization: quickly copy client list and release lock
@@ -170,13 +186,21 @@ func (h *Hub) Run() {
 
 			// Pre-allocate memory for client list
 			clients := make([]*Client, 0, clientCount)
+			scopedClients := make([]*Client, 0)
 			for client := range h.clients {
-				clients = append(clients, client)
+				if client.Scoped {
+					scopedClients = append(scopedClients, client)
+				} else {
+					clients = append(clients, client)
+				}
 			}
 			h.mu.RUnlock()
 
 			// Parallel broadcast using worker pool
-			h.broadcastParallel(clients, message)
+			h.broadcastParallel(clients, message.data)
+			if message.scoped != nil {
+				h.broadcastParallel(scopedClients, message.scoped)
+			}
 		}
 	}
 }
@@ -251,6 +275,15 @@ func (h *Hub) broadcastParallel(clients []*Client, message []byte) {
 
 // Broadcast sends a message to all connected clients
 func (h *Hub) Broadcast(messageType MessageType, payload any) {
+	h.broadcastMessage(messageType, payload, true)
+}
+
+// BroadcastUnscoped sends a message only to clients that see all inbounds.
+func (h *Hub) BroadcastUnscoped(messageType MessageType, payload any) {
+	h.broadcastMessage(messageType, payload, false)
+}
+
+func (h *Hub) broadcastMessage(messageType MessageType, payload any, toScoped bool) {
 	if h == nil {
 		return
 	}
@@ -278,9 +311,20 @@ func (h *Hub) Broadcast(messageType MessageType, payload any) {
 		return
 	}
 
+	message := broadcastMessage{data: data, scoped: data}
+	if !toScoped {
+		message.scoped = nil
+	} else if scopedMessageTypes[messageType] {
+		message.scoped, _ = json.Marshal(Message{
+			Type:    messageType,
+			Payload: map[string]bool{"refresh": true},
+			Time:    msg.Time,
+		})
+	}
+
 	// Non-blocking send with timeout to prevent delays
 	select {
-	case h.broadcast <- data:
+	case h.broadcast <- message:
 	case <-time.After(100 * time.Millisecond):
 		logger.Warning("WebSocket broadcast channel is full, dropping message")
 	case <-h.ctx.Done():
@@ -321,6 +365,9 @@ func (h *Hub) BroadcastToTopic(messageType MessageType, payload any) {
 	// Filter clients by topics and quickly release lock
 	subscribedClients := make([]*Client, 0)
 	for client := range h.clients {
+		if client.Scoped && scopedMessageTypes[messageType] {
+			continue
+		}
 		if len(client.Topics) == 0 || client.Topics[messageType] {
 			subscribedClients = append(subscribedClients, client)
 		}
@@ -78,6 +78,20 @@ func BroadcastNotification(title, message, level string) {
 	}
 }
 
+// BroadcastUnscopedNotification broadcasts a system notification only to
+// clients that see all inbounds, for notifications about any owner's data.
+func BroadcastUnscopedNotification(title, message, level string) {
+	hub := GetHub()
+	if hub != nil {
+		notification := map[string]string{
+			"title":   title,
+			"message": message,
+			"level":   level,
+		}
+		hub.BroadcastUnscoped(MessageTypeNotification, notification)
+	}
+}
+
 // BroadcastXrayState broadcasts Xray state change to all connected clients
 func BroadcastXrayState(state string, errorMsg string) {
 	hub := GetHub()
@@ -0,0 +1,288 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Config delta operation types exchanged between master and slave.
+const (
+	OpAddInbound    = "add_inbound"
+	OpRemoveInbound = "remove_inbound"
+	OpAddUser       = "add_user"
+	OpRemoveUser    = "remove_user"
+)
+
+// ConfigOp is a single live change that can be applied to a running Xray instance
+// through the gRPC handler service without restarting the process.
+type ConfigOp struct {
+	Type     string         `json:"type"`
+	Tag      string         `json:"tag"`
+	Protocol string         `json:"protocol,omitempty"`
+	Email    string         `json:"email,omitempty"`
+	User     map[string]any `json:"user,omitempty"`
+	// Inbound holds the full inbound for add_inbound, and the inbound as it
+	// looks after the change for user operations so the receiver can keep its
+	// copy of the config in sync with the live state.
+	Inbound *InboundConfig `json:"inbound,omitempty"`
+}
+
+// liveUserProtocols lists the protocols whose users can be altered via AlterInbound.
+var liveUserProtocols = map[string]bool{
+	"vmess":       true,
+	"vless":       true,
+	"trojan":      true,
+	"shadowsocks": true,
+}
+
+// TemplateEquals reports whether two configs are identical apart from the given
+// inbound tags, i.e. whether moving between them requires no process restart.
+func (c *Config) TemplateEquals(other *Config, ignoreTags map[string]bool) bool {
+	a, b := *c, *other
+	a.InboundConfigs = filterInbounds(c.InboundConfigs, ignoreTags)
+	b.InboundConfigs = filterInbounds(other.InboundConfigs, ignoreTags)
+	return a.Equals(&b)
+}
+
+func filterInbounds(inbounds []InboundConfig, ignoreTags map[string]bool) []InboundConfig {
+	result := make([]InboundConfig, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		if !ignoreTags[inbound.Tag] {
+			result = append(result, inbound)
+		}
+	}
+	return result
+}
+
+// DiffInbounds computes the ordered list of operations that turn the old inbound
+// set into the new one. Removals are emitted before additions so that a changed
+// inbound releases its port before it is re-added.
+func DiffInbounds(oldInbounds, newInbounds []InboundConfig) []ConfigOp {
+	oldByTag := make(map[string]*InboundConfig, len(oldInbounds))
+	for i := range oldInbounds {
+		oldByTag[oldInbounds[i].Tag] = &oldInbounds[i]
+	}
+	newByTag := make(map[string]*InboundConfig, len(newInbounds))
+	for i := range newInbounds {
+		newByTag[newInbounds[i].Tag] = &newInbounds[i]
+	}
+
+	removes := make([]ConfigOp, 0)
+	adds := make([]ConfigOp, 0)
+
+	for i := range oldInbounds {
+		old := &oldInbounds[i]
+		if _, ok := newByTag[old.Tag]; !ok {
+			removes = append(removes, ConfigOp{Type: OpRemoveInbound, Tag: old.Tag})
+		}
+	}
+
+	for i := range newInbounds {
+		inbound := &newInbounds[i]
+		old, ok := oldByTag[inbound.Tag]
+		if !ok {
+			adds = append(adds, ConfigOp{Type: OpAddInbound, Tag: inbound.Tag, Inbound: inbound})
+			continue
+		}
+		if old.Equals(inbound) {
+			continue
+		}
+		userRemoves, userAdds, ok := diffUsers(old, inbound)
+		if !ok {
+			removes = append(removes, ConfigOp{Type: OpRemoveInbound, Tag: old.Tag})
+			adds = append(adds, ConfigOp{Type: OpAddInbound, Tag: inbound.Tag, Inbound: inbound})
+			continue
+		}
+		removes = append(removes, userRemoves...)
+		adds = append(adds, userAdds...)
+	}
+
+	return append(removes, adds...)
+}
+
+// diffUsers returns user-level operations for two versions of the same inbound.
+// The boolean result is false when anything besides the client list changed,
+// in which case the whole inbound has to be replaced.
+func diffUsers(old, inbound *InboundConfig) ([]ConfigOp, []ConfigOp, bool) {
+	if !liveUserProtocols[inbound.Protocol] || old.Protocol != inbound.Protocol || old.Port != inbound.Port ||
+		!bytes.Equal(old.Listen, inbound.Listen) ||
+		!bytes.Equal(old.StreamSettings, inbound.StreamSettings) ||
+		!bytes.Equal(old.Sniffing, inbound.Sniffing) {
+		return nil, nil, false
+	}
+
+	oldSettings, oldClients, err := splitClients(old.Settings)
+	if err != nil {
+		return nil, nil, false
+	}
+	newSettings, newClients, err := splitClients(inbound.Settings)
+	if err != nil {
+		return nil, nil, false
+	}
+	if !reflect.DeepEqual(oldSettings, newSettings) {
+		return nil, nil, false
+	}
+
+	cipher := ""
+	if inbound.Protocol == "shadowsocks" {
+		cipher, _ = newSettings["method"].(string)
+	}
+
+	removes := make([]ConfigOp, 0)
+	adds := make([]ConfigOp, 0)
+	for email, client := range oldClients {
+		if newClient, ok := newClients[email]; !ok || !reflect.DeepEqual(client, newClient) {
+			removes = append(removes, ConfigOp{Type: OpRemoveUser, Tag: inbound.Tag, Email: email, Inbound: inbound})
+		}
+	}
+	for email, client := range newClients {
+		if oldClient, ok := oldClients[email]; !ok || !reflect.DeepEqual(client, oldClient) {
+			adds = append(adds, ConfigOp{
+				Type:     OpAddUser,
+				Tag:      inbound.Tag,
+				Protocol: inbound.Protocol,
+				Email:    email,
+				User:     userFromClient(email, client, cipher),
+				Inbound:  inbound,
+			})
+		}
+	}
+	return removes, adds, true
+}
+
+// splitClients parses inbound settings and separates the clients, keyed by email,
+// from the remaining settings.
+func splitClients(settings []byte) (map[string]any, map[string]map[string]any, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal(settings, &parsed); err != nil {
+		return nil, nil, err
+	}
+	clients := make(map[string]map[string]any)
+	rawClients, _ := parsed["clients"].([]any)
+	for _, raw := range rawClients {
+		client, ok := raw.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid client entry")
+		}
+		email, _ := client["email"].(string)
+		if email == "" {
+			return nil, nil, fmt.Errorf("client without email")
+		}
+		clients[email] = client
+	}
+	delete(parsed, "clients")
+	return parsed, clients, nil
+}
+
+// userFromClient builds the user map expected by XrayAPI.AddUser.
+func userFromClient(email string, client map[string]any, cipher string) map[string]any {
+	str := func(key string) string {
+		v, _ := client[key].(string)
+		return v
+	}
+	if method := str("method"); method != "" {
+		cipher = method
+	}
+	return map[string]any{
+		"email":    email,
+		"id":       str("id"),
+		"security": str("security"),
+		"flow":     str("flow"),
+		"password": str("password"),
+		"cipher":   cipher,
+	}
+}
+
+// ApplyOps mirrors the given operations onto the config so that it reflects the
+// state of the running process after the operations have been applied live.
+func (c *Config) ApplyOps(ops []ConfigOp) {
+	for _, op := range ops {
+		switch op.Type {
+		case OpRemoveInbound:
+			c.InboundConfigs = filterInbounds(c.InboundConfigs, map[string]bool{op.Tag: true})
+		case OpAddInbound, OpAddUser, OpRemoveUser:
+			if op.Inbound == nil {
+				continue
+			}
+			replaced := false
+			for i := range c.InboundConfigs {
+				if c.InboundConfigs[i].Tag == op.Tag {
+					c.InboundConfigs[i] = *op.Inbound
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				c.InboundConfigs = append(c.InboundConfigs, *op.Inbound)
+			}
+		}
+	}
+}
+
+// ApplyOps executes the given operations against the running Xray core.
+// It stops at the first failure so the caller can fall back to a restart.
+func (x *XrayAPI) ApplyOps(ops []ConfigOp) error {
+	if !x.isConnected {
+		return fmt.Errorf("xray api is not initialized")
+	}
+	for _, op := range ops {
+		var err error
+		switch op.Type {
+		case OpAddInbound:
+			var inboundJson []byte
+			inboundJson, err = json.Marshal(op.Inbound)
+			if err == nil {
+				err = x.AddInbound(inboundJson)
+			}
+		case OpRemoveInbound:
+			err = x.DelInbound(op.Tag)
+		case OpAddUser:
+			err = x.AddUser(op.Protocol, op.Tag, op.User)
+		case OpRemoveUser:
+			err = x.RemoveUser(op.Tag, op.Email)
+		default:
+			err = fmt.Errorf("unknown config op %q", op.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %w", op.Type, op.Tag, op.Email, err)
+		}
+	}
+	return nil
+}
+
+// ReconnectUserOps returns operations that remove and re-add a user of every
+// inbound in the config that has it, which drops the user's open connections.
+func (c *Config) ReconnectUserOps(email string) []ConfigOp {
+	removes := make([]ConfigOp, 0)
+	adds := make([]ConfigOp, 0)
+	for i := range c.InboundConfigs {
+		inbound := &c.InboundConfigs[i]
+		if !liveUserProtocols[inbound.Protocol] {
+			continue
+		}
+		settings, clients, err := splitClients(inbound.Settings)
+		if err != nil {
+			continue
+		}
+		client, ok := clients[email]
+		if !ok {
+			continue
+		}
+		cipher := ""
+		if inbound.Protocol == "shadowsocks" {
+			cipher, _ = settings["method"].(string)
+		}
+		removes = append(removes, ConfigOp{Type: OpRemoveUser, Tag: inbound.Tag, Email: email, Inbound: inbound})
+		adds = append(adds, ConfigOp{
+			Type:     OpAddUser,
+			Tag:      inbound.Tag,
+			Protocol: inbound.Protocol,
+			Email:    email,
+			User:     userFromClient(email, client, cipher),
+			Inbound:  inbound,
+		})
+	}
+	return append(removes, adds...)
+}
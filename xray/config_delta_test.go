@@ -0,0 +1,172 @@
+package xray
+
+import (
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/util/json_util"
+)
+
+func testInbound(tag, protocol string, port int, settings, stream string) InboundConfig {
+	return InboundConfig{
+		Port:           port,
+		Protocol:       protocol,
+		Settings:       json_util.RawMessage(settings),
+		StreamSettings: json_util.RawMessage(stream),
+		Tag:            tag,
+	}
+}
+
+func opSummary(ops []ConfigOp) []string {
+	result := make([]string, len(ops))
+	for i, op := range ops {
+		result[i] = op.Type + ":" + op.Tag + ":" + op.Email
+	}
+	return result
+}
+
+func TestDiffInbounds(t *testing.T) {
+	const (
+		twoClients   = `{"clients":[{"email":"a","id":"1"},{"email":"b","id":"2"}],"decryption":"none"}`
+		oneClient    = `{"clients":[{"email":"a","id":"1"}],"decryption":"none"}`
+		changedB     = `{"clients":[{"email":"a","id":"1"},{"email":"b","id":"3"}],"decryption":"none"}`
+		otherSetting = `{"clients":[{"email":"a","id":"1"},{"email":"b","id":"2"}],"decryption":"other"}`
+		tcp          = `{"network":"tcp"}`
+		ws           = `{"network":"ws"}`
+	)
+
+	tests := []struct {
+		name string
+		old  []InboundConfig
+		new  []InboundConfig
+		want []string
+	}{
+		{
+			name: "unchanged",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			want: []string{},
+		},
+		{
+			name: "added inbound",
+			old:  []InboundConfig{},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			want: []string{"add_inbound:in-1:"},
+		},
+		{
+			name: "removed inbound",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			new:  []InboundConfig{},
+			want: []string{"remove_inbound:in-1:"},
+		},
+		{
+			name: "removed user only",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			want: []string{"remove_user:in-1:b"},
+		},
+		{
+			name: "added user only",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			want: []string{"add_user:in-1:b"},
+		},
+		{
+			name: "changed user is removed before it is re-added",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, changedB, tcp)},
+			want: []string{"remove_user:in-1:b", "add_user:in-1:b"},
+		},
+		{
+			name: "stream settings change replaces the inbound",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, ws)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-1:"},
+		},
+		{
+			name: "port change replaces the inbound",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 8443, oneClient, tcp)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-1:"},
+		},
+		{
+			name: "non-client setting change replaces the inbound",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, twoClients, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, otherSetting, tcp)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-1:"},
+		},
+		{
+			name: "protocol without live users replaces the inbound",
+			old:  []InboundConfig{testInbound("in-1", "socks", 1080, `{"accounts":[]}`, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "socks", 1080, `{"accounts":[{"user":"u"}]}`, tcp)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-1:"},
+		},
+		{
+			name: "client without email replaces the inbound",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			new:  []InboundConfig{testInbound("in-1", "vless", 443, `{"clients":[{"id":"1"}],"decryption":"none"}`, tcp)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-1:"},
+		},
+		{
+			name: "removals come before additions across inbounds",
+			old:  []InboundConfig{testInbound("in-1", "vless", 443, oneClient, tcp)},
+			new:  []InboundConfig{testInbound("in-2", "vless", 443, oneClient, tcp)},
+			want: []string{"remove_inbound:in-1:", "add_inbound:in-2:"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := opSummary(DiffInbounds(tt.old, tt.new))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got ops %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got ops %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffUsersShadowsocksCipher(t *testing.T) {
+	old := testInbound("ss", "shadowsocks", 8388, `{"method":"aes-256-gcm","clients":[]}`, `{}`)
+	inbound := testInbound("ss", "shadowsocks", 8388, `{"method":"aes-256-gcm","clients":[{"email":"a","password":"p"}]}`, `{}`)
+
+	removes, adds, ok := diffUsers(&old, &inbound)
+	if !ok {
+		t.Fatal("expected a user-level diff")
+	}
+	if len(removes) != 0 || len(adds) != 1 {
+		t.Fatalf("got %d removes and %d adds, want 0 and 1", len(removes), len(adds))
+	}
+	if cipher := adds[0].User["cipher"]; cipher != "aes-256-gcm" {
+		t.Errorf("cipher = %v, want the inbound method", cipher)
+	}
+	if adds[0].Inbound != &inbound {
+		t.Error("user op does not carry the updated inbound")
+	}
+}
+
+func TestApplyOpsMirrorsDiff(t *testing.T) {
+	oldInbounds := []InboundConfig{
+		testInbound("in-1", "vless", 443, `{"clients":[{"email":"a","id":"1"}]}`, `{}`),
+		testInbound("in-2", "vless", 444, `{"clients":[]}`, `{}`),
+	}
+	newInbounds := []InboundConfig{
+		testInbound("in-1", "vless", 443, `{"clients":[{"email":"a","id":"1"},{"email":"b","id":"2"}]}`, `{}`),
+		testInbound("in-3", "vless", 445, `{"clients":[]}`, `{}`),
+	}
+
+	config := &Config{InboundConfigs: append([]InboundConfig(nil), oldInbounds...)}
+	config.ApplyOps(DiffInbounds(oldInbounds, newInbounds))
+
+	if len(config.InboundConfigs) != len(newInbounds) {
+		t.Fatalf("got %d inbounds, want %d", len(config.InboundConfigs), len(newInbounds))
+	}
+	for i := range newInbounds {
+		if !config.InboundConfigs[i].Equals(&newInbounds[i]) {
+			t.Errorf("inbound %d = %s, want %s", i, config.InboundConfigs[i].Tag, newInbounds[i].Tag)
+		}
+	}
+}
@@ -69,6 +69,16 @@ func GetAccessPersistentPrevLogPath() string {
 
 // GetAccessLogPath reads the Xray config and returns the access log file path.
 func GetAccessLogPath() (string, error) {
+	return getLogPath("access")
+}
+
+// GetErrorLogPath reads the Xray config and returns the error log file path.
+func GetErrorLogPath() (string, error) {
+	return getLogPath("error")
+}
+
+// getLogPath returns the file path of the given log in the Xray config.
+func getLogPath(key string) (string, error) {
 	config, err := os.ReadFile(GetConfigPath())
 	if err != nil {
 		// In Master-only mode, config.json doesn't exist - this is expected
@@ -84,9 +94,9 @@ func GetAccessLogPath() (string, error) {
 
 	if jsonConfig["log"] != nil {
 		jsonLog := jsonConfig["log"].(map[string]any)
-		if jsonLog["access"] != nil {
-			accessLogPath := jsonLog["access"].(string)
-			return accessLogPath, nil
+		if jsonLog[key] != nil {
+			logPath := jsonLog[key].(string)
+			return logPath, nil
 		}
 	}
 	return "", err
@@ -189,6 +199,12 @@ func (p *Process) GetConfig() *Config {
 	return p.config
 }
 
+// SetConfig replaces the configuration used by the Xray process.
+// It is used after live API changes so that a later restart reproduces the same state.
+func (p *Process) SetConfig(config *Config) {
+	p.config = config
+}
+
 // GetOnlineClients returns the list of online clients for the Xray process.
 func (p *Process) GetOnlineClients() []string {
 	return p.onlineClients
@@ -0,0 +1,170 @@
+package xray
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+)
+
+// GeofileURLs maps the geofiles that may be downloaded to their source.
+var GeofileURLs = map[string]string{
+	"geoip.dat":      "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat",
+	"geosite.dat":    "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat",
+	"geoip_IR.dat":   "https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geoip.dat",
+	"geosite_IR.dat": "https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geosite.dat",
+	"geoip_RU.dat":   "https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geoip.dat",
+	"geosite_RU.dat": "https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geosite.dat",
+}
+
+// GetReleaseAssetName returns the name of the Xray-core release archive for this platform.
+func GetReleaseAssetName() string {
+	osName := runtime.GOOS
+	arch := runtime.GOARCH
+
+	switch osName {
+	case "darwin":
+		osName = "macos"
+	case "windows":
+		osName = "windows"
+	}
+
+	switch arch {
+	case "amd64":
+		arch = "64"
+	case "arm64":
+		arch = "arm64-v8a"
+	case "armv7":
+		arch = "arm32-v7a"
+	case "armv6":
+		arch = "arm32-v6"
+	case "armv5":
+		arch = "arm32-v5"
+	case "386":
+		arch = "32"
+	case "s390x":
+		arch = "s390x"
+	}
+
+	return fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
+}
+
+// GetReleaseURL returns the download URL of the Xray-core release archive for this platform.
+func GetReleaseURL(version string) string {
+	return fmt.Sprintf("https://github.com/XTLS/Xray-core/releases/download/%s/%s", version, GetReleaseAssetName())
+}
+
+// GetInstalledBinaryPath returns where an Xray binary extracted from a release is installed.
+func GetInstalledBinaryPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(config.GetBinFolderPath(), "xray-windows-amd64.exe")
+	}
+	return GetBinaryPath()
+}
+
+// DownloadFile saves url to path and returns the SHA-256 of the content.
+func DownloadFile(url, path string) (string, error) {
+	return DownloadFileWithHeader(url, nil, path)
+}
+
+// DownloadFileWithHeader is DownloadFile with extra request headers.
+func DownloadFileWithHeader(url string, header http.Header, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s: status %d", url, resp.StatusCode)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// FetchReleaseChecksum downloads the SHA-256 published next to a release file.
+// Xray-core publishes a .dgst file with a "SHA2-256=" line, geofile repositories
+// a .sha256sum file in sha256sum format. It returns "" when none is published.
+func FetchReleaseChecksum(url string) (string, error) {
+	for _, suffix := range []string{".dgst", ".sha256sum"} {
+		resp, err := http.Get(url + suffix)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if after, ok := strings.CutPrefix(line, "SHA2-256="); ok {
+				resp.Body.Close()
+				return strings.ToLower(strings.TrimSpace(after)), nil
+			}
+			if suffix == ".sha256sum" {
+				if fields := strings.Fields(line); len(fields) > 0 && len(fields[0]) == sha256.Size*2 {
+					resp.Body.Close()
+					return strings.ToLower(fields[0]), nil
+				}
+			}
+		}
+		resp.Body.Close()
+	}
+	return "", nil
+}
+
+// ExtractBinary copies the Xray executable out of a release archive to dest.
+func ExtractBinary(zipPath, dest string) error {
+	reader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	name := "xray"
+	if runtime.GOOS == "windows" {
+		name = "xray.exe"
+	}
+	src, err := reader.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, src)
+	return err
+}